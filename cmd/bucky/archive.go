@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ArchiveWriter writes metrics into an archive.  It follows the interface
+// of archive/tar's Writer: each entry is described by a tar.Header and its
+// data written with Write.  Formats that can't represent PAX global
+// headers skip them.
+type ArchiveWriter interface {
+	io.Writer
+
+	// WriteHeader starts a new entry described by hdr.
+	WriteHeader(hdr *tar.Header) error
+
+	// Flush finishes the current entry, which must be complete, so that
+	// everything written so far reaches the underlying writer.
+	Flush() error
+
+	// Close writes the archive trailer.  The underlying writer is not
+	// closed.
+	Close() error
+}
+
+// archiveFormats are the formats accepted by -format.
+var archiveFormats = []string{"tar", "cpio"}
+
+// NewArchiveWriter returns an ArchiveWriter writing the named format to w.
+func NewArchiveWriter(format string, w io.Writer) (ArchiveWriter, error) {
+	switch format {
+	case "", "tar":
+		return tar.NewWriter(w), nil
+	case "cpio":
+		return NewCpioWriter(w), nil
+	}
+	return nil, fmt.Errorf("Unknown archive format: %s", format)
+}
+
+// cpioTrailer is the name of the last entry of a cpio archive.
+const cpioTrailer = "TRAILER!!!"
+
+// ErrCpioWriteTooLong is returned when more data is written to an entry
+// than its header declared.
+var ErrCpioWriteTooLong = errors.New("cpio: write too long")
+
+// CpioWriter writes a cpio archive in the SVR4 "newc" format as read by
+// GNU cpio -i -H newc and most initramfs and imaging tools.
+type CpioWriter struct {
+	w         io.Writer
+	ino       int64
+	remaining int64
+	pad       int64
+	err       error
+}
+
+// NewCpioWriter returns a CpioWriter writing to w.
+func NewCpioWriter(w io.Writer) *CpioWriter {
+	return &CpioWriter{w: w}
+}
+
+// flush pads the data of the current entry to a 4 byte boundary.
+func (c *CpioWriter) flush() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.remaining > 0 {
+		c.err = fmt.Errorf("cpio: missed writing %d bytes", c.remaining)
+		return c.err
+	}
+	if c.pad > 0 {
+		_, c.err = c.w.Write(make([]byte, c.pad))
+		c.pad = 0
+	}
+	return c.err
+}
+
+// writeEntry writes a newc header for the named entry.
+func (c *CpioWriter) writeEntry(name string, mode, uid, gid, nlink, mtime, size int64) error {
+	if err := c.flush(); err != nil {
+		return err
+	}
+	hdr := fmt.Sprintf("070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		c.ino, mode, uid, gid, nlink, mtime, size, 0, 0, 0, 0, len(name)+1, 0)
+	// The header and name are padded to a multiple of 4 bytes
+	buf := make([]byte, (len(hdr)+len(name)+1+3)&^3)
+	copy(buf, hdr)
+	copy(buf[len(hdr):], name)
+	if _, c.err = c.w.Write(buf); c.err != nil {
+		return c.err
+	}
+	c.remaining = size
+	c.pad = (4 - size%4) % 4
+	return nil
+}
+
+// WriteHeader starts a regular file or directory entry for hdr.  PAX
+// global headers have no cpio equivalent and are skipped.
+func (c *CpioWriter) WriteHeader(hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		return nil
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		c.ino++
+		name := strings.TrimSuffix(hdr.Name, "/")
+		return c.writeEntry(name, 040000|(hdr.Mode&07777), int64(hdr.Uid), int64(hdr.Gid),
+			2, hdr.ModTime.Unix(), 0)
+	}
+	if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+		return fmt.Errorf("cpio: unsupported entry type 0x%X for %s", hdr.Typeflag, hdr.Name)
+	}
+	if len(hdr.PAXRecords) > 0 {
+		return fmt.Errorf("cpio: cannot store PAX records for %s", hdr.Name)
+	}
+	if hdr.Size > 0xFFFFFFFF {
+		return fmt.Errorf("cpio: %s is too large for the newc format", hdr.Name)
+	}
+	c.ino++
+	return c.writeEntry(hdr.Name, 0100000|(hdr.Mode&07777), int64(hdr.Uid), int64(hdr.Gid),
+		1, hdr.ModTime.Unix(), hdr.Size)
+}
+
+// Write writes data to the current entry.
+func (c *CpioWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if int64(len(b)) > c.remaining {
+		return 0, ErrCpioWriteTooLong
+	}
+	n, err := c.w.Write(b)
+	c.remaining -= int64(n)
+	c.err = err
+	return n, err
+}
+
+// Flush writes the padding of the current entry, which must be complete,
+// as tar.Writer's Flush does.
+func (c *CpioWriter) Flush() error {
+	return c.flush()
+}
+
+// Close writes the trailer entry that ends the archive.
+func (c *CpioWriter) Close() error {
+	if err := c.writeEntry(cpioTrailer, 0, 0, 0, 1, 0, 0); err != nil {
+		return err
+	}
+	return c.flush()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+type cpioEntry struct {
+	name  string
+	mode  int64
+	mtime int64
+	data  string
+}
+
+// readCpio parses a newc cpio archive up to and including its trailer.
+func readCpio(t *testing.T, b []byte) []cpioEntry {
+	r := bytes.NewReader(b)
+	entries := make([]cpioEntry, 0)
+	align := func() {
+		off := int64(len(b) - r.Len())
+		r.Seek((4-off%4)%4, io.SeekCurrent)
+	}
+	field := func(hdr []byte, i int) int64 {
+		v, err := strconv.ParseInt(string(hdr[6+8*i:14+8*i]), 16, 64)
+		if err != nil {
+			t.Fatalf("Bad cpio header field %d: %s", i, err)
+		}
+		return v
+	}
+	for {
+		hdr := make([]byte, 110)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			t.Fatalf("Error reading cpio header: %s", err)
+		}
+		if string(hdr[:6]) != "070701" {
+			t.Fatalf("Bad cpio magic: %q", hdr[:6])
+		}
+		name := make([]byte, field(hdr, 11))
+		io.ReadFull(r, name)
+		align()
+		data := make([]byte, field(hdr, 6))
+		io.ReadFull(r, data)
+		align()
+		e := cpioEntry{string(name[:len(name)-1]), field(hdr, 1), field(hdr, 5), string(data)}
+		entries = append(entries, e)
+		if e.name == cpioTrailer {
+			break
+		}
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes follow the cpio trailer", r.Len())
+	}
+	return entries
+}
+
+func TestWriteCpio(t *testing.T) {
+	resetTarState()
+	tarFormat = "cpio"
+	tarTotals = true
+	restoreTestCluster(ringFor(1, "a", "b"), "4242")
+	defer func() {
+		tarFormat = ""
+		tarTotals = false
+		Cluster = nil
+	}()
+
+	workOut := make(chan *metrics.MetricData, 2)
+	workOut <- &metrics.MetricData{Name: "foo.bar", Size: 3, Mode: 0644, ModTime: 1500000000,
+		Encoding: metrics.EncIdentity, Data: []byte("abc")}
+	workOut <- &metrics.MetricData{Name: "foo.bazz", Size: 8, Mode: 0600, ModTime: 1500000001,
+		Encoding: metrics.EncIdentity, Data: []byte("abcdefgh")}
+	close(workOut)
+
+	buf := new(bytes.Buffer)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(buf, workOut, wg)
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+	if buf.Len()%4 != 0 {
+		t.Errorf("Archive length %d is not 4 byte aligned", buf.Len())
+	}
+
+	expected := []cpioEntry{
+		{"foo/bar.wsp", 0100644, 1500000000, "abc"},
+		{"foo/bazz.wsp", 0100600, 1500000001, "abcdefgh"},
+		{cpioTrailer, 0, 0, ""},
+	}
+	entries := readCpio(t, buf.Bytes())
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries, got %v", len(expected), entries)
+	}
+	for i := range expected {
+		if entries[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected[i], entries[i])
+		}
+	}
+}
+
+func TestCpioWriteTooLong(t *testing.T) {
+	cw := NewCpioWriter(new(bytes.Buffer))
+	hdr := &tar.Header{Name: "a.wsp", Size: 2, Mode: 0644, ModTime: time.Unix(0, 0)}
+	if err := cw.WriteHeader(hdr); err != nil {
+		t.Fatalf("Error writing header: %s", err)
+	}
+	if _, err := cw.Write([]byte("abc")); err != ErrCpioWriteTooLong {
+		t.Errorf("Expected ErrCpioWriteTooLong, got %v", err)
+	}
+	cw.Write([]byte("a"))
+	if err := cw.Close(); err == nil {
+		t.Errorf("Closing a short entry did not fail")
+	}
+}
+
+func TestNewArchiveWriter(t *testing.T) {
+	if _, err := NewArchiveWriter("zip", new(bytes.Buffer)); err == nil {
+		t.Errorf("Unknown format was accepted")
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// tarChecksum is the algorithm of the checksum computed over the archive
+// as it is written.  Empty computes no checksum.
+var tarChecksum string
+
+// tarChecksumFile writes the archive checksum to a sidecar file next to
+// the -o archive.
+var tarChecksumFile bool
+
+// archiveHash accumulates the checksum of the archive stream.
+var archiveHash hash.Hash
+
+// checksumFileName returns the name of the sidecar file holding the algo
+// checksum of the archive at path, such as out.tar.sha256.
+func checksumFileName(path, algo string) string {
+	return path + "." + algo
+}
+
+// writeChecksumFile atomically writes the sum in h of the archive at path
+// to its sidecar file in the format of sha256sum and md5sum so that it can
+// be verified with "sha256sum -c".
+func writeChecksumFile(path, algo string, h hash.Hash) error {
+	sink, err := NewFileSink(checksumFileName(path, algo))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(sink, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), filepath.Base(path))
+	if err != nil {
+		sink.Abort()
+		return err
+	}
+	return sink.Close()
+}
+
+// readChecksumFile returns the algo checksum recorded in the sidecar file
+// of the file at path as ALGORITHM:HEXDIGEST.
+func readChecksumFile(path, algo string) (string, error) {
+	blob, err := ioutil.ReadFile(checksumFileName(path, algo))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(blob))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("No checksum in %s", checksumFileName(path, algo))
+	}
+	return algo + ":" + fields[0], nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestWriteTarChecksum(t *testing.T) {
+	resetTarState()
+	tarChecksum = "sha256"
+	defer func() { tarChecksum = "" }()
+
+	workOut := make(chan *metrics.MetricData, 1)
+	workOut <- &metrics.MetricData{Name: "foo.bar", Size: 3, Mode: 0644,
+		Encoding: metrics.EncIdentity, Data: []byte("abc")}
+	close(workOut)
+
+	buf := new(bytes.Buffer)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(buf, workOut, wg)
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+	if archiveHash == nil {
+		t.Fatalf("No archive checksum was computed")
+	}
+
+	// The streamed digest covers every byte written
+	sum := sha256.Sum256(buf.Bytes())
+	expected := hex.EncodeToString(sum[:])
+	if digest := hex.EncodeToString(archiveHash.Sum(nil)); digest != expected {
+		t.Errorf("Expected digest %s, got %s", expected, digest)
+	}
+	if s := metrics.FormatChecksum("sha256", archiveHash); s != "sha256:"+expected {
+		t.Errorf("Bad formatted checksum: %s", s)
+	}
+
+	dir, err := ioutil.TempDir("", "archivesum_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.tar")
+	if err := writeChecksumFile(path, "sha256", archiveHash); err != nil {
+		t.Fatalf("Error writing checksum file: %s", err)
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "out.tar.sha256"))
+	if err != nil {
+		t.Fatalf("Error reading checksum file: %s", err)
+	}
+	if string(blob) != expected+"  out.tar\n" {
+		t.Errorf("Bad checksum file: %q", blob)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tarWorkersMin and tarWorkersMax bound the download workers of tar when
+// -w-max enables scaling the workers during the run.
+var tarWorkersMin int
+var tarWorkersMax int
+
+// tarScaleStep is the percent of the current workers added or removed
+// each time the workers are scaled.
+var tarScaleStep int
+
+// tarScaleInterval is how often the workers are scaled.
+var tarScaleInterval time.Duration
+
+// tarScaler scales the download workers of the current tar run if
+// enabled.
+var tarScaler *WorkerScaler
+
+// maxScaleErrorRate is the fraction of failed downloads in an interval
+// above which the workers are scaled down.
+const maxScaleErrorRate = 0.05
+
+// maxScaleLatency is the multiple of the lowest mean download latency seen
+// above which the workers are scaled down.
+const maxScaleLatency = 2
+
+// WorkerChange is a point of the worker count timeline.
+type WorkerChange struct {
+	At      time.Duration
+	Workers int
+	Reason  string
+}
+
+// WorkerScaler runs a pool of workers that grows while the cluster is
+// healthy and shrinks on errors or rising latency, within min and max.
+// Every interval the failures and mean download latency since the last
+// interval decide the next size: more than 5% failures or twice the
+// lowest mean latency seen remove step percent of the workers, otherwise
+// step percent are added.  At least one worker is added or removed.
+type WorkerScaler struct {
+	min, max, step int
+	interval       time.Duration
+	run            func(quit <-chan struct{})
+	wg             *sync.WaitGroup
+
+	done     chan struct{}
+	stopped  chan struct{}
+	lock     sync.Mutex
+	quits    []chan struct{}
+	started  time.Time
+	timeline []WorkerChange
+	baseline time.Duration
+
+	// Counters since the last interval
+	latency   int64
+	downloads int64
+	failures  int64
+}
+
+// NewWorkerScaler returns a WorkerScaler that runs each worker with run.
+// A worker returns once its quit channel is closed, or on its own, and
+// must call wg.Done() either way.
+func NewWorkerScaler(min, max, step int, interval time.Duration, run func(quit <-chan struct{}), wg *sync.WaitGroup) *WorkerScaler {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &WorkerScaler{
+		min:      min,
+		max:      max,
+		step:     step,
+		interval: interval,
+		run:      run,
+		wg:       wg,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+// Start launches min workers and scales them every interval until Stop
+// is called.
+func (s *WorkerScaler) Start() {
+	s.lock.Lock()
+	s.started = time.Now()
+	s.lock.Unlock()
+	s.resize(s.min, "start")
+
+	go func() {
+		defer close(s.stopped)
+		tick := time.NewTicker(s.interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-tick.C:
+				s.Scale()
+			}
+		}
+	}()
+}
+
+// Stop ends scaling so that the workers may be waited for.  The workers
+// keep running until their work runs out.
+func (s *WorkerScaler) Stop() {
+	close(s.done)
+	<-s.stopped
+}
+
+// Observe records a download that took d and whether it failed.
+func (s *WorkerScaler) Observe(d time.Duration, failed bool) {
+	atomic.AddInt64(&s.latency, int64(d))
+	atomic.AddInt64(&s.downloads, 1)
+	if failed {
+		atomic.AddInt64(&s.failures, 1)
+	}
+}
+
+// Scale resizes the pool from the downloads observed since the last call.
+func (s *WorkerScaler) Scale() {
+	latency := atomic.SwapInt64(&s.latency, 0)
+	downloads := atomic.SwapInt64(&s.downloads, 0)
+	failures := atomic.SwapInt64(&s.failures, 0)
+	if downloads == 0 {
+		return
+	}
+
+	mean := time.Duration(latency / downloads)
+	s.lock.Lock()
+	if s.baseline == 0 || mean < s.baseline {
+		s.baseline = mean
+	}
+	baseline := s.baseline
+	current := len(s.quits)
+	s.lock.Unlock()
+
+	n, reason := nextWorkers(current, s.min, s.max, s.step,
+		float64(failures)/float64(downloads), mean, baseline)
+	if n != current {
+		s.resize(n, reason)
+	}
+}
+
+// nextWorkers returns the number of workers to run in place of current
+// and why given the error rate and mean latency of the last interval and
+// the lowest mean latency seen.
+func nextWorkers(current, min, max, step int, errRate float64, mean, baseline time.Duration) (int, string) {
+	delta := current * step / 100
+	if delta < 1 {
+		delta = 1
+	}
+	switch {
+	case errRate > maxScaleErrorRate:
+		current -= delta
+		if current < min {
+			current = min
+		}
+		return current, fmt.Sprintf("%.1f%% errors", 100*errRate)
+	case baseline > 0 && mean > maxScaleLatency*baseline:
+		current -= delta
+		if current < min {
+			current = min
+		}
+		return current, fmt.Sprintf("latency %s over %s", mean, baseline)
+	}
+	current += delta
+	if current > max {
+		current = max
+	}
+	return current, "healthy"
+}
+
+// resize starts or stops workers to run n of them and records the change
+// in the timeline.  Stopped workers finish the metric they are working on.
+func (s *WorkerScaler) resize(n int, reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.quits) < n {
+		quit := make(chan struct{})
+		s.quits = append(s.quits, quit)
+		s.wg.Add(1)
+		go s.run(quit)
+	}
+	for len(s.quits) > n {
+		last := len(s.quits) - 1
+		close(s.quits[last])
+		s.quits = s.quits[:last]
+	}
+	s.timeline = append(s.timeline, WorkerChange{time.Since(s.started), n, reason})
+}
+
+// Workers returns the number of workers running.
+func (s *WorkerScaler) Workers() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.quits)
+}
+
+// Timeline returns the changes of the worker count in order.
+func (s *WorkerScaler) Timeline() []WorkerChange {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]WorkerChange(nil), s.timeline...)
+}
+
+// Summary logs the worker count timeline.
+func (s *WorkerScaler) Summary() {
+	for _, c := range s.Timeline() {
+		log.Printf("Workers at %s: %d (%s)", c.At.Truncate(time.Second), c.Workers, c.Reason)
+	}
+}
+
+// checkWorkerScaling returns true if the -w-min, -w-max, and -w-step
+// options are usable, logging why if not.
+func checkWorkerScaling() bool {
+	if tarWorkersMax == 0 {
+		return true
+	}
+	if tarWorkersMin < 1 || tarWorkersMax < tarWorkersMin {
+		log.Printf("The -w-max option requires 1 <= -w-min <= -w-max.")
+		return false
+	}
+	if tarScaleStep < 1 || tarScaleStep > 100 || tarScaleInterval <= 0 {
+		log.Printf("The -w-step must be 1 to 100 percent and -w-interval positive.")
+		return false
+	}
+	return true
+}
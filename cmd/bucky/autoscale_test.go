@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNextWorkers(t *testing.T) {
+	ms := time.Millisecond
+	tests := []struct {
+		name           string
+		current        int
+		errRate        float64
+		mean, baseline time.Duration
+		expected       int
+	}{
+		{"healthy", 4, 0, 10 * ms, 10 * ms, 5},
+		{"healthy percent", 20, 0, 10 * ms, 10 * ms, 25},
+		{"healthy at max", 30, 0, 10 * ms, 10 * ms, 30},
+		{"errors", 20, 0.1, 10 * ms, 10 * ms, 15},
+		{"errors at min", 2, 0.5, 10 * ms, 10 * ms, 2},
+		{"slow", 8, 0, 30 * ms, 10 * ms, 6},
+		{"no baseline", 8, 0, 30 * ms, 0, 10},
+	}
+	for _, v := range tests {
+		n, reason := nextWorkers(v.current, 2, 30, 25, v.errRate, v.mean, v.baseline)
+		if n != v.expected {
+			t.Errorf("%s: expected %d workers, got %d (%s)", v.name, v.expected, n, reason)
+		}
+	}
+}
+
+func TestWorkerScaler(t *testing.T) {
+	var running int32
+	wg := new(sync.WaitGroup)
+	release := make(chan struct{})
+	s := NewWorkerScaler(1, 3, 100, time.Hour, func(quit <-chan struct{}) {
+		atomic.AddInt32(&running, 1)
+		select {
+		case <-quit:
+		case <-release:
+		}
+		atomic.AddInt32(&running, -1)
+		wg.Done()
+	}, wg)
+	s.Start()
+
+	// Healthy downloads grow the pool up to max
+	for i := 0; i < 3; i++ {
+		s.Observe(time.Millisecond, false)
+		s.Scale()
+	}
+	if s.Workers() != 3 {
+		t.Errorf("Expected 3 workers, got %d", s.Workers())
+	}
+
+	// Failures shrink it down to min
+	for i := 0; i < 3; i++ {
+		s.Observe(time.Millisecond, true)
+		s.Scale()
+	}
+	if s.Workers() != 1 {
+		t.Errorf("Expected 1 worker, got %d", s.Workers())
+	}
+
+	s.Stop()
+	close(release)
+	wg.Wait()
+	if running != 0 {
+		t.Errorf("%d workers still running", running)
+	}
+
+	timeline := s.Timeline()
+	expected := []int{1, 2, 3, 1}
+	if len(timeline) != len(expected) {
+		t.Fatalf("Expected %d changes, got %v", len(expected), timeline)
+	}
+	for i, c := range timeline {
+		if c.Workers != expected[i] {
+			t.Errorf("Change %d: expected %d workers, got %d", i, expected[i], c.Workers)
+		}
+	}
+}
+
+func TestTarWorkerScaling(t *testing.T) {
+	server := exitTestServer()
+	defer server.Close()
+
+	tarWorkersMin, tarWorkersMax = 1, 4
+	tarScaleStep, tarScaleInterval = 50, 10*time.Millisecond
+	defer func() { tarWorkersMin, tarWorkersMax, tarScaler = 1, 0, nil }()
+
+	if code := runTar(t, server, "foo.a", "foo.b", "foo.c", "bad.d"); code != ExitPartial {
+		t.Errorf("Expected exit code %d, got %d", ExitPartial, code)
+	}
+	if tarScaler == nil || len(tarScaler.Timeline()) == 0 {
+		t.Errorf("Expected a worker timeline")
+	}
+}
@@ -67,14 +67,16 @@ func backfillWorker(workIn chan *MigrateWork, wg *sync.WaitGroup) {
 		metric, err := GetMetricData(work.oldLocation, work.oldName)
 		if err != nil {
 			// errors already handled
-			workerErrors = true
+			workFailed()
 			continue
 		}
 		metric.Name = work.newName
 		err = PostMetric(work.newLocation, metric)
 		if err != nil {
 			// errors already handled
-			workerErrors = true
+			workFailed()
+		} else {
+			workSucceeded()
 		}
 	}
 	wg.Done()
@@ -125,7 +127,7 @@ func BackfillMetrics(metricMap map[string]string) error {
 		work.oldName = m
 		work.newName = CleanMetric(metricMap[m])
 		work.oldLocation = server
-		work.newLocation = Cluster.Hash.GetNode(work.newName).Server
+		work.newLocation = Cluster.NodeHostPort(Cluster.Hash.GetNode(work.newName))
 
 		workIn <- work
 		c++
@@ -145,7 +147,7 @@ func BackfillMetrics(metricMap map[string]string) error {
 	close(workIn)
 	wg.Wait()
 	log.Printf("Backfill request complete.")
-	if workerErrors {
+	if workerErrors() {
 		log.Printf("Errors are present.")
 		return fmt.Errorf("Backfill errors are present.")
 	}
@@ -175,7 +177,8 @@ func readBackfillMap(fd *os.File) (map[string]string, error) {
 // backfillCommand runs this subcommand.
 func backfillCommand(c Command) int {
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+		log.Print("At least one argument is required.")
+		return ExitUsage
 	}
 
 	var err error
@@ -183,13 +186,17 @@ func backfillCommand(c Command) int {
 	_, err = GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
+	}
+	if !checkWritable(Cluster.HostPorts()) {
+		return ExitUsage
 	}
 
 	if c.Flag.Arg(0) != "-" {
 		fd, err = os.Open(c.Flag.Arg(0))
 		if err != nil {
-			log.Fatal("Error opening json map: %s", err)
+			log.Printf("Error opening json map: %s", err)
+			return ExitUsage
 		}
 		defer fd.Close()
 	} else {
@@ -201,8 +208,5 @@ func backfillCommand(c Command) int {
 		err = BackfillMetrics(metricMap)
 	}
 
-	if err != nil {
-		return 1
-	}
-	return 0
+	return exitStatus(err)
 }
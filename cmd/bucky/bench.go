@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var benchCount int
+var benchDuration time.Duration
+var benchSeed int64
+
+func init() {
+	usage := "[options] <metric expression>"
+	short := "Measure the read throughput of the cluster."
+	long := `Download a sample of metrics from the cluster the same way tar does and
+report the aggregate throughput, the throughput of each server, and the
+latency of the downloads.  Nothing is written.  Use this to choose -w and to
+plan the window needed to archive the cluster.
+
+Without any arguments every metric in the cluster is eligible.  The
+arguments are a series of one or more metric key names.  If the first
+argument is a "-" then read a JSON array from STDIN as our list of metrics.
+Use -r to enable regular expression mode.  Use -s to only benchmark the
+buckyd daemon given by -h.
+
+The -count metrics to download are chosen at random from the matching
+metrics by -seed so that repeated runs download the same sample.  A metric
+held by more than one server may be chosen from each of them.  They are
+downloaded by -w workers.  Use -duration to download the sample repeatedly
+until that much time has passed rather than once.  Downloads still in
+progress when it ends are not counted.
+
+Throughput is the Whisper data downloaded per second of wall clock time in
+MiB/s.  The minimum, 50th, 90th, and 99th percentile, and maximum latency
+of the downloads are printed overall and the 50th and 99th percentile of
+each server.  Use -j for JSON output.
+
+Exits 2 if some downloads failed and 3 if all of them did.`
+
+	c := NewCommand(benchCommand, "bench", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Downloader threads.")
+	c.Flag.IntVar(&metricWorkers, "workers", 5,
+		"Downloader threads.")
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force metric re-inventory.")
+	c.Flag.IntVar(&benchCount, "count", 100,
+		"Number of metrics to download.")
+	c.Flag.DurationVar(&benchDuration, "duration", 0,
+		"Download the sample repeatedly for this long rather than once.")
+	c.Flag.Int64Var(&benchSeed, "seed", 0,
+		"Seed choosing the sampled metrics.")
+}
+
+// benchJob is a metric to download from a server.
+type benchJob struct {
+	server string
+	metric string
+}
+
+// benchTiming is the outcome of a single download.
+type benchTiming struct {
+	server  string
+	latency time.Duration
+	bytes   int64
+	err     error
+}
+
+// BenchLatency summarizes the latency of a set of downloads.
+type BenchLatency struct {
+	Min time.Duration
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+	Max time.Duration
+}
+
+// BenchServer is the throughput of a single server.
+type BenchServer struct {
+	Server     string
+	Metrics    int
+	Failed     int
+	Bytes      int64
+	MiBPerSec  float64
+	LatencyP50 time.Duration
+	LatencyP99 time.Duration
+}
+
+// BenchResult is the result of the bench subcommand.
+type BenchResult struct {
+	Workers          int
+	Metrics          int
+	Failed           int
+	Bytes            int64
+	Elapsed          time.Duration
+	MiBPerSec        float64
+	MetricsPerSecond float64
+	Latency          BenchLatency
+	Servers          []BenchServer
+}
+
+// BenchSample returns count metrics of metricMap, a map of server =>
+// metrics, chosen at random by seed.  Every metric is returned if there are
+// no more than count.
+func BenchSample(metricMap map[string][]string, count int, seed int64) []benchJob {
+	servers := make([]string, 0, len(metricMap))
+	for server := range metricMap {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	jobs := make([]benchJob, 0)
+	for _, server := range servers {
+		metrics := append([]string(nil), metricMap[server]...)
+		sort.Strings(metrics)
+		for _, m := range metrics {
+			jobs = append(jobs, benchJob{server, m})
+		}
+	}
+
+	r := rand.New(rand.NewSource(seed))
+	r.Shuffle(len(jobs), func(i, j int) { jobs[i], jobs[j] = jobs[j], jobs[i] })
+	if len(jobs) > count {
+		jobs = jobs[:count]
+	}
+	return jobs
+}
+
+// RunBench downloads jobs with the given number of workers and returns the
+// measured throughput.  If duration is greater than 0 the jobs are
+// downloaded repeatedly until it passes, otherwise once.
+func RunBench(jobs []benchJob, workers int, duration time.Duration) *BenchResult {
+	ctx := context.Background()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	workIn := make(chan benchJob)
+	timings := make(chan benchTiming, workers)
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for job := range workIn {
+				start := time.Now()
+				metric, err := GetMetricDataContext(ctx, job.server, job.metric)
+				t := benchTiming{server: job.server, latency: time.Since(start), err: err}
+				if err != nil && ctx.Err() != nil {
+					// Cut short by -duration
+					continue
+				}
+				if err == nil {
+					t.bytes = metric.Size
+				}
+				timings <- t
+			}
+		}()
+	}
+
+	start := time.Now()
+	go func() {
+		defer close(workIn)
+		for {
+			for _, job := range jobs {
+				select {
+				case workIn <- job:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if duration <= 0 {
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(timings)
+	}()
+
+	results := make([]benchTiming, 0, len(jobs))
+	for t := range timings {
+		if t.err != nil {
+			workFailed()
+		} else {
+			workSucceeded()
+		}
+		results = append(results, t)
+	}
+	return benchSummary(results, workers, time.Since(start))
+}
+
+// benchLatency returns the latency summary of the sorted latencies.
+func benchLatency(sorted []time.Duration) BenchLatency {
+	if len(sorted) == 0 {
+		return BenchLatency{}
+	}
+	return BenchLatency{
+		Min: sorted[0],
+		P50: percentile(sorted, 50),
+		P90: percentile(sorted, 90),
+		P99: percentile(sorted, 99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+// mibPerSec returns the throughput of bytes over elapsed in MiB/s.
+func mibPerSec(bytes int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(bytes) / (1024 * 1024) / elapsed.Seconds()
+}
+
+// benchSummary builds the BenchResult of the downloads in timings that took
+// elapsed time in total.  Only successful downloads count toward latency.
+func benchSummary(timings []benchTiming, workers int, elapsed time.Duration) *BenchResult {
+	result := &BenchResult{Workers: workers, Elapsed: elapsed, Servers: make([]BenchServer, 0)}
+	all := make([]time.Duration, 0, len(timings))
+	latencies := make(map[string][]time.Duration)
+	servers := make(map[string]*BenchServer)
+	for _, t := range timings {
+		s, ok := servers[t.server]
+		if !ok {
+			s = &BenchServer{Server: t.server}
+			servers[t.server] = s
+		}
+		if t.err != nil {
+			result.Failed++
+			s.Failed++
+			continue
+		}
+		result.Metrics++
+		result.Bytes += t.bytes
+		s.Metrics++
+		s.Bytes += t.bytes
+		all = append(all, t.latency)
+		latencies[t.server] = append(latencies[t.server], t.latency)
+	}
+
+	sort.Slice(all, func(a, b int) bool { return all[a] < all[b] })
+	result.Latency = benchLatency(all)
+	result.MiBPerSec = mibPerSec(result.Bytes, elapsed)
+	if elapsed > 0 {
+		result.MetricsPerSecond = float64(result.Metrics) / elapsed.Seconds()
+	}
+	for _, s := range servers {
+		sorted := latencies[s.Server]
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		l := benchLatency(sorted)
+		s.LatencyP50, s.LatencyP99 = l.P50, l.P99
+		s.MiBPerSec = mibPerSec(s.Bytes, elapsed)
+		result.Servers = append(result.Servers, *s)
+	}
+	sort.Slice(result.Servers, func(a, b int) bool {
+		return result.Servers[a].Server < result.Servers[b].Server
+	})
+	return result
+}
+
+// printBench writes a human readable form of result to STDOUT.
+func printBench(result *BenchResult) {
+	fmt.Printf("Workers: %d\n", result.Workers)
+	fmt.Printf("Downloaded: %d metrics, %d failed, %.2f MiB in %s\n", result.Metrics,
+		result.Failed, float64(result.Bytes)/(1024*1024), result.Elapsed)
+	fmt.Printf("Throughput: %.2f MiB/s, %.2f metrics/s\n", result.MiBPerSec,
+		result.MetricsPerSecond)
+	l := result.Latency
+	fmt.Printf("Latency: min=%s p50=%s p90=%s p99=%s max=%s\n",
+		l.Min, l.P50, l.P90, l.P99, l.Max)
+
+	fmt.Printf("%-30s %8s %8s %10s %12s %12s\n", "server", "metrics", "failed", "MiB/s", "p50", "p99")
+	for _, s := range result.Servers {
+		fmt.Printf("%-30s %8d %8d %10.2f %12s %12s\n", s.Server, s.Metrics, s.Failed,
+			s.MiBPerSec, s.LatencyP50, s.LatencyP99)
+	}
+}
+
+// benchCommand runs this subcommand.
+func benchCommand(c Command) int {
+	if metricWorkers < 1 {
+		log.Print("The -w option must be at least 1.")
+		return ExitUsage
+	}
+	if benchCount < 1 {
+		log.Print("The -count option must be at least 1.")
+		return ExitUsage
+	}
+	if benchDuration < 0 {
+		log.Print("The -duration option can not be negative.")
+		return ExitUsage
+	}
+
+	var servers []string
+	if SingleHost {
+		server, err := singleServer(HostPort)
+		if err != nil {
+			log.Printf("Malformed hostname: %s", err)
+			return ExitUsage
+		}
+		servers = []string{server}
+	} else {
+		_, err := GetClusterConfig(HostPort)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+		if !Cluster.Healthy {
+			log.Printf("Warning: Cluster is not optimal.")
+		}
+		servers = Cluster.HostPorts()
+	}
+
+	metricMap, err := ListSelection(c, servers)
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return ExitError
+	}
+	jobs := BenchSample(metricMap, benchCount, benchSeed)
+	if len(jobs) == 0 {
+		log.Print("No metrics matched.")
+		return ExitUsage
+	}
+	if benchDuration > 0 {
+		log.Printf("Downloading %d metrics with %d workers for %s.", len(jobs),
+			metricWorkers, benchDuration)
+	} else {
+		log.Printf("Downloading %d metrics with %d workers.", len(jobs), metricWorkers)
+	}
+
+	result := RunBench(jobs, metricWorkers, benchDuration)
+	if JSONOutput {
+		blob, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("%s", err)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		printBench(result)
+	}
+	return workStatus()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBenchSample(t *testing.T) {
+	metricMap := map[string][]string{
+		"a:4242": []string{"foo.a", "foo.b", "foo.c"},
+		"b:4242": []string{"foo.d", "foo.e"},
+	}
+	jobs := BenchSample(metricMap, 3, 1)
+	if len(jobs) != 3 {
+		t.Fatalf("Expected 3 sampled metrics, got %v", jobs)
+	}
+	again := BenchSample(metricMap, 3, 1)
+	for i := range jobs {
+		if jobs[i] != again[i] {
+			t.Errorf("The same seed sampled %v and %v", jobs, again)
+			break
+		}
+	}
+	if all := BenchSample(metricMap, 100, 1); len(all) != 5 {
+		t.Errorf("Expected every metric sampled, got %v", all)
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	good := strings.TrimPrefix(server.URL, "http://")
+	bad := strings.TrimPrefix(missing.URL, "http://")
+
+	resetTarState()
+	jobs := []benchJob{{good, "foo.a"}, {good, "foo.b"}, {good, "foo.c"}, {bad, "foo.d"}}
+	result := RunBench(jobs, 2, 0)
+	if result.Metrics != 3 || result.Failed != 1 {
+		t.Errorf("Expected 3 downloads and 1 failure, got %d and %d", result.Metrics, result.Failed)
+	}
+	if result.Bytes != 3*int64(len("whisper data")) {
+		t.Errorf("Expected %d bytes, got %d", 3*len("whisper data"), result.Bytes)
+	}
+	if len(result.Servers) != 2 || result.Servers[0].Server > result.Servers[1].Server {
+		t.Fatalf("Expected 2 sorted servers, got %v", result.Servers)
+	}
+	for _, s := range result.Servers {
+		if s.Server == good && (s.Metrics != 3 || s.LatencyP50 <= 0 || s.MiBPerSec <= 0) {
+			t.Errorf("Bad throughput for %s: %+v", good, s)
+		}
+		if s.Server == bad && (s.Metrics != 0 || s.Failed != 1) {
+			t.Errorf("Bad throughput for %s: %+v", bad, s)
+		}
+	}
+	l := result.Latency
+	if l.Min <= 0 || l.Min > l.P50 || l.P50 > l.P99 || l.P99 > l.Max {
+		t.Errorf("Bad latency percentiles: %+v", l)
+	}
+	if workStatus() != ExitPartial {
+		t.Errorf("Expected partial success, got %d", workStatus())
+	}
+
+	// With -duration the sample is downloaded repeatedly
+	resetTarState()
+	result = RunBench(jobs[:1], 1, 50*time.Millisecond)
+	if result.Metrics < 2 || result.Elapsed < 50*time.Millisecond {
+		t.Errorf("Expected repeated downloads for 50ms, got %d in %s", result.Metrics, result.Elapsed)
+	}
+}
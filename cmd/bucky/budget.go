@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// ByteBudget is a semaphore counted in bytes that bounds the memory held
+// by metric bodies in flight.  A request larger than the limit is admitted
+// once nothing else is in flight so that it can't wait forever.
+type ByteBudget struct {
+	lock      sync.Mutex
+	wake      chan struct{}
+	limit     int64
+	used      int64
+	peak      int64
+	throttled int
+}
+
+// NewByteBudget returns a ByteBudget of limit bytes.
+func NewByteBudget(limit int64) *ByteBudget {
+	return &ByteBudget{wake: make(chan struct{}), limit: limit}
+}
+
+// Acquire blocks until n bytes fit within the budget or ctx is cancelled.
+func (b *ByteBudget) Acquire(ctx context.Context, n int64) error {
+	b.lock.Lock()
+	waited := false
+	for b.used > 0 && b.used+n > b.limit {
+		if !waited {
+			b.throttled++
+			waited = true
+		}
+		wake := b.wake
+		b.lock.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		b.lock.Lock()
+	}
+	b.used += n
+	if b.used > b.peak {
+		b.peak = b.used
+	}
+	b.lock.Unlock()
+	return nil
+}
+
+// Release returns n bytes to the budget and wakes any waiters.
+func (b *ByteBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	b.used -= n
+	close(b.wake)
+	b.wake = make(chan struct{})
+	b.lock.Unlock()
+}
+
+// Stats returns the most bytes ever in flight and the number of
+// acquisitions that had to wait.
+func (b *ByteBudget) Stats() (peak int64, throttled int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.peak, b.throttled
+}
+
+type budgetKey struct{}
+
+// withBudget returns a context that makes metric downloads reserve their
+// declared size from b before reading the body.  The caller must Release
+// the Size of each metric returned once it is done with the data.
+func withBudget(ctx context.Context, b *ByteBudget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, b)
+}
+
+// budgetFrom returns the ByteBudget of ctx or nil if there is none.
+func budgetFrom(ctx context.Context) *ByteBudget {
+	b, _ := ctx.Value(budgetKey{}).(*ByteBudget)
+	return b
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestByteBudget(t *testing.T) {
+	const limit = 1000
+	budget := NewByteBudget(limit)
+	var inFlight, over int64
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			r := rand.New(rand.NewSource(seed))
+			for j := 0; j < 200; j++ {
+				n := r.Int63n(limit) + 1
+				budget.Acquire(context.Background(), n)
+				if atomic.AddInt64(&inFlight, n) > limit {
+					atomic.AddInt64(&over, 1)
+				}
+				time.Sleep(time.Microsecond)
+				atomic.AddInt64(&inFlight, -n)
+				budget.Release(n)
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	peak, throttled := budget.Stats()
+	if over > 0 || peak > limit {
+		t.Errorf("In-flight bytes exceeded the cap %d times, peak %d", over, peak)
+	}
+	if throttled == 0 {
+		t.Errorf("Budget never throttled")
+	}
+}
+
+func TestByteBudgetOversized(t *testing.T) {
+	budget := NewByteBudget(10)
+	if err := budget.Acquire(context.Background(), 100); err != nil {
+		t.Fatalf("Oversized request with nothing in flight was refused: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := budget.Acquire(ctx, 1); err == nil {
+		t.Errorf("Request was admitted over the cap")
+	}
+	budget.Release(100)
+	if err := budget.Acquire(context.Background(), 1); err != nil {
+		t.Errorf("Request refused after release: %s", err)
+	}
+}
+
+func TestTarMaxInFlight(t *testing.T) {
+	// Metrics named size.N are N bytes long
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+		size, _ := strconv.Atoi(strings.Split(name, ".")[1])
+		data := bytes.Repeat([]byte("x"), size)
+		stat, _ := json.Marshal(&metrics.MetricData{Name: name, Size: int64(size), Mode: 0644})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		time.Sleep(5 * time.Millisecond)
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 8
+	tarMaxInFlight = 3000
+	NoEncoding = true
+	defer func() {
+		tarMaxInFlight = 0
+		NoEncoding = false
+	}()
+	host := strings.TrimPrefix(server.URL, "http://")
+	metricMap := map[string][]string{host: nil}
+	for i := 0; i < 40; i++ {
+		metricMap[host] = append(metricMap[host], "size."+strconv.Itoa(500+i*50)+".m"+strconv.Itoa(i))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != nil {
+		t.Fatalf("Error building archive: %s", err)
+	}
+	if archiveFiles != 40 {
+		t.Errorf("Expected 40 metrics archived, got %d", archiveFiles)
+	}
+	peak, throttled := tarBudget.Stats()
+	if peak > tarMaxInFlight {
+		t.Errorf("Peak in-flight bytes %d exceeded the cap", peak)
+	}
+	if throttled == 0 {
+		t.Errorf("Cap never throttled downloads")
+	}
+	if tarBudget.used != 0 {
+		t.Errorf("%d bytes still reserved after the archive completed", tarBudget.used)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// statBatchSize is the number of metrics stat()ed with each bulk stat
+// request to buckyd.
+var statBatchSize = 1000
+
+// errNoBulkStat is returned by bulkStat when the server predates the
+// /stat endpoint.
+var errNoBulkStat = errors.New("Bulk stat not supported")
+
+// noBulkStat records the servers found to lack the /stat endpoint so
+// we only ask them once.
+var noBulkStat = make(map[string]bool)
+var noBulkStatLock sync.Mutex
+
+// statWork is a batch of metrics to stat on a single server.
+type statWork struct {
+	server  string
+	metrics []string
+}
+
+// bulkStat POSTs a single batch of metric names to the /stat endpoint of
+// server and returns the stats of the metrics found.
+func bulkStat(server string, metrics []string) ([]*MetricData, error) {
+	var err error
+	httpClient := GetHTTP()
+	u := &url.URL{
+		Scheme: buckyScheme(),
+		Path:   "/stat",
+	}
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return nil, err
+	}
+
+	blob, err := json.Marshal(metrics)
+	if err != nil {
+		log.Printf("Error marshalling JSON data: %s", err)
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("list", string(blob))
+	r, err := NewRequest("POST", u.String(), strings.NewReader(query.Encode()))
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		log.Printf("Error communicating: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading response from %s: %s", server, err)
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		stats := make([]*MetricData, 0)
+		err = json.Unmarshal(body, &stats)
+		if err != nil {
+			log.Printf("Error unmarshalling stat data from %s: %s", server, err)
+			return nil, err
+		}
+		return stats, nil
+	case http.StatusNotFound:
+		return nil, errNoBulkStat
+	}
+
+	log.Printf("Error: Bulk stat on %s returned %s: %s", server, resp.Status, body)
+	return nil, fmt.Errorf("Bulk stat on %s returned %s", server, resp.Status)
+}
+
+// StatRemoteMetrics stats the given metrics on server.  Metrics are sent
+// in batches of statBatchSize and metrics that are not found are left out
+// of the results.  If the server does not support bulk stat we fall back
+// to StatRemoteMetric for each metric.
+func StatRemoteMetrics(server string, metrics []string) ([]*MetricData, error) {
+	results := make([]*MetricData, 0, len(metrics))
+	for i := 0; i < len(metrics); i += statBatchSize {
+		j := i + statBatchSize
+		if j > len(metrics) {
+			j = len(metrics)
+		}
+
+		noBulkStatLock.Lock()
+		fallback := noBulkStat[server]
+		noBulkStatLock.Unlock()
+
+		if !fallback {
+			stats, err := bulkStat(server, metrics[i:j])
+			if err == nil {
+				logMissing(metrics[i:j], stats)
+				results = append(results, stats...)
+				continue
+			}
+			if err != errNoBulkStat {
+				return results, err
+			}
+			log.Printf("%s does not support bulk stat, using a request per metric.", server)
+			noBulkStatLock.Lock()
+			noBulkStat[server] = true
+			noBulkStatLock.Unlock()
+		}
+
+		for _, m := range metrics[i:j] {
+			stat, err := StatRemoteMetric(server, m)
+			if err == nil {
+				results = append(results, stat)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// logMissing logs the metrics that a bulk stat did not find.
+func logMissing(metrics []string, stats []*MetricData) {
+	found := make(map[string]bool)
+	for _, stat := range stats {
+		found[stat.Name] = true
+	}
+	for _, m := range metrics {
+		if !found[m] {
+			log.Printf("Metric not found: %s", m)
+		}
+	}
+}
+
+// statBatchWorker stats each batch of metrics from workIn and passes the
+// results to workOut.  Metrics that could not be stat()ed are failures.
+func statBatchWorker(workIn chan *statWork, workOut chan *MetricData, wg *sync.WaitGroup) {
+	for work := range workIn {
+		stats, _ := StatRemoteMetrics(work.server, work.metrics)
+		found := make(map[string]bool)
+		for _, stat := range stats {
+			found[stat.Name] = true
+			workSucceeded()
+			workOut <- stat
+		}
+		for _, m := range work.metrics {
+			if !found[m] {
+				workFailed()
+			}
+		}
+	}
+	wg.Done()
+}
+
+// statBatches stats every metric in metricMap, a map of server => metrics,
+// using metricWorkers workers that each request a batch of statBatchSize
+// metrics at a time.  The function results is called with each stat from
+// a single goroutine.
+func statBatches(metricMap map[string][]string, results func(*MetricData)) {
+	wg := new(sync.WaitGroup)
+	wg2 := new(sync.WaitGroup)
+	workIn := make(chan *statWork, 25)
+	workOut := make(chan *MetricData, 25)
+
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go statBatchWorker(workIn, workOut, wg)
+	}
+
+	wg2.Add(1)
+	go func() {
+		for stat := range workOut {
+			results(stat)
+		}
+		wg2.Done()
+	}()
+
+	c := 0
+	l := countMap(metricMap)
+	for server, metrics := range metricMap {
+		for i := 0; i < len(metrics); i += statBatchSize {
+			j := i + statBatchSize
+			if j > len(metrics) {
+				j = len(metrics)
+			}
+			workIn <- &statWork{server, metrics[i:j]}
+			c = c + j - i
+			log.Printf("Progress: %d/%d %.2f%%", c, l, float64(c)/float64(l)*100)
+		}
+	}
+
+	close(workIn)
+	wg.Wait()
+
+	close(workOut)
+	wg2.Wait()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// statTestServer fakes a buckyd that knows every metric but "missing".
+// With bulk false the server predates the /stat endpoint.
+func statTestServer(bulk bool, requests map[string]int, lock *sync.Mutex) *httptest.Server {
+	stat := func(m string) *MetricData {
+		return &MetricData{Name: m, Size: int64(len(m))}
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.Method+" "+strings.SplitN(r.URL.Path, ".", 2)[0]]++
+		lock.Unlock()
+
+		switch {
+		case bulk && r.URL.Path == "/stat":
+			names := make([]string, 0)
+			json.Unmarshal([]byte(r.FormValue("list")), &names)
+			stats := make([]*MetricData, 0)
+			for _, m := range names {
+				if m != "missing" {
+					stats = append(stats, stat(m))
+				}
+			}
+			blob, _ := json.Marshal(stats)
+			w.Write(blob)
+		case r.Method == "HEAD" && r.URL.Path != "/metrics/missing":
+			blob, _ := json.Marshal(stat(r.URL.Path[len("/metrics/"):]))
+			w.Header().Set("X-Metric-Stat", string(blob))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestStatRemoteMetrics(t *testing.T) {
+	defer func(n int) { statBatchSize = n }(statBatchSize)
+	statBatchSize = 2
+	metrics := []string{"a.b", "missing", "c.d", "e.f", "g.h"}
+
+	for _, bulk := range []bool{true, false} {
+		requests := make(map[string]int)
+		lock := new(sync.Mutex)
+		server := statTestServer(bulk, requests, lock)
+		host := strings.TrimPrefix(server.URL, "http://")
+
+		stats, err := StatRemoteMetrics(host, metrics)
+		server.Close()
+		if err != nil {
+			t.Fatalf("bulk %v: %s", bulk, err)
+		}
+		if len(stats) != 4 {
+			t.Errorf("bulk %v: expected 4 stats, got %d", bulk, len(stats))
+		}
+		for _, s := range stats {
+			if s.Name == "missing" || s.Size != int64(len(s.Name)) {
+				t.Errorf("bulk %v: bad stat %v", bulk, s)
+			}
+		}
+
+		if bulk {
+			if requests["POST /stat"] != 3 || requests["HEAD /metrics/a"] != 0 {
+				t.Errorf("Expected 3 bulk requests only, got %v", requests)
+			}
+		} else {
+			// One probe of /stat before falling back
+			if requests["POST /stat"] != 1 || len(requests) != 6 {
+				t.Errorf("Expected fall back to HEAD requests, got %v", requests)
+			}
+		}
+	}
+}
+
+func TestDuBulkStat(t *testing.T) {
+	resetTarState()
+	defer resetTarState()
+	defer func(n int) { statBatchSize = n }(statBatchSize)
+	statBatchSize = 2
+	metricWorkers = 3
+	duTotal = 0
+
+	requests := make(map[string]int)
+	server := statTestServer(true, requests, new(sync.Mutex))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	size, err := duMetrics(map[string][]string{
+		host: []string{"a.b", "missing", "c.d", "e.f", "g.h"},
+	})
+	if err == nil {
+		t.Errorf("Missing metric not reported as an error")
+	}
+	if size != 12 {
+		t.Errorf("Expected 12 bytes, got %d", size)
+	}
+	if workerSucceeded != 4 || workerFailed != 1 {
+		t.Errorf("Expected 4 succeeded and 1 failed, got %d and %d",
+			workerSucceeded, workerFailed)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// MetricCache is a local directory of previously downloaded metrics used
+// to skip downloading metrics that have not changed.  Each metric is stored
+// decoded at its relative whisper path with the file's modification time
+// set to the metric's ModTime.  An entry is only used if both the metric
+// and its ModTime match.
+type MetricCache struct {
+	dir    string
+	hits   int32
+	misses int32
+}
+
+// NewMetricCache returns a MetricCache stored in dir.
+func NewMetricCache(dir string) *MetricCache {
+	return &MetricCache{dir: dir}
+}
+
+func (c *MetricCache) path(name string) string {
+	return filepath.Join(c.dir, MetricToRelative(name))
+}
+
+// modTime returns the ModTime of the cached copy of the metric or 0 if
+// there is none.
+func (c *MetricCache) modTime(name string) int64 {
+	s, err := os.Stat(c.path(name))
+	if err != nil || !s.Mode().IsRegular() {
+		return 0
+	}
+	return s.ModTime().Unix()
+}
+
+// load returns the cached data for the metric described by stat or an
+// error if the cache does not hold that metric at that ModTime.
+func (c *MetricCache) load(stat *MetricData) ([]byte, error) {
+	if c.modTime(stat.Name) != stat.ModTime {
+		return nil, os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(c.path(stat.Name))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != stat.Size {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+// store saves the decoded data of metric to the cache.  The file is
+// written to a temporary name and renamed into place.
+func (c *MetricCache) store(metric *MetricData, data []byte) error {
+	path := c.path(metric.Name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	fd, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	mtime := time.Unix(metric.ModTime, 0)
+	if err == nil {
+		err = os.Chtimes(fd.Name(), mtime, mtime)
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// Get returns the metric from the server.  If the cache holds a copy the
+// request is conditional and the cached copy is returned when the server
+// replies that the metric is not modified.  Otherwise, or if the server
+// ignores the condition, the metric is downloaded and cached.  The
+// returned metric is always decoded.
+func (c *MetricCache) Get(ctx context.Context, server, name string) (*MetricData, error) {
+	budget := budgetFrom(ctx)
+	since := c.modTime(name)
+	metric, err := GetMetricDataSince(ctx, server, name, since)
+	if err == ErrNotModified {
+		if budget != nil {
+			if err := budget.Acquire(ctx, metric.Size); err != nil {
+				return nil, err
+			}
+		}
+		data, lerr := c.load(metric)
+		if lerr == nil {
+			atomic.AddInt32(&c.hits, 1)
+			metric.Data = data
+			metric.Encoding = EncIdentity
+			return metric, nil
+		}
+		// The cached copy doesn't match the server, download it all
+		budget.Release(metric.Size)
+		metric, err = GetMetricDataContext(ctx, server, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	atomic.AddInt32(&c.misses, 1)
+	data, err := MetricDecode(metric)
+	if err != nil {
+		budget.Release(metric.Size)
+		return nil, err
+	}
+	metric.Data = data
+	metric.Encoding = EncIdentity
+	if err := c.store(metric, data); err != nil {
+		log.Printf("Warning: Error caching %s: %s", name, err)
+	}
+	return metric, nil
+}
+
+// Summary logs the number of metrics served from the cache.
+func (c *MetricCache) Summary() {
+	total := c.hits + c.misses
+	if total == 0 {
+		return
+	}
+	log.Printf("Cache: %d hits, %d misses, %.1f%% hit rate.",
+		c.hits, c.misses, 100*float64(c.hits)/float64(total))
+}
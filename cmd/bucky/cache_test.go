@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+// cacheServer serves a metric with the given data and ModTime.  Unless
+// ignoreIMS is set If-Modified-Since is honored.
+type cacheServer struct {
+	data      string
+	mtime     int64
+	ignoreIMS bool
+	requests  int
+}
+
+func (s *cacheServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.requests++
+	stat, _ := json.Marshal(&metrics.MetricData{
+		Name:    strings.TrimPrefix(r.URL.Path, "/metrics/"),
+		Size:    int64(len(s.data)),
+		Mode:    0644,
+		ModTime: s.mtime,
+	})
+	w.Header().Set("X-Metric-Stat", string(stat))
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if !s.ignoreIMS && err == nil && s.mtime <= since.Unix() {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(s.data))
+}
+
+func TestMetricCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &cacheServer{data: "whisper data", mtime: 1500000000}
+	server := httptest.NewServer(s)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	NoEncoding = true
+	defer func() { NoEncoding = false }()
+
+	cache := NewMetricCache(dir)
+	get := func(expected string) {
+		metric, err := cache.Get(context.Background(), host, "foo.bar")
+		if err != nil {
+			t.Fatalf("Error fetching metric: %s", err)
+		}
+		if string(metric.Data) != expected || metric.Encoding != metrics.EncIdentity {
+			t.Errorf("Expected %q, got %q", expected, metric.Data)
+		}
+	}
+
+	get("whisper data") // miss, cached
+	get("whisper data") // hit
+	if cache.hits != 1 || cache.misses != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %d and %d", cache.hits, cache.misses)
+	}
+
+	// Modified metrics are downloaded again
+	s.data, s.mtime = "new whisper data", 1500000100
+	get("new whisper data")
+	if cache.misses != 2 {
+		t.Errorf("Modified metric was served from the cache")
+	}
+
+	// A server metric older than the cache doesn't match the cache key
+	s.data, s.mtime = "old data", 1400000000
+	get("old data")
+	if cache.misses != 3 || s.requests != 5 {
+		t.Errorf("Older metric: %d misses in %d requests", cache.misses, s.requests)
+	}
+
+	// Servers that don't honor the condition fall back to a download
+	s.ignoreIMS = true
+	get("old data")
+	if cache.hits != 1 || cache.misses != 4 {
+		t.Errorf("Expected 1 hit and 4 misses, got %d and %d", cache.hits, cache.misses)
+	}
+}
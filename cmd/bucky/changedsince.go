@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// tarChangedSinceFile is the -changed-since-file marker holding the time
+// of the last successful archive.  Only metrics modified since then are
+// archived and the marker is updated when the run fully succeeds.
+var tarChangedSinceFile string
+
+// tarChangedSince is the time read from -changed-since-file.  It is zero
+// when the marker does not exist yet and every metric is archived.
+var tarChangedSince time.Time
+
+// ReadChangedSince returns the RFC 3339 time held in the marker file at
+// path.  The zero time is returned if the marker does not exist.
+func ReadChangedSince(path string) (time.Time, error) {
+	blob, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(blob)))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Bad time in %s: %s", path, err)
+	}
+	return t, nil
+}
+
+// WriteChangedSince replaces the marker file at path with the time t.
+func WriteChangedSince(path string, t time.Time) error {
+	fd, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(fd, t.UTC().Format(time.RFC3339Nano))
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), path)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// FilterChangedSince returns the metrics in sorted modified at or after
+// since according to a stat of each on the first of the servers returned
+// by serversFor.  Metrics that can not be stat()ed are kept so that their
+// download reports the problem.  The order of sorted is kept.
+func FilterChangedSince(sorted []string, serversFor func(string) []string, since time.Time) []string {
+	metricMap := make(map[string][]string)
+	for _, m := range sorted {
+		server := serversFor(m)[0]
+		metricMap[server] = append(metricMap[server], m)
+	}
+
+	// The stat is not part of the work the exit code reports on
+	succeeded, failed := workerSucceeded, workerFailed
+	defer func() {
+		workerSucceeded, workerFailed = succeeded, failed
+	}()
+
+	unchanged := make(map[string]bool)
+	statBatches(metricMap, func(stat *MetricData) {
+		// Whole seconds, so a metric modified in the second of the
+		// marker is archived again rather than missed
+		if stat.ModTime < since.Unix() {
+			unchanged[stat.Name] = true
+		}
+	})
+
+	ret := make([]string, 0, len(sorted)-len(unchanged))
+	for _, m := range sorted {
+		if !unchanged[m] {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// applyChangedSince filters sorted by -changed-since-file if set.
+func applyChangedSince(sorted []string, serversFor func(string) []string) []string {
+	if tarChangedSinceFile == "" {
+		return sorted
+	}
+	if tarChangedSince.IsZero() {
+		log.Printf("No marker in %s, archiving every selected metric.", tarChangedSinceFile)
+		return sorted
+	}
+	ret := FilterChangedSince(sorted, serversFor, tarChangedSince)
+	log.Printf("%d of %d selected metrics changed since %s.", len(ret), len(sorted),
+		tarChangedSince.Format(time.RFC3339))
+	return ret
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestTarChangedSinceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	modTimes := map[string]int64{"foo.old": 500, "foo.new": 1500, "foo.same": 1000, "bad.new": 2000}
+	lock := new(sync.Mutex)
+	downloads := make([]string, 0)
+	data := []byte("whisper data")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := make([]string, 0)
+		json.Unmarshal([]byte(r.FormValue("list")), &list)
+		switch r.URL.Path {
+		case "/metrics":
+			blob, _ := json.Marshal(list)
+			w.Write(blob)
+		case "/stat":
+			stats := make([]*metrics.MetricData, 0)
+			for _, m := range list {
+				stats = append(stats, &metrics.MetricData{Name: m, Size: 12, ModTime: modTimes[m]})
+			}
+			blob, _ := json.Marshal(stats)
+			w.Write(blob)
+		case "/status":
+			http.NotFound(w, r)
+		default:
+			name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+			lock.Lock()
+			downloads = append(downloads, name)
+			lock.Unlock()
+			if strings.HasPrefix(name, "bad.") {
+				http.Error(w, "Broken", http.StatusInternalServerError)
+				return
+			}
+			stat, _ := json.Marshal(&metrics.MetricData{Name: name, Size: 12, Mode: 0644,
+				ModTime: modTimes[name]})
+			w.Header().Set("X-Metric-Stat", string(stat))
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	marker := filepath.Join(dir, "marker")
+	tarChangedSinceFile = marker
+	defer func() { tarChangedSinceFile = "" }()
+	run := func(msg string, code int, expected ...string) {
+		t.Helper()
+		downloads = downloads[:0]
+		if c := runTar(t, server, "foo.old", "foo.new", "foo.same"); c != code {
+			t.Errorf("%s: expected exit %d, got %d", msg, code, c)
+		}
+		sort.Strings(downloads)
+		sort.Strings(expected)
+		if strings.Join(downloads, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected downloads %v, got %v", msg, expected, downloads)
+		}
+	}
+
+	// First run archives everything and records when it started
+	before := time.Now()
+	run("First run", ExitOK, "foo.old", "foo.new", "foo.same")
+	since, err := ReadChangedSince(marker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since.Before(before.Add(-time.Second)) || since.After(time.Now()) {
+		t.Errorf("Marker not updated to the start of the run: %s", since)
+	}
+
+	// Nothing has changed since, an empty archive is still a success
+	run("Nothing changed", ExitOK)
+
+	// Incremental run from an older marker
+	if err := WriteChangedSince(marker, time.Unix(1000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	run("Incremental", ExitOK, "foo.new", "foo.same")
+	if since, _ := ReadChangedSince(marker); since.Unix() <= 1000 {
+		t.Errorf("Marker not updated after success: %s", since)
+	}
+
+	// A partial failure leaves the marker alone for the next run to retry
+	WriteChangedSince(marker, time.Unix(1000, 0))
+	downloads = downloads[:0]
+	if c := runTar(t, server, "foo.old", "bad.new"); c != ExitFailed {
+		t.Errorf("Expected exit %d with a failed download, got %d", ExitFailed, c)
+	}
+	if since, _ := ReadChangedSince(marker); since.Unix() != 1000 {
+		t.Errorf("Marker updated after a failed run: %s", since)
+	}
+
+	ioutil.WriteFile(marker, []byte("yesterday\n"), 0644)
+	if _, err := ReadChangedSince(marker); err == nil {
+		t.Errorf("Expected an error for a malformed marker")
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 )
 
 import "github.com/jjneely/buckytools/hashing"
@@ -20,81 +23,442 @@ type ClusterConfig struct {
 	// that the cluster is using
 	Hash hashing.HashRing
 
+	// Replicas is the number of copies of each metric stored in the
+	// cluster as configured on the buckyd daemons
+	Replicas int
+
+	// Ring is the hash ring configuration reported by the initial
+	// buckyd daemon
+	Ring *hashing.JSONRingType
+
 	// Healthy is true if the cluster configuration represents a Healthy
 	// cluster
 	Healthy bool
+
+	// InstancePorts maps a Node.Instance to the port of the buckyd daemon
+	// serving that carbon instance.  Nodes without a mapped instance use
+	// Port.
+	InstancePorts map[string]string
 }
 
 // Cluster is the working and cached cluster configuration
 var Cluster *ClusterConfig
 
+// RelayConfig is the path to a carbon-c-relay configuration file.  When
+// set the hash ring is built from this file rather than from the buckyd
+// daemons.  RelayCluster selects the cluster in the file to use.
+var RelayConfig string
+var RelayCluster string
+
+// KeyTransform names the transformation in hashing.KeyTransforms applied
+// to metric keys before they are hashed.
+var KeyTransform string
+
+// DiverseReplicas places replicas on distinct servers like carbon's
+// DIVERSE_REPLICAS when set by -diverse-replicas.
+var DiverseReplicas bool
+
+// PlacementStrategy selects how metrics are placed on the cluster's
+// nodes.  "ring" uses the consistent hash ring of the cluster's algorithm
+// and "rendezvous" uses hashing.RendezvousHash.
+var PlacementStrategy string
+
+// RingHashType and RingCopies override the hash ring algorithm and the
+// number of copies of each metric advertised by the buckyd daemons when
+// set by -hashtype and -cluster-replicas.
+var RingHashType string
+var RingCopies int
+
+// InstancePortMap is a comma separated list of INSTANCE=PORT pairs as
+// given to -instance-port.
+var InstancePortMap string
+
+// ParseInstancePorts parses a comma separated list of INSTANCE=PORT pairs
+// into a map of instance => port.
+func ParseInstancePorts(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if s == "" {
+		return ret, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("Invalid instance port %q, expected INSTANCE=PORT", pair)
+		}
+		port, err := strconv.ParseUint(fields[1], 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("Invalid port for instance %s: %q", fields[0], fields[1])
+		}
+		ret[fields[0]] = fields[1]
+	}
+	return ret, nil
+}
+
+// NodeHostPort returns the server string used to contact the buckyd
+// daemon for the given Node.  If the Node's instance has a port mapped
+// in InstancePorts the result is HOST:PORT, otherwise it is the bare
+// hostname and the cluster's port is used when the request is made.
+func (c *ClusterConfig) NodeHostPort(n hashing.Node) string {
+	if c == nil || n.Instance == "" {
+		return n.Server
+	}
+	if port, ok := c.InstancePorts[n.Instance]; ok {
+		return net.JoinHostPort(n.Server, port)
+	}
+	return n.Server
+}
+
 func (c *ClusterConfig) HostPorts() []string {
 	if c == nil {
 		return nil
 	}
 	ret := make([]string, 0)
+	if len(c.InstancePorts) > 0 && c.Ring != nil {
+		// Each instance may have its own buckyd daemon
+		for _, n := range c.Ring.Nodes {
+			port, ok := c.InstancePorts[n.Instance]
+			if !ok || n.Instance == "" {
+				port = c.Port
+			}
+			hostport := net.JoinHostPort(n.Server, port)
+			if !containsString(ret, hostport) {
+				ret = append(ret, hostport)
+			}
+		}
+		return ret
+	}
 	for _, v := range c.Servers {
-		ret = append(ret, fmt.Sprintf("%s:%s", v, c.Port))
+		ret = append(ret, net.JoinHostPort(v, c.Port))
 	}
 	return ret
 }
 
 // GetClusterConfig returns either the cached ClusterConfig object or
 // builds it if needed.  The initial HOST:PORT of the buckyd daemon
-// must be given.
+// must be given.  A healthy cluster's ring is saved to -ring-cache and
+// reused without contacting the cluster until it expires.
 func GetClusterConfig(hostport string) (*ClusterConfig, error) {
 	if Cluster != nil {
 		return Cluster, nil
 	}
 
-	master, err := GetSingleHashRing(hostport)
+	key := ringCacheKey(hostport)
+	if ring := loadRingCache(key); ring != nil {
+		cluster, err := newClusterConfig(hostport, ring)
+		if err != nil {
+			return nil, err
+		}
+		// Only healthy clusters are cached
+		cluster.Healthy = true
+		Cluster = cluster
+		return Cluster, nil
+	}
+
+	master, err := discoverRing(hostport)
+	if err != nil {
+		log.Printf("Abort: %s", err)
+		return nil, err
+	}
+	cluster, err := newClusterConfig(hostport, master)
 	if err != nil {
-		log.Printf("Abort: Cannot communicate with initial buckyd daemon.")
 		return nil, err
 	}
+	Cluster = cluster
+
+	members := make([]*hashing.JSONRingType, 0)
+	for _, host := range Cluster.HostPorts() {
+		if host == net.JoinHostPort(master.Name, Cluster.Port) {
+			// Don't query the initial daemon again
+			continue
+		}
+		member, err := GetSingleHashRing(host)
+		if err != nil {
+			log.Printf("Cluster unhealthy: %s: %s", host, err)
+		}
+		// Compare like with like when -dedup-servers is set
+		member, _ = dedupRing(member, false)
+		members = append(members, member)
+	}
+	if err := checkRingConfigs(master, members); err != nil {
+		log.Printf("Abort: %s", err)
+		Cluster = nil
+		return nil, err
+	}
+
+	// Health compares the rings as advertised, before -hashtype and
+	// -cluster-replicas are applied
+	advertised, _ := dedupRing(master, false)
+	Cluster.Healthy = isHealthy(advertised, members)
+	if Cluster.Healthy {
+		saveRingCache(key, master)
+	}
+	return Cluster, nil
+}
 
+// newClusterConfig builds the ClusterConfig of the given ring as found
+// through the buckyd daemon at hostport.  Duplicate nodes are removed if
+// -dedup-servers is set.  Health is not checked.
+func newClusterConfig(hostport string, ring *hashing.JSONRingType) (*ClusterConfig, error) {
 	_, port, err := net.SplitHostPort(hostport)
 	if err != nil {
 		log.Printf("Abort: Invalid host:port representation: %s", hostport)
 		return nil, err
 	}
 
-	Cluster = new(ClusterConfig)
-	Cluster.Port = port
-	Cluster.Servers = make([]string, 0)
-	switch master.Algo {
+	ring, err = dedupRing(ring, true)
+	if err != nil {
+		log.Printf("Abort: %s", err)
+		return nil, err
+	}
+	ring = overrideRing(ring)
+
+	instancePorts, err := ParseInstancePorts(InstancePortMap)
+	if err != nil {
+		log.Printf("Abort: %s", err)
+		return nil, err
+	}
+
+	cluster := new(ClusterConfig)
+	cluster.Port = port
+	cluster.InstancePorts = instancePorts
+	cluster.Replicas = ring.Replicas
+	cluster.Ring = ring
+	cluster.Servers = make([]string, 0)
+	cluster.Hash, err = NewHashRing(ring)
+	if err != nil {
+		log.Print(err)
+		recordError(err)
+		return nil, err
+	}
+	for _, v := range ring.Nodes {
+		cluster.Servers = append(cluster.Servers, v.Server)
+	}
+	return cluster, nil
+}
+
+// overrideRing returns a copy of ring with the algorithm and the number of
+// copies of each metric set by -hashtype and -cluster-replicas, if any.
+// Otherwise ring, as advertised by buckyd, is returned.
+func overrideRing(ring *hashing.JSONRingType) *hashing.JSONRingType {
+	if RingHashType == "" && RingCopies == 0 {
+		return ring
+	}
+	r := *ring
+	if RingHashType != "" {
+		r.Algo = RingHashType
+	}
+	if RingCopies > 0 {
+		r.Replicas = RingCopies
+	}
+	return &r
+}
+
+// checkRingConfigs returns an error if a member of the cluster advertises
+// a different hash ring algorithm or number of copies than master.  Those
+// are misconfigured daemons, not an unhealthy cluster.  Parameters
+// overridden by -hashtype or -cluster-replicas are not checked.  Members
+// that could not be reached are skipped.
+func checkRingConfigs(master *hashing.JSONRingType, members []*hashing.JSONRingType) error {
+	want := master.Config()
+	for _, m := range members {
+		if m == nil {
+			continue
+		}
+		got := m.Config()
+		if RingHashType == "" && got.Algo != want.Algo {
+			return fmt.Errorf("Conflicting hash ring algorithms: %s advertises %s and %s advertises %s",
+				want.Name, want.Algo, got.Name, got.Algo)
+		}
+		if RingCopies == 0 && got.Replicas != want.Replicas {
+			return fmt.Errorf("Conflicting replica counts: %s advertises %d and %s advertises %d",
+				want.Name, want.Replicas, got.Name, got.Replicas)
+		}
+	}
+	return nil
+}
+
+// discoverRing returns the hash ring of the cluster as reported by the
+// buckyd daemon at hostport, or as read from -relay-config if set.
+func discoverRing(hostport string) (*hashing.JSONRingType, error) {
+	master, err := GetSingleHashRing(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot communicate with initial buckyd daemon: %s", err)
+	}
+	if RelayConfig == "" {
+		return master, nil
+	}
+
+	relay, err := GetRelayRing(RelayConfig, RelayCluster)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range RingDiff(master, relay) {
+		log.Printf("Warning: Relay ring differs from buckyd: %s", d)
+	}
+	relay.Name = master.Name
+	return relay, nil
+}
+
+// GetRelayRing reads the carbon-c-relay configuration file at path and
+// returns the ring of the named cluster.  If name is empty the first
+// consistent hashing cluster is used.
+func GetRelayRing(path, name string) (*hashing.JSONRingType, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	clusters, err := hashing.ParseRelayConfig(fd)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", path, err)
+	}
+	for _, c := range clusters {
+		if name == "" {
+			if ring, err := c.JSONRing(); err == nil {
+				return ring, nil
+			}
+		} else if c.Name == name {
+			return c.JSONRing()
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("No consistent hashing cluster found in %s", path)
+	}
+	return nil, fmt.Errorf("Cluster %s not found in %s", name, path)
+}
+
+// NewHashRing builds the HashRing described by the given ring
+// configuration.
+func NewHashRing(ring *hashing.JSONRingType) (hashing.HashRing, error) {
+	var hash hashing.HashRing
+	var err error
+	if len(ring.Nodes) == 0 {
+		return nil, ErrEmptyRing
+	}
+	switch {
+	case PlacementStrategy == "rendezvous":
+		hash = hashing.NewRendezvousHash(ring.Replicas)
+		for _, v := range ring.Nodes {
+			hash.AddNode(v)
+		}
+	case PlacementStrategy != "" && PlacementStrategy != "ring":
+		return nil, fmt.Errorf("Unknown placement strategy: %s", PlacementStrategy)
+	default:
+		hash, err = NewAlgoRing(ring)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if KeyTransform != "" && KeyTransform != "none" {
+		transform, ok := hashing.KeyTransforms[KeyTransform]
+		if !ok {
+			return nil, fmt.Errorf("Unknown key transformation: %s", KeyTransform)
+		}
+		hash = hashing.NewKeyTransformRing(hash, transform)
+	}
+	return hash, nil
+}
+
+// RingReplicas is the number of positions each node is placed at on the
+// carbon and fnv1a rings as set by -ring-replicas.  0 when the option is
+// not given keeps carbon's default of 100.
+var RingReplicas int
+
+// ringReplicasSet is true if -ring-replicas was given.
+var ringReplicasSet bool
+
+// ringReplicasValue is a flag.Value that sets RingReplicas and records
+// that it was given, so that an explicit 0 is refused.
+type ringReplicasValue struct{}
+
+func (ringReplicasValue) String() string {
+	return strconv.Itoa(RingReplicas)
+}
+
+func (ringReplicasValue) Set(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return err
+	}
+	RingReplicas = n
+	ringReplicasSet = true
+	return nil
+}
+
+// SetupRingReplicas installs the -ring-replicas flag in the given Command.
+func SetupRingReplicas(c Command) {
+	c.Flag.Var(ringReplicasValue{}, "ring-replicas",
+		"Positions of each node on the carbon or fnv1a ring.  Must match carbon.  Defaults to carbon's 100.")
+}
+
+// checkRingReplicas returns false and logs why if -ring-replicas is not
+// usable.
+func checkRingReplicas() bool {
+	if ringReplicasSet && RingReplicas < 1 {
+		log.Printf("The -ring-replicas option must be at least 1.")
+		return false
+	}
+	return true
+}
+
+// NewAlgoRing builds the consistent hash ring of the given configuration's
+// algorithm exactly as carbon would.  The -placement and -key-transform
+// options are not applied.  Nodes are placed -ring-replicas times on the
+// carbon and fnv1a rings when it is set and -diverse-replicas is applied.
+func NewAlgoRing(ring *hashing.JSONRingType) (hashing.HashRing, error) {
+	var hash hashing.HashRing
+	switch ring.Algo {
 	case "carbon":
-		Cluster.Hash = hashing.NewCarbonHashRing()
+		hash = hashing.NewCarbonHashRing()
 	case "fnv1a":
-		Cluster.Hash = hashing.NewFNV1aHashRing()
+		hash = hashing.NewFNV1aHashRing()
 	case "jump_fnv1a":
-		Cluster.Hash = hashing.NewJumpHashRing(master.Replicas)
+		hash = hashing.NewJumpHashRing(ring.Replicas)
 	default:
-		log.Printf("Unknown consistent hash algorithm: %s", master.Algo)
-		return nil, fmt.Errorf("Unknown consistent hash algorithm: %s", master.Algo)
+		return nil, fmt.Errorf("Unknown consistent hash algorithm: %s", ring.Algo)
 	}
 
-	for _, v := range master.Nodes {
-		Cluster.Hash.AddNode(v)
-		Cluster.Servers = append(Cluster.Servers, v.Server)
+	if RingReplicas != 0 {
+		r, ok := hash.(interface{ SetReplicas(int) })
+		if !ok || RingReplicas < 0 {
+			return nil, fmt.Errorf("Can not place nodes %d times on the %s ring",
+				RingReplicas, ring.Algo)
+		}
+		r.SetReplicas(RingReplicas)
 	}
+	if DiverseReplicas {
+		r, ok := hash.(interface{ SetDiverseReplicas(bool) })
+		if !ok {
+			return nil, fmt.Errorf("The %s ring does not support -diverse-replicas", ring.Algo)
+		}
+		r.SetDiverseReplicas(true)
+	}
+	for _, v := range ring.Nodes {
+		hash.AddNode(v)
+	}
+	return hash, nil
+}
 
-	members := make([]*hashing.JSONRingType, 0)
-	for _, srv := range Cluster.Servers {
-		if srv == master.Name {
-			// Don't query the initial daemon again
+// RingOwners returns the distinct servers that should hold a copy of the
+// given metric according to the hash ring and the replication factor.
+// The primary owner is first.
+func RingOwners(ring hashing.HashRing, replicas int, metric string) []string {
+	if replicas < 1 {
+		replicas = 1
+	}
+	owners := make([]string, 0)
+	for _, n := range ring.GetNodes(metric) {
+		if containsString(owners, n.Server) {
 			continue
 		}
-		host := fmt.Sprintf("%s:%s", srv, Cluster.Port)
-		member, err := GetSingleHashRing(host)
-		if err != nil {
-			log.Printf("Cluster unhealthy: %s: %s", host, err)
+		owners = append(owners, n.Server)
+		if len(owners) == replicas {
+			break
 		}
-		members = append(members, member)
 	}
-
-	Cluster.Healthy = isHealthy(master, members)
-	return Cluster, nil
+	return owners
 }
 
 // isHealthy will return true if the cluster ring data represents
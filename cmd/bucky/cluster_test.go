@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func TestGetRelayRing(t *testing.T) {
+	fd, err := ioutil.TempFile("", "relay.conf")
+	if err != nil {
+		t.Fatalf("Error creating config: %s", err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString(`
+cluster backup forward 10.0.0.9:2003;
+cluster graphite fnv1a_ch replication 2
+    graphite010:2003 graphite011:2003 graphite012:2003;
+`)
+	fd.Close()
+
+	ring, err := GetRelayRing(fd.Name(), "")
+	if err != nil {
+		t.Fatalf("Error reading relay ring: %s", err)
+	}
+	if ring.Algo != "fnv1a" || ring.Replicas != 2 || len(ring.Nodes) != 3 {
+		t.Errorf("Bad ring: %v", ring)
+	}
+	if _, err := NewHashRing(ring); err != nil {
+		t.Errorf("Error building hash ring: %s", err)
+	}
+
+	if _, err := GetRelayRing(fd.Name(), "backup"); err == nil {
+		t.Errorf("Expected an error selecting a forward cluster")
+	}
+	if _, err := GetRelayRing(fd.Name(), "missing"); err == nil {
+		t.Errorf("Expected an error selecting a missing cluster")
+	}
+}
+
+func TestNewHashRingPlacement(t *testing.T) {
+	defer func() { PlacementStrategy = "" }()
+	ring := ringFor(2, "a", "b", "c")
+
+	PlacementStrategy = "rendezvous"
+	hash, err := NewHashRing(ring)
+	if err != nil {
+		t.Fatalf("Error building rendezvous placement: %s", err)
+	}
+	if _, ok := hash.(*hashing.RendezvousHash); !ok || hash.Len() != 3 || hash.Replicas() != 2 {
+		t.Errorf("Expected a rendezvous hash of 3 nodes, got %v", hash)
+	}
+
+	PlacementStrategy = "random"
+	if _, err := NewHashRing(ring); err == nil {
+		t.Errorf("Unknown placement strategy was accepted")
+	}
+}
+
+func TestRingReplicas(t *testing.T) {
+	defer func() { RingReplicas, ringReplicasSet = 0, false }()
+	ring := ringFor(1, "a", "b", "c", "d")
+	metrics := verifyTestMetrics(100)
+
+	for _, algo := range []string{"carbon", "fnv1a"} {
+		ring.Algo = algo
+		RingReplicas = 0
+		def, _ := NewAlgoRing(ring)
+		RingReplicas = 7
+		modeled, err := NewAlgoRing(ring)
+		if err != nil {
+			t.Fatalf("Error building %s ring: %s", algo, err)
+		}
+		if n := len(modeled.(hashing.PositionRing).Entries()); n != 7*len(ring.Nodes) {
+			t.Errorf("%s: expected %d ring entries, got %d", algo, 7*len(ring.Nodes), n)
+		}
+		moved := 0
+		for _, m := range metrics {
+			if !hashing.NodeCmp(def.GetNode(m), modeled.GetNode(m)) {
+				moved++
+			}
+		}
+		if moved == 0 {
+			t.Errorf("%s: changing the ring replicas moved no metrics", algo)
+		}
+	}
+
+	ring.Algo = "jump_fnv1a"
+	if _, err := NewAlgoRing(ring); err == nil {
+		t.Errorf("Expected -ring-replicas to fail on a jump hash ring")
+	}
+	RingReplicas = 0
+	if !checkRingReplicas() {
+		t.Errorf("Leaving out -ring-replicas was refused")
+	}
+	for _, s := range []string{"0", "-1"} {
+		ringReplicasValue{}.Set(s)
+		if checkRingReplicas() {
+			t.Errorf("-ring-replicas %s was accepted", s)
+		}
+	}
+}
+
+func TestDiverseReplicasFlag(t *testing.T) {
+	defer func() { DiverseReplicas = false }()
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: 2}
+	for _, s := range []string{"a", "b", "c"} {
+		for _, i := range []string{"1", "2"} {
+			ring.Nodes = append(ring.Nodes, hashing.NewNode(s, 0, i))
+		}
+	}
+
+	DiverseReplicas = true
+	hash, err := NewAlgoRing(ring)
+	if err != nil {
+		t.Fatalf("Error building ring: %s", err)
+	}
+	for _, m := range verifyTestMetrics(100) {
+		nodes := hash.GetNodesN(m, 2)
+		if nodes[0].Server == nodes[1].Server {
+			t.Errorf("%s: replicas share server %s", m, nodes[0].Server)
+		}
+	}
+
+	ring.Algo = "jump_fnv1a"
+	if _, err := NewAlgoRing(ring); err == nil {
+		t.Errorf("Expected -diverse-replicas to fail on a jump hash ring")
+	}
+}
+
+func TestParseInstancePorts(t *testing.T) {
+	ports, err := ParseInstancePorts("a=2004,b=2104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ports) != 2 || ports["a"] != "2004" || ports["b"] != "2104" {
+		t.Errorf("Bad instance ports: %v", ports)
+	}
+	if ports, err := ParseInstancePorts(""); err != nil || len(ports) != 0 {
+		t.Errorf("Empty string should give no ports: %v %v", ports, err)
+	}
+	for _, bad := range []string{"a", "a=", "=2004", "a=port", "a=70000", "a=2004,,b=2104"} {
+		if _, err := ParseInstancePorts(bad); err == nil {
+			t.Errorf("Expected an error for %q", bad)
+		}
+	}
+}
+
+func TestNodeHostPort(t *testing.T) {
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: 1}
+	ring.Nodes = []hashing.Node{
+		hashing.NewNode("graphite010", 0, ""),
+		hashing.NewNode("graphite011", 0, "a"),
+		hashing.NewNode("graphite011", 0, "b"),
+		hashing.NewNode("graphite012", 0, "c"),
+	}
+	c := &ClusterConfig{Port: "4242", Ring: ring}
+	c.InstancePorts, _ = ParseInstancePorts("a=2004,b=2104")
+
+	expected := []string{"graphite010", "graphite011:2004", "graphite011:2104", "graphite012"}
+	for i, n := range ring.Nodes {
+		if s := c.NodeHostPort(n); s != expected[i] {
+			t.Errorf("Expected %s for %v, got %s", expected[i], n, s)
+		}
+	}
+
+	hostports := c.HostPorts()
+	expected = []string{"graphite010:4242", "graphite011:2004", "graphite011:2104", "graphite012:4242"}
+	if len(hostports) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, hostports)
+	}
+	for i := range expected {
+		if hostports[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, hostports)
+		}
+	}
+
+	c = &ClusterConfig{Port: "4242", Servers: []string{"2001:db8::1"}}
+	if hostports := c.HostPorts(); len(hostports) != 1 || hostports[0] != "[2001:db8::1]:4242" {
+		t.Errorf("Expected [[2001:db8::1]:4242], got %v", hostports)
+	}
+}
+
+func TestInstancePortRequest(t *testing.T) {
+	defer func(c *ClusterConfig) { Cluster = c }(Cluster)
+
+	contacted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contacted = true
+		w.Header().Set("X-Metric-Stat", `{"Name": "foo.bar"}`)
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(strings.TrimPrefix(server.URL, "http://"))
+
+	// Instance a is served by our test server, nothing listens on port 1
+	Cluster = &ClusterConfig{Port: "1", InstancePorts: map[string]string{"a": port}}
+	node := hashing.NewNode(host, 0, "a")
+	if _, err := StatRemoteMetric(Cluster.NodeHostPort(node), "foo.bar"); err != nil {
+		t.Errorf("Error contacting instance a: %s", err)
+	}
+	if !contacted {
+		t.Errorf("Instance a was not contacted on port %s", port)
+	}
+}
+
+func TestRingConfigConflict(t *testing.T) {
+	// localhost advertises two copies of each metric, 127.0.0.1 one
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		ring := ringFor(1, "127.0.0.1", "localhost")
+		ring.Name = host
+		if host == "localhost" {
+			ring.Replicas = 2
+		}
+		blob, _ := json.Marshal(ring)
+		w.Write(blob)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	defer func() {
+		Cluster = nil
+		RingCopies = 0
+		RingHashType = ""
+	}()
+
+	Cluster = nil
+	if _, err := GetClusterConfig("127.0.0.1:" + port); err == nil {
+		t.Errorf("Conflicting replica counts did not fail")
+	}
+	if Cluster != nil {
+		t.Errorf("Cluster configured despite the conflict")
+	}
+
+	// Overridden parameters are adopted from the flags
+	RingCopies = 3
+	RingHashType = "fnv1a"
+	cluster, err := GetClusterConfig("127.0.0.1:" + port)
+	if err != nil {
+		t.Fatalf("Error with -cluster-replicas: %s", err)
+	}
+	if cluster.Replicas != 3 || cluster.Ring.Algo != "fnv1a" {
+		t.Errorf("Overrides not applied: %d copies, %s", cluster.Replicas, cluster.Ring.Algo)
+	}
+	if !cluster.Healthy {
+		t.Errorf("Overridden algorithm made the cluster unhealthy")
+	}
+}
+
+func TestCheckRingConfigs(t *testing.T) {
+	defer func() { RingHashType = "" }()
+	master := ringFor(1, "a", "b")
+	master.Name = "a"
+	member := ringFor(1, "a", "b")
+	member.Name = "b"
+	member.Algo = "fnv1a"
+
+	if err := checkRingConfigs(master, []*hashing.JSONRingType{nil, ringFor(1, "a", "b")}); err != nil {
+		t.Errorf("Matching rings failed: %s", err)
+	}
+	err := checkRingConfigs(master, []*hashing.JSONRingType{member})
+	if err == nil || !strings.Contains(err.Error(), "fnv1a") {
+		t.Errorf("Expected an algorithm conflict, got %v", err)
+	}
+	RingHashType = "carbon"
+	if err := checkRingConfigs(master, []*hashing.JSONRingType{member}); err != nil {
+		t.Errorf("Overridden algorithm was checked: %s", err)
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -11,6 +16,8 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 import "github.com/golang/snappy"
@@ -26,25 +33,68 @@ var HostPort string
 // files.  Or other possible encodings of transferred files.
 var NoEncoding bool
 
+// ChecksumAlgo is the algorithm used to verify Whisper data transferred
+// to and from buckyd daemons.  One of metrics.ChecksumAlgorithms.
+var ChecksumAlgo string
+
+// CompressAtRest asks buckyd daemons to store the Whisper DBs uploaded by
+// PostMetric gzip compressed.
+var CompressAtRest bool
+
 // Verbose is a flag to indicate verbose logging
 var Verbose bool
 
+// UserAgent is the User-Agent header sent with requests to buckyd daemons.
+// When not set with -user-agent it identifies bucky and the subcommand.
+var UserAgent string
+
+// ErrNotModified is returned by GetMetricDataSince when the metric has not
+// changed.
+var ErrNotModified = errors.New("Metric not modified")
+
+// ErrMetricNotFound is returned by DeleteMetric when the server does not
+// have the metric.
+var ErrMetricNotFound = errors.New("Metric not found.")
+
 // httpClient is a cached http.Client. Use GetHTTP() to setup and return.
 var httpClient *http.Client
+var httpClientOnce sync.Once
 
 // GetHTTP returns a *http.Client that can be used to interact with remote
-// buckyd daemons.
+// buckyd daemons.  It is safe for concurrent use.
 func GetHTTP() *http.Client {
-	if httpClient != nil {
-		return httpClient
-	}
+	httpClientOnce.Do(func() {
+		if httpClient != nil {
+			return
+		}
+		httpClient = new(http.Client)
 
-	httpClient = new(http.Client)
+		// Set a 30 second timeout on all operations
+		//httpClient.Timeout = 30 * time.Second
+	})
+	return httpClient
+}
 
-	// Set a 30 second timeout on all operations
-	//httpClient.Timeout = 30 * time.Second
+// IdempotencyKey returns the content hash of the metric's data.  Buckyd
+// uses it to apply a retried upload only once.
+func IdempotencyKey(metric *MetricData) string {
+	sum := sha256.Sum256(metric.Data)
+	return hex.EncodeToString(sum[:])
+}
 
-	return httpClient
+// NewRequest wraps http.NewRequest and sets the User-Agent header and the
+// credentials of the host, if any.  All requests to buckyd daemons should
+// be built here.
+func NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("User-Agent", UserAgent)
+	if c, ok := CredentialsFor(r.URL.Host); ok {
+		c.apply(r)
+	}
+	return r, nil
 }
 
 // MetricDecode accepts a MetricData struct and returns a slice of bytes
@@ -121,7 +171,7 @@ func DeleteMetric(server, metric string) error {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: buckyScheme(),
 		Path:   "/metrics/" + metric,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -130,7 +180,7 @@ func DeleteMetric(server, metric string) error {
 		return err
 	}
 
-	r, err := http.NewRequest("DELETE", u.String(), nil)
+	r, err := NewRequest("DELETE", u.String(), nil)
 	if err != nil {
 		log.Printf("Error building request: %s", err)
 		return err
@@ -148,7 +198,7 @@ func DeleteMetric(server, metric string) error {
 		log.Printf("DELETED: %s", metric)
 	case 404:
 		log.Printf("Not found / Not deleted: %s", metric)
-		return fmt.Errorf("Metric not found.")
+		return ErrMetricNotFound
 	case 500:
 		msg, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
@@ -168,10 +218,25 @@ func DeleteMetric(server, metric string) error {
 // name that lives on the given server.  The port buckyd runs on is
 // assumed to be the same as other servers in the hash ring.
 func GetMetricData(server, name string) (*MetricData, error) {
+	return GetMetricDataContext(context.Background(), server, name)
+}
+
+// GetMetricDataContext is GetMetricData but the transfer is abandoned
+// when ctx is cancelled.
+func GetMetricDataContext(ctx context.Context, server, name string) (*MetricData, error) {
+	return GetMetricDataSince(ctx, server, name, 0)
+}
+
+// GetMetricDataSince is GetMetricDataContext with an If-Modified-Since
+// header of the Unix time since, unless since is 0.  If the metric has
+// not been modified since then the returned MetricData has no Data and
+// the error is ErrNotModified.  If ctx carries a ByteBudget the metric's
+// Size is reserved before the body is read.
+func GetMetricDataSince(ctx context.Context, server, name string, since int64) (*MetricData, error) {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: buckyScheme(),
 		Path:   "/metrics/" + name,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -179,14 +244,21 @@ func GetMetricData(server, name string) (*MetricData, error) {
 		log.Printf("Malformed hostname: %s", err)
 		return nil, err
 	}
-	r, err := http.NewRequest("GET", u.String(), nil)
+	r, err := NewRequest("GET", u.String(), nil)
 	if err != nil {
 		log.Printf("Error building request: %s", err)
 		return nil, err
 	}
+	r = r.WithContext(ctx)
 	if !NoEncoding {
 		r.Header.Set("accept-encoding", "snappy")
 	}
+	if since > 0 {
+		r.Header.Set("If-Modified-Since", time.Unix(since, 0).UTC().Format(http.TimeFormat))
+	}
+	if ChecksumAlgo != "" {
+		r.Header.Set(ChecksumHeader, ChecksumAlgo)
+	}
 
 	resp, err := httpClient.Do(r)
 	if err != nil {
@@ -194,11 +266,11 @@ func GetMetricData(server, name string) (*MetricData, error) {
 		return nil, err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode != 200 {
+	if resp.StatusCode != 200 && resp.StatusCode != http.StatusNotModified {
 		body, _ := ioutil.ReadAll(resp.Body)
 		log.Printf("Error: Fetching [%s]:%s returned status code: %d  Body: %s",
 			server, name, resp.StatusCode, string(body))
-		return nil, fmt.Errorf("Fetching metric returned status code: %s", resp.Status)
+		return nil, &StatusError{resp.StatusCode, resp.Status}
 	}
 
 	data := new(MetricData)
@@ -207,7 +279,17 @@ func GetMetricData(server, name string) (*MetricData, error) {
 		log.Printf("Error unmarshalling X-Metric-Stat header for [%s]:%s: %s", server, name, err)
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusNotModified {
+		return data, ErrNotModified
+	}
 
+	// Hold the body until its declared size fits in the in-flight budget
+	budget := budgetFrom(ctx)
+	if budget != nil {
+		if err := budget.Acquire(ctx, data.Size); err != nil {
+			return nil, err
+		}
+	}
 	data.Data, err = ioutil.ReadAll(resp.Body)
 	encoding := resp.Header.Get("Content-Encoding")
 	switch encoding {
@@ -218,8 +300,17 @@ func GetMetricData(server, name string) (*MetricData, error) {
 	}
 	if err != nil {
 		log.Printf("Error reading response body: %s", err)
+		budget.Release(data.Size)
 		return nil, err
 	}
+	// Older buckyd daemons do not send a checksum
+	if checksum := resp.Header.Get(ChecksumHeader); checksum != "" {
+		if err := VerifyChecksum(checksum, data.Data); err != nil {
+			log.Printf("Error verifying [%s]:%s: %s", server, name, err)
+			budget.Release(data.Size)
+			return nil, err
+		}
+	}
 
 	return data, nil
 }
@@ -228,7 +319,7 @@ func StatRemoteMetric(server, metric string) (*MetricData, error) {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: buckyScheme(),
 		Path:   "/metrics/" + metric,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -236,7 +327,7 @@ func StatRemoteMetric(server, metric string) (*MetricData, error) {
 		log.Printf("Malformed hostname: %s", err)
 		return nil, err
 	}
-	r, err := http.NewRequest("HEAD", u.String(), nil)
+	r, err := NewRequest("HEAD", u.String(), nil)
 	if err != nil {
 		log.Printf("Error building request: %s", err)
 		return nil, err
@@ -285,10 +376,21 @@ func StatRemoteMetric(server, metric string) (*MetricData, error) {
 // PostMetric sends a POST request with new metric data to the given server.
 // A post request does a backfill if this metric is already present on disk.
 func PostMetric(server string, metric *MetricData) error {
+	return sendMetric("POST", server, metric)
+}
+
+// PutMetric sends a PUT request with new metric data to the given server.
+// A put request replaces the metric if it is already present on disk.
+func PutMetric(server string, metric *MetricData) error {
+	return sendMetric("PUT", server, metric)
+}
+
+// sendMetric uploads metric to server with the given HTTP method.
+func sendMetric(method, server string, metric *MetricData) error {
 	var err error
 	httpClient := GetHTTP()
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: buckyScheme(),
 		Path:   "/metrics/" + metric.Name,
 	}
 	u.Host, err = SanitizeHostPort(server)
@@ -298,7 +400,7 @@ func PostMetric(server string, metric *MetricData) error {
 	}
 
 	buf := bytes.NewBuffer(metric.Data)
-	r, err := http.NewRequest("POST", u.String(), buf)
+	r, err := NewRequest(method, u.String(), buf)
 	if err != nil {
 		log.Printf("Error building request: %s", err)
 		return err
@@ -308,13 +410,24 @@ func PostMetric(server string, metric *MetricData) error {
 		return err
 	}
 	r.Header.Set("X-Metric-Stat", string(statInfo))
+	r.Header.Set("X-Bucky-Idempotency-Key", IdempotencyKey(metric))
+	if CompressAtRest {
+		r.Header.Set("X-Bucky-Compress-At-Rest", "true")
+	}
+	if ChecksumAlgo != "" {
+		checksum, err := Checksum(ChecksumAlgo, metric.Data)
+		if err != nil {
+			return err
+		}
+		r.Header.Set(ChecksumHeader, checksum)
+	}
 	r.Header.Set("Content-Type", "application/octet-stream")
 	switch metric.Encoding {
 	case EncSnappy:
 		r.Header.Set("Content-Encoding", "snappy")
 	}
 
-	// This doesn't return until the backfill operation completes
+	// This doesn't return until the backfill or replace completes
 	resp, err := httpClient.Do(r)
 	if err != nil {
 		log.Printf("Error communicating with server: %s", err)
@@ -338,13 +451,13 @@ func PostMetric(server string, metric *MetricData) error {
 // string must include any port information.
 func GetSingleHashRing(server string) (*hashing.JSONRingType, error) {
 	u := &url.URL{
-		Scheme: "http",
+		Scheme: buckyScheme(),
 		Host:   server,
 		Path:   "/hashring",
 	}
 	httpClient := GetHTTP()
 
-	r, err := http.NewRequest("GET", u.String(), nil)
+	r, err := NewRequest("GET", u.String(), nil)
 	if err != nil {
 		log.Printf("Error building request: %s", err)
 		return nil, err
@@ -384,6 +497,23 @@ func SetupCommon(c Command) {
 		"Verbose log output.")
 	c.Flag.BoolVar(&NoEncoding, "no-encoding", false,
 		"Disable Content-Encoding methods for HTTP API calls.")
+	c.Flag.StringVar(&UserAgent, "user-agent", "",
+		"User-Agent header for requests to buckyd.  Defaults to buckytools/VERSION SUBCOMMAND.")
+	c.Flag.StringVar(&ChecksumAlgo, "checksum", "md5",
+		"Checksum to verify transferred Whisper data with: md5 or sha256.")
+	c.Flag.BoolVar(&UseTLS, "tls", false,
+		"Reach buckyd daemons over HTTPS.")
+	c.Flag.StringVar(&TLSClientCert, "client-cert", "",
+		"PEM client certificate presented to buckyd daemons.  Implies -tls.")
+	c.Flag.StringVar(&TLSClientKey, "client-key", "",
+		"PEM private key of -client-cert.")
+	c.Flag.StringVar(&TLSCACert, "ca-cert", "",
+		"PEM CA certificates trusted for buckyd daemons.  Implies -tls.")
+	c.Flag.StringVar(&CredentialsFile, "credentials", os.Getenv("BUCKYCREDENTIALS"),
+		".netrc style file of buckyd credentials by host.  Defaults to ~/.netrc.")
+	c.Flag.StringVar(&AuthUser, "auth-user", "",
+		"Basic auth user, with BUCKY_PASSWORD, for hosts not in -credentials.")
+	SetupErrorJSON(c)
 }
 
 // SetupHostname sets up a generic find the host to connect to flag
@@ -399,6 +529,26 @@ func SetupHostname(c Command) {
 		"HOST:PORT to find a remote buckyd daemon. Port is optional.")
 	c.Flag.StringVar(&HostPort, "host", host,
 		"HOST:PORT to find a remote buckyd daemon. Port is optional.")
+	c.Flag.StringVar(&RelayConfig, "relay-config", "",
+		"Build the hash ring from this carbon-c-relay configuration file.")
+	c.Flag.StringVar(&RelayCluster, "relay-cluster", "",
+		"Cluster to use from -relay-config.  Defaults to the first hashing cluster.")
+	c.Flag.StringVar(&KeyTransform, "key-transform", "none",
+		"Normalize tagged metric keys before hashing: none, tagged, or name.")
+	c.Flag.StringVar(&PlacementStrategy, "placement", "ring",
+		"Metric placement: ring or rendezvous.  rendezvous is not carbon compatible.")
+	c.Flag.BoolVar(&DiverseReplicas, "diverse-replicas", false,
+		"Place replicas on distinct servers like carbon's DIVERSE_REPLICAS.")
+	c.Flag.StringVar(&InstancePortMap, "instance-port", "",
+		"Comma separated INSTANCE=PORT buckyd ports for carbon instances.")
+	c.Flag.BoolVar(&DedupServers, "dedup-servers", false,
+		"Collapse ring nodes naming the same host and instance.  Not carbon compatible.")
+	c.Flag.StringVar(&ServerAliasMap, "server-alias", "",
+		"Comma separated ALIAS=SERVER names of the same host for -dedup-servers.")
+	c.Flag.StringVar(&RingHashType, "hashtype", "",
+		"Override the hash ring algorithm advertised by buckyd: carbon, fnv1a, or jump_fnv1a.")
+	c.Flag.IntVar(&RingCopies, "cluster-replicas", 0,
+		"Override the copies of each metric advertised by buckyd.  0 adopts buckyd's.")
 }
 
 // SingleHost is a convenience variable for sub-commands.  A sub-command
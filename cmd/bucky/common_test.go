@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// resetHTTPClient makes the next GetHTTP build a new client.
+func resetHTTPClient() {
+	httpClient = nil
+	httpClientOnce = sync.Once{}
+}
+
+func TestUserAgent(t *testing.T) {
+	UserAgent = "buckytools/test tar"
+	defer func() { UserAgent = "" }()
+
+	agents := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	GetMetricData(host, "foo.bar")
+	StatRemoteMetric(host, "foo.bar")
+	ListAllMetrics([]string{host}, false)
+
+	if len(agents) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(agents))
+	}
+	for _, ua := range agents {
+		if ua != UserAgent {
+			t.Errorf("Bad User-Agent: %s", ua)
+		}
+	}
+}
+
+func TestMetricChecksum(t *testing.T) {
+	defer func(algo string) { ChecksumAlgo = algo }(ChecksumAlgo)
+	ChecksumAlgo = "sha256"
+	NoEncoding = true
+	defer func() { NoEncoding = false }()
+
+	data := []byte("whisper data")
+	checksum := ""
+	uploaded := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			body, _ := ioutil.ReadAll(r.Body)
+			if VerifyChecksum(r.Header.Get(ChecksumHeader), body) != nil {
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			uploaded = r.Header.Get(ChecksumHeader)
+			return
+		}
+		if r.Header.Get(ChecksumHeader) != "sha256" {
+			t.Errorf("Checksum algorithm not requested: %s", r.Header.Get(ChecksumHeader))
+		}
+		w.Header().Set("X-Metric-Stat", `{"Name": "foo.bar", "Size": 12}`)
+		if checksum != "" {
+			w.Header().Set(ChecksumHeader, checksum)
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	// Older buckyd daemons send no checksum
+	if _, err := GetMetricData(host, "foo.bar"); err != nil {
+		t.Errorf("Error without a checksum: %s", err)
+	}
+	checksum, _ = Checksum("sha256", data)
+	if _, err := GetMetricData(host, "foo.bar"); err != nil {
+		t.Errorf("Error with a good checksum: %s", err)
+	}
+	checksum, _ = Checksum("md5", []byte("other data"))
+	if _, err := GetMetricData(host, "foo.bar"); err != ErrChecksumMismatch {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+
+	metric := &MetricData{Name: "foo.bar", Size: 12, Data: data}
+	if err := PostMetric(host, metric); err != nil {
+		t.Errorf("Error uploading: %s", err)
+	}
+	if !strings.HasPrefix(uploaded, "sha256:") {
+		t.Errorf("Upload checksum not SHA-256: %s", uploaded)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/tar"
+	"math"
+	"strconv"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// compressSample is the number of bytes at the start of an entry examined
+// to decide if the entry is worth compressing.
+const compressSample = 4096
+
+// compressEntropy is the Shannon entropy in bits per byte above which a
+// sample is considered already compressed or otherwise incompressible.
+const compressEntropy = 7.5
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	if len(b) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	e := 0.0
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(b))
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// compressible returns true if a sample from the start of data suggests
+// that compressing it would save space.
+func compressible(data []byte) bool {
+	sample := data
+	if len(sample) > compressSample {
+		sample = sample[:compressSample]
+	}
+	return entropy(sample) < compressEntropy
+}
+
+// compressEntry snappy compresses data for storage in the tar archive under
+// the header th unless it looks incompressible and force is false.  The
+// header is updated to describe the stored data.  The encoding and original
+// size are recorded in the BUCKYTOOLS.encoding and BUCKYTOOLS.entry_size
+// PAX records so restore can decode the entry.  BUCKYTOOLS.size is the
+// archive total in the -totals record.
+func compressEntry(th *tar.Header, data []byte, force bool) ([]byte, error) {
+	if !force && !compressible(data) {
+		return data, nil
+	}
+
+	metric := &MetricData{Size: int64(len(data)), Data: data}
+	if err := MetricEncode(metric, EncSnappy); err != nil {
+		return nil, err
+	}
+	th.Size = int64(len(metric.Data))
+	th.PAXRecords = map[string]string{
+		"BUCKYTOOLS.encoding":   "snappy",
+		"BUCKYTOOLS.entry_size": strconv.Itoa(len(data)),
+	}
+	return metric.Data, nil
+}
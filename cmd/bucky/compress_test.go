@@ -0,0 +1,55 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestCompressEntry(t *testing.T) {
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+	th := &tar.Header{Name: "random.wsp", Size: int64(len(random))}
+	data, err := compressEntry(th, random, false)
+	if err != nil {
+		t.Fatalf("Error compressing entry: %s", err)
+	}
+	if !bytes.Equal(data, random) || th.PAXRecords != nil {
+		t.Errorf("Random data was compressed")
+	}
+	if th.Size != int64(len(random)) {
+		t.Errorf("Header size changed for uncompressed entry: %d", th.Size)
+	}
+
+	// A freshly created Whisper DB is mostly zeros
+	zeros := make([]byte, 64*1024)
+	th = &tar.Header{Name: "zeros.wsp", Size: int64(len(zeros))}
+	data, err = compressEntry(th, zeros, false)
+	if err != nil {
+		t.Fatalf("Error compressing entry: %s", err)
+	}
+	if th.PAXRecords["BUCKYTOOLS.encoding"] != "snappy" {
+		t.Fatalf("Zeroed data was not compressed")
+	}
+	if th.PAXRecords["BUCKYTOOLS.entry_size"] != "65536" {
+		t.Errorf("Bad original size: %s", th.PAXRecords["BUCKYTOOLS.entry_size"])
+	}
+	if th.Size != int64(len(data)) || len(data) >= len(zeros) {
+		t.Errorf("Bad compressed size: header %d data %d", th.Size, len(data))
+	}
+	metric := &MetricData{Size: int64(len(zeros)), Encoding: EncSnappy, Data: data}
+	decoded, err := MetricDecode(metric)
+	if err != nil || !bytes.Equal(decoded, zeros) {
+		t.Errorf("Compressed entry does not decode: %s", err)
+	}
+
+	// Forced compression ignores the content
+	th = &tar.Header{Name: "random.wsp", Size: int64(len(random))}
+	compressEntry(th, random, true)
+	if th.PAXRecords["BUCKYTOOLS.encoding"] != "snappy" {
+		t.Errorf("Forced compression skipped random data")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// MetricCount is the result of the count subcommand.  Total is the
+// number of distinct metrics matched.  Servers maps each buckyd HOST:PORT
+// to the number of matching metrics it holds.
+type MetricCount struct {
+	Total   int
+	Servers map[string]int
+}
+
+func init() {
+	usage := "[options] <metric expression>"
+	short := "Count matching metrics."
+	long := `Print the number of matching metrics in the cluster and on each server.
+Without any arguments / options this will count every metric in the cluster.
+
+The default mode is to work with lists.  The arguments are a series of
+one or more metric key names.  If the first argument is a "-" then read a
+JSON array from STDIN as our list of metrics.
+
+Use -r to enable regular expression mode.  The first argument is a
+regular expression.
+
+Only the metric inventory of each server is consulted.  No metrics are
+downloaded.  The total counts each distinct metric once regardless of how
+many servers hold a copy.`
+
+	c := NewCommand(countCommand, "count", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+	SetupRetry(c)
+
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemons to rebuild their cache.")
+}
+
+// CountMetrics summarizes a map of server => metrics.
+func CountMetrics(metricMap map[string][]string) *MetricCount {
+	count := &MetricCount{Servers: make(map[string]int)}
+	seen := make(map[string]bool)
+	for server, metrics := range metricMap {
+		count.Servers[server] = len(metrics)
+		for _, m := range metrics {
+			seen[m] = true
+		}
+	}
+	count.Total = len(seen)
+	return count
+}
+
+// countCommand runs this subcommand.
+func countCommand(c Command) int {
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+
+	list, err := ListSelection(c, Cluster.HostPorts())
+	count := CountMetrics(list)
+
+	if JSONOutput {
+		blob, err := json.Marshal(count)
+		if err != nil {
+			log.Printf("%s", err)
+		} else {
+			os.Stdout.Write(blob)
+			os.Stdout.Write([]byte("\n"))
+		}
+	} else {
+		servers := make([]string, 0)
+		for s := range count.Servers {
+			servers = append(servers, s)
+		}
+		sort.Strings(servers)
+		for _, s := range servers {
+			fmt.Printf("%s: %d\n", s, count.Servers[s])
+		}
+		fmt.Printf("Total: %d\n", count.Total)
+	}
+
+	if err != nil {
+		return ExitError
+	}
+	return ExitOK
+}
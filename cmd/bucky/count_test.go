@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCountMetrics(t *testing.T) {
+	inventory := map[string][]string{
+		"graphite010:4242": []string{"foo.bar", "foo.baz"},
+		"graphite011:4242": []string{"foo.bar", "foo.qux", "bar.foo"},
+		"graphite012:4242": []string{},
+	}
+	count := CountMetrics(inventory)
+
+	if count.Total != 4 {
+		t.Errorf("Expected 4 distinct metrics, got %d", count.Total)
+	}
+	expected := map[string]int{
+		"graphite010:4242": 2,
+		"graphite011:4242": 3,
+		"graphite012:4242": 0,
+	}
+	if len(count.Servers) != len(expected) {
+		t.Errorf("Expected %v, got %v", expected, count.Servers)
+	}
+	for s, n := range expected {
+		if count.Servers[s] != n {
+			t.Errorf("Expected %d metrics on %s, got %d", n, s, count.Servers[s])
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CredentialsFile is the .netrc style file given by -credentials, or the
+// BUCKYCREDENTIALS environment variable, that holds the credentials sent to
+// buckyd daemons.  When empty ~/.netrc is read if it exists, without its
+// default entry.
+var CredentialsFile string
+
+// AuthUser is the -auth-user sent with the BUCKY_PASSWORD environment
+// variable to hosts without an entry in the credentials file.
+var AuthUser string
+
+// credentials maps a machine of the credentials file, HOST or HOST:PORT,
+// to its credentials.  The default entry is keyed by "".
+var credentials map[string]Credentials
+
+// Credentials authenticate requests to a buckyd daemon, usually behind an
+// authenticating proxy.  A Token is sent as a bearer token, otherwise the
+// Login and Password are sent with basic authentication.
+type Credentials struct {
+	Login    string
+	Password string
+	Token    string
+}
+
+// String describes c without its secrets so that it is safe to log.
+func (c Credentials) String() string {
+	switch {
+	case c.Token != "":
+		return "token"
+	case c.Login != "":
+		return "login " + c.Login
+	}
+	return "none"
+}
+
+// GoString is String so that %#v does not reveal the secrets either.
+func (c Credentials) GoString() string {
+	return c.String()
+}
+
+// empty returns true if c holds nothing to authenticate with.
+func (c Credentials) empty() bool {
+	return c.Token == "" && c.Login == "" && c.Password == ""
+}
+
+// apply adds the credentials to r.
+func (c Credentials) apply(r *http.Request) {
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	} else {
+		r.SetBasicAuth(c.Login, c.Password)
+	}
+}
+
+// ParseNetrc parses a .netrc style file into a map of machine =>
+// credentials.  The default entry is keyed by "".  Besides the login and
+// password of .netrc an entry may have a token.  Account and macdef
+// entries are ignored.
+func ParseNetrc(r io.Reader) (map[string]Credentials, error) {
+	ret := make(map[string]Credentials)
+	tokens := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	inMacro := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if inMacro {
+			// A macro ends at a blank line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i, f := range fields {
+			if f == "macdef" {
+				fields = fields[:i]
+				inMacro = true
+				break
+			}
+		}
+		tokens = append(tokens, fields...)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	machine := ""
+	entry := false
+	for i := 0; i < len(tokens); i++ {
+		switch tokens[i] {
+		case "default":
+			machine, entry = "", true
+			continue
+		}
+		if i+1 >= len(tokens) {
+			return nil, fmt.Errorf("Missing value for %s", tokens[i])
+		}
+		key, value := tokens[i], tokens[i+1]
+		i++
+		if key == "machine" {
+			machine, entry = value, true
+			continue
+		}
+		if !entry {
+			return nil, fmt.Errorf("%s outside of a machine entry", key)
+		}
+		c := ret[machine]
+		switch key {
+		case "login":
+			c.Login = value
+		case "password":
+			c.Password = value
+		case "token":
+			c.Token = value
+		case "account":
+		default:
+			return nil, fmt.Errorf("Unknown keyword %s", key)
+		}
+		ret[machine] = c
+	}
+	return ret, nil
+}
+
+// credentialsPath returns the credentials file to read or "" for none.
+func credentialsPath() string {
+	if CredentialsFile != "" {
+		return CredentialsFile
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(home, ".netrc")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
+
+// LoadCredentials reads the credentials file, if any, for use by
+// NewRequest.
+func LoadCredentials() error {
+	credentials = nil
+	path := credentialsPath()
+	if path == "" {
+		return nil
+	}
+	fd, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening credentials file: %s", err)
+	}
+	defer fd.Close()
+	if s, err := fd.Stat(); err == nil && s.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: Credentials file %s is accessible by other users.", path)
+	}
+	credentials, err = ParseNetrc(fd)
+	if err != nil {
+		return fmt.Errorf("Error parsing credentials file %s: %s", path, err)
+	}
+	if CredentialsFile == "" {
+		// The default entry of ~/.netrc is meant for other services
+		delete(credentials, "")
+	}
+	return nil
+}
+
+// CredentialsFor returns the credentials for the buckyd daemon at
+// hostport.  The credentials file entry of HOST:PORT is preferred, then
+// that of HOST, then the default entry of a -credentials file.  Without an entry the -auth-user
+// and the BUCKY_PASSWORD or BUCKY_TOKEN environment variables are used.
+func CredentialsFor(hostport string) (Credentials, bool) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	for _, machine := range []string{hostport, host, ""} {
+		if c, ok := credentials[machine]; ok {
+			return c, true
+		}
+	}
+
+	c := Credentials{
+		Login:    AuthUser,
+		Password: os.Getenv("BUCKY_PASSWORD"),
+		Token:    os.Getenv("BUCKY_TOKEN"),
+	}
+	return c, !c.empty()
+}
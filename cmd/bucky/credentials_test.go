@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testNetrc = `# buckyd credentials
+machine graphite010 login alice password s3cret
+machine graphite011:4242
+	token t0ken
+machine graphite011 login bob password other
+macdef init
+cd /tmp
+
+default login carol password fallback
+`
+
+func TestParseNetrc(t *testing.T) {
+	creds, err := ParseNetrc(strings.NewReader(testNetrc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Credentials{
+		"graphite010":      {Login: "alice", Password: "s3cret"},
+		"graphite011:4242": {Token: "t0ken"},
+		"graphite011":      {Login: "bob", Password: "other"},
+		"":                 {Login: "carol", Password: "fallback"},
+	}
+	if len(creds) != len(expected) {
+		t.Fatalf("Expected %d entries, got %d", len(expected), len(creds))
+	}
+	for machine, c := range expected {
+		if creds[machine] != c {
+			t.Errorf("%q: expected %s, got %s", machine, c, creds[machine])
+		}
+	}
+
+	for _, bad := range []string{"login alice", "machine a login", "machine a user b"} {
+		if _, err := ParseNetrc(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestCredentialsFor(t *testing.T) {
+	defer func() {
+		credentials = nil
+		CredentialsFile = ""
+		AuthUser = ""
+	}()
+	dir, err := ioutil.TempDir("", "bucky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	CredentialsFile = filepath.Join(dir, "credentials")
+	ioutil.WriteFile(CredentialsFile, []byte(testNetrc), 0600)
+	if err := LoadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, _ := NewRequest("GET", "http://graphite011:4242/hashring", nil)
+	if h := r.Header.Get("Authorization"); h != "Bearer t0ken" {
+		t.Errorf("Expected the HOST:PORT token, got %q", h)
+	}
+	r, _ = NewRequest("GET", "http://graphite011:4343/hashring", nil)
+	if user, pass, _ := r.BasicAuth(); user != "bob" || pass != "other" {
+		t.Errorf("Expected the HOST login, got %s", user)
+	}
+	r, _ = NewRequest("GET", "http://graphite099:4242/hashring", nil)
+	if user, _, _ := r.BasicAuth(); user != "carol" {
+		t.Errorf("Expected the default login, got %s", user)
+	}
+
+	// The default entry of ~/.netrc is not sent to buckyd
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	os.Setenv("HOME", dir)
+	ioutil.WriteFile(filepath.Join(dir, ".netrc"), []byte(testNetrc), 0600)
+	CredentialsFile = ""
+	if err := LoadCredentials(); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = NewRequest("GET", "http://graphite099:4242/hashring", nil)
+	if h := r.Header.Get("Authorization"); h != "" {
+		t.Errorf("Expected no credentials from the ~/.netrc default, got %q", h)
+	}
+	r, _ = NewRequest("GET", "http://graphite010:4242/hashring", nil)
+	if user, _, _ := r.BasicAuth(); user != "alice" {
+		t.Errorf("Expected the ~/.netrc machine login, got %s", user)
+	}
+
+	// Without a matching entry the flag and environment are used
+	credentials = nil
+	r, _ = NewRequest("GET", "http://graphite099:4242/hashring", nil)
+	if h := r.Header.Get("Authorization"); h != "" {
+		t.Errorf("Expected no credentials, got %q", h)
+	}
+	AuthUser = "dave"
+	os.Setenv("BUCKY_PASSWORD", "env")
+	defer os.Unsetenv("BUCKY_PASSWORD")
+	r, _ = NewRequest("GET", "http://graphite099:4242/hashring", nil)
+	if user, pass, _ := r.BasicAuth(); user != "dave" || pass != "env" {
+		t.Errorf("Expected -auth-user and BUCKY_PASSWORD, got %s", user)
+	}
+
+	// Secrets are never formatted
+	c := Credentials{Login: "alice", Password: "s3cret", Token: "t0ken"}
+	for _, s := range []string{fmt.Sprint(c), fmt.Sprintf("%v %+v %#v", c, c, c)} {
+		if strings.Contains(s, "s3cret") || strings.Contains(s, "t0ken") {
+			t.Errorf("Credentials formatted with a secret: %s", s)
+		}
+	}
+}
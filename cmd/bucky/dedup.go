@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// DedupServers collapses nodes of the hash ring that name the same carbon
+// instance on the same host under different names when set by
+// -dedup-servers.  carbon places each name separately, so this is off by
+// default.
+var DedupServers bool
+
+// ServerAliasMap is a comma separated list of ALIAS=SERVER pairs as given
+// to -server-alias.
+var ServerAliasMap string
+
+// lookupHost resolves a host name to its addresses.
+var lookupHost = net.LookupHost
+
+// NodeCollapse records a node removed by DedupNodes as a duplicate of the
+// node kept in its place.
+type NodeCollapse struct {
+	Duplicate hashing.Node
+	Kept      hashing.Node
+}
+
+// ParseServerAliases parses a comma separated list of ALIAS=SERVER pairs
+// into a map of alias => server.  Names are normalized with
+// normalizeServer.
+func ParseServerAliases(s string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if s == "" {
+		return ret, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		fields := strings.SplitN(pair, "=", 2)
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("Invalid server alias %q, expected ALIAS=SERVER", pair)
+		}
+		ret[normalizeServer(fields[0])] = normalizeServer(fields[1])
+	}
+	return ret, nil
+}
+
+// normalizeServer returns server in lower case without the brackets of an
+// IPv6 literal or the trailing dot of a fully qualified name.  IP
+// addresses are returned in their canonical form.
+func normalizeServer(server string) string {
+	s := strings.ToLower(strings.TrimSpace(server))
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	s = strings.TrimSuffix(s, ".")
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return s
+}
+
+// serverIdentity returns the identities of server.  Two servers are the
+// same host if they share any identity.  These are the normalized name
+// after applying aliases and the addresses it resolves to.  A name that
+// does not resolve is identified by the name alone.
+func serverIdentity(server string, aliases map[string]string) []string {
+	name := normalizeServer(server)
+	if alias, ok := aliases[name]; ok {
+		name = alias
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		return []string{name}
+	}
+
+	ids := []string{name}
+	addrs, err := lookupHost(name)
+	if err != nil {
+		return ids
+	}
+	for _, a := range addrs {
+		ids = append(ids, normalizeServer(a))
+	}
+	return ids
+}
+
+// DedupNodes returns nodes without the nodes that are the same carbon
+// instance as an earlier node.  That is the same port and instance on a
+// server that shares a name, alias, or address with the earlier node's
+// server.  Distinct instances on the same host are kept.  The order of the
+// kept nodes is unchanged and the removed nodes are also returned.
+func DedupNodes(nodes []hashing.Node, aliases map[string]string) ([]hashing.Node, []NodeCollapse) {
+	kept := make([]hashing.Node, 0, len(nodes))
+	keptIDs := make([][]string, 0, len(nodes))
+	collapsed := make([]NodeCollapse, 0)
+
+	identities := make(map[string][]string)
+	for _, n := range nodes {
+		ids, ok := identities[n.Server]
+		if !ok {
+			ids = serverIdentity(n.Server, aliases)
+			identities[n.Server] = ids
+		}
+
+		dup := -1
+		for i, k := range kept {
+			if k.Port == n.Port && k.Instance == n.Instance && shareString(keptIDs[i], ids) {
+				dup = i
+				break
+			}
+		}
+		if dup >= 0 {
+			collapsed = append(collapsed, NodeCollapse{n, kept[dup]})
+			continue
+		}
+		kept = append(kept, n)
+		keptIDs = append(keptIDs, ids)
+	}
+	return kept, collapsed
+}
+
+// shareString returns true if a and b have a string in common.
+func shareString(a, b []string) bool {
+	for _, s := range a {
+		if containsString(b, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupRing returns ring with the duplicate nodes removed by DedupNodes
+// if -dedup-servers is set, otherwise ring itself.  Collapsed nodes are
+// logged if verbose.
+func dedupRing(ring *hashing.JSONRingType, verbose bool) (*hashing.JSONRingType, error) {
+	if !DedupServers || ring == nil {
+		return ring, nil
+	}
+	aliases, err := ParseServerAliases(ServerAliasMap)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, collapsed := DedupNodes(ring.Nodes, aliases)
+	if verbose {
+		for _, c := range collapsed {
+			log.Printf("Collapsed duplicate node %s into %s", c.Duplicate, c.Kept)
+		}
+	}
+	if len(collapsed) == 0 {
+		return ring, nil
+	}
+	ret := *ring
+	ret.Nodes = nodes
+	return &ret, nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func TestDedupNodes(t *testing.T) {
+	defer func(f func(string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(host string) ([]string, error) {
+		switch host {
+		case "graphite01", "graphite01.example.com":
+			return []string{"10.0.0.1"}, nil
+		case "graphite02":
+			return []string{"10.0.0.2", "2001:DB8::2"}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+
+	aliases, err := ParseServerAliases("old-graphite=graphite01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodes := []hashing.Node{
+		hashing.NewNode("graphite01", 0, "a"),
+		hashing.NewNode("graphite01", 0, "b"),
+		hashing.NewNode("graphite01.example.com", 0, "a"),
+		hashing.NewNode("GRAPHITE01.example.com.", 0, "b"),
+		hashing.NewNode("10.0.0.1", 2003, "a"),
+		hashing.NewNode("Old-Graphite", 0, "a"),
+		hashing.NewNode("graphite02", 0, "a"),
+		hashing.NewNode("[2001:db8:0::2]", 0, "a"),
+		hashing.NewNode("unknown", 0, "a"),
+		hashing.NewNode("unknown.example.com", 0, "a"),
+	}
+	expected := []hashing.Node{
+		hashing.NewNode("graphite01", 0, "a"),
+		hashing.NewNode("graphite01", 0, "b"),
+		hashing.NewNode("10.0.0.1", 2003, "a"),
+		hashing.NewNode("graphite02", 0, "a"),
+		hashing.NewNode("unknown", 0, "a"),
+		hashing.NewNode("unknown.example.com", 0, "a"),
+	}
+
+	kept, collapsed := DedupNodes(nodes, aliases)
+	if len(kept) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, kept)
+	}
+	for i := range expected {
+		if !hashing.NodeCmp(kept[i], expected[i]) {
+			t.Errorf("Expected node %d to be %s, got %s", i, expected[i], kept[i])
+		}
+	}
+	if len(collapsed) != len(nodes)-len(expected) {
+		t.Errorf("Expected %d collapsed nodes, got %v", len(nodes)-len(expected), collapsed)
+	}
+	for _, c := range collapsed {
+		if c.Duplicate.Instance != c.Kept.Instance {
+			t.Errorf("Collapsed %s into another instance %s", c.Duplicate, c.Kept)
+		}
+	}
+}
+
+func TestDedupRing(t *testing.T) {
+	defer func() {
+		DedupServers = false
+		ServerAliasMap = ""
+	}()
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: 1}
+	ring.Nodes = []hashing.Node{
+		hashing.NewNode("127.0.0.1", 0, "a"),
+		hashing.NewNode("localhost", 0, "a"),
+	}
+
+	if r, _ := dedupRing(ring, true); len(r.Nodes) != 2 {
+		t.Errorf("Nodes collapsed without -dedup-servers: %v", r.Nodes)
+	}
+	DedupServers = true
+	ServerAliasMap = "localhost=127.0.0.1"
+	r, err := dedupRing(ring, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Nodes) != 1 || len(ring.Nodes) != 2 {
+		t.Errorf("Expected 1 node and the original ring unchanged, got %v and %v", r.Nodes, ring.Nodes)
+	}
+
+	ServerAliasMap = "localhost"
+	if _, err := dedupRing(ring, true); err == nil {
+		t.Errorf("Expected an error for a malformed -server-alias")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,11 +9,16 @@ import (
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var deleteRegexMode bool
 var deleteForce bool
 
+// deleteAbsent counts the metrics found already deleted when a delete was
+// retried, such as after the response to a successful delete was lost.
+var deleteAbsent int32
+
 type DeleteWork struct {
 	server string
 	name   string
@@ -31,13 +37,20 @@ Use -r to enable regular expression mode.  The first argument is a regular
 expression.  If metrics names match they will be included in the output.
 
 Use -s to only delete metrics found on the server specified by -h or the
-BUCKYSERVER environment variable.`
+BUCKYSERVER environment variable.
+
+Failed deletes are retried -retries times with an exponential backoff
+starting at -retry-backoff.  A retried delete that finds the metric gone
+is counted as a success since the earlier attempt removed it before its
+response was lost.  These are reported as already absent when the delete
+completes.  A metric not found on the first attempt is still an error.`
 
 	c := NewCommand(deleteCommand, "delete", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupRetry(c)
 
 	c.Flag.BoolVar(&deleteRegexMode, "r", false,
 		"Filter by a regular expression.")
@@ -49,11 +62,42 @@ BUCKYSERVER environment variable.`
 		"Downloader threads.")
 }
 
+// deleteMetricRetry deletes metric from server, retrying failures.  A
+// retry that finds the metric not found returns absent and no error as an
+// earlier attempt deleted it.  Not found on the first attempt is an error.
+func deleteMetricRetry(server, metric string) (absent bool, err error) {
+	attempts := 0
+	neverFound := false
+	err = withRetry(context.Background(), "delete of "+metric, func() error {
+		attempts++
+		err := DeleteMetric(server, metric)
+		if err == ErrMetricNotFound {
+			// Stop retrying, the outcome is known
+			absent = attempts > 1
+			neverFound = attempts == 1
+			return nil
+		}
+		return err
+	})
+	if neverFound {
+		return false, ErrMetricNotFound
+	}
+	if absent {
+		log.Printf("Already absent on retry, counted as deleted: %s", metric)
+	}
+	return absent, err
+}
+
 func deleteWorker(workIn chan *DeleteWork, wg *sync.WaitGroup) {
 	for work := range workIn {
-		err := DeleteMetric(work.server, work.name)
+		absent, err := deleteMetricRetry(work.server, work.name)
 		if err != nil {
-			workerErrors = true
+			workFailed()
+		} else {
+			workSucceeded()
+		}
+		if absent {
+			atomic.AddInt32(&deleteAbsent, 1)
 		}
 	}
 	wg.Done()
@@ -88,8 +132,9 @@ func deleteMetrics(metricMap map[string][]string) error {
 	close(workIn)
 	wg.Wait()
 
-	log.Printf("Delete operation complete.")
-	if workerErrors {
+	log.Printf("Delete operation complete: %d deleted, %d already absent, %d failed.",
+		workerSucceeded-deleteAbsent, deleteAbsent, workerFailed)
+	if workerErrors() {
 		log.Printf("Errors occured in delete operation.")
 		return fmt.Errorf("Errors occured in delete operations.")
 	}
@@ -141,12 +186,18 @@ func deleteCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
-	} else if deleteRegexMode && c.Flag.NArg() > 0 {
+		log.Print("At least one argument is required.")
+		return ExitUsage
+	}
+	if !checkWritable(Cluster.HostPorts()) {
+		return ExitUsage
+	}
+
+	if deleteRegexMode && c.Flag.NArg() > 0 {
 		err = DeleteRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), deleteForce)
 	} else if c.Flag.Arg(0) != "-" {
 		err = DeleteSliceMetrics(Cluster.HostPorts(), c.Flag.Args(), deleteForce)
@@ -154,8 +205,5 @@ func deleteCommand(c Command) int {
 		err = DeleteJSONMetrics(Cluster.HostPorts(), os.Stdin, deleteForce)
 	}
 
-	if err != nil {
-		return 1
-	}
-	return 0
+	return exitStatus(err)
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteRetryAlreadyAbsent(t *testing.T) {
+	Retries = 2
+	RetryBackoff = time.Millisecond
+	defer func() { Retries = 0 }()
+
+	calls := 0
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if deleted {
+			http.NotFound(w, r)
+			return
+		}
+		// Delete the metric but lose the response
+		deleted = true
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Fatalf("Error hijacking connection: %s", err)
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	absent, err := deleteMetricRetry(host, "foo.bar")
+	if err != nil || !absent || calls != 2 {
+		t.Errorf("Expected an already absent success after 2 calls: %d calls, absent %v, err %v",
+			calls, absent, err)
+	}
+
+	// Not found on the first attempt is not retried and is an error
+	calls = 0
+	absent, err = deleteMetricRetry(host, "foo.bar")
+	if err != ErrMetricNotFound || absent || calls != 1 {
+		t.Errorf("Expected not found after 1 call: %d calls, absent %v, err %v",
+			calls, absent, err)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// tarDirectMax is the largest list of metric names tar locates through the
+// hash ring rather than by asking every server.  0 always asks every
+// server.
+var tarDirectMax int
+
+// ownerHostPort returns the HOST:PORT of the buckyd daemon of the primary
+// owner of metric in the hash ring.
+func ownerHostPort(metric string) string {
+	server := Cluster.NodeHostPort(Cluster.Hash.GetNode(metric))
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, Cluster.Port)
+	}
+	return server
+}
+
+// LocateOwnedMetrics stats each of the metrics on the buckyd daemon of its
+// primary owner in the hash ring.  The metrics found are returned in a map
+// of server => metrics.  The metrics that were not found, or whose owner
+// could not be reached, are returned as missed.
+func LocateOwnedMetrics(metrics []string) (map[string][]string, []string) {
+	owners := make(map[string][]string)
+	for _, m := range metrics {
+		owner := ownerHostPort(m)
+		owners[owner] = append(owners[owner], m)
+	}
+
+	found := make(map[string][]string)
+	missed := make([]string, 0)
+	for owner, list := range owners {
+		stats, err := StatRemoteMetrics(owner, list)
+		if err != nil {
+			log.Printf("Error reaching %s: %s", owner, err)
+		}
+		held := make(map[string]bool)
+		for _, stat := range stats {
+			held[stat.Name] = true
+		}
+		for _, m := range list {
+			if held[m] {
+				found[owner] = append(found[owner], m)
+			} else {
+				missed = append(missed, m)
+			}
+		}
+	}
+	return found, missed
+}
+
+// DirectSliceMetrics returns where the listed metrics are found like
+// ListSliceMetrics.  Lists of no more than -direct-max metrics are found
+// on their owners in the hash ring without asking every server.  Only the
+// metrics missing from their owners, such as misplaced metrics, are then
+// looked for on every server.  -f always asks every server.
+func DirectSliceMetrics(servers []string, metrics []string, force bool) (map[string][]string, error) {
+	if force || len(metrics) > tarDirectMax || Cluster == nil || Cluster.Hash == nil {
+		return ListSliceMetrics(servers, metrics, force)
+	}
+
+	found, missed := LocateOwnedMetrics(metrics)
+	if len(missed) == 0 {
+		log.Printf("Found all %d metrics on their owners.", len(metrics))
+		return found, nil
+	}
+	log.Printf("%d metrics not found on their owners, asking every server.", len(missed))
+	rest, err := ListSliceMetrics(servers, missed, force)
+	for server, list := range rest {
+		found[server] = append(found[server], list...)
+	}
+	return found, err
+}
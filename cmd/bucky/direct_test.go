@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestDirectSliceMetrics(t *testing.T) {
+	lock := new(sync.Mutex)
+	held := make(map[string][]string)
+	inventories := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		list := make([]string, 0)
+		json.Unmarshal([]byte(r.FormValue("list")), &list)
+		lock.Lock()
+		defer lock.Unlock()
+		switch r.URL.Path {
+		case "/metrics":
+			inventories++
+			found := make([]string, 0)
+			for _, m := range list {
+				if containsString(held[host], m) {
+					found = append(found, m)
+				}
+			}
+			blob, _ := json.Marshal(found)
+			w.Write(blob)
+		case "/stat":
+			stats := make([]*metrics.MetricData, 0)
+			for _, m := range list {
+				if containsString(held[host], m) {
+					stats = append(stats, &metrics.MetricData{Name: m, Size: 12})
+				}
+			}
+			blob, _ := json.Marshal(stats)
+			w.Write(blob)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1", "localhost"), port)
+	defer func() {
+		Cluster = nil
+		tarDirectMax = 0
+	}()
+	tarDirectMax = 10
+	servers := Cluster.HostPorts()
+
+	// foo.placed lives on its owner, foo.misplaced on the other server
+	placed, misplaced := "foo.placed", "foo.misplaced"
+	other := map[string]string{"127.0.0.1": "localhost", "localhost": "127.0.0.1"}
+	placedOwner := Cluster.Hash.GetNode(placed).Server
+	misplacedOwner := Cluster.Hash.GetNode(misplaced).Server
+	held[placedOwner] = append(held[placedOwner], placed)
+	held[other[misplacedOwner]] = append(held[other[misplacedOwner]], misplaced)
+
+	metricMap, err := DirectSliceMetrics(servers, []string{placed}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventories != 0 {
+		t.Errorf("Expected no inventory for a metric on its owner, got %d requests", inventories)
+	}
+	owner := net.JoinHostPort(placedOwner, port)
+	if len(metricMap) != 1 || len(metricMap[owner]) != 1 {
+		t.Errorf("Expected %s on %s, got %v", placed, owner, metricMap)
+	}
+
+	metricMap, err = DirectSliceMetrics(servers, []string{placed, misplaced}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inventories != len(servers) {
+		t.Errorf("Expected every server asked for the misplaced metric, got %d requests", inventories)
+	}
+	location := net.JoinHostPort(other[misplacedOwner], port)
+	if !containsString(metricMap[location], misplaced) || !containsString(metricMap[owner], placed) {
+		t.Errorf("Expected %s on %s and %s on %s, got %v", placed, owner, misplaced, location, metricMap)
+	}
+
+	// Over -direct-max or with -f every server is asked
+	for _, force := range []bool{false, true} {
+		inventories = 0
+		tarDirectMax = 1
+		if force {
+			tarDirectMax = 10
+		}
+		if _, err := DirectSliceMetrics(servers, []string{placed, misplaced}, force); err != nil {
+			t.Fatal(err)
+		}
+		if inventories != len(servers) {
+			t.Errorf("Expected every server asked with force %v, got %d requests", force, inventories)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"path"
+)
+
+// tarDirs writes a directory entry for each directory above the metrics
+// in the archive.
+var tarDirs bool
+
+// dirArchiveWriter is an ArchiveWriter that writes a directory entry for
+// each directory of a file entry's path before the file.  Each directory
+// is written once and owned like the file.
+type dirArchiveWriter struct {
+	ArchiveWriter
+	seen map[string]bool
+}
+
+// newDirArchiveWriter returns tw wrapped to write directory entries.
+func newDirArchiveWriter(tw ArchiveWriter) *dirArchiveWriter {
+	return &dirArchiveWriter{tw, make(map[string]bool)}
+}
+
+// newMetricArchiveWriter returns the ArchiveWriter of the given format
+// that writes the metrics to w, writing directory entries with -dirs.
+func newMetricArchiveWriter(format string, w io.Writer) (ArchiveWriter, error) {
+	tw, err := NewArchiveWriter(format, w)
+	if err != nil || !tarDirs {
+		return tw, err
+	}
+	return newDirArchiveWriter(tw), nil
+}
+
+// missingDirs returns the directories of name not yet written to the
+// archive with the top most first.
+func (d *dirArchiveWriter) missingDirs(name string) []string {
+	ret := make([]string, 0)
+	for dir := path.Dir(name); dir != "." && dir != "/" && !d.seen[dir]; dir = path.Dir(dir) {
+		ret = append([]string{dir}, ret...)
+	}
+	return ret
+}
+
+// WriteHeader writes the missing directory entries for a regular file
+// before starting the file's entry.
+func (d *dirArchiveWriter) WriteHeader(hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		for _, dir := range d.missingDirs(hdr.Name) {
+			dh := &tar.Header{
+				Typeflag: tar.TypeDir,
+				Name:     dir + "/",
+				Mode:     0755,
+				ModTime:  hdr.ModTime,
+				Uid:      hdr.Uid,
+				Gid:      hdr.Gid,
+				Uname:    hdr.Uname,
+				Gname:    hdr.Gname,
+			}
+			if err := d.ArchiveWriter.WriteHeader(dh); err != nil {
+				return err
+			}
+			d.seen[dir] = true
+		}
+	}
+	return d.ArchiveWriter.WriteHeader(hdr)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func dirsTestWork() chan *metrics.MetricData {
+	workOut := make(chan *metrics.MetricData, 3)
+	for _, name := range []string{"foo.bar.a", "foo.bar.b", "foo.baz.c"} {
+		workOut <- &metrics.MetricData{Name: name, Size: 3, Mode: 0644,
+			Encoding: metrics.EncIdentity, Data: []byte("abc")}
+	}
+	close(workOut)
+	return workOut
+}
+
+func TestWriteTarDirs(t *testing.T) {
+	resetTarState()
+	tarDirs = true
+	defer func() { tarDirs = false }()
+
+	buf := new(bytes.Buffer)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(buf, dirsTestWork(), wg)
+	if archiveErr != nil || archiveFiles != 3 {
+		t.Fatalf("Wrote %d files: %v", archiveFiles, archiveErr)
+	}
+
+	// Each directory is written once and before its first metric
+	expected := []string{"foo/", "foo/bar/", "foo/bar/a.wsp", "foo/bar/b.wsp",
+		"foo/baz/", "foo/baz/c.wsp"}
+	names := make([]string, 0)
+	tr := tar.NewReader(buf)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.Typeflag == tar.TypeDir && th.Mode != 0755 {
+			t.Errorf("Directory %s has mode %o", th.Name, th.Mode)
+		}
+		if th.Typeflag != tar.TypeXGlobalHeader {
+			names = append(names, th.Name)
+		}
+	}
+	if len(names) != len(expected) {
+		t.Fatalf("Expected entries %v, got %v", expected, names)
+	}
+	for i := range names {
+		if names[i] != expected[i] {
+			t.Errorf("Entry %d: expected %s, got %s", i, expected[i], names[i])
+		}
+	}
+}
+
+func TestWriteCpioDirs(t *testing.T) {
+	resetTarState()
+	tarDirs = true
+	tarFormat = "cpio"
+	defer func() { tarDirs, tarFormat = false, "" }()
+
+	buf := new(bytes.Buffer)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(buf, dirsTestWork(), wg)
+	if archiveErr != nil || archiveFiles != 3 {
+		t.Fatalf("Wrote %d files: %v", archiveFiles, archiveErr)
+	}
+
+	entries := readCpio(t, buf.Bytes())
+	if len(entries) != 7 {
+		t.Fatalf("Expected 6 entries and the trailer, got %v", entries)
+	}
+	if entries[0].name != "foo" || entries[0].mode != 040755 {
+		t.Errorf("Bad directory entry: %s %o", entries[0].name, entries[0].mode)
+	}
+	if entries[2].name != "foo/bar/a.wsp" || entries[2].mode != 0100644 {
+		t.Errorf("Bad file entry: %s %o", entries[2].name, entries[2].mode)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var drainNoOp bool
+
+func init() {
+	usage := "[options] <HOST[:PORT]>"
+	short := "Move all metrics off of a server."
+	long := `Move every metric physically stored on the given buckyd daemon to its
+owner in the hash ring and delete it from the drained server.
+
+The server must already be removed from the hash ring of the cluster.
+Each metric is placed according to the current ring which no longer
+includes the drained server.  The port defaults to the port used by the
+cluster.
+
+Use -n to print how many metrics and bytes would be moved to each server
+without altering any metrics.
+
+Set -w to change the number of worker threads used to move the Whisper
+DBs between the servers.`
+
+	c := NewCommand(drainCommand, "drain", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+
+	c.Flag.BoolVar(&drainNoOp, "n", false,
+		"Do not alter metrics and print the volume that would move.")
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Downloader threads.")
+	c.Flag.IntVar(&metricWorkers, "workers", 5,
+		"Downloader threads.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemon to rebuild its cache.")
+}
+
+// inRing returns true if the given hostname is a server in the hash ring.
+func inRing(ring hashing.HashRing, host string) bool {
+	for _, n := range ring.Nodes() {
+		if n.Server == host {
+			return true
+		}
+	}
+	return false
+}
+
+// DrainPlan returns a map of new owner => metrics to move there from a
+// server that is no longer part of the given ring.
+func DrainPlan(ring hashing.HashRing, metrics []string) map[string][]string {
+	plan := make(map[string][]string)
+	for _, m := range metrics {
+		owner := Cluster.NodeHostPort(ring.GetNode(m))
+		plan[owner] = append(plan[owner], m)
+	}
+	return plan
+}
+
+// DrainMetrics moves the metrics on server according to the plan from
+// DrainPlan and removes them from server.
+func DrainMetrics(server string, plan map[string][]string) error {
+	l := countMap(plan)
+	log.Printf("Draining %d metrics from %s.", l, server)
+	workIn := make(chan *MigrateWork, 25)
+	wg := new(sync.WaitGroup)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go rebalanceWorker(workIn, wg, true)
+	}
+
+	c := 0
+	t := time.Now().Unix()
+	for owner, metrics := range plan {
+		for _, m := range metrics {
+			work := new(MigrateWork)
+			work.oldName = m
+			work.newName = m
+			work.oldLocation = server
+			work.newLocation = owner
+			workIn <- work
+			c++
+			if c%10 == 0 {
+				now := time.Now().Unix()
+				s := now - t
+				if s == 0 {
+					s = 1
+				}
+				log.Printf("Progress %d / %d: %.2f%%  Metrics/second: %.2f",
+					c, l,
+					100*float64(c)/float64(l),
+					float64(c)/float64(s))
+			}
+		}
+	}
+
+	close(workIn)
+	wg.Wait()
+
+	log.Printf("Drain complete.")
+	if workerErrors() {
+		log.Printf("Errors are present in drain.")
+		return fmt.Errorf("Errors present.")
+	}
+	return nil
+}
+
+// drainCommand runs this subcommand.
+func drainCommand(c Command) int {
+	if c.Flag.NArg() != 1 {
+		log.Print("Exactly one server to drain is required.")
+		return ExitUsage
+	}
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+
+	server, err := SanitizeHostPort(c.Flag.Arg(0))
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return ExitUsage
+	}
+	if inRing(Cluster.Hash, hostOnly(server)) {
+		log.Printf("%s is still in the hash ring.  Remove it from the ring "+
+			"and restart the cluster before draining it.", hostOnly(server))
+		return ExitUsage
+	}
+	if !Cluster.Healthy {
+		log.Printf("Cluster is unhealthy.")
+		return ExitUsage
+	}
+	if !drainNoOp && !checkWritable(append(Cluster.HostPorts(), server)) {
+		return ExitUsage
+	}
+
+	metricMap, err := ListAllMetrics([]string{server}, listForce)
+	if err != nil {
+		return ExitError
+	}
+	plan := DrainPlan(Cluster.Hash, metricMap[server])
+
+	owners := make([]string, 0)
+	for owner := range plan {
+		owners = append(owners, owner)
+	}
+	sort.Strings(owners)
+	for _, owner := range owners {
+		log.Printf("%d metrics on %s must move to %s", len(plan[owner]), server, owner)
+	}
+
+	if drainNoOp {
+		total := 0
+		for _, owner := range owners {
+			duTotal = 0
+			size, err := duMetrics(map[string][]string{server: plan[owner]})
+			if err != nil {
+				return ExitError
+			}
+			total = total + size
+			fmt.Printf("%s: %d metrics, %d bytes\n", owner, len(plan[owner]), size)
+		}
+		fmt.Printf("Total: %d metrics, %d bytes\n", countMap(plan), total)
+		return ExitOK
+	}
+
+	err = DrainMetrics(server, plan)
+	return exitStatus(err)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDrainPlan(t *testing.T) {
+	ring := scanTestRing()
+	metrics := []string{"foo.bar", "foo.baz", "foo.qux", "bar.foo"}
+	plan := DrainPlan(ring, metrics)
+
+	if countMap(plan) != len(metrics) {
+		t.Errorf("Expected %d metrics in plan, got %v", len(metrics), plan)
+	}
+	for owner, ms := range plan {
+		for _, m := range ms {
+			if ring.GetNode(m).Server != owner {
+				t.Errorf("%s planned for %s, owned by %s", m, owner, ring.GetNode(m).Server)
+			}
+		}
+	}
+}
+
+func TestInRing(t *testing.T) {
+	ring := scanTestRing()
+	if !inRing(ring, "graphite010") {
+		t.Errorf("graphite010 not found in ring")
+	}
+	if inRing(ring, "graphite009") {
+		t.Errorf("graphite009 found in ring")
+	}
+}
+
+func TestDrainMetrics(t *testing.T) {
+	fake := &fakeCluster{metrics: map[string]map[string]bool{
+		"127.0.0.1": make(map[string]bool),
+		"localhost": {"foo.bar": true, "foo.baz": true},
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	defer func() { Cluster = nil }()
+
+	resetTarState()
+	metricWorkers = 2
+	drained := net.JoinHostPort("localhost", port)
+	plan := DrainPlan(Cluster.Hash, []string{"foo.bar", "foo.baz"})
+	if err := DrainMetrics(drained, plan); err != nil {
+		t.Fatalf("Drain failed: %s", err)
+	}
+	if len(fake.metrics["localhost"]) != 0 || len(fake.metrics["127.0.0.1"]) != 2 {
+		t.Errorf("Expected both metrics moved off localhost, got %v", fake.metrics)
+	}
+	if doDelete {
+		t.Errorf("Drain changed the rebalance -delete flag")
+	}
+}
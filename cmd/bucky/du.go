@@ -7,12 +7,16 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"sync"
 )
 
+import . "github.com/jjneely/buckytools/metrics"
+
 // duTotal is the result of the du operation in bytes.
 var duTotal int
 
+// duHistogram collects the -hist buckets during the du operation.
+var duHistogram *Histogram
+
 func init() {
 	usage := "[options] <metric expression>"
 	short := "Find the storage space used."
@@ -26,7 +30,14 @@ Use -r to enable regular expression mode.  The first argument is a regular
 expression.  If metrics names match they will be included in the output.
 
 Use -s to only find metrics found on the server specified by -h or the
-BUCKYSERVER environment variable.`
+BUCKYSERVER environment variable.
+
+Use -hist to find which subtrees of the namespace dominate.  The metrics are
+grouped by the first -depth dot separated components of their names and one
+line is printed for each group with the prefix, the number of metrics, and
+the bytes they consume, tab separated and sorted by bytes with the largest
+first.  Replicas add to the bytes but are counted as one metric.  Use -j for
+a JSON array.`
 
 	c := NewCommand(duCommand, "du", usage, short, long)
 	SetupCommon(c)
@@ -40,67 +51,22 @@ BUCKYSERVER environment variable.`
 		"Force metric re-inventory.")
 	c.Flag.IntVar(&metricWorkers, "w", 5,
 		"Downloader threads.")
-}
-
-func duWorker(workIn chan *DeleteWork, workOut chan int, wg *sync.WaitGroup) {
-	for work := range workIn {
-		stat, err := StatRemoteMetric(work.server, work.name)
-		if err != nil {
-			workerErrors = true
-		} else {
-			workOut <- int(stat.Size)
-		}
-	}
-	wg.Done()
-}
-
-func duResults(workOut chan int, wg *sync.WaitGroup) {
-	for size := range workOut {
-		duTotal = duTotal + size
-	}
-	wg.Done()
+	c.Flag.BoolVar(&duHist, "hist", false,
+		"Print a histogram of metrics and bytes by name prefix.")
+	c.Flag.IntVar(&duDepth, "depth", 1,
+		"Number of name components -hist groups metrics by.")
 }
 
 func duMetrics(metricMap map[string][]string) (int, error) {
-	wg := new(sync.WaitGroup)
-	wg2 := new(sync.WaitGroup)
-	workIn := make(chan *DeleteWork, 25)
-	workOut := make(chan int, 25)
-
-	wg.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go duWorker(workIn, workOut, wg)
-	}
-
-	wg2.Add(1)
-	go duResults(workOut, wg2)
-
-	c := 0
-	l := countMap(metricMap)
-	for server, metrics := range metricMap {
-		if len(metrics) == 0 {
-			continue
+	statBatches(metricMap, func(stat *MetricData) {
+		duTotal = duTotal + int(stat.Size)
+		if duHistogram != nil {
+			duHistogram.Add(stat.Name, stat.Size)
 		}
-		for _, m := range metrics {
-			work := new(DeleteWork)
-			work.server = server
-			work.name = m
-			workIn <- work
-			c++
-			if c%100 == 0 {
-				log.Printf("Progress: %d/%d %.2f%%", c, l, float64(c)/float64(l)*100)
-			}
-		}
-	}
-
-	close(workIn)
-	wg.Wait()
-
-	close(workOut)
-	wg2.Wait()
+	})
 
 	log.Printf("Du operation complete.")
-	if workerErrors {
+	if workerErrors() {
 		log.Printf("Errors occured in du operation.")
 		return duTotal, fmt.Errorf("Errors occured in du operations.")
 	}
@@ -143,15 +109,24 @@ func DuJSONMetrics(servers []string, fd io.Reader, force bool) (int, error) {
 
 // duCommand runs this subcommand.
 func duCommand(c Command) int {
+	if duHist {
+		if duDepth < 1 {
+			log.Printf("The -depth option must be at least 1.")
+			return ExitUsage
+		}
+		duHistogram = NewHistogram(duDepth)
+	}
+
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	var storage int
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+		log.Print("At least one argument is required.")
+		return ExitUsage
 	} else if listRegexMode && c.Flag.NArg() > 0 {
 		storage, err = DuRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
 	} else if c.Flag.Arg(0) != "-" {
@@ -160,12 +135,16 @@ func duCommand(c Command) int {
 		storage, err = DuJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce)
 	}
 
+	if duHistogram != nil {
+		if herr := printHistogram(duHistogram); herr != nil {
+			log.Printf("Error writing histogram: %s", herr)
+			return ExitError
+		}
+	}
+
 	log.Printf("%d Bytes", storage)
 	log.Printf("%.2f MiB", float64(storage)/float64(1024*1024))
 	log.Printf("%.2f GiB", float64(storage)/float64(1024*1024*1024))
 
-	if err != nil {
-		return 1
-	}
-	return 0
+	return exitStatus(err)
 }
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var dumpServersFile string
+var dumpAlgo string
+var dumpNodes bool
+
+func init() {
+	usage := "[options]"
+	short := "Dump every entry of the expanded hash ring."
+	long := `Print every entry of the expanded hash ring sorted by ring position for
+offline analysis.  Each entry is printed as CSV with the columns position,
+server, and instance following a header row.  Use -j for a JSON array.
+Entries that share a position are collisions and are printed in the order
+the ring resolves them.  The number of entries, nodes, and collisions is
+logged.
+
+The ring is built from the nodes discovered through the buckyd daemon given
+by -h, or -relay-config.  Use -servers FILE to build the ring from a file of
+nodes instead, one HOST[:PORT][=INSTANCE] per line, with the algorithm given
+by -algo.  No buckyd daemon is contacted in that case.  Blank lines and lines
+starting with # are ignored.  Use -dedup-servers to collapse nodes that are
+the same instance listed under more than one name.
+
+Only the carbon and fnv1a rings have positions.  The jump_fnv1a ring can not
+be dumped.
+
+Use -ring-replicas to place each node that many times on the carbon or
+fnv1a ring instead of carbon's 100 to model how a different count changes
+placement.  Results only match where carbon routes metrics when it is the
+count carbon uses.
+
+Use -nodes to print each distinct node of the ring, as
+SERVER:PORT=INSTANCE, with its number of ring entries instead.  A node
+listed more than once has a multiple of the entries of the others, and a
+mistyped instance shows up as a node of its own.`
+
+	c := NewCommand(dumpRingCommand, "dump-ring", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+	SetupRingReplicas(c)
+
+	c.Flag.StringVar(&dumpServersFile, "servers", "",
+		"Build the ring from the nodes in this file rather than the cluster.")
+	c.Flag.StringVar(&dumpAlgo, "algo", "carbon",
+		"Hash ring algorithm used with -servers: carbon or fnv1a.")
+	c.Flag.BoolVar(&dumpNodes, "nodes", false,
+		"Print each distinct node with its number of ring entries.")
+}
+
+// RingDumpEntry is a single entry of the expanded hash ring.
+type RingDumpEntry struct {
+	Position int
+	Server   string
+	Instance string
+}
+
+// DumpRing returns every entry of ring in ring position order and the
+// number of entries that share their position with the entry before.
+func DumpRing(ring hashing.HashRing) ([]RingDumpEntry, int, error) {
+	pr, ok := ring.(hashing.PositionRing)
+	if !ok {
+		return nil, 0, fmt.Errorf("Hash ring %T has no ring positions to dump", ring)
+	}
+
+	entries := make([]RingDumpEntry, 0)
+	collisions := 0
+	for i, e := range pr.Entries() {
+		if i > 0 && entries[i-1].Position == e.Position {
+			collisions++
+		}
+		entries = append(entries, RingDumpEntry{e.Position, e.Node.Server, e.Node.Instance})
+	}
+	return entries, collisions, nil
+}
+
+// RingNodeCount is a distinct node of the hash ring and its number of
+// entries.
+type RingNodeCount struct {
+	Node    string
+	Entries int
+}
+
+// CountRingNodes returns each distinct node of ring, named by
+// Node.String(), with its number of ring entries in order of the node's
+// first entry.
+func CountRingNodes(ring hashing.HashRing) ([]RingNodeCount, error) {
+	pr, ok := ring.(hashing.PositionRing)
+	if !ok {
+		return nil, fmt.Errorf("Hash ring %T has no ring entries to count", ring)
+	}
+
+	counts := make([]RingNodeCount, 0)
+	index := make(map[string]int)
+	for _, e := range pr.Entries() {
+		name := e.Node.String()
+		i, ok := index[name]
+		if !ok {
+			i = len(counts)
+			index[name] = i
+			counts = append(counts, RingNodeCount{Node: name})
+		}
+		counts[i].Entries++
+	}
+	return counts, nil
+}
+
+// printRingNodes writes counts to STDOUT as CSV, or JSON with -j.
+func printRingNodes(counts []RingNodeCount) error {
+	if JSONOutput {
+		blob, err := json.Marshal(counts)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+		return nil
+	}
+	w := csv.NewWriter(os.Stdout)
+	w.Write([]string{"node", "entries"})
+	for _, n := range counts {
+		w.Write([]string{n.Node, strconv.Itoa(n.Entries)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// readServersFile parses the HOST[:PORT][=INSTANCE] nodes listed one per
+// line in the file at path.
+func readServersFile(path string) ([]hashing.Node, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]hashing.Node, 0)
+	for _, line := range strings.Split(string(blob), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		n, err := hashing.NewNodeParser(line)
+		if err != nil {
+			return nil, fmt.Errorf("Bad node in %s: %s", path, err)
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("No nodes found in %s", path)
+	}
+	return nodes, nil
+}
+
+// dumpRingCommand runs this subcommand.
+func dumpRingCommand(c Command) int {
+	if !checkRingReplicas() {
+		return ExitUsage
+	}
+	var ring *hashing.JSONRingType
+	if dumpServersFile != "" {
+		nodes, err := readServersFile(dumpServersFile)
+		if err != nil {
+			log.Print(err)
+			return ExitUsage
+		}
+		ring = &hashing.JSONRingType{Algo: dumpAlgo, Replicas: 1, Nodes: nodes}
+		ring, err = dedupRing(ring, true)
+		if err != nil {
+			log.Print(err)
+			return ExitUsage
+		}
+	} else {
+		_, err := GetClusterConfig(HostPort)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+		if !Cluster.Healthy {
+			log.Printf("Warning: Cluster is not optimal.")
+		}
+		ring = Cluster.Ring
+	}
+
+	hash, err := NewAlgoRing(ring)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+	if dumpNodes {
+		counts, err := CountRingNodes(hash)
+		if err != nil {
+			log.Print(err)
+			return ExitUsage
+		}
+		if err := printRingNodes(counts); err != nil {
+			log.Printf("Error writing nodes: %s", err)
+			return ExitError
+		}
+		log.Printf("Counted %d distinct nodes of %d configured.", len(counts), len(ring.Nodes))
+		return ExitOK
+	}
+	entries, collisions, err := DumpRing(hash)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+
+	if JSONOutput {
+		blob, err := json.Marshal(entries)
+		if err != nil {
+			log.Printf("%s", err)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		w := csv.NewWriter(os.Stdout)
+		w.Write([]string{"position", "server", "instance"})
+		for _, e := range entries {
+			w.Write([]string{strconv.Itoa(e.Position), e.Server, e.Instance})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			log.Printf("Error writing ring: %s", err)
+			return ExitError
+		}
+	}
+	log.Printf("Dumped %d ring entries for %d nodes, %d collisions.",
+		len(entries), len(ring.Nodes), collisions)
+	return ExitOK
+}
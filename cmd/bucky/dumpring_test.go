@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func TestDumpRing(t *testing.T) {
+	for _, algo := range []string{"carbon", "fnv1a"} {
+		ring := ringFor(1, "a", "b", "c", "d", "e")
+		ring.Algo = algo
+		hash, err := NewAlgoRing(ring)
+		if err != nil {
+			t.Fatalf("Error building %s ring: %s", algo, err)
+		}
+		entries, collisions, err := DumpRing(hash)
+		if err != nil {
+			t.Fatalf("Error dumping %s ring: %s", algo, err)
+		}
+
+		replicas := hash.(interface{ Replicas() int }).Replicas()
+		if len(entries) != replicas*len(ring.Nodes) {
+			t.Errorf("%s: expected %d entries, got %d", algo,
+				replicas*len(ring.Nodes), len(entries))
+		}
+		positions := make(map[int]bool)
+		for i, e := range entries {
+			positions[e.Position] = true
+			if i > 0 && e.Position < entries[i-1].Position {
+				t.Errorf("%s: entry %d at %d follows %d", algo, i, e.Position,
+					entries[i-1].Position)
+			}
+		}
+		if len(positions) != len(entries)-collisions {
+			t.Errorf("%s: %d distinct positions with %d entries and %d collisions",
+				algo, len(positions), len(entries), collisions)
+		}
+	}
+
+	if _, _, err := DumpRing(hashing.NewJumpHashRing(1)); err == nil {
+		t.Errorf("Dumping a jump hash ring did not fail")
+	}
+}
+
+func TestCountRingNodes(t *testing.T) {
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: 1}
+	ring.Nodes = []hashing.Node{
+		hashing.NewNode("graphite1", 2004, "a"),
+		hashing.NewNode("graphite1", 2004, "b"),
+		hashing.NewNode("graphite2", 2004, "a"),
+		hashing.NewNode("graphite2", 2004, "a"),
+		hashing.NewNode("graphite2", 2004, "bb"),
+	}
+	hash, err := NewAlgoRing(ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts, err := CountRingNodes(hash)
+	if err != nil {
+		t.Fatalf("Error counting nodes: %s", err)
+	}
+
+	replicas := hash.(interface{ Replicas() int }).Replicas()
+	got := make(map[string]int)
+	for _, n := range counts {
+		got[n.Node] = n.Entries
+	}
+	expected := map[string]int{
+		"graphite1:2004=a":  replicas,
+		"graphite1:2004=b":  replicas,
+		"graphite2:2004=a":  2 * replicas,
+		"graphite2:2004=bb": replicas,
+	}
+	if len(got) != len(expected) {
+		t.Errorf("Expected %d nodes, got %v", len(expected), got)
+	}
+	for node, n := range expected {
+		if got[node] != n {
+			t.Errorf("%s: expected %d entries, got %d", node, n, got[node])
+		}
+	}
+
+	if _, err := CountRingNodes(hashing.NewJumpHashRing(1)); err == nil {
+		t.Errorf("Counting the nodes of a jump hash ring did not fail")
+	}
+}
+
+func TestReadServersFile(t *testing.T) {
+	fd, err := ioutil.TempFile("", "dumpring_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString("# graphite cluster\ngraphite1:2004=a\n\n  graphite2\n")
+	fd.Close()
+
+	nodes, err := readServersFile(fd.Name())
+	if err != nil {
+		t.Fatalf("Error reading servers: %s", err)
+	}
+	expected := []hashing.Node{
+		hashing.NewNode("graphite1", 2004, "a"),
+		hashing.NewNode("graphite2", 0, ""),
+	}
+	if len(nodes) != len(expected) {
+		t.Fatalf("Expected %d nodes, got %v", len(expected), nodes)
+	}
+	for i := range nodes {
+		if !hashing.NodeCmp(nodes[i], expected[i]) || nodes[i].Port != expected[i].Port {
+			t.Errorf("Expected %v, got %v", expected[i], nodes[i])
+		}
+	}
+}
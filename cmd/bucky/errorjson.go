@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrorJSON reports a failed subcommand on STDERR as a JSON encoded
+// CommandError after the usual log output with -error-json.
+var ErrorJSON bool
+
+// maxErrorEntries caps the servers and metrics listed in a CommandError.
+// The counts still cover every failure.
+const maxErrorEntries = 100
+
+// CommandError is the structured report of a failed subcommand written
+// with -error-json.  Automation should branch on Code rather than parse
+// Message.
+type CommandError struct {
+	// Code names the failure: the typed error of the subcommand when
+	// there is one, such as ring_changed, or else the category of the
+	// exit code, such as partial.
+	Code     string `json:"code"`
+	ExitCode int    `json:"exit_code"`
+
+	// Message is the error of the subcommand, or the last line it
+	// logged when it did not return one.
+	Message string `json:"message"`
+
+	Servers   []string `json:"servers,omitempty"`
+	Metrics   []string `json:"metrics,omitempty"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+}
+
+// errorCodes name the typed errors that automation may branch on.
+var errorCodes = map[error]string{
+	ErrRingChanged:        "ring_changed",
+	ErrOverBudget:         "over_budget",
+	ErrEmptySelection:     "empty_selection",
+	ErrDuplicateSelection: "duplicate_selection",
+	ErrStrictNames:        "strict_names",
+	ErrCircuitOpen:        "circuit_open",
+	ErrMetricNotFound:     "metric_not_found",
+	ErrPipeNoOutput:       "pipe_no_output",
+	ErrDuplicateMetric:    "duplicate_metric",
+	ErrVerifyFailed:       "verify_failed",
+	ErrEmptyRing:          "empty_ring",
+}
+
+// exitCodeNames are the categories of the exit codes.
+var exitCodeNames = map[int]string{
+	ExitError:   "error",
+	ExitPartial: "partial",
+	ExitFailed:  "failed",
+	ExitTimeout: "timeout",
+	ExitUsage:   "usage",
+}
+
+// failures records the error and the failed servers and metrics of the
+// running subcommand for -error-json.
+var failures = struct {
+	sync.Mutex
+	err     error
+	last    string
+	servers map[string]bool
+	metrics map[string]bool
+}{servers: map[string]bool{}, metrics: map[string]bool{}}
+
+// SetupErrorJSON installs the -error-json flag in the given Command.
+func SetupErrorJSON(c Command) {
+	c.Flag.BoolVar(&ErrorJSON, "error-json", false,
+		"On failure also write a JSON error object to STDERR.")
+}
+
+// recordError records err as the error the subcommand failed with.
+func recordError(err error) {
+	if err == nil {
+		return
+	}
+	failures.Lock()
+	failures.err = err
+	failures.Unlock()
+}
+
+// recordedError returns the error recorded by recordError, if any.
+func recordedError() error {
+	failures.Lock()
+	defer failures.Unlock()
+	return failures.err
+}
+
+// workFailedOn records a metric a worker failed to process on server.
+func workFailedOn(server, metric string) {
+	failures.Lock()
+	if server != "" && len(failures.servers) < maxErrorEntries {
+		failures.servers[server] = true
+	}
+	if len(failures.metrics) < maxErrorEntries {
+		failures.metrics[metric] = true
+	}
+	failures.Unlock()
+	workFailed()
+}
+
+// errorCode returns the code of a subcommand that exited with code after
+// failing with err.
+func errorCode(err error, code int) string {
+	if name, ok := errorCodes[err]; ok {
+		return name
+	}
+	if e, ok := err.(*StatusError); ok && e.Code >= 500 {
+		return "server_error"
+	}
+	if name, ok := exitCodeNames[code]; ok {
+		return name
+	}
+	return "error"
+}
+
+// NewCommandError returns the report of the running subcommand that
+// exited with code.
+func NewCommandError(code int) *CommandError {
+	failures.Lock()
+	defer failures.Unlock()
+
+	e := &CommandError{
+		Code:      errorCode(failures.err, code),
+		ExitCode:  code,
+		Message:   failures.last,
+		Servers:   sortedKeys(failures.servers),
+		Metrics:   sortedKeys(failures.metrics),
+		Succeeded: int(workerSucceeded),
+		Failed:    int(workerFailed),
+	}
+	if failures.err != nil {
+		e.Message = failures.err.Error()
+	}
+	return e
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// WriteCommandError writes e to w as a single line of JSON.
+func WriteCommandError(w io.Writer, e *CommandError) error {
+	blob, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(blob, '\n'))
+	return err
+}
+
+// lastLineWriter passes log output through to w and remembers the last
+// line, without the date and time, as the message of a CommandError.
+type lastLineWriter struct {
+	w io.Writer
+}
+
+func (l lastLineWriter) Write(p []byte) (int, error) {
+	line := string(bytes.TrimSpace(p))
+	if log.Flags()&log.LstdFlags == log.LstdFlags {
+		if f := strings.SplitN(line, " ", 3); len(f) == 3 {
+			line = f[2]
+		}
+	}
+	if line != "" {
+		failures.Lock()
+		failures.last = line
+		failures.Unlock()
+	}
+	return l.w.Write(p)
+}
+
+// captureLog remembers the log output of the subcommand for -error-json.
+func captureLog(w io.Writer) {
+	log.SetOutput(lastLineWriter{w})
+}
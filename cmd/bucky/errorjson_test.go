@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"testing"
+)
+
+// resetFailures forgets the failures recorded for -error-json.
+func resetFailures() {
+	failures.Lock()
+	failures.err = nil
+	failures.last = ""
+	failures.servers = map[string]bool{}
+	failures.metrics = map[string]bool{}
+	failures.Unlock()
+}
+
+func TestCommandErrorPartial(t *testing.T) {
+	server := exitTestServer()
+	defer server.Close()
+	defer resetTarState()
+
+	if code := runTar(t, server, "foo.a", "bad.b"); code != ExitPartial {
+		t.Fatalf("Expected exit code %d, got %d", ExitPartial, code)
+	}
+	e := NewCommandError(ExitPartial)
+	if e.Code != "partial" || e.ExitCode != ExitPartial {
+		t.Errorf("Bad code: %s %d", e.Code, e.ExitCode)
+	}
+	if e.Succeeded != 1 || e.Failed != 1 {
+		t.Errorf("Bad counts: %d succeeded, %d failed", e.Succeeded, e.Failed)
+	}
+	if len(e.Metrics) != 1 || e.Metrics[0] != "bad.b" {
+		t.Errorf("Expected the failed metric bad.b, got %v", e.Metrics)
+	}
+	if len(e.Servers) != 1 {
+		t.Errorf("Expected the failed server, got %v", e.Servers)
+	}
+}
+
+func TestCommandErrorTyped(t *testing.T) {
+	resetFailures()
+	defer resetFailures()
+
+	recordError(ErrRingChanged)
+	e := NewCommandError(ExitUsage)
+	if e.Code != "ring_changed" || e.Message != ErrRingChanged.Error() {
+		t.Errorf("Bad error: %s: %s", e.Code, e.Message)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := WriteCommandError(buf, e); err != nil {
+		t.Fatal(err)
+	}
+	var back CommandError
+	if err := json.Unmarshal(buf.Bytes(), &back); err != nil {
+		t.Fatalf("Error decoding %q: %s", buf.String(), err)
+	}
+	if back.Code != e.Code || back.ExitCode != ExitUsage {
+		t.Errorf("Bad round trip: %+v", back)
+	}
+
+	if code := errorCode(&StatusError{Code: 503, Status: "503 Busy"}, ExitError); code != "server_error" {
+		t.Errorf("Expected server_error, got %s", code)
+	}
+	if code := errorCode(nil, ExitTimeout); code != "timeout" {
+		t.Errorf("Expected timeout, got %s", code)
+	}
+}
+
+func TestCommandErrorLastLine(t *testing.T) {
+	resetFailures()
+	defer resetFailures()
+
+	buf := new(bytes.Buffer)
+	captureLog(buf)
+	defer log.SetOutput(os.Stderr)
+
+	log.Printf("first")
+	log.Printf("Cluster is not optimal.")
+	e := NewCommandError(ExitUsage)
+	if e.Code != "usage" || e.Message != "Cluster is not optimal." {
+		t.Errorf("Bad error: %s: %q", e.Code, e.Message)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("first")) {
+		t.Errorf("Log output not passed through: %s", buf.String())
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"log"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// tarMaxTotalBytes is the largest estimated archive size tar starts
+// downloading for with -max-total-bytes.  0 for no limit.
+var tarMaxTotalBytes int64
+
+// tarForce starts the archive even if its estimated size is over
+// -max-total-bytes.
+var tarForce bool
+
+// ErrOverBudget is returned when the estimated size of an archive is over
+// -max-total-bytes and -force was not given.
+var ErrOverBudget = errors.New("Estimated archive size is over -max-total-bytes, use -force to archive anyway")
+
+// EstimateTarSize returns the total size of the metrics in sorted as
+// reported by a stat of each metric on the first of the servers returned
+// by serversFor.  Nothing is downloaded.  Metrics that can not be stat()ed
+// are not counted.
+func EstimateTarSize(sorted []string, serversFor func(string) []string) int64 {
+	metricMap := make(map[string][]string)
+	for _, m := range sorted {
+		server := serversFor(m)[0]
+		metricMap[server] = append(metricMap[server], m)
+	}
+
+	// The estimate is not part of the work the exit code reports on
+	succeeded, failed := workerSucceeded, workerFailed
+	defer func() {
+		workerSucceeded, workerFailed = succeeded, failed
+	}()
+
+	var total int64
+	statBatches(metricMap, func(stat *MetricData) {
+		total += stat.Size
+	})
+	return total
+}
+
+// checkTarBudget estimates the size of the archive of sorted and returns
+// ErrOverBudget if it is over -max-total-bytes unless -force was given.
+func checkTarBudget(sorted []string, serversFor func(string) []string) error {
+	total := EstimateTarSize(sorted, serversFor)
+	if total <= tarMaxTotalBytes {
+		log.Printf("Estimated archive size %d bytes is within -max-total-bytes %d.",
+			total, tarMaxTotalBytes)
+		return nil
+	}
+	if tarForce {
+		log.Printf("Warning: Estimated archive size %d bytes is over -max-total-bytes %d, continuing with -force.",
+			total, tarMaxTotalBytes)
+		return nil
+	}
+	log.Printf("Abort: Estimated archive size %d bytes for %d metrics is over -max-total-bytes %d.",
+		total, len(sorted), tarMaxTotalBytes)
+	return ErrOverBudget
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestTarMaxTotalBytes(t *testing.T) {
+	var downloads int32
+	data := []byte(strings.Repeat("x", 100))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		list := make([]string, 0)
+		json.Unmarshal([]byte(r.FormValue("list")), &list)
+		switch r.URL.Path {
+		case "/metrics":
+			blob, _ := json.Marshal(list)
+			w.Write(blob)
+		case "/stat":
+			stats := make([]*metrics.MetricData, 0)
+			for _, m := range list {
+				stats = append(stats, &metrics.MetricData{Name: m, Size: int64(len(data))})
+			}
+			blob, _ := json.Marshal(stats)
+			w.Write(blob)
+		case "/status":
+			http.NotFound(w, r)
+		default:
+			atomic.AddInt32(&downloads, 1)
+			stat, _ := json.Marshal(&metrics.MetricData{
+				Name: strings.TrimPrefix(r.URL.Path, "/metrics/"),
+				Size: int64(len(data)),
+				Mode: 0644,
+			})
+			w.Header().Set("X-Metric-Stat", string(stat))
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+	defer func() {
+		tarMaxTotalBytes = 0
+		tarForce = false
+	}()
+
+	tests := []struct {
+		limit     int64
+		force     bool
+		code      int
+		downloads int32
+	}{
+		{250, false, ExitUsage, 0},
+		{250, true, ExitOK, 3},
+		{300, false, ExitOK, 3},
+	}
+	for _, v := range tests {
+		tarMaxTotalBytes = v.limit
+		tarForce = v.force
+		atomic.StoreInt32(&downloads, 0)
+		code := runTar(t, server, "foo.a", "foo.b", "foo.c")
+		if code != v.code {
+			t.Errorf("Limit %d force %v: expected exit %d, got %d", v.limit, v.force, v.code, code)
+		}
+		if n := atomic.LoadInt32(&downloads); n != v.downloads {
+			t.Errorf("Limit %d force %v: expected %d downloads, got %d", v.limit, v.force, v.downloads, n)
+		}
+	}
+}
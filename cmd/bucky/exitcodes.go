@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Exit codes returned by the bucky subcommands.  Automation can use these
+// to tell failures worth retrying from those that need a person.
+const (
+	// ExitOK is returned when everything succeeded.
+	ExitOK = 0
+
+	// ExitError is returned for unexpected errors such as failing to
+	// reach the cluster or to write an archive.
+	ExitError = 1
+
+	// ExitPartial is returned when some metrics were processed and
+	// others failed.
+	ExitPartial = 2
+
+	// ExitFailed is returned when every metric failed.
+	ExitFailed = 3
+
+	// ExitTimeout is returned when the run was interrupted or its time
+	// budget, such as tar -timeout, was exceeded.
+	ExitTimeout = 4
+
+	// ExitUsage is returned for bad arguments and unmet preconditions
+	// such as an unhealthy cluster, a node in maintenance, or a changed
+	// hash ring.
+	ExitUsage = 5
+)
+
+// ErrEmptyRing is returned when no servers were discovered.  The hashing
+// package's rings panic when a node is requested from a ring without any
+// nodes, so such a ring is refused before any workers start.
+var ErrEmptyRing = errors.New("No servers discovered.  The hash ring is empty, check discovery and connectivity to buckyd.")
+
+// runCommand runs the subcommand c and returns its exit code.  A cluster
+// whose hash ring is empty is reported as an unmet precondition.
+func runCommand(c Command) int {
+	code := c.Run(c)
+	if code == ExitError && recordedError() == ErrEmptyRing {
+		return ExitUsage
+	}
+	return code
+}
+
+// workerSucceeded and workerFailed count the metrics that the workers of a
+// subcommand processed and failed to process.
+var workerSucceeded int32
+var workerFailed int32
+
+// workSucceeded records a metric processed by a worker.
+func workSucceeded() {
+	atomic.AddInt32(&workerSucceeded, 1)
+}
+
+// workFailed records a metric a worker failed to process.
+func workFailed() {
+	atomic.AddInt32(&workerFailed, 1)
+}
+
+// workerErrors returns true if a worker failed to process a metric.
+func workerErrors() bool {
+	return atomic.LoadInt32(&workerFailed) > 0
+}
+
+// workFailedLate records that a metric already counted by workSucceeded
+// failed in a later stage, such as while being prepared for an archive.
+func workFailedLate() {
+	atomic.AddInt32(&workerSucceeded, -1)
+	workFailed()
+}
+
+// workStatus returns the exit code describing the work done by the
+// subcommand's workers.
+func workStatus() int {
+	switch {
+	case !workerErrors():
+		return ExitOK
+	case atomic.LoadInt32(&workerSucceeded) == 0:
+		return ExitFailed
+	}
+	return ExitPartial
+}
+
+// exitStatus returns the exit code of a subcommand that finished with
+// err.  Errors from individual metrics are reported by workStatus and
+// anything else is an unexpected error.
+func exitStatus(err error) int {
+	recordError(err)
+	if err == nil || workerErrors() {
+		return workStatus()
+	}
+	return ExitError
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestWorkStatus(t *testing.T) {
+	defer resetTarState()
+	tests := []struct {
+		succeeded, failed int32
+		code              int
+	}{
+		{5, 0, ExitOK},
+		{0, 0, ExitOK},
+		{3, 2, ExitPartial},
+		{0, 5, ExitFailed},
+	}
+	for _, v := range tests {
+		workerSucceeded, workerFailed = v.succeeded, v.failed
+		if code := workStatus(); code != v.code {
+			t.Errorf("%d succeeded %d failed: expected %d, got %d",
+				v.succeeded, v.failed, v.code, code)
+		}
+	}
+}
+
+// exitTestServer is a buckyd that lists every requested metric.  Metrics
+// named bad.* fail to download and slow.* take a second.
+func exitTestServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/metrics" {
+			list := make([]string, 0)
+			json.Unmarshal([]byte(r.FormValue("list")), &list)
+			blob, _ := json.Marshal(list)
+			w.Write(blob)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+		switch {
+		case strings.HasPrefix(name, "bad."):
+			http.Error(w, "Broken", http.StatusInternalServerError)
+			return
+		case strings.HasPrefix(name, "slow."):
+			time.Sleep(time.Second)
+		}
+		data := []byte("whisper data")
+		stat, _ := json.Marshal(&metrics.MetricData{Name: name, Size: int64(len(data)), Mode: 0644})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write(data)
+	}))
+}
+
+// runTar runs the tar subcommand with args against server and returns
+// its exit code.
+func runTar(t *testing.T, server *httptest.Server, args ...string) int {
+	dir, err := ioutil.TempDir("", "exitcodes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	resetTarState()
+	metricWorkers = 1
+	Retries = 0
+	defer func() {
+		Cluster = nil
+		tarOutput = ""
+		tarTimeout = 0
+		tarFormat = ""
+		tarListMetrics = ""
+		tarStatStream = ""
+		tarStrict = false
+		Retries = 3
+	}()
+
+	c := Command{Name: "tar", Flag: flag.NewFlagSet("tar", flag.ContinueOnError)}
+	c.Flag.StringVar(&tarOutput, "o", filepath.Join(dir, "out.tar"), "")
+	c.Flag.DurationVar(&tarTimeout, "timeout", 0, "")
+	c.Flag.StringVar(&tarFormat, "format", "tar", "")
+	c.Flag.StringVar(&tarListMetrics, "list-metrics", "", "")
+	c.Flag.StringVar(&tarStatStream, "stat-stream", "", "")
+	c.Flag.BoolVar(&tarStrict, "strict", false, "")
+	c.Flag.Parse(args)
+	return tarCommand(c)
+}
+
+func TestTarExitCodes(t *testing.T) {
+	server := exitTestServer()
+	defer server.Close()
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"success", []string{"foo.a", "foo.b"}, ExitOK},
+		{"partial", []string{"foo.a", "bad.b"}, ExitPartial},
+		{"all failed", []string{"bad.a", "bad.b"}, ExitFailed},
+		{"timeout", []string{"-timeout", "100ms", "slow.a", "slow.b", "slow.c"}, ExitTimeout},
+		{"no arguments", []string{}, ExitUsage},
+		{"bad format", []string{"-format", "zip", "foo.a"}, ExitUsage},
+		{"stat stream without archive", []string{"-o", "", "-list-metrics", "/nonexistent/list.json",
+			"-stat-stream", "/nonexistent/stats.json", "foo.a"}, ExitUsage},
+		{"strict list only", []string{"-o", "", "-list-metrics", os.DevNull, "-strict", "foo..a"}, ExitUsage},
+	}
+	for _, v := range tests {
+		if code := runTar(t, server, v.args...); code != v.code {
+			t.Errorf("%s: expected exit code %d, got %d", v.name, v.code, code)
+		}
+	}
+}
+
+func TestRestoreExitCodes(t *testing.T) {
+	defer func() { restoreForce, restoreRemap = false, false }()
+	if _, err := restoreTo(t, ringFor(1, "127.0.0.1"), ringFor(1, "localhost")); err != ErrRingChanged {
+		t.Errorf("Changed ring returned %v", err)
+	}
+
+	// Unhealthy clusters are a precondition failure
+	restoreTestCluster(ringFor(1, "127.0.0.1"), "4242")
+	defer func() { Cluster = nil }()
+	Cluster.Healthy = false
+	c := Command{Name: "restore", Flag: flag.NewFlagSet("restore", flag.ContinueOnError)}
+	c.Flag.Parse([]string{"-"})
+	if code := restoreCommand(c); code != ExitUsage {
+		t.Errorf("Unhealthy cluster: expected exit code %d, got %d", ExitUsage, code)
+	}
+}
+
+func TestRunCommandEmptyRing(t *testing.T) {
+	// Discovery returns a ring without any servers
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, _ := json.Marshal(ringFor(1))
+		w.Write(blob)
+	}))
+	defer server.Close()
+	defer func(h string) { HostPort = h }(HostPort)
+	HostPort = server.Listener.Addr().String()
+	Cluster = nil
+	defer func() {
+		Cluster = nil
+		failures.err = nil
+	}()
+
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := Command{Name: "locate", Run: locateCommand,
+		Flag: flag.NewFlagSet("locate", flag.ContinueOnError)}
+	c.Flag.Parse([]string{"foo.bar"})
+	if code := runCommand(c); code != ExitUsage {
+		t.Errorf("Expected exit code %d, got %d", ExitUsage, code)
+	}
+	if !strings.Contains(buf.String(), "No servers discovered") {
+		t.Errorf("Expected the empty ring to be reported, got: %s", buf.String())
+	}
+	if Cluster != nil {
+		t.Errorf("Cluster configured with an empty ring")
+	}
+
+	// Other errors are not changed
+	failures.err = nil
+	if code := runCommand(Command{Run: func(c Command) int { return ExitError }}); code != ExitError {
+		t.Errorf("Expected exit code %d, got %d", ExitError, code)
+	}
+}
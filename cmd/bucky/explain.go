@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var explainContext int
+
+func init() {
+	usage := "[options] <metric list>"
+	short := "Explain how metrics are routed through the hash ring."
+	long := `Show each step of routing the given metric keys through the hash ring.
+
+For each key the ring position of the key is printed along with the bisect
+index, the first ring entry at or after that position, and the ring entries
+on either side with their positions and owning nodes.  Positions are in the
+16 bit space used by the carbon and fnv1a rings.  A key past the last entry
+wraps around to the first.  Ring entries that share a position are ordered
+by server then instance.
+
+Use -n to set the number of surrounding entries shown on each side.  Use -j
+for JSON output.  The jump_fnv1a ring has no ring positions and can not be
+explained.`
+
+	c := NewCommand(explainCommand, "explain", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+	SetupRingCache(c)
+
+	c.Flag.IntVar(&explainContext, "n", 3,
+		"Ring entries to show before and after the chosen entry.")
+}
+
+// printExplanation writes a human readable form of e to STDOUT.
+func printExplanation(e *hashing.Explanation) {
+	fmt.Printf("%s\n", e.Key)
+	if e.HashedKey != e.Key {
+		fmt.Printf("    hashed key:   %s\n", e.HashedKey)
+	}
+	fmt.Printf("    position:     0x%04x (%d)\n", e.Position, e.Position)
+	fmt.Printf("    bisect index: %d of %d entries\n", e.Bisect, e.Size)
+	if e.Wrapped {
+		fmt.Printf("    position is past the last entry, wrapped to index 0\n")
+	}
+	for _, r := range e.Entries {
+		mark := " "
+		if r.Index == e.Index {
+			mark = ">"
+		}
+		fmt.Printf("  %s [%5d] 0x%04x %s\n", mark, r.Index, r.Position, r.Node)
+	}
+	if c := e.Collisions(); len(c) > 0 {
+		fmt.Printf("    %d other entries share position 0x%04x\n", len(c), c[0].Position)
+	}
+	fmt.Printf("    routes to %s\n", e.Node)
+}
+
+// explainCommand runs this subcommand.
+func explainCommand(c Command) int {
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if c.Flag.NArg() == 0 {
+		log.Print("At least one argument is required.")
+		return ExitUsage
+	}
+	if !Cluster.Healthy {
+		log.Printf("Warning: Cluster is not optimal.")
+	}
+
+	results := make([]*hashing.Explanation, 0)
+	for _, key := range c.Flag.Args() {
+		e, err := hashing.Explain(Cluster.Hash, key, explainContext)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+		results = append(results, e)
+	}
+
+	if JSONOutput {
+		blob, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			log.Printf("%s", err)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+		return ExitOK
+	}
+	for _, e := range results {
+		printExplanation(e)
+	}
+	return ExitOK
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+var exportFormat string
+var exportFrom string
+var exportUntil string
+
+func init() {
+	usage := "[options] <metric expression>"
+	short := "Export the datapoints of metrics as CSV or line protocol."
+	long := `Download the Whisper DBs of the matching metrics and print their
+datapoints for analysis in a spreadsheet or another time series database.
+
+The default mode is to work with lists.  The arguments are a series of one or
+more metric key names.  If the first argument is a "-" then read a JSON array
+from STDIN as our list of metrics.
+
+Use -r to enable regular expression mode.  The first argument is a regular
+expression.  If metrics names match they will be included in the output.
+
+Use -s to only export metrics found on the server specified by -h or the
+BUCKYSERVER environment variable.
+
+Datapoints between -from and -until are read from the highest resolution
+archive that covers -from, just as whisper-fetch.py does.  Each takes a
+Unix timestamp, an RFC3339 time, or a negative duration relative to now
+such as -6h.  By default the last 24 hours are exported.  Intervals without
+a datapoint are left out.
+
+The default -format csv prints a header row and then the columns metric,
+timestamp, and value.  Use -format line for InfluxDB line protocol with
+the metric name as the measurement, a single value field, and the timestamp
+in nanoseconds.
+
+A metric held by more than one server is downloaded from the first of
+them in sorted order.`
+
+	c := NewCommand(exportCommand, "export", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force metric re-inventory.")
+	c.Flag.StringVar(&exportFormat, "format", "csv",
+		"Output format: csv or line.")
+	c.Flag.StringVar(&exportFrom, "from", "-24h",
+		"Export datapoints from this time.")
+	c.Flag.StringVar(&exportUntil, "until", "",
+		"Export datapoints until this time.  Defaults to now.")
+}
+
+// ParseExportTime parses a -from or -until time.  It may be a Unix
+// timestamp, an RFC3339 time, or a negative duration before now.  An empty
+// string is now.
+func ParseExportTime(s string, now time.Time) (int, error) {
+	if s == "" {
+		return int(now.Unix()), nil
+	}
+	if ts, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return int(ts), nil
+	}
+	if strings.HasPrefix(s, "-") {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("Invalid time %q: %s", s, err)
+		}
+		return int(now.Add(d).Unix()), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time %q, expected a Unix timestamp, RFC3339, or -DURATION", s)
+	}
+	return int(t.Unix()), nil
+}
+
+// FetchMetricData decodes the Whisper DB downloaded in metric and returns
+// its datapoints between from and until.  The series is nil if the range
+// is outside of the DB's retention.
+func FetchMetricData(metric *MetricData, from, until int) (*whisper.TimeSeries, error) {
+	wsp, err := OpenMetricData(metric)
+	if err != nil {
+		return nil, err
+	}
+	defer wsp.Close()
+	return wsp.Fetch(from, until)
+}
+
+// OpenMetricData decodes the Whisper DB downloaded in metric and opens it
+// for reading.  The caller must close it.
+func OpenMetricData(metric *MetricData) (*whisper.Whisper, error) {
+	data, err := MetricDecode(metric)
+	if err != nil {
+		return nil, err
+	}
+
+	// The whisper package only reads files
+	fd, err := ioutil.TempFile("", "bucky-export")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fd.Name())
+	_, err = fd.Write(data)
+	fd.Close()
+	if err != nil {
+		return nil, err
+	}
+	return whisper.Open(fd.Name())
+}
+
+// lineEscaper escapes a measurement name for InfluxDB line protocol.
+var lineEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+
+// writeExport writes the known datapoints of the metric name in ts to w in
+// the given format.  It returns the number of datapoints written.
+func writeExport(w io.Writer, name string, ts *whisper.TimeSeries, format string) (int, error) {
+	if ts == nil {
+		return 0, nil
+	}
+	n := 0
+	var cw *csv.Writer
+	if format == "csv" {
+		cw = csv.NewWriter(w)
+	}
+	for _, p := range ts.Points() {
+		if math.IsNaN(p.Value) {
+			continue
+		}
+		value := strconv.FormatFloat(p.Value, 'g', -1, 64)
+		if cw != nil {
+			cw.Write([]string{name, strconv.Itoa(p.Time), value})
+		} else if _, err := fmt.Fprintf(w, "%s value=%s %d\n",
+			lineEscaper.Replace(name), value, int64(p.Time)*int64(time.Second)); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if cw != nil {
+		cw.Flush()
+		return n, cw.Error()
+	}
+	return n, nil
+}
+
+// exportMetrics downloads and writes the datapoints of each metric in
+// metricMap, a map of server => metrics, to w.
+func exportMetrics(w io.Writer, metricMap map[string][]string, from, until int) error {
+	servers := make(map[string]string)
+	names := make([]string, 0)
+	hosts := make([]string, 0, len(metricMap))
+	for server := range metricMap {
+		hosts = append(hosts, server)
+	}
+	sort.Strings(hosts)
+	for _, server := range hosts {
+		for _, m := range metricMap[server] {
+			if _, ok := servers[m]; !ok {
+				servers[m] = server
+				names = append(names, m)
+			}
+		}
+	}
+	sort.Strings(names)
+
+	if exportFormat == "csv" {
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"metric", "timestamp", "value"})
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Error writing export: %s", err)
+			return err
+		}
+	}
+	points := 0
+	for _, m := range names {
+		metric, err := GetMetricData(servers[m], m)
+		if err != nil {
+			// errors already handled
+			workFailed()
+			continue
+		}
+		ts, err := FetchMetricData(metric, from, until)
+		if err != nil {
+			log.Printf("Error reading %s: %s", m, err)
+			workFailed()
+			continue
+		}
+		n, err := writeExport(w, m, ts, exportFormat)
+		if err != nil {
+			log.Printf("Error writing export: %s", err)
+			return err
+		}
+		points += n
+		workSucceeded()
+	}
+
+	log.Printf("Exported %d datapoints from %d metrics.", points, len(names))
+	if workerErrors() {
+		log.Printf("Errors occured in export operation.")
+		return fmt.Errorf("Errors occured in export operations.")
+	}
+	return nil
+}
+
+// exportCommand runs this subcommand.
+func exportCommand(c Command) int {
+	if exportFormat != "csv" && exportFormat != "line" {
+		log.Printf("Unknown export format: %s", exportFormat)
+		return ExitUsage
+	}
+	now := time.Now()
+	from, err := ParseExportTime(exportFrom, now)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+	until, err := ParseExportTime(exportUntil, now)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+	if from >= until {
+		log.Printf("The -from time must be before the -until time.")
+		return ExitUsage
+	}
+
+	if c.Flag.NArg() == 0 {
+		log.Print("At least one argument is required.")
+		return ExitUsage
+	}
+
+	var servers []string
+	if SingleHost {
+		server, err := singleServer(HostPort)
+		if err != nil {
+			log.Printf("Malformed hostname: %s", err)
+			return ExitUsage
+		}
+		servers = []string{server}
+	} else {
+		_, err := GetClusterConfig(HostPort)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+		servers = Cluster.HostPorts()
+	}
+
+	metricMap, err := ListSelection(c, servers)
+	if err != nil {
+		return exitStatus(err)
+	}
+
+	return exitStatus(exportMetrics(os.Stdout, metricMap, from, until))
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+func TestParseExportTime(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	tests := map[string]int{
+		"":                     1500000000,
+		"1400000000":           1400000000,
+		"-6h":                  1500000000 - 6*3600,
+		"2017-07-14T02:40:00Z": 1500000000,
+	}
+	for s, expected := range tests {
+		if ts, err := ParseExportTime(s, now); err != nil || ts != expected {
+			t.Errorf("ParseExportTime(%q) = %d, %v, expected %d", s, ts, err, expected)
+		}
+	}
+	if _, err := ParseExportTime("yesterday", now); err == nil {
+		t.Errorf("Expected an error for an invalid time")
+	}
+}
+
+func TestExportMetricData(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cpu.wsp")
+	retentions, _ := whisper.ParseRetentionDefs("60s:1d,1h:30d")
+	wsp, err := whisper.Create(path, retentions, whisper.Average, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int(time.Now().Unix())
+	now -= now % 60
+	wsp.Update(1.5, now-120)
+	wsp.Update(3, now-60)
+	wsp.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metric := &MetricData{Name: "app.cpu", Size: int64(len(data)), Data: data, Encoding: EncIdentity}
+	ts, err := FetchMetricData(metric, now-600, now)
+	if err != nil {
+		t.Fatalf("Error fetching datapoints: %s", err)
+	}
+	if ts.Step() != 60 {
+		t.Errorf("Expected the 60s archive, got a step of %d", ts.Step())
+	}
+
+	buf := new(bytes.Buffer)
+	if n, err := writeExport(buf, "app.cpu", ts, "csv"); err != nil || n != 2 {
+		t.Fatalf("Expected 2 datapoints, got %d: %v", n, err)
+	}
+	expected := "app.cpu," + strconv.Itoa(now-120) + ",1.5\napp.cpu," + strconv.Itoa(now-60) + ",3\n"
+	if buf.String() != expected {
+		t.Errorf("Expected CSV %q, got %q", expected, buf.String())
+	}
+
+	buf.Reset()
+	writeExport(buf, "app cpu,total", ts, "line")
+	expected = `app\ cpu\,total value=1.5 ` + strconv.Itoa(now-120) + "000000000\n" +
+		`app\ cpu\,total value=3 ` + strconv.Itoa(now-60) + "000000000\n"
+	if buf.String() != expected {
+		t.Errorf("Expected line protocol %q, got %q", expected, buf.String())
+	}
+}
+
+func TestExportSingleServer(t *testing.T) {
+	data := migrationTestWhisper(t, "60s:1d", 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hashring":
+			http.Error(w, "The hash ring is not needed with -s", http.StatusInternalServerError)
+		case "/metrics":
+			list := make([]string, 0)
+			json.Unmarshal([]byte(r.FormValue("list")), &list)
+			blob, _ := json.Marshal(list)
+			w.Write(blob)
+		default:
+			stat, _ := json.Marshal(&MetricData{Name: "app.cpu", Size: int64(len(data)), Mode: 0644})
+			w.Header().Set("X-Metric-Stat", string(stat))
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	defer func(h string, stdout *os.File) {
+		HostPort, SingleHost, os.Stdout = h, false, stdout
+	}(HostPort, os.Stdout)
+	HostPort = server.Listener.Addr().String()
+	SingleHost = true
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer os.Stdout.Close()
+	Cluster = nil
+	resetTarState()
+
+	c := Command{Name: "export", Flag: flag.NewFlagSet("export", flag.ContinueOnError)}
+	c.Flag.Parse([]string{"app.cpu"})
+	if code := exportCommand(c); code != ExitOK {
+		t.Errorf("Expected exit code %d, got %d", ExitOK, code)
+	}
+	if Cluster != nil || workerSucceeded != 1 {
+		t.Errorf("Expected 1 metric exported without the hash ring, got %d", workerSucceeded)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// OnlyServer restricts a selection to metrics belonging to this server.
+// Set up by calling SetupOnlyServer() from a sub-command's init().
+var OnlyServer string
+
+// OnlyServerLocation matches OnlyServer against where metrics physically
+// live rather than their owners in the hash ring.
+var OnlyServerLocation bool
+
+// SetupOnlyServer installs the -only-server and -only-location flags in
+// the given Command.
+func SetupOnlyServer(c Command) {
+	c.Flag.StringVar(&OnlyServer, "only-server", "",
+		"Only select metrics owned by this server in the hash ring.")
+	c.Flag.BoolVar(&OnlyServerLocation, "only-location", false,
+		"Match -only-server against where metrics live, not ring ownership.")
+}
+
+// FilterOnlyServer returns the part of metricMap, a map of buckyd HOST:PORT
+// => metrics, that belongs to the server host.  With byLocation metrics
+// belong to the server they were found on.  Otherwise metrics belong to
+// their owners in the hash ring given the replication factor.
+func FilterOnlyServer(ring hashing.HashRing, replicas int, metricMap map[string][]string,
+	host string, byLocation bool) map[string][]string {
+
+	result := make(map[string][]string)
+	for server, metrics := range metricMap {
+		if byLocation {
+			if hostOnly(server) == host {
+				result[server] = metrics
+			}
+			continue
+		}
+		for _, m := range metrics {
+			if containsString(RingOwners(ring, replicas, m), host) {
+				result[server] = append(result[server], m)
+			}
+		}
+	}
+	return result
+}
+
+// applyOnlyServer filters metricMap by the -only-server flag if set.
+func applyOnlyServer(metricMap map[string][]string) map[string][]string {
+	if OnlyServer == "" {
+		return metricMap
+	}
+	if !inRing(Cluster.Hash, OnlyServer) {
+		log.Printf("Warning: %s is not a server in the hash ring.", OnlyServer)
+	}
+	result := FilterOnlyServer(Cluster.Hash, Cluster.Replicas, metricMap,
+		OnlyServer, OnlyServerLocation)
+	log.Printf("%d of %d metrics selected by -only-server %s.",
+		countMap(result), countMap(metricMap), OnlyServer)
+	return result
+}
+
+// SkipPattern is a regular expression matching metrics to leave out of a
+// selection, such as carbon-aggregator output kept next to the raw series.
+var SkipPattern string
+
+// skipRegexp is SkipPattern compiled by checkSkipPattern().
+var skipRegexp *regexp.Regexp
+
+// SetupSkipPattern installs the -skip-pattern flag in the given Command.
+func SetupSkipPattern(c Command) {
+	c.Flag.StringVar(&SkipPattern, "skip-pattern", "",
+		"Leave out metrics matching this regular expression.")
+}
+
+// checkSkipPattern compiles SkipPattern and returns false, logging why, if
+// it is not a valid regular expression.
+func checkSkipPattern() bool {
+	if SkipPattern == "" {
+		skipRegexp = nil
+		return true
+	}
+	var err error
+	skipRegexp, err = regexp.Compile(SkipPattern)
+	if err != nil {
+		log.Printf("Invalid -skip-pattern: %s", err)
+		return false
+	}
+	return true
+}
+
+// SkipMetrics returns the part of metricMap, a map of server => metrics,
+// whose metrics do not match re.
+func SkipMetrics(metricMap map[string][]string, re *regexp.Regexp) map[string][]string {
+	result := make(map[string][]string)
+	for server, metrics := range metricMap {
+		for _, m := range metrics {
+			if !re.MatchString(m) {
+				result[server] = append(result[server], m)
+			}
+		}
+	}
+	return result
+}
+
+// applySkipPattern filters metricMap by the -skip-pattern flag if set.
+func applySkipPattern(metricMap map[string][]string) map[string][]string {
+	if skipRegexp == nil {
+		return metricMap
+	}
+	result := SkipMetrics(metricMap, skipRegexp)
+	log.Printf("%d of %d matched metrics skipped by -skip-pattern %s.",
+		countMap(metricMap)-countMap(result), countMap(metricMap), SkipPattern)
+	return result
+}
+
+// SampleRate is the probability each selected metric is kept.  1 keeps
+// every metric.  SampleSeed chooses which metrics make up the sample.
+var SampleRate float64
+var SampleSeed int64
+
+// samplePercent is a flag.Value that sets SampleRate from a percentage.
+type samplePercent struct{}
+
+func (samplePercent) String() string {
+	return strconv.FormatFloat(SampleRate*100, 'g', -1, 64)
+}
+
+func (samplePercent) Set(s string) error {
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return err
+	}
+	SampleRate = pct / 100
+	return nil
+}
+
+// SetupSample installs the -sample-rate, -sample, and -sample-seed flags
+// in the given Command.
+func SetupSample(c Command) {
+	c.Flag.Float64Var(&SampleRate, "sample-rate", 1,
+		"Keep each selected metric with this probability, between 0 and 1.")
+	c.Flag.Var(samplePercent{}, "sample",
+		"Keep this percentage of the selected metrics, the same as -sample-rate.")
+	c.Flag.Int64Var(&SampleSeed, "sample-seed", 0,
+		"Seed choosing the metrics kept by -sample-rate.")
+	c.Flag.Int64Var(&SampleSeed, "seed", 0,
+		"Seed choosing the metrics kept by -sample-rate.")
+}
+
+// inSample returns true if metric is kept by a sample of the given rate.
+// The choice depends only on the metric name and seed so the same metrics
+// are sampled on every run.
+func inSample(metric string, rate float64, seed int64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := hashing.XorShift(hashing.Fnv1a64([]byte(strconv.FormatInt(seed, 10) + "\x00" + metric)))
+	// Use the top 53 bits to compare exactly as a float64
+	return float64(h>>11) < rate*(1<<53)
+}
+
+// SampleMetrics returns the part of metricMap, a map of server => metrics,
+// kept by a sample of the given rate and seed.
+func SampleMetrics(metricMap map[string][]string, rate float64, seed int64) map[string][]string {
+	result := make(map[string][]string)
+	for server, metrics := range metricMap {
+		for _, m := range metrics {
+			if inSample(m, rate, seed) {
+				result[server] = append(result[server], m)
+			}
+		}
+	}
+	return result
+}
+
+// applySample filters metricMap by the -sample-rate flag if set.
+func applySample(metricMap map[string][]string) map[string][]string {
+	if SampleRate >= 1 {
+		return metricMap
+	}
+	result := SampleMetrics(metricMap, SampleRate, SampleSeed)
+	log.Printf("%d of %d matched metrics sampled by -sample-rate %g.",
+		countMap(result), countMap(metricMap), SampleRate)
+	return result
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"regexp"
+	"testing"
+)
+
+func TestFilterOnlyServer(t *testing.T) {
+	ring := scanTestRing()
+	metrics := []string{"foo.bar", "foo.baz", "foo.qux", "bar.foo", "bar.baz"}
+	metricMap := map[string][]string{
+		"graphite010:4242": metrics,
+		"graphite011:4242": []string{"foo.bar"},
+	}
+
+	owned := FilterOnlyServer(ring, 1, metricMap, "graphite010", false)
+	for server, ms := range owned {
+		for _, m := range ms {
+			if ring.GetNode(m).Server != "graphite010" {
+				t.Errorf("%s on %s is not owned by graphite010", m, server)
+			}
+		}
+	}
+	expected := 0
+	for _, m := range metrics {
+		if ring.GetNode(m).Server == "graphite010" {
+			expected++
+		}
+	}
+	if n := len(owned["graphite010:4242"]); n != expected {
+		t.Errorf("Expected %d owned metrics on graphite010, got %d", expected, n)
+	}
+
+	located := FilterOnlyServer(ring, 1, metricMap, "graphite011", true)
+	if len(located) != 1 || len(located["graphite011:4242"]) != 1 {
+		t.Errorf("Bad location filter: %v", located)
+	}
+}
+
+func TestSampleMetrics(t *testing.T) {
+	metrics := make([]string, 0)
+	for i := 0; i < 100000; i++ {
+		metrics = append(metrics, fmt.Sprintf("app%d.host%d.cpu", i%97, i))
+	}
+	metricMap := map[string][]string{"graphite010:4242": metrics}
+
+	sample := SampleMetrics(metricMap, 0.01, 42)["graphite010:4242"]
+	if len(sample) < 900 || len(sample) > 1100 {
+		t.Errorf("Expected a sample of about 1000, got %d", len(sample))
+	}
+
+	again := SampleMetrics(metricMap, 0.01, 42)["graphite010:4242"]
+	if len(again) != len(sample) {
+		t.Fatalf("Sample not stable: %d then %d metrics", len(sample), len(again))
+	}
+	for i := range sample {
+		if sample[i] != again[i] {
+			t.Fatalf("Sample not stable: %s then %s", sample[i], again[i])
+		}
+	}
+
+	other := SampleMetrics(metricMap, 0.01, 43)["graphite010:4242"]
+	same := 0
+	for _, m := range other {
+		if containsString(sample, m) {
+			same++
+		}
+	}
+	if same > 100 {
+		t.Errorf("Seed did not change the sample, %d metrics in common", same)
+	}
+
+	// A larger rate keeps a superset of the sample
+	larger := SampleMetrics(metricMap, 0.1, 42)["graphite010:4242"]
+	for _, m := range sample {
+		if !containsString(larger, m) {
+			t.Fatalf("%s in 1%% sample but not 10%% sample", m)
+		}
+	}
+	if all := SampleMetrics(metricMap, 1, 42); countMap(all) != len(metrics) {
+		t.Errorf("Rate 1 should keep every metric, kept %d", countMap(all))
+	}
+}
+
+func TestSamplePercentFlag(t *testing.T) {
+	defer func() { SampleRate, SampleSeed = 1, 0 }()
+	c := Command{Name: "tar", Flag: flag.NewFlagSet("tar", flag.ContinueOnError)}
+	SetupSample(c)
+	if err := c.Flag.Parse([]string{"-sample", "5", "-seed", "7"}); err != nil {
+		t.Fatalf("Error parsing flags: %s", err)
+	}
+	if SampleRate != 0.05 || SampleSeed != 7 {
+		t.Errorf("Expected rate 0.05 and seed 7, got %v and %d", SampleRate, SampleSeed)
+	}
+	if err := c.Flag.Parse([]string{"-sample", "lots"}); err == nil {
+		t.Errorf("Expected an error for a non-numeric -sample")
+	}
+}
+
+func TestSkipMetrics(t *testing.T) {
+	metricMap := map[string][]string{
+		"graphite010:4242": []string{"app.cpu", "app.cpu.sum_all", "app.mem"},
+		"graphite011:4242": []string{"agg.app.requests"},
+	}
+	result := SkipMetrics(metricMap, regexp.MustCompile(`^agg\.|\.sum_all$`))
+	if countMap(result) != 2 || !containsString(result["graphite010:4242"], "app.mem") {
+		t.Errorf("Unexpected metrics after skipping: %v", result)
+	}
+	if _, ok := result["graphite011:4242"]; ok {
+		t.Errorf("Server with every metric skipped should be dropped: %v", result)
+	}
+
+	defer func() { SkipPattern = ""; skipRegexp = nil }()
+	SkipPattern = "app.(cpu"
+	if checkSkipPattern() {
+		t.Errorf("Expected an invalid -skip-pattern to be refused")
+	}
+}
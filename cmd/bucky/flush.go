@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// tarGzip compresses the whole archive stream with gzip with -z.
+var tarGzip bool
+
+// tarFlushInterval is the -flush-interval between flushes of the archive
+// stream.  0 never flushes before the archive is closed.
+var tarFlushInterval time.Duration
+
+// flusher is a writer of the archive stream that buffers data, such as
+// tar.Writer or gzip.Writer.
+type flusher interface {
+	Flush() error
+}
+
+// StreamFlusher flushes the buffering writers of an archive stream at most
+// once every interval.  It is only called between archive entries so that
+// a flush never splits an entry and the stream written so far is always a
+// valid prefix of the archive.
+type StreamFlusher struct {
+	interval time.Duration
+	last     time.Time
+	writers  []flusher
+	flushes  int
+}
+
+// NewStreamFlusher returns a StreamFlusher that flushes every interval.
+// An interval of 0 never flushes.
+func NewStreamFlusher(interval time.Duration) *StreamFlusher {
+	return &StreamFlusher{interval: interval, last: time.Now()}
+}
+
+// Add registers w to be flushed.  Writers are flushed in the order added
+// so the writer nearest the archive entries goes first.
+func (f *StreamFlusher) Add(w flusher) {
+	f.writers = append(f.writers, w)
+}
+
+// Boundary is called after each complete archive entry and flushes every
+// writer if the interval has passed since the last flush.
+func (f *StreamFlusher) Boundary() error {
+	if f.interval <= 0 || time.Since(f.last) < f.interval {
+		return nil
+	}
+	for _, w := range f.writers {
+		if err := w.Flush(); err != nil {
+			log.Printf("Error flushing archive: %s", err)
+			return err
+		}
+	}
+	f.last = time.Now()
+	f.flushes++
+	return nil
+}
+
+// Flushes returns the number of times the stream was flushed.
+func (f *StreamFlusher) Flushes() int {
+	return f.flushes
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamFlusher(t *testing.T) {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	flusher := NewStreamFlusher(time.Nanosecond)
+	flusher.Add(tw)
+	flusher.Add(gz)
+
+	data := []byte("whisper data")
+	tw.WriteHeader(&tar.Header{Name: "foo/bar.wsp", Size: int64(len(data)), Mode: 0644})
+	tw.Write(data)
+	time.Sleep(time.Millisecond)
+	if err := flusher.Boundary(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	if flusher.Flushes() != 1 {
+		t.Errorf("Expected 1 flush, got %d", flusher.Flushes())
+	}
+
+	// The stream so far holds the complete entry as if bucky had crashed
+	zr, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Error reading flushed stream: %s", err)
+	}
+	tr := tar.NewReader(zr)
+	th, err := tr.Next()
+	if err != nil || th.Name != "foo/bar.wsp" {
+		t.Fatalf("Flushed entry not readable: %v, %v", th, err)
+	}
+	blob := make([]byte, len(data))
+	if _, err := io.ReadFull(tr, blob); err != nil || !bytes.Equal(blob, data) {
+		t.Errorf("Flushed entry data not readable: %q, %v", blob, err)
+	}
+
+	never := NewStreamFlusher(0)
+	never.Add(tw)
+	if never.Boundary(); never.Flushes() != 0 {
+		t.Errorf("A 0 interval flushed")
+	}
+}
+
+func TestTarFlushInterval(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 2
+	tarGzip = true
+	tarFlushInterval = time.Nanosecond
+	defer func() {
+		tarGzip = false
+		tarFlushInterval = 0
+	}()
+	names := []string{"foo.a", "foo.b", "foo.c", "foo.d"}
+	metricMap := map[string][]string{
+		strings.TrimPrefix(server.URL, "http://"): names,
+	}
+
+	buf := new(bytes.Buffer)
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != nil {
+		t.Fatalf("Error building archive: %s", err)
+	}
+	zr, err := gzip.NewReader(buf)
+	if err != nil {
+		t.Fatalf("Archive is not gzip compressed: %s", err)
+	}
+	tr := tar.NewReader(zr)
+	files := 0
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.Typeflag == tar.TypeReg {
+			files++
+		}
+	}
+	if files != len(names) {
+		t.Errorf("Expected %d metrics in the archive, got %d", len(names), files)
+	}
+}
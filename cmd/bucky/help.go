@@ -47,14 +47,13 @@ func helpCommand(cmd Command) int {
 		for _, c := range commands {
 			if c.Name == cmd.Flag.Arg(0) {
 				longHelp(c)
-				return 0
+				return ExitOK
 			}
 		}
 		fmt.Printf("Unknown sub-command.\n")
-		os.Exit(1)
-	} else {
-		shortHelp()
+		return ExitUsage
 	}
 
-	return 0
+	shortHelp()
+	return ExitOK
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// duHist enables the prefix histogram of du.
+var duHist bool
+
+// duDepth is the number of metric name components a histogram bucket
+// groups by.
+var duDepth int
+
+// HistBucket is the metrics and storage under a metric name prefix.
+type HistBucket struct {
+	Prefix  string
+	Metrics int
+	Bytes   int64
+
+	names map[string]bool
+}
+
+// Histogram groups metrics by the first Depth dot separated components of
+// their names.
+type Histogram struct {
+	Depth   int
+	buckets map[string]*HistBucket
+}
+
+// NewHistogram returns an empty Histogram bucketing at depth.
+func NewHistogram(depth int) *Histogram {
+	return &Histogram{
+		Depth:   depth,
+		buckets: make(map[string]*HistBucket),
+	}
+}
+
+// metricPrefix returns the first depth dot separated components of name.
+func metricPrefix(name string, depth int) string {
+	fields := strings.SplitN(name, ".", depth+1)
+	if len(fields) > depth {
+		fields = fields[:depth]
+	}
+	return strings.Join(fields, ".")
+}
+
+// Add records size bytes of the named metric.  A metric seen again, such as
+// a replica on another server, adds its bytes but is counted once.
+func (h *Histogram) Add(name string, size int64) {
+	prefix := metricPrefix(name, h.Depth)
+	b, ok := h.buckets[prefix]
+	if !ok {
+		b = &HistBucket{Prefix: prefix, names: make(map[string]bool)}
+		h.buckets[prefix] = b
+	}
+	if !b.names[name] {
+		b.names[name] = true
+		b.Metrics++
+	}
+	b.Bytes += size
+}
+
+// Buckets returns the buckets sorted by bytes with the largest first.
+// Buckets of equal size are sorted by metric count and then by prefix.
+func (h *Histogram) Buckets() []*HistBucket {
+	ret := make([]*HistBucket, 0, len(h.buckets))
+	for _, b := range h.buckets {
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Bytes != ret[j].Bytes {
+			return ret[i].Bytes > ret[j].Bytes
+		}
+		if ret[i].Metrics != ret[j].Metrics {
+			return ret[i].Metrics > ret[j].Metrics
+		}
+		return ret[i].Prefix < ret[j].Prefix
+	})
+	return ret
+}
+
+// writeHistogram writes one tab separated line of prefix, metric count,
+// and bytes for each bucket.
+func writeHistogram(w io.Writer, buckets []*HistBucket) error {
+	for _, b := range buckets {
+		if _, err := fmt.Fprintf(w, "%s\t%d\t%d\n", b.Prefix, b.Metrics, b.Bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printHistogram writes the buckets of h to STDOUT as text or, with -j,
+// as a JSON array.
+func printHistogram(h *Histogram) error {
+	buckets := h.Buckets()
+	if JSONOutput {
+		blob, err := json.Marshal(buckets)
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+		return nil
+	}
+	return writeHistogram(os.Stdout, buckets)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMetricPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		depth  int
+		prefix string
+	}{
+		{"foo.bar.baz", 1, "foo"},
+		{"foo.bar.baz", 2, "foo.bar"},
+		{"foo.bar.baz", 3, "foo.bar.baz"},
+		{"foo.bar.baz", 5, "foo.bar.baz"},
+		{"foo", 2, "foo"},
+	}
+	for _, test := range tests {
+		if p := metricPrefix(test.name, test.depth); p != test.prefix {
+			t.Errorf("Prefix of %s at depth %d: expected %s, got %s",
+				test.name, test.depth, test.prefix, p)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram(2)
+	h.Add("app.web.requests", 100)
+	h.Add("app.web.requests", 100) // replica
+	h.Add("app.web.errors", 50)
+	h.Add("app.db.queries", 400)
+	h.Add("sys.cpu.user", 10)
+	h.Add("sys.mem", 10)
+
+	buckets := h.Buckets()
+	expected := []HistBucket{
+		{Prefix: "app.db", Metrics: 1, Bytes: 400},
+		{Prefix: "app.web", Metrics: 2, Bytes: 250},
+		{Prefix: "sys.cpu", Metrics: 1, Bytes: 10},
+		{Prefix: "sys.mem", Metrics: 1, Bytes: 10},
+	}
+	if len(buckets) != len(expected) {
+		t.Fatalf("Expected %d buckets, got %d", len(expected), len(buckets))
+	}
+	for i, b := range buckets {
+		e := expected[i]
+		if b.Prefix != e.Prefix || b.Metrics != e.Metrics || b.Bytes != e.Bytes {
+			t.Errorf("Bucket %d: expected %s %d %d, got %s %d %d", i,
+				e.Prefix, e.Metrics, e.Bytes, b.Prefix, b.Metrics, b.Bytes)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeHistogram(buf, buckets[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "app.db\t1\t400\napp.web\t2\t250\n" {
+		t.Errorf("Bad histogram output: %q", buf.String())
+	}
+}
@@ -61,7 +61,9 @@ func InconsistentMetrics(hostports []string) (map[string][]string, error) {
 				// is done.  They will never be consistent and shouldn't be.
 				continue
 			}
-			if Cluster.Hash.GetNode(m).Server != host {
+			// Nodes with an instance port are HOST:PORT
+			owner := Cluster.NodeHostPort(Cluster.Hash.GetNode(m))
+			if owner != host && owner != server {
 				results[server] = append(results[server], m)
 			}
 		}
@@ -85,7 +87,7 @@ func inconsistentCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	if !Cluster.Healthy {
@@ -109,7 +111,7 @@ func inconsistentCommand(c Command) int {
 	}
 
 	if err != nil {
-		return 1
+		return ExitError
 	}
-	return 0
+	return ExitOK
 }
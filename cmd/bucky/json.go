@@ -37,7 +37,8 @@ func jsonCommand(c Command) int {
 	var list string
 	var err error
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+		log.Print("At least one argument is required.")
+		return ExitUsage
 	} else if c.Flag.Arg(0) != "-" {
 		list, err = JSONSliceMetrics(c.Flag.Args())
 	} else {
@@ -55,10 +56,10 @@ func jsonCommand(c Command) int {
 	}
 
 	if err != nil {
-		return 1
+		return ExitError
 	}
 
 	fmt.Println(list)
 
-	return 0
+	return ExitOK
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,6 +20,7 @@ import (
 var listRegexMode bool
 var listForce bool
 var listLocation bool
+var listNamesOnly bool
 
 // metricListRequest defines the parameters for the /metrics API call to a
 // remote bucky daemon.
@@ -62,13 +64,25 @@ output.
 
 With -l we list the server that the metric resides on.  This is the
 actual location of the metric and not the location computed by the
-consistent hash ring.  Combined with -j the JSON output will be a hash.`
+consistent hash ring.  Combined with -j the JSON output will be a hash.
+
+Use -only-server to list only the metrics a server owns in the hash ring.
+With -only-location the metrics physically stored on that server are listed
+instead.
+
+Use -names-only to print a JSON array of the selected metric names sorted and
+with duplicates from replicas removed.  The array is the input the commands
+reading a JSON array from STDIN expect, such as "bucky delete -" or
+"bucky tar -".  Nothing is downloaded.  -names-only can not be combined with
+-l.`
 
 	c := NewCommand(listCommand, "list", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupRetry(c)
+	SetupOnlyServer(c)
 
 	c.Flag.BoolVar(&listRegexMode, "r", false,
 		"Filter by a regular expression.")
@@ -76,6 +90,8 @@ consistent hash ring.  Combined with -j the JSON output will be a hash.`
 		"Force the remote daemons to rebuild their cache.")
 	c.Flag.BoolVar(&listLocation, "l", false,
 		"List the metric's real relocation.")
+	c.Flag.BoolVar(&listNamesOnly, "names-only", false,
+		"Print a sorted, de-duplicated JSON array of names for other commands' STDIN.")
 }
 
 // getMetricCache accepts a url.URL and body  that defines a request to
@@ -134,9 +150,9 @@ func HTTPFetch(u url.URL, body *string) (*http.Response, error) {
 		var r *http.Request
 		var err error
 		if body == nil {
-			r, err = http.NewRequest(method, u.String(), nil)
+			r, err = NewRequest(method, u.String(), nil)
 		} else {
-			r, err = http.NewRequest(method, u.String(), rc)
+			r, err = NewRequest(method, u.String(), rc)
 		}
 		if method == "POST" {
 			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
@@ -178,7 +194,12 @@ func multiplexListRequests(r []metricListRequest) (map[string][]string, error) {
 
 	for _, v := range r {
 		go func(req metricListRequest) {
-			metrics, err := getMetricCache(req.url, req.body)
+			var metrics map[string][]string
+			err := withRetry(context.Background(), "inventory of "+req.url.Host,
+				func() (err error) {
+					metrics, err = getMetricCache(req.url, req.body)
+					return err
+				})
 			if err == nil {
 				// Errors reported by getMetricsCache
 				comms <- metrics
@@ -215,7 +236,7 @@ func ListAllMetrics(servers []string, force bool) (map[string][]string, error) {
 
 	for _, buckyd := range servers {
 		u := url.URL{
-			Scheme: "http",
+			Scheme: buckyScheme(),
 			Host:   buckyd,
 			Path:   "/metrics",
 		}
@@ -238,7 +259,7 @@ func ListRegexMetrics(servers []string, regex string, force bool) (map[string][]
 
 	for _, buckyd := range servers {
 		u := url.URL{
-			Scheme: "http",
+			Scheme: buckyScheme(),
 			Host:   buckyd,
 			Path:   "/metrics",
 		}
@@ -263,7 +284,7 @@ func ListSliceMetrics(servers []string, metrics []string, force bool) (map[strin
 
 	for _, buckyd := range servers {
 		u := url.URL{
-			Scheme: "http",
+			Scheme: buckyScheme(),
 			Host:   buckyd,
 			Path:   "/metrics",
 		}
@@ -289,19 +310,112 @@ func ListSliceMetrics(servers []string, metrics []string, force bool) (map[strin
 // io.Reader interface which points to a data source containing a JSON
 // array.  Results are returned in a map of server => metrics.
 func ListJSONMetrics(servers []string, fd io.Reader, force bool) (map[string][]string, error) {
+	metrics, err := ReadJSONMetrics(fd)
+	if err != nil {
+		return nil, err
+	}
+
+	return ListSliceMetrics(servers, metrics, force)
+}
+
+// ReadJSONMetrics reads a JSON array of metric names from fd as given to
+// the commands that read their metrics from STDIN.  Elements may also be
+// the objects read by ReadAnnotatedMetrics.
+func ReadJSONMetrics(fd io.Reader) ([]string, error) {
+	metrics, _, err := ReadAnnotatedMetrics(fd)
+	return metrics, err
+}
+
+// jsonMetric is an annotated metric in a JSON array of metrics.  Retries
+// overrides -retries for the metric.
+type jsonMetric struct {
+	Name    string
+	Retries *int
+}
+
+// ReadAnnotatedMetrics reads a JSON array from fd whose elements are either
+// metric names or objects such as {"name": "foo.bar", "retries": 10}.  The
+// metric names are returned along with a map of metric => retries for the
+// metrics that override the number of retries.
+func ReadAnnotatedMetrics(fd io.Reader) ([]string, map[string]int, error) {
 	// Read the JSON from the file-like object
 	blob, err := ioutil.ReadAll(fd)
-	metrics := make([]string, 0)
+	if err != nil {
+		log.Printf("Error reading JSON data: %s", err)
+		return nil, nil, err
+	}
+	elements := make([]json.RawMessage, 0)
 
-	err = json.Unmarshal(blob, &metrics)
 	// We could just package this up and query the server, but lets check the
 	// JSON is valid first.
+	err = json.Unmarshal(blob, &elements)
 	if err != nil {
 		log.Printf("Error unmarshalling JSON data: %s", err)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return ListSliceMetrics(servers, metrics, force)
+	metrics := make([]string, 0, len(elements))
+	retries := make(map[string]int)
+	for _, e := range elements {
+		var name string
+		if err := json.Unmarshal(e, &name); err == nil {
+			metrics = append(metrics, name)
+			continue
+		}
+		var m jsonMetric
+		err := json.Unmarshal(e, &m)
+		if err == nil && m.Name == "" {
+			err = fmt.Errorf("metric object has no name: %s", e)
+		}
+		if err == nil && m.Retries != nil && *m.Retries < 0 {
+			err = fmt.Errorf("negative retries for %s", m.Name)
+		}
+		if err != nil {
+			log.Printf("Error unmarshalling JSON data: %s", err)
+			return nil, nil, err
+		}
+		metrics = append(metrics, m.Name)
+		if m.Retries != nil {
+			retries[m.Name] = *m.Retries
+		}
+	}
+	return metrics, retries, nil
+}
+
+// MetricNames returns the sorted and de-duplicated names of the metrics in
+// a map of server => metrics.
+func MetricNames(list map[string][]string) []string {
+	names := make([]string, 0)
+	for _, v := range list {
+		names = append(names, v...)
+	}
+	sort.Strings(names)
+	return uniqSorted(names)
+}
+
+// ListSelection inventories the given servers for the metrics selected
+// by the command line arguments of c.  No arguments selects every metric,
+// -r treats the first argument as a regular expression, and a first
+// argument of "-" reads a JSON array from STDIN.
+func ListSelection(c Command, servers []string) (map[string][]string, error) {
+	if c.Flag.NArg() == 0 {
+		return ListAllMetrics(servers, listForce)
+	} else if listRegexMode {
+		return ListRegexMetrics(servers, c.Flag.Arg(0), listForce)
+	} else if c.Flag.Arg(0) != "-" {
+		return ListSliceMetrics(servers, c.Flag.Args(), listForce)
+	}
+	return ListJSONMetrics(servers, os.Stdin, listForce)
+}
+
+// writeNames writes names to w as a JSON array.
+func writeNames(w io.Writer, names []string) error {
+	blob, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(blob, '\n'))
+	return err
 }
 
 // listCommand runs this subcommand.
@@ -309,18 +423,27 @@ func listCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
-	var list map[string][]string
-	if c.Flag.NArg() == 0 {
-		list, err = ListAllMetrics(Cluster.HostPorts(), listForce)
-	} else if listRegexMode && c.Flag.NArg() > 0 {
-		list, err = ListRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
-	} else if c.Flag.Arg(0) != "-" {
-		list, err = ListSliceMetrics(Cluster.HostPorts(), c.Flag.Args(), listForce)
-	} else {
-		list, err = ListJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce)
+	if listNamesOnly && listLocation {
+		log.Print("The -names-only and -l options can not be combined.")
+		return ExitUsage
+	}
+
+	warnMaintenance(Cluster.HostPorts())
+	list, err := ListSelection(c, Cluster.HostPorts())
+	list = applyOnlyServer(list)
+
+	if listNamesOnly {
+		if err != nil {
+			return ExitError
+		}
+		if err = writeNames(os.Stdout, MetricNames(list)); err != nil {
+			log.Printf("Error writing names: %s", err)
+			return ExitError
+		}
+		return ExitOK
 	}
 
 	results := make([]string, 0)
@@ -366,7 +489,7 @@ func listCommand(c Command) int {
 	}
 
 	if err != nil {
-		return 1
+		return ExitError
 	}
-	return 0
+	return ExitOK
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMetricNamesRoundTrip(t *testing.T) {
+	list := map[string][]string{
+		"graphite1:4242": []string{"foo.b", "foo.a", "foo.c"},
+		"graphite2:4242": []string{"foo.c", "foo.a", "bar.z"},
+	}
+	names := MetricNames(list)
+	if strings.Join(names, ",") != "bar.z,foo.a,foo.b,foo.c" {
+		t.Errorf("Names not sorted and de-duplicated: %v", names)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := writeNames(buf, names); err != nil {
+		t.Fatalf("Error writing names: %s", err)
+	}
+	read, err := ReadJSONMetrics(buf)
+	if err != nil {
+		t.Fatalf("Names did not parse as JSON metrics: %s", err)
+	}
+	if strings.Join(read, ",") != strings.Join(names, ",") {
+		t.Errorf("Round trip changed names: %v => %v", names, read)
+	}
+
+	// An empty selection is an empty array rather than null
+	buf.Reset()
+	writeNames(buf, MetricNames(map[string][]string{}))
+	if buf.String() != "[]\n" {
+		t.Errorf("Empty selection wrote %q", buf.String())
+	}
+}
+
+func TestReadAnnotatedMetrics(t *testing.T) {
+	in := `["foo.a", {"name": "foo.b", "retries": 10}, {"name": "foo.c"}, {"Name": "foo.d", "Retries": 0}]`
+	metrics, retries, err := ReadAnnotatedMetrics(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("Error reading annotated metrics: %s", err)
+	}
+	if strings.Join(metrics, ",") != "foo.a,foo.b,foo.c,foo.d" {
+		t.Errorf("Bad metrics: %v", metrics)
+	}
+	if len(retries) != 2 || retries["foo.b"] != 10 || retries["foo.d"] != 0 {
+		t.Errorf("Bad retry overrides: %v", retries)
+	}
+
+	// Plain string arrays keep working everywhere
+	metrics, err = ReadJSONMetrics(strings.NewReader(`["foo.a", "foo.b"]`))
+	if err != nil || strings.Join(metrics, ",") != "foo.a,foo.b" {
+		t.Errorf("Plain array read as %v, %v", metrics, err)
+	}
+
+	for _, bad := range []string{
+		`{"name": "foo.a"}`,
+		`[{"retries": 3}]`,
+		`[{"name": "foo.a", "retries": -1}]`,
+		`[42]`,
+	} {
+		if _, _, err := ReadAnnotatedMetrics(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected an error reading %s", bad)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var listServersFile string
+var listServersAlgo string
+var listServersReplicas int
+var listServersCheck bool
+
+func init() {
+	usage := "[options]"
+	short := "Print the cluster nodes as bucky resolves them."
+	long := `Print each node of the hash ring as bucky resolves it from the command
+line, environment, and configuration files, one per line.  Use this to
+catch misconfiguration before running other commands.  Each line shows the
+URL of the node's buckyd daemon, taking -instance-port into account, the
+carbon instance, and the carbon port.  The hash algorithm, replica count,
+placement, and key transformation in effect are printed first.  Use -j for
+JSON output.
+
+The nodes are read from the file given by -servers, one HOST[:PORT][=INSTANCE]
+per line with the algorithm and replica count given by -algo and -replicas,
+or from the carbon-c-relay configuration given by -relay-config.  No network
+calls are made in either case.  Otherwise the hash ring is requested from the
+buckyd daemon given by -h, which is the only call made.  Unlike the servers
+command the other members are not contacted and their hash rings are not
+compared.
+
+Use -check to also request the hash ring from each buckyd daemon and report
+whether it answered.  Exits 2 if some daemons did not answer and 3 if none
+did.`
+
+	c := NewCommand(listServersCommand, "list-servers", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupJSON(c)
+
+	c.Flag.StringVar(&listServersFile, "servers", "",
+		"Read the nodes from this file rather than the cluster.")
+	c.Flag.StringVar(&listServersAlgo, "algo", "carbon",
+		"Hash ring algorithm used with -servers.")
+	c.Flag.IntVar(&listServersReplicas, "replicas", 1,
+		"Replica count used with -servers.")
+	c.Flag.BoolVar(&listServersCheck, "check", false,
+		"Request the hash ring from each buckyd daemon to check it is up.")
+}
+
+// ResolvedNode is a node of the hash ring and the buckyd daemon serving it.
+type ResolvedNode struct {
+	Scheme     string
+	Server     string
+	Port       string
+	Instance   string
+	CarbonPort int
+	Status     string `json:",omitempty"`
+}
+
+// URL returns the base URL of the node's buckyd daemon.
+func (n ResolvedNode) URL() string {
+	return fmt.Sprintf("%s://%s", n.Scheme, net.JoinHostPort(n.Server, n.Port))
+}
+
+// ResolvedCluster is the cluster configuration bucky resolved.
+type ResolvedCluster struct {
+	Algo         string
+	Replicas     int
+	Placement    string
+	KeyTransform string
+	Diverse      bool
+	Nodes        []ResolvedNode
+}
+
+// resolveRing returns the hash ring configuration from -servers,
+// -relay-config, or the buckyd daemon at server in that order.
+func resolveRing(server string) (*hashing.JSONRingType, error) {
+	switch {
+	case listServersFile != "":
+		nodes, err := readServersFile(listServersFile)
+		if err != nil {
+			return nil, err
+		}
+		return &hashing.JSONRingType{
+			Algo:     listServersAlgo,
+			Replicas: listServersReplicas,
+			Nodes:    nodes,
+		}, nil
+	case RelayConfig != "":
+		return GetRelayRing(RelayConfig, RelayCluster)
+	}
+	return GetSingleHashRing(server)
+}
+
+// ResolveCluster describes the nodes of ring and the buckyd daemons that
+// serve them.  Daemons listen on port unless their instance is mapped in
+// instancePorts.
+func ResolveCluster(ring *hashing.JSONRingType, port string, instancePorts map[string]string) *ResolvedCluster {
+	rc := &ResolvedCluster{
+		Algo:         ring.Algo,
+		Replicas:     ring.Replicas,
+		Placement:    PlacementStrategy,
+		KeyTransform: KeyTransform,
+		Diverse:      DiverseReplicas,
+	}
+	for _, n := range ring.Nodes {
+		p, ok := instancePorts[n.Instance]
+		if !ok || n.Instance == "" {
+			p = port
+		}
+		rc.Nodes = append(rc.Nodes, ResolvedNode{
+			Scheme:     buckyScheme(),
+			Server:     n.Server,
+			Port:       p,
+			Instance:   n.Instance,
+			CarbonPort: n.Port,
+		})
+	}
+	return rc
+}
+
+// checkNodes requests the hash ring from each distinct buckyd daemon of
+// rc, records the result in each node's Status, and returns the number of
+// daemons that answered and did not.
+func checkNodes(rc *ResolvedCluster) (int, int) {
+	status := make(map[string]string)
+	up, down := 0, 0
+	for i, n := range rc.Nodes {
+		hostport := net.JoinHostPort(n.Server, n.Port)
+		if _, ok := status[hostport]; !ok {
+			if _, err := GetSingleHashRing(hostport); err != nil {
+				status[hostport] = err.Error()
+				down++
+			} else {
+				status[hostport] = "ok"
+				up++
+			}
+		}
+		rc.Nodes[i].Status = status[hostport]
+	}
+	return up, down
+}
+
+// printResolvedCluster writes a human readable form of rc to STDOUT.
+func printResolvedCluster(rc *ResolvedCluster) {
+	fmt.Printf("Hashing algorithm: %s\n", rc.Algo)
+	fmt.Printf("Number of replicas: %d\n", rc.Replicas)
+	fmt.Printf("Placement: %s\n", rc.Placement)
+	fmt.Printf("Key transformation: %s\n", rc.KeyTransform)
+	fmt.Printf("Diverse replicas: %v\n", rc.Diverse)
+	fmt.Printf("Nodes:\n")
+	for _, n := range rc.Nodes {
+		instance := n.Instance
+		if instance == "" {
+			instance = "None"
+		}
+		carbon := "-"
+		if n.CarbonPort != 0 {
+			carbon = strconv.Itoa(n.CarbonPort)
+		}
+		fmt.Printf("\t%s\tinstance=%s\tcarbon_port=%s", n.URL(), instance, carbon)
+		if n.Status != "" {
+			fmt.Printf("\t%s", n.Status)
+		}
+		fmt.Printf("\n")
+	}
+}
+
+// listServersCommand runs this subcommand.
+func listServersCommand(c Command) int {
+	server, err := singleServer(HostPort)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return ExitUsage
+	}
+	_, port, _ := net.SplitHostPort(server)
+	instancePorts, err := ParseInstancePorts(InstancePortMap)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+	ring, err := resolveRing(server)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+
+	rc := ResolveCluster(ring, port, instancePorts)
+	up, down := 0, 0
+	if listServersCheck {
+		up, down = checkNodes(rc)
+	}
+
+	if JSONOutput {
+		blob, err := json.Marshal(rc)
+		if err != nil {
+			log.Printf("%s", err)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		printResolvedCluster(rc)
+	}
+
+	switch {
+	case down == 0:
+		return ExitOK
+	case up == 0:
+		return ExitFailed
+	}
+	return ExitPartial
+}
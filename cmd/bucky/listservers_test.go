@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func TestResolveCluster(t *testing.T) {
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: 2, Nodes: []hashing.Node{
+		hashing.NewNode("graphite1", 2004, "a"),
+		hashing.NewNode("graphite1", 2104, "b"),
+		hashing.NewNode("graphite2", 0, ""),
+	}}
+	rc := ResolveCluster(ring, "4242", map[string]string{"b": "4343"})
+	if rc.Algo != "carbon" || rc.Replicas != 2 {
+		t.Errorf("Bad ring settings: %+v", rc)
+	}
+
+	expected := []string{
+		"http://graphite1:4242",
+		"http://graphite1:4343",
+		"http://graphite2:4242",
+	}
+	if len(rc.Nodes) != len(expected) {
+		t.Fatalf("Expected %d nodes, got %+v", len(expected), rc.Nodes)
+	}
+	for i, n := range rc.Nodes {
+		if n.URL() != expected[i] {
+			t.Errorf("Node %d: expected %s, got %s", i, expected[i], n.URL())
+		}
+		if n.Instance != ring.Nodes[i].Instance || n.CarbonPort != ring.Nodes[i].Port {
+			t.Errorf("Node %d does not match the ring: %+v", i, n)
+		}
+	}
+}
+
+func TestCheckNodes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, _ := json.Marshal(ringFor(1, "127.0.0.1"))
+		w.Write(blob)
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// Nothing listens on the port of a closed server
+	closed := httptest.NewServer(http.NotFoundHandler())
+	_, closedPort, _ := net.SplitHostPort(closed.Listener.Addr().String())
+	closed.Close()
+
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: 1, Nodes: []hashing.Node{
+		hashing.NewNode("127.0.0.1", 0, "a"),
+		hashing.NewNode("127.0.0.1", 0, "b"),
+		hashing.NewNode("127.0.0.1", 0, "c"),
+	}}
+	rc := ResolveCluster(ring, port, map[string]string{"c": closedPort})
+	up, down := checkNodes(rc)
+	if up != 1 || down != 1 {
+		t.Errorf("Expected 1 daemon up and 1 down, got %d up %d down", up, down)
+	}
+	if rc.Nodes[0].Status != "ok" || rc.Nodes[1].Status != "ok" || rc.Nodes[2].Status == "ok" {
+		t.Errorf("Bad node status: %+v", rc.Nodes)
+	}
+}
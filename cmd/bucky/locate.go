@@ -23,29 +23,32 @@ produce a JSON map/hash on STDOUT of metric => host.
 
 Use -s to query the hash ring only on the host given by -h or in the BUCKYHOST
 environment variable.  Without -s, we verify the health of the cluster before
-calculating metric locations.`
+calculating metric locations.
+
+Use -ring-replicas to place each node that many times on the carbon or
+fnv1a ring instead of carbon's 100 to model how a different count changes
+placement.  Results only match where carbon routes metrics when it is the
+count carbon uses.`
 
 	c := NewCommand(locateCommand, "locate", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupRingReplicas(c)
+	SetupRingCache(c)
 }
 
 // LocateSliceMetrics takes a slice of metric ken names and derives the location
 // of each metric in the cluster by using the consistent hash algorithm.  It
 // returns a map of metric => server.
 func LocateSliceMetrics(metrics []string) map[string]string {
-	if !Cluster.Healthy {
-		log.Fatal("Cluster is inconsistent. Use the servers command to investigate.")
-	}
-
 	result := make(map[string]string)
 	spread := make(map[string]int)
 	for _, key := range metrics {
-		// XXX: we toss away instance info here due to our assumption that a
-		// graphite node has one whisper db store
-		result[key] = Cluster.Hash.GetNode(key).Server
+		// Instance info is only kept when -instance-port maps the
+		// instance to its own buckyd daemon
+		result[key] = Cluster.NodeHostPort(Cluster.Hash.GetNode(key))
 		spread[result[key]]++
 	}
 
@@ -71,15 +74,24 @@ func LocateJSONMetrics(fd io.Reader) map[string]string {
 
 // locateCommand runs this subcommand.
 func locateCommand(c Command) int {
+	if !checkRingReplicas() {
+		return ExitUsage
+	}
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
+	}
+
+	if !Cluster.Healthy {
+		log.Print("Cluster is inconsistent. Use the servers command to investigate.")
+		return ExitUsage
 	}
 
 	var list map[string]string
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+		log.Print("At least one argument is required.")
+		return ExitUsage
 	} else if c.Flag.Arg(0) != "-" {
 		list = LocateSliceMetrics(c.Flag.Args())
 	} else {
@@ -100,5 +112,5 @@ func locateCommand(c Command) int {
 		}
 	}
 
-	return 0
+	return ExitOK
 }
@@ -3,13 +3,14 @@ package main
 import (
 	"flag"
 	"fmt"
-	//"log"
+	"log"
 	"os"
 	"sort"
 	"strings"
 )
 
 import . "github.com/jjneely/buckytools"
+import . "github.com/jjneely/buckytools/metrics"
 
 // We use STDIN and STDOUT as much as possible for handing lists, and
 // other data.  Status, errors, and other data not related to pushing
@@ -66,7 +67,8 @@ func NewCommand(run func(c Command) int, name, usage, short, long string) Comman
 	c.Long = long
 	c.Run = run
 
-	c.Flag = flag.NewFlagSet(name, flag.ExitOnError)
+	// Parse errors are reported by main() with ExitUsage
+	c.Flag = flag.NewFlagSet(name, flag.ContinueOnError)
 	commands = append(commands, c)
 	return c
 }
@@ -91,16 +93,51 @@ func usage() {
 func main() {
 	if len(os.Args) < 2 {
 		usage()
-		os.Exit(1)
+		os.Exit(ExitUsage)
 	}
 
 	sort.Sort(commands)
 	for _, c := range commands {
 		if c.Name == os.Args[1] {
-			c.Flag.Parse(os.Args[2:])
-			os.Exit(c.Run(c))
+			err := c.Flag.Parse(os.Args[2:])
+			if err == flag.ErrHelp {
+				os.Exit(ExitOK)
+			} else if err != nil {
+				os.Exit(ExitUsage)
+			}
+			if ErrorJSON {
+				captureLog(os.Stderr)
+			}
+			if ChecksumAlgo != "" {
+				if _, err := NewChecksum(ChecksumAlgo); err != nil {
+					log.Print(err)
+					exit(ExitUsage)
+				}
+			}
+			if err := ConfigureTLS(); err != nil {
+				log.Print(err)
+				exit(ExitUsage)
+			}
+			if err := LoadCredentials(); err != nil {
+				log.Print(err)
+				exit(ExitUsage)
+			}
+			if UserAgent == "" {
+				UserAgent = fmt.Sprintf("buckytools/%s %s", Version, c.Name)
+			}
+			exit(runCommand(c))
 		}
 	}
 
 	usage()
+	os.Exit(ExitUsage)
+}
+
+// exit ends bucky with the exit code of the subcommand, reporting its
+// failure as JSON first with -error-json.
+func exit(code int) {
+	if ErrorJSON && code != ExitOK {
+		WriteCommandError(os.Stderr, NewCommandError(code))
+	}
+	os.Exit(code)
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// NodeStatus is the JSON encoded response of a buckyd daemon's /status
+// endpoint.
+type NodeStatus struct {
+	Name        string
+	Maintenance bool
+}
+
+// GetNodeStatus retrieves the status of the buckyd daemon at the given
+// HOST:PORT.  Daemons too old to have a /status endpoint are reported as
+// not in maintenance.
+func GetNodeStatus(server string) (*NodeStatus, error) {
+	var err error
+	httpClient := GetHTTP()
+	u := &url.URL{
+		Scheme: buckyScheme(),
+		Path:   "/status",
+	}
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	status := new(NodeStatus)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return status, nil
+	default:
+		return nil, fmt.Errorf("Fetching status returned: %s", resp.Status)
+	}
+
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(blob, status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// MaintenanceNodes returns the servers, given as HOST:PORT, that are in
+// read-only maintenance.  An error is returned if the status of any
+// server could not be determined.
+func MaintenanceNodes(servers []string) ([]string, error) {
+	var errors error
+	nodes := make([]string, 0)
+	for _, server := range servers {
+		status, err := GetNodeStatus(server)
+		if err != nil {
+			log.Printf("Error fetching status of %s: %s", server, err)
+			errors = err
+			continue
+		}
+		if status.Maintenance {
+			nodes = append(nodes, server)
+		}
+	}
+	return nodes, errors
+}
+
+// checkWritable returns true if none of the given servers are in read-only
+// maintenance.  Commands that alter metrics should abort otherwise.
+func checkWritable(servers []string) bool {
+	nodes, err := MaintenanceNodes(servers)
+	if err != nil {
+		log.Printf("Abort: Unable to verify the maintenance state of the cluster.")
+		return false
+	}
+	for _, node := range nodes {
+		log.Printf("Abort: %s is in read-only maintenance.", node)
+	}
+	return len(nodes) == 0
+}
+
+// warnMaintenance logs a warning for each of the given servers that is in
+// read-only maintenance.  Read only commands may proceed.
+func warnMaintenance(servers []string) {
+	nodes, _ := MaintenanceNodes(servers)
+	for _, node := range nodes {
+		log.Printf("Warning: %s is in read-only maintenance.", node)
+	}
+}
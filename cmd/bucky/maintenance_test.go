@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func statusServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if body == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestMaintenanceNodes(t *testing.T) {
+	maint := statusServer(`{"Name":"graphite010","Maintenance":true}`)
+	defer maint.Close()
+	ok := statusServer(`{"Name":"graphite011","Maintenance":false}`)
+	defer ok.Close()
+	old := statusServer("")
+	defer old.Close()
+
+	servers := []string{
+		strings.TrimPrefix(maint.URL, "http://"),
+		strings.TrimPrefix(ok.URL, "http://"),
+		strings.TrimPrefix(old.URL, "http://"),
+	}
+	nodes, err := MaintenanceNodes(servers)
+	if err != nil {
+		t.Fatalf("Error fetching status: %s", err)
+	}
+	if len(nodes) != 1 || nodes[0] != servers[0] {
+		t.Errorf("Expected %s in maintenance, got %v", servers[0], nodes)
+	}
+
+	if checkWritable(servers) {
+		t.Errorf("Cluster with a node in maintenance reported writable")
+	}
+	if !checkWritable(servers[1:]) {
+		t.Errorf("Cluster without maintenance reported read-only")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// tarMetadata archives the metadata sidecar of each metric with -include-metadata.
+var tarMetadata bool
+
+// metadataURL returns the URL of the metadata sidecar of metric on the
+// buckyd daemon at server.
+func metadataURL(server, metric string) (string, error) {
+	var err error
+	u := &url.URL{
+		Scheme: buckyScheme(),
+		Path:   "/metadata/" + metric,
+	}
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// GetMetadata retrieves the metadata sidecar kept next to the given metric
+// on server.  A metric without a sidecar, or a buckyd daemon too old to
+// serve them, returns nil data and no error.
+func GetMetadata(ctx context.Context, server, metric string) ([]byte, error) {
+	u, err := metadataURL(server, metric)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewRequest("GET", u, nil)
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return nil, err
+	}
+
+	resp, err := GetHTTP().Do(r.WithContext(ctx))
+	if err != nil {
+		log.Printf("Error downloading metadata: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		log.Printf("Error: Fetching metadata [%s]:%s returned status code: %d",
+			server, metric, resp.StatusCode)
+		return nil, &StatusError{resp.StatusCode, resp.Status}
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// PutMetadata replaces the metadata sidecar of the given metric on server.
+func PutMetadata(server, metric string, data []byte) error {
+	u, err := metadataURL(server, metric)
+	if err != nil {
+		return err
+	}
+	r, err := NewRequest("PUT", u, bytes.NewReader(data))
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return err
+	}
+	r.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		log.Printf("Error communicating with server: %s", err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("Error reported by server: %s for metadata of %s",
+			resp.Status, metric)
+		log.Printf("%s", msg)
+		return fmt.Errorf("%s", msg)
+	}
+	return nil
+}
+
+// metadataEntryName returns the archive entry name of the metadata sidecar
+// of the metric archived as name.
+func metadataEntryName(name string) string {
+	return name + MetadataSuffix
+}
+
+// isMetadataEntry returns true if the archive entry name is the metadata
+// sidecar of a metric rather than a Whisper DB.
+func isMetadataEntry(name string) bool {
+	return strings.HasSuffix(name, ".wsp"+MetadataSuffix)
+}
+
+// metadataHeader returns the archive header of the metadata sidecar of
+// size bytes belonging to the metric described by th.
+func metadataHeader(th *tar.Header, size int) *tar.Header {
+	return &tar.Header{
+		Name:    metadataEntryName(th.Name),
+		Size:    int64(size),
+		Mode:    th.Mode,
+		ModTime: th.ModTime,
+		Uid:     th.Uid,
+		Gid:     th.Gid,
+		Uname:   th.Uname,
+		Gname:   th.Gname,
+	}
+}
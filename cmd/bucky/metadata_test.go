@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestTarRestoreMetadata(t *testing.T) {
+	// foo.bar has a sidecar and foo.baz does not
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/metadata/") {
+			if r.URL.Path != "/metadata/foo.bar" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte("tags"))
+			return
+		}
+		data := []byte("whisper data")
+		stat, _ := json.Marshal(&metrics.MetricData{
+			Name: strings.TrimPrefix(r.URL.Path, "/metrics/"),
+			Size: int64(len(data)),
+			Mode: 0644,
+		})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write(data)
+	}))
+	defer source.Close()
+
+	fd, err := ioutil.TempFile("", "metadata_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	resetTarState()
+	Cluster = nil
+	metricWorkers = 1
+	tarMetadata = true
+	defer func() { tarMetadata = false }()
+	metricMap := map[string][]string{
+		strings.TrimPrefix(source.URL, "http://"): []string{"foo.bar", "foo.baz"},
+	}
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{fd}); err != nil {
+		t.Fatalf("Error building archive: %s", err)
+	}
+
+	fd.Seek(0, 0)
+	tr := tar.NewReader(fd)
+	names := make([]string, 0)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		names = append(names, th.Name)
+		if th.Name == "foo/bar.wsp.meta" {
+			blob, _ := ioutil.ReadAll(tr)
+			if string(blob) != "tags" {
+				t.Errorf("Expected sidecar data tags, got %q", blob)
+			}
+		}
+	}
+	if strings.Join(names, ",") != "foo/bar.wsp,foo/bar.wsp.meta,foo/baz.wsp" {
+		t.Errorf("Unexpected archive contents: %v", names)
+	}
+	if archiveFiles != 2 {
+		t.Errorf("Expected 2 metrics archived, got %d", archiveFiles)
+	}
+
+	// Restore uploads the sidecar with its metric
+	var lock sync.Mutex
+	uploads := make([]string, 0)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		uploads = append(uploads, r.Method+" "+r.URL.Path)
+		lock.Unlock()
+		if r.URL.Path == "/metadata/foo.bar" && string(blob) != "tags" {
+			t.Errorf("Expected sidecar data tags, got %q", blob)
+		}
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	defer func() { Cluster = nil }()
+	workerFailed = 0
+
+	fd.Seek(0, 0)
+	if err := RestoreTar(Cluster.HostPorts(), fd); err != nil {
+		t.Fatalf("Restore failed: %s", err)
+	}
+	expected := "POST /metrics/foo.bar,PUT /metadata/foo.bar,POST /metrics/foo.baz"
+	if strings.Join(uploads, ",") != expected {
+		t.Errorf("Expected uploads %s, got %v", expected, uploads)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io"
+	"log"
+)
+
+// tarMetadataOnly writes a catalog of the selected metrics' stats rather
+// than an archive of their data with -metadata-only.
+var tarMetadataOnly bool
+
+// writeMetadataCatalog stats the sorted metrics on the first server
+// serversFor returns for each, in batches, and writes a StatRecord for
+// each metric found to w as newline delimited JSON.  Nothing is
+// downloaded.  Metrics that are not found are failures.
+func writeMetadataCatalog(w io.Writer, sorted []string, serversFor func(string) []string) error {
+	catalog := NewStatStream(w, "")
+	metricMap := make(map[string][]string)
+	for _, m := range sorted {
+		server := serversFor(m)[0]
+		metricMap[server] = append(metricMap[server], m)
+		catalog.Downloaded(m, server)
+	}
+
+	statBatches(metricMap, catalog.Archived)
+	if err := catalog.Err(); err != nil {
+		return err
+	}
+	log.Printf("Catalog complete: %d of %d metrics.", catalog.Records(), len(sorted))
+	return nil
+}
+
+// checkMetadataOnly returns true if the options given can be used with
+// -metadata-only, logging why if not.
+func checkMetadataOnly() bool {
+	if !tarMetadataOnly {
+		return true
+	}
+	if tarGzip || splitting() || tarChecksum != "" || tarSecondaryOutput != "" ||
+		tarMetadata || tarCompress || tarVerify || tarPipeThrough != "" ||
+		tarStatStream != "" || tarTotals {
+		log.Printf("The -metadata-only option can not be used with -z, -split-size, -split-count, " +
+			"-archive-checksum, -secondary, -include-metadata, -compress, -verify, " +
+			"-pipe-through, -stat-stream, or -totals.")
+		return false
+	}
+	if tarChangedSinceFile != "" {
+		// Moving the marker would skip the changes in the next backup
+		log.Printf("The -metadata-only option can not be used with -changed-since-file " +
+			"as it archives no data.")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestWriteMetadataCatalog(t *testing.T) {
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stat" {
+			downloads++
+			http.NotFound(w, r)
+			return
+		}
+		list := make([]string, 0)
+		json.Unmarshal([]byte(r.FormValue("list")), &list)
+		stats := make([]*metrics.MetricData, 0)
+		for _, m := range list {
+			if !strings.HasPrefix(m, "missing.") {
+				stats = append(stats, &metrics.MetricData{Name: m, Size: 4096,
+					Mode: 0644, ModTime: 1500000000})
+			}
+		}
+		blob, _ := json.Marshal(stats)
+		w.Write(blob)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	resetTarState()
+	defer resetTarState()
+	metricWorkers = 2
+	buf := new(bytes.Buffer)
+	err := writeMetadataCatalog(buf, []string{"foo.a", "foo.b", "missing.c"},
+		func(string) []string { return []string{host} })
+	if err != nil {
+		t.Fatalf("Error writing catalog: %s", err)
+	}
+	if downloads != 0 {
+		t.Errorf("Expected no downloads, got %d", downloads)
+	}
+
+	records := make(map[string]*StatRecord)
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		record := new(StatRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatalf("Bad record %q: %s", scanner.Text(), err)
+		}
+		records[record.Name] = record
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 records, got %d", len(records))
+	}
+	if r := records["foo.a"]; r == nil || r.Server != host || r.Size != 4096 || r.ModTime != 1500000000 {
+		t.Errorf("Bad record for foo.a: %+v", r)
+	}
+	if workerSucceeded != 2 || workerFailed != 1 {
+		t.Errorf("Expected 2 found and 1 failed, got %d and %d", workerSucceeded, workerFailed)
+	}
+}
+
+func TestCheckMetadataOnly(t *testing.T) {
+	tarMetadataOnly = true
+	defer func() {
+		tarMetadataOnly, tarVerify, tarTotals = false, false, false
+		tarChangedSinceFile, tarPipeThrough, tarStatStream = "", "", ""
+	}()
+	if !checkMetadataOnly() {
+		t.Errorf("Expected -metadata-only alone to be accepted")
+	}
+
+	conflicts := map[string]func(){
+		"-verify":             func() { tarVerify = true },
+		"-totals":             func() { tarTotals = true },
+		"-changed-since-file": func() { tarChangedSinceFile = "marker" },
+		"-pipe-through":       func() { tarPipeThrough = "cat" },
+		"-stat-stream":        func() { tarStatStream = "stats.json" },
+	}
+	for flag, set := range conflicts {
+		tarVerify, tarTotals = false, false
+		tarChangedSinceFile, tarPipeThrough, tarStatStream = "", "", ""
+		set()
+		if checkMetadataOnly() {
+			t.Errorf("Expected %s to be refused with -metadata-only", flag)
+		}
+	}
+}
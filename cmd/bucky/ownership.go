@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tarOwner, tarGroup, and tarMode override the ownership and permissions
+// of the metrics in the archive.
+var tarOwner string
+var tarGroup string
+var tarMode string
+
+// tarOwnership is the parsed -owner, -group, and -mode overrides.
+var tarOwnership *Ownership
+
+// Ownership is a uniform owner, group, and mode applied to archive
+// entries in place of the values of the source files.  Nil fields and
+// empty names leave the source values as is.
+type Ownership struct {
+	Uid   *int
+	Gid   *int
+	Uname string
+	Gname string
+	Mode  *int64
+}
+
+// parseOwner parses a user or group given as NAME, ID, or NAME:ID as GNU
+// tar's --owner and --group do.
+func parseOwner(s string) (string, *int, error) {
+	if s == "" {
+		return "", nil, nil
+	}
+	name, id := s, ""
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		name, id = s[:i], s[i+1:]
+	} else if _, err := strconv.Atoi(s); err == nil {
+		name, id = "", s
+	}
+	if id == "" {
+		return name, nil, nil
+	}
+	n, err := strconv.Atoi(id)
+	if err != nil || n < 0 {
+		return "", nil, fmt.Errorf("Bad numeric ID in %q", s)
+	}
+	return name, &n, nil
+}
+
+// ParseOwnership parses the -owner, -group, and -mode options.  The mode
+// is given in octal.
+func ParseOwnership(owner, group, mode string) (*Ownership, error) {
+	o := new(Ownership)
+	var err error
+	if o.Uname, o.Uid, err = parseOwner(owner); err != nil {
+		return nil, fmt.Errorf("Bad owner: %s", err)
+	}
+	if o.Gname, o.Gid, err = parseOwner(group); err != nil {
+		return nil, fmt.Errorf("Bad group: %s", err)
+	}
+	if mode != "" {
+		m, err := strconv.ParseInt(mode, 8, 64)
+		if err != nil || m < 0 || m > 07777 {
+			return nil, fmt.Errorf("Bad mode: %q is not an octal file mode", mode)
+		}
+		o.Mode = &m
+	}
+	return o, nil
+}
+
+// Apply sets the overridden fields of th.
+func (o *Ownership) Apply(th *tar.Header) {
+	if o.Uid != nil {
+		th.Uid = *o.Uid
+	}
+	if o.Gid != nil {
+		th.Gid = *o.Gid
+	}
+	if o.Uname != "" {
+		th.Uname = o.Uname
+	}
+	if o.Gname != "" {
+		th.Gname = o.Gname
+	}
+	if o.Mode != nil {
+		th.Mode = *o.Mode
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestParseOwner(t *testing.T) {
+	tests := []struct {
+		s    string
+		name string
+		id   int
+	}{
+		{"", "", -1},
+		{"carbon", "carbon", -1},
+		{"998", "", 998},
+		{"carbon:998", "carbon", 998},
+	}
+	for _, test := range tests {
+		name, id, err := parseOwner(test.s)
+		if err != nil {
+			t.Errorf("%q: %s", test.s, err)
+			continue
+		}
+		if name != test.name || (id == nil) != (test.id < 0) || (id != nil && *id != test.id) {
+			t.Errorf("%q: expected %s %d, got %s %v", test.s, test.name, test.id, name, id)
+		}
+	}
+	for _, s := range []string{"carbon:x", "carbon:-1"} {
+		if _, _, err := parseOwner(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+	for _, mode := range []string{"644x", "9", "17777"} {
+		if _, err := ParseOwnership("", "", mode); err == nil {
+			t.Errorf("Mode %q was accepted", mode)
+		}
+	}
+}
+
+func TestOwnershipHeaders(t *testing.T) {
+	work := &metrics.MetricData{Name: "foo.bar", Size: 3, Mode: 0600,
+		Encoding: metrics.EncIdentity, Data: []byte("abc")}
+
+	// Source values are preserved by default
+	o, err := ParseOwnership("", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarOwnership = o
+	defer func() { tarOwnership = nil }()
+	th := prepareEntry(work).Header
+	if th.Mode != 0600 || th.Uid != 0 || th.Gid != 0 || th.Uname != "" || th.Gname != "" {
+		t.Errorf("Source values were not preserved: %+v", th)
+	}
+
+	tarOwnership, err = ParseOwnership("carbon:998", "999", "0644")
+	if err != nil {
+		t.Fatal(err)
+	}
+	th = prepareEntry(work).Header
+	if th.Mode != 0644 || th.Uid != 998 || th.Gid != 999 || th.Uname != "carbon" || th.Gname != "" {
+		t.Errorf("Overrides were not applied: %+v", th)
+	}
+}
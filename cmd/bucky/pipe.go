@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// tarPipeThrough is the -pipe-through shell command that each metric's
+// Whisper data is filtered through before it is archived.
+var tarPipeThrough string
+
+// tarPipeWorkers caps the -pipe-through processes running at once.  0 is
+// limited only by -compress-workers.
+var tarPipeWorkers int
+
+// tarPipeSlots holds a token for each running -pipe-through process when
+// -pipe-workers is set.
+var tarPipeSlots chan struct{}
+
+// tarPipeContext kills the running -pipe-through commands when it is
+// cancelled at tar's hard stop.  nil never kills them.
+var tarPipeContext context.Context
+
+// ErrPipeNoOutput is returned when a -pipe-through command writes nothing.
+var ErrPipeNoOutput = errors.New("Filter wrote no data")
+
+// pipeThrough runs command with "sh -c" and returns what it writes to
+// STDOUT when given data on STDIN.  The metric's name is in the
+// BUCKY_METRIC environment variable.  A command that exits non-zero or
+// writes nothing fails, and its STDERR is included in the error.  A
+// command still running when tarPipeContext is cancelled is killed and
+// fails.
+func pipeThrough(command, metric string, data []byte) ([]byte, error) {
+	if tarPipeSlots != nil {
+		tarPipeSlots <- struct{}{}
+		defer func() { <-tarPipeSlots }()
+	}
+
+	ctx := tarPipeContext
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	stdout := new(bytes.Buffer)
+	stderr := new(bytes.Buffer)
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "BUCKY_METRIC="+metric)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Filter failed: %s", err)
+	}
+	// Processes the filter started may keep its output open after it is
+	// killed, so do not wait for them.
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Filter killed: %s", ctx.Err())
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("Filter failed: %s: %s", err, msg)
+		}
+		return nil, fmt.Errorf("Filter failed: %s", err)
+	}
+	if stdout.Len() == 0 {
+		return nil, ErrPipeNoOutput
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipedArchive archives foo.a, foo.b, and foo.c through the -pipe-through
+// command and returns the archived data of each metric.
+func pipedArchive(t *testing.T, command string) map[string]string {
+	server := slowMetricServer(0)
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 2
+	tarPipeThrough = command
+	defer func() { tarPipeThrough = "" }()
+	metricMap := map[string][]string{
+		strings.TrimPrefix(server.URL, "http://"): []string{"foo.a", "foo.b", "foo.c"},
+	}
+
+	buf := new(bytes.Buffer)
+	multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf})
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+	result := make(map[string]string)
+	tr := tar.NewReader(buf)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, _ := ioutil.ReadAll(tr)
+		if int64(len(data)) != th.Size {
+			t.Errorf("%s: header size %d, read %d bytes", th.Name, th.Size, len(data))
+		}
+		result[th.Name] = string(data)
+	}
+	return result
+}
+
+func TestTarPipeThrough(t *testing.T) {
+	files := pipedArchive(t, "cat")
+	if len(files) != 3 || files["foo/a.wsp"] != "whisper data" {
+		t.Errorf("Passthrough changed the archive: %v", files)
+	}
+	if archiveBytes != 3*int64(len("whisper data")) || workStatus() != ExitOK {
+		t.Errorf("Passthrough: %d bytes, exit %d", archiveBytes, workStatus())
+	}
+
+	files = pipedArchive(t, "head -c 7")
+	if len(files) != 3 || files["foo/b.wsp"] != "whisper" {
+		t.Errorf("Filter output not archived: %v", files)
+	}
+	if archiveBytes != 3*7 {
+		t.Errorf("Expected 21 bytes archived, got %d", archiveBytes)
+	}
+
+	// A failing filter fails only its metric
+	files = pipedArchive(t, `test "$BUCKY_METRIC" != foo.b && cat`)
+	if _, ok := files["foo/b.wsp"]; ok || len(files) != 2 {
+		t.Errorf("Expected foo.b left out, got %v", files)
+	}
+	if workStatus() != ExitPartial || workerFailed != 1 || workerSucceeded != 2 {
+		t.Errorf("Expected 1 failure, got %d succeeded %d failed", workerSucceeded, workerFailed)
+	}
+
+	if _, err := pipeThrough("true", "foo.a", []byte("data")); err != ErrPipeNoOutput {
+		t.Errorf("Expected ErrPipeNoOutput, got %v", err)
+	}
+}
+
+func TestTarPipeThroughHardStop(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 1
+	// The sleep outlives its shell when the filter of foo.b is killed
+	tarPipeThrough = `test "$BUCKY_METRIC" != foo.b || sleep 5; cat`
+	defer func(d time.Duration) { tarPipeThrough, tarDrainTimeout = "", d }(tarDrainTimeout)
+	tarDrainTimeout = 10 * time.Millisecond
+	metricMap := map[string][]string{
+		strings.TrimPrefix(server.URL, "http://"): []string{"foo.a", "foo.b"},
+	}
+
+	stop, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	multiplexTarContext(stop, metricMap, &stdoutSink{ioutil.Discard})
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Hung filter stalled tar for %s", d)
+	}
+	if workerSucceeded != 1 || workerFailed != 1 {
+		t.Errorf("Expected the killed filter to fail its metric, got %d succeeded %d failed",
+			workerSucceeded, workerFailed)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http/httptrace"
+	"os"
+	"sort"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+var probeCount int
+
+func init() {
+	usage := "[options] <metric>"
+	short := "Time the download of a single metric."
+	long := `Download one metric and print how long each phase of the request took
+to tell whether slowness comes from the network, the buckyd daemon, or its
+disk.  The phases are the DNS lookup, the TCP connect, the TLS handshake,
+the time from sending the request to the first byte of the response, which
+is buckyd reading the metric from disk, and reading the body.  The total
+time and the metric's stat information as reported by buckyd are printed
+as well.
+
+The metric is downloaded from the server that holds it according to the
+hash ring.  Use -s to download it from the host given by -h or in the
+BUCKYHOST environment variable instead without discovering the cluster.
+
+Use -count N to probe N times.  Each probe opens a new connection so that
+every phase is measured each time.  The minimum, 50th, 90th, and 99th
+percentile, and maximum of each phase are printed after the individual
+probes.  Use -j for JSON output.
+
+Exits 2 if some probes failed and 3 if all of them did.`
+
+	c := NewCommand(probeCommand, "probe", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+
+	c.Flag.IntVar(&probeCount, "count", 1,
+		"Number of times to download the metric.")
+}
+
+// ProbeTiming is the time taken by each phase of a single download.
+type ProbeTiming struct {
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+	Body      time.Duration
+	Total     time.Duration
+}
+
+// ProbeResult is the result of the probe subcommand.
+type ProbeResult struct {
+	Metric string
+	Server string
+	Stat   *MetricData
+	Probes []ProbeTiming
+	Failed int
+}
+
+// probePhases names the phases of a ProbeTiming in the order printed.
+var probePhases = []string{"dns", "connect", "tls", "first_byte", "body", "total"}
+
+// phases returns the durations of t in the order of probePhases.
+func (t ProbeTiming) phases() []time.Duration {
+	return []time.Duration{t.DNS, t.Connect, t.TLS, t.FirstByte, t.Body, t.Total}
+}
+
+// ProbeMetric downloads metric from server once and returns the timing of
+// each phase of the request along with the metric.
+func ProbeMetric(server, metric string) (*MetricData, ProbeTiming, error) {
+	var t ProbeTiming
+	var dnsStart, connectStart, tlsStart, wrote, firstByte time.Time
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { t.DNS = time.Since(dnsStart) },
+		ConnectStart: func(string, string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.Connect = time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.TLS = time.Since(tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() {
+			firstByte = time.Now()
+			t.FirstByte = firstByte.Sub(wrote)
+		},
+	}
+
+	// Measure a new connection every time
+	defer GetHTTP().CloseIdleConnections()
+	start := time.Now()
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	data, err := GetMetricDataContext(ctx, server, metric)
+	t.Total = time.Since(start)
+	if !firstByte.IsZero() {
+		t.Body = t.Total - firstByte.Sub(start)
+	}
+	return data, t, err
+}
+
+// percentile returns the p'th percentile of the sorted durations using the
+// nearest rank.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// printProbe writes a human readable form of result to STDOUT.
+func printProbe(result *ProbeResult) {
+	fmt.Printf("Metric: %s\n", result.Metric)
+	fmt.Printf("Server: %s\n", result.Server)
+	if s := result.Stat; s != nil {
+		fmt.Printf("Stat: size=%d mode=%o mtime=%s\n", s.Size, s.Mode,
+			time.Unix(s.ModTime, 0).UTC().Format(time.RFC3339))
+	}
+	for i, t := range result.Probes {
+		fmt.Printf("Probe %d:", i+1)
+		for j, d := range t.phases() {
+			fmt.Printf(" %s=%s", probePhases[j], d)
+		}
+		fmt.Printf("\n")
+	}
+	if len(result.Probes) < 2 {
+		return
+	}
+
+	fmt.Printf("%-10s %12s %12s %12s %12s %12s\n", "phase", "min", "p50", "p90", "p99", "max")
+	for j, phase := range probePhases {
+		sorted := make([]time.Duration, 0, len(result.Probes))
+		for _, t := range result.Probes {
+			sorted = append(sorted, t.phases()[j])
+		}
+		sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+		fmt.Printf("%-10s %12s %12s %12s %12s %12s\n", phase, sorted[0],
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99),
+			sorted[len(sorted)-1])
+	}
+}
+
+// probeCommand runs this subcommand.
+func probeCommand(c Command) int {
+	if c.Flag.NArg() != 1 {
+		log.Print("A single metric is required.")
+		return ExitUsage
+	}
+	if probeCount < 1 {
+		log.Print("The -count option must be at least 1.")
+		return ExitUsage
+	}
+
+	result := &ProbeResult{Metric: c.Flag.Arg(0), Probes: make([]ProbeTiming, 0)}
+	if SingleHost {
+		server, err := singleServer(HostPort)
+		if err != nil {
+			log.Printf("Malformed hostname: %s", err)
+			return ExitUsage
+		}
+		result.Server = server
+	} else {
+		_, err := GetClusterConfig(HostPort)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+		if !Cluster.Healthy {
+			log.Printf("Warning: Cluster is not optimal.")
+		}
+		result.Server = Cluster.NodeHostPort(Cluster.Hash.GetNode(result.Metric))
+	}
+
+	for i := 0; i < probeCount; i++ {
+		stat, t, err := ProbeMetric(result.Server, result.Metric)
+		if err != nil {
+			log.Printf("Probe %d of %s failed after %s: %s", i+1, result.Metric, t.Total, err)
+			result.Failed++
+			workFailed()
+			continue
+		}
+		stat.Data = nil
+		result.Stat = stat
+		result.Probes = append(result.Probes, t)
+		workSucceeded()
+	}
+
+	if JSONOutput {
+		blob, err := json.Marshal(result)
+		if err != nil {
+			log.Printf("%s", err)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		printProbe(result)
+	}
+	return workStatus()
+}
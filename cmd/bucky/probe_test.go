@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func probeTestHandler(w http.ResponseWriter, r *http.Request) {
+	// buckyd reading the metric from disk
+	time.Sleep(10 * time.Millisecond)
+	data := []byte("whisper data")
+	stat, _ := json.Marshal(&metrics.MetricData{
+		Name: strings.TrimPrefix(r.URL.Path, "/metrics/"),
+		Size: int64(len(data)),
+		Mode: 0644,
+	})
+	w.Header().Set("X-Metric-Stat", string(stat))
+	w.Write(data)
+}
+
+func TestProbeMetric(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(probeTestHandler))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		stat, timing, err := ProbeMetric(strings.TrimPrefix(server.URL, "http://"), "foo.bar")
+		if err != nil {
+			t.Fatalf("Probe failed: %s", err)
+		}
+		if stat.Name != "foo.bar" || stat.Size != 12 {
+			t.Errorf("Unexpected stat: %v", stat)
+		}
+		// Every probe makes a new connection
+		if timing.Connect <= 0 {
+			t.Errorf("Probe %d: no connect time", i)
+		}
+		if timing.FirstByte < 10*time.Millisecond {
+			t.Errorf("Probe %d: expected at least 10ms to first byte, got %s", i, timing.FirstByte)
+		}
+		if timing.Total < timing.FirstByte+timing.Connect {
+			t.Errorf("Probe %d: total %s shorter than its phases", i, timing.Total)
+		}
+		if timing.TLS != 0 {
+			t.Errorf("Probe %d: TLS timed over HTTP", i)
+		}
+	}
+
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(probeTestHandler))
+	defer tlsServer.Close()
+	httpClient = tlsServer.Client()
+	UseTLS = true
+	defer func() {
+		resetHTTPClient()
+		UseTLS = false
+	}()
+	_, timing, err := ProbeMetric(strings.TrimPrefix(tlsServer.URL, "https://"), "foo.bar")
+	if err != nil {
+		t.Fatalf("TLS probe failed: %s", err)
+	}
+	if timing.TLS <= 0 {
+		t.Errorf("No TLS handshake time")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 0)
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i))
+	}
+	tests := map[float64]time.Duration{0: 1, 50: 50, 90: 90, 99: 99, 100: 100}
+	for p, expected := range tests {
+		if d := percentile(sorted, p); d != expected {
+			t.Errorf("Percentile %.0f: expected %d, got %d", p, expected, d)
+		}
+	}
+	if d := percentile(sorted[:1], 99); d != 1 {
+		t.Errorf("Percentile of one probe: expected 1, got %d", d)
+	}
+}
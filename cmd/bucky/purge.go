@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var purgeExecute bool
+
+// PurgePlan is the result of planning a purge-stale run.  Both maps are
+// keyed by the buckyd HOST:PORT holding the stale copies.
+type PurgePlan struct {
+	// Purge holds stale copies whose data was verified on a ring owner
+	Purge map[string][]string
+
+	// Kept holds stale copies that no ring owner could be verified to
+	// have and so must not be deleted
+	Kept map[string][]string
+}
+
+func init() {
+	usage := "[options] <metric expression>"
+	short := "Delete stale copies of metrics from non-owners."
+	long := `Find copies of metrics living on servers that are not among the
+metric's owners in the hash ring and delete them once the data is verified
+to exist on an owner.  This is the clean up half of a rebalance that was
+run without deleting the source metrics.  Without any arguments every
+metric in the cluster is considered.
+
+The default mode is to work with lists.  The arguments are a series of one or
+more metric key names.  If the first argument is a "-" then read a JSON array
+from STDIN as our list of metrics.  Use -r to enable regular expression mode.
+
+A stale copy is only deleted if a ring owner reports holding the metric
+and a stat of the owner's copy succeeds.  Stale copies without a verified
+owner copy are kept and reported.
+
+This is a dry run that only reports what would be deleted unless -execute
+is given.  Deletes ask for confirmation per server unless -noconfirm is
+also given.`
+
+	c := NewCommand(purgeStaleCommand, "purge-stale", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupJSON(c)
+	SetupRetry(c)
+
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemons to rebuild their cache.")
+	c.Flag.BoolVar(&purgeExecute, "execute", false,
+		"Delete the stale copies rather than reporting them.")
+	c.Flag.BoolVar(&deleteForce, "noconfirm", false,
+		"No confirmation.")
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Delete threads.")
+}
+
+// verifyOwnerCopy returns true if the metric exists with data on the
+// given server.
+func verifyOwnerCopy(server, metric string) bool {
+	stat, err := StatRemoteMetric(server, metric)
+	return err == nil && stat.Size > 0
+}
+
+// PlanPurge finds the copies in the inventory, a map of buckyd HOST:PORT
+// => metrics, held by servers that are not ring owners of the metric.
+// Verify is called with the HOST:PORT of an owner holding a copy and
+// must return true if the owner's copy is good.
+func PlanPurge(ring hashing.HashRing, replicas int, inventory map[string][]string,
+	verify func(server, metric string) bool) *PurgePlan {
+
+	plan := &PurgePlan{
+		Purge: make(map[string][]string),
+		Kept:  make(map[string][]string),
+	}
+
+	locations := make(map[string][]string)
+	servers := make([]string, 0)
+	for server := range inventory {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		for _, m := range inventory[server] {
+			locations[m] = append(locations[m], server)
+		}
+	}
+
+	for m, held := range locations {
+		owners := RingOwners(ring, replicas, m)
+		stale := make([]string, 0)
+		verified := false
+		for _, server := range held {
+			if !containsString(owners, hostOnly(server)) {
+				stale = append(stale, server)
+			} else if !verified && verify(server, m) {
+				verified = true
+			}
+		}
+
+		for _, server := range stale {
+			if verified {
+				plan.Purge[server] = append(plan.Purge[server], m)
+			} else {
+				plan.Kept[server] = append(plan.Kept[server], m)
+			}
+		}
+	}
+
+	for _, metrics := range plan.Purge {
+		sort.Strings(metrics)
+	}
+	for _, metrics := range plan.Kept {
+		sort.Strings(metrics)
+	}
+	return plan
+}
+
+// purgeStaleCommand runs this subcommand.
+func purgeStaleCommand(c Command) int {
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if !Cluster.Healthy {
+		log.Printf("Cluster is unhealthy.")
+		return ExitUsage
+	}
+	if purgeExecute && !checkWritable(Cluster.HostPorts()) {
+		return ExitUsage
+	}
+
+	inventory, err := ListSelection(c, Cluster.HostPorts())
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return ExitError
+	}
+
+	plan := PlanPurge(Cluster.Hash, Cluster.Replicas, inventory, verifyOwnerCopy)
+	log.Printf("%d stale copies verified on an owner, %d stale copies without a verified owner.",
+		countMap(plan.Purge), countMap(plan.Kept))
+
+	if !purgeExecute {
+		if JSONOutput {
+			blob, err := json.Marshal(plan)
+			if err != nil {
+				log.Printf("%s", err)
+				return ExitError
+			}
+			os.Stdout.Write(blob)
+			os.Stdout.Write([]byte("\n"))
+			return ExitOK
+		}
+		for server, metrics := range plan.Purge {
+			for _, m := range metrics {
+				fmt.Printf("purge: %s: %s\n", server, m)
+			}
+		}
+		for server, metrics := range plan.Kept {
+			for _, m := range metrics {
+				fmt.Printf("keep: %s: %s\n", server, m)
+			}
+		}
+		return ExitOK
+	}
+
+	err = deleteMetrics(plan.Purge)
+	return exitStatus(err)
+}
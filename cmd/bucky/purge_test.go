@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+import "github.com/jjneely/buckytools/metrics"
+
+// fakeCluster is a set of buckyd daemons sharing one listener.  Each
+// daemon is identified by the host name in the request.
+type fakeCluster struct {
+	lock    sync.Mutex
+	metrics map[string]map[string]bool
+}
+
+func (f *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	host, _, _ := net.SplitHostPort(r.Host)
+	held := f.metrics[host]
+	if r.URL.Path == "/metrics" {
+		list := make([]string, 0)
+		for m := range held {
+			list = append(list, m)
+		}
+		blob, _ := json.Marshal(list)
+		w.Write(blob)
+		return
+	}
+
+	m := strings.TrimPrefix(r.URL.Path, "/metrics/")
+	if r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/metrics/") {
+		held[m] = true
+		return
+	}
+	if !held[m] {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "HEAD":
+		stat, _ := json.Marshal(&metrics.MetricData{Name: m, Size: 4096})
+		w.Header().Set("X-Metric-Stat", string(stat))
+	case "GET":
+		stat, _ := json.Marshal(&metrics.MetricData{Name: m, Size: 4, Mode: 0644})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write([]byte("data"))
+	case "DELETE":
+		delete(held, m)
+	}
+}
+
+func TestPurgeStale(t *testing.T) {
+	ring := hashing.NewCarbonHashRing()
+	ring.AddNode(hashing.NewNode("127.0.0.1", 0, ""))
+	ring.AddNode(hashing.NewNode("localhost", 0, ""))
+	other := map[string]string{"127.0.0.1": "localhost", "localhost": "127.0.0.1"}
+
+	fake := &fakeCluster{metrics: map[string]map[string]bool{
+		"127.0.0.1": make(map[string]bool),
+		"localhost": make(map[string]bool),
+	}}
+	// foo.verified is on its owner and a non-owner
+	verified := ring.GetNode("foo.verified").Server
+	fake.metrics[verified]["foo.verified"] = true
+	fake.metrics[other[verified]]["foo.verified"] = true
+	// foo.unverified is only on a non-owner
+	unverified := ring.GetNode("foo.unverified").Server
+	fake.metrics[other[unverified]]["foo.unverified"] = true
+
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	hostPorts := []string{"127.0.0.1:" + port, "localhost:" + port}
+
+	inventory, err := ListAllMetrics(hostPorts, false)
+	if err != nil {
+		t.Fatalf("Error fetching inventory: %s", err)
+	}
+	plan := PlanPurge(ring, 1, inventory, verifyOwnerCopy)
+	if countMap(plan.Purge) != 1 || countMap(plan.Kept) != 1 {
+		t.Fatalf("Bad plan: %v", plan)
+	}
+
+	deleteForce = true
+	metricWorkers = 1
+	workerFailed = 0
+	defer func() { deleteForce = false }()
+	if err := deleteMetrics(plan.Purge); err != nil {
+		t.Fatalf("Error purging: %s", err)
+	}
+
+	if fake.metrics[other[verified]]["foo.verified"] {
+		t.Errorf("Stale copy with a verified owner copy was not deleted")
+	}
+	if !fake.metrics[verified]["foo.verified"] {
+		t.Errorf("Owner copy was deleted")
+	}
+	if !fake.metrics[other[unverified]]["foo.unverified"] {
+		t.Errorf("Stale copy without a verified owner copy was deleted")
+	}
+}
@@ -57,34 +57,38 @@ DBs to the remote servers.`
 		"Force the remote daemons to rebuild their cache.")
 }
 
-func rebalanceWorker(workIn chan *MigrateWork, wg *sync.WaitGroup) {
+// rebalanceWorker moves each metric from workIn and deletes the source
+// if del is true.
+func rebalanceWorker(workIn chan *MigrateWork, wg *sync.WaitGroup, del bool) {
 	for work := range workIn {
 		if Verbose {
 			log.Printf("Relocating [%s] %s => [%s] %s  Delete Source: %t",
 				work.oldLocation, work.oldName,
-				work.newLocation, work.newName, doDelete)
+				work.newLocation, work.newName, del)
 		}
 		metric, err := GetMetricData(work.oldLocation, work.oldName)
 		if err != nil {
 			// errors already handled
-			workerErrors = true
+			workFailedOn(work.oldLocation, work.oldName)
 			continue
 		}
 		metric.Name = work.newName
 		err = PostMetric(work.newLocation, metric)
 		if err != nil {
 			// errors already handled
-			workerErrors = true
+			workFailedOn(work.newLocation, work.newName)
 			continue
 		}
 
 		// We only delete if there are no errors present
-		if doDelete {
+		if del {
 			err = DeleteMetric(work.oldLocation, work.oldName)
 			if err != nil {
-				workerErrors = true
+				workFailedOn(work.oldLocation, work.oldName)
+				continue
 			}
 		}
+		workSucceeded()
 	}
 	wg.Done()
 }
@@ -130,7 +134,7 @@ func RebalanceMetrics(extraHostPorts []string) error {
 	wg := new(sync.WaitGroup)
 	wg.Add(metricWorkers)
 	for i := 0; i < metricWorkers; i++ {
-		go rebalanceWorker(workIn, wg)
+		go rebalanceWorker(workIn, wg, doDelete)
 	}
 
 	// build an order of jobs not dependent on location
@@ -144,7 +148,7 @@ func RebalanceMetrics(extraHostPorts []string) error {
 			work.oldName = m
 			work.newName = m
 			work.oldLocation = server
-			work.newLocation = Cluster.Hash.GetNode(work.newName).Server
+			work.newLocation = Cluster.NodeHostPort(Cluster.Hash.GetNode(work.newName))
 
 			id := fmt.Sprintf("[%s] %s", server, m)
 			jobs[id] = work
@@ -190,7 +194,7 @@ func RebalanceMetrics(extraHostPorts []string) error {
 	wg.Wait()
 
 	log.Printf("Rebalance complete.")
-	if workerErrors {
+	if workerErrors() {
 		log.Printf("Errors are present in rebalance.")
 		return fmt.Errorf("Errors present.")
 	}
@@ -202,17 +206,17 @@ func rebalanceCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	var oldBuckyd []string
 	for i := 0; i < c.Flag.NArg(); i++ {
 		oldBuckyd = append(oldBuckyd, c.Flag.Arg(i))
 	}
+	if !noOp && !checkWritable(append(Cluster.HostPorts(), oldBuckyd...)) {
+		return ExitUsage
+	}
 	err = RebalanceMetrics(oldBuckyd)
 
-	if err != nil {
-		return 1
-	}
-	return 0
+	return exitStatus(err)
 }
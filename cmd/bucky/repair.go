@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var repairDryRun bool
+var repairRate float64
+
+func init() {
+	usage := "[options]"
+	short := "Move every misplaced metric to its owner in the hash ring."
+	long := `Find every metric that is not on the server that owns it in the hash ring
+and move it there in one pass.  This is inconsistent followed by rebalance
+-delete: each misplaced metric is copied to its owner, backfilling any copy
+the owner already holds, and is deleted from the wrong server only once the
+copy succeeded.  Metrics already on their owner are not touched.
+
+Repair is safe to run again.  A metric whose copy or delete failed is still
+misplaced and is moved by the next run, and a run that finds nothing
+misplaced changes nothing.  The cluster must be healthy.
+
+Use -n for a dry run that prints each planned move as SERVER: METRIC =>
+OWNER and changes nothing.  Use -rate to move at most that many metrics per
+second to limit the load on the cluster.  Moves are made by -w workers.
+
+The number of metrics moved and failed is logged at the end.  Exits 2 if
+some moves failed and 3 if all of them did.`
+
+	c := NewCommand(repairCommand, "repair", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+
+	c.Flag.BoolVar(&repairDryRun, "n", false,
+		"Dry run, print the planned moves and change nothing.")
+	c.Flag.BoolVar(&repairDryRun, "dry-run", false,
+		"Dry run, print the planned moves and change nothing.")
+	c.Flag.Float64Var(&repairRate, "rate", 0,
+		"Move at most this many metrics per second.  0 for no limit.")
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Worker threads.")
+	c.Flag.IntVar(&metricWorkers, "workers", 5,
+		"Worker threads.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemons to rebuild their cache.")
+}
+
+// RepairPlan returns a move of each metric in metricMap, a map of server
+// => misplaced metrics, to its owner in the hash ring, sorted by server
+// and metric.
+func RepairPlan(metricMap map[string][]string) []*MigrateWork {
+	servers := make([]string, 0, len(metricMap))
+	for server := range metricMap {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	plan := make([]*MigrateWork, 0)
+	for _, server := range servers {
+		metrics := append([]string(nil), metricMap[server]...)
+		sort.Strings(metrics)
+		for _, m := range metrics {
+			plan = append(plan, &MigrateWork{
+				oldName:     m,
+				newName:     m,
+				oldLocation: server,
+				newLocation: Cluster.NodeHostPort(Cluster.Hash.GetNode(m)),
+			})
+		}
+	}
+	return plan
+}
+
+// RunRepair makes the moves of plan with metricWorkers workers, starting
+// at most rate moves per second if rate is greater than 0.  Sources are
+// deleted after they are copied.
+func RunRepair(plan []*MigrateWork, rate float64) {
+	workIn := make(chan *MigrateWork)
+	wg := new(sync.WaitGroup)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		// Moving is rebalance that always deletes the source
+		go rebalanceWorker(workIn, wg, true)
+	}
+
+	var tick <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for i, work := range plan {
+		if tick != nil && i > 0 {
+			<-tick
+		}
+		workIn <- work
+		if (i+1)%10 == 0 {
+			log.Printf("Progress %d / %d: %.2f%%", i+1, len(plan),
+				100*float64(i+1)/float64(len(plan)))
+		}
+	}
+	close(workIn)
+	wg.Wait()
+}
+
+// printRepairPlan writes each move of plan to STDOUT.
+func printRepairPlan(plan []*MigrateWork) {
+	for _, work := range plan {
+		fmt.Printf("%s: %s => %s\n", work.oldLocation, work.oldName, work.newLocation)
+	}
+}
+
+// repairCommand runs this subcommand.
+func repairCommand(c Command) int {
+	if metricWorkers < 1 {
+		log.Print("The -w option must be at least 1.")
+		return ExitUsage
+	}
+	if repairRate < 0 {
+		log.Print("The -rate option can not be negative.")
+		return ExitUsage
+	}
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if !Cluster.Healthy {
+		log.Printf("Abort: Cluster is unhealthy, not repairing.")
+		return ExitUsage
+	}
+	hostPorts := Cluster.HostPorts()
+	if !repairDryRun && !checkWritable(hostPorts) {
+		return ExitUsage
+	}
+
+	metricMap, err := InconsistentMetrics(hostPorts)
+	if err != nil {
+		return ExitError
+	}
+	plan := RepairPlan(metricMap)
+	if repairDryRun {
+		printRepairPlan(plan)
+		log.Printf("Dry run: %d metrics would be moved.", len(plan))
+		return ExitOK
+	}
+	if len(plan) == 0 {
+		log.Printf("Cluster is balanced, nothing to repair.")
+		return ExitOK
+	}
+
+	log.Printf("Moving %d metrics.", len(plan))
+	RunRepair(plan, repairRate)
+	log.Printf("Repair complete: %d moved, %d failed.",
+		atomic.LoadInt32(&workerSucceeded), atomic.LoadInt32(&workerFailed))
+	return workStatus()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	fake := &fakeCluster{metrics: map[string]map[string]bool{
+		"127.0.0.1": make(map[string]bool),
+		"localhost": make(map[string]bool),
+	}}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1", "localhost"), port)
+	defer func() {
+		Cluster = nil
+		repairDryRun = false
+		repairRate = 0
+	}()
+	other := map[string]string{"127.0.0.1": "localhost", "localhost": "127.0.0.1"}
+	owner := func(m string) string { return Cluster.Hash.GetNode(m).Server }
+
+	// foo.placed is already on its owner, foo.misplaced only on the other
+	// server, and foo.duplicate on both
+	fake.metrics[owner("foo.placed")]["foo.placed"] = true
+	fake.metrics[other[owner("foo.misplaced")]]["foo.misplaced"] = true
+	fake.metrics[owner("foo.duplicate")]["foo.duplicate"] = true
+	fake.metrics[other[owner("foo.duplicate")]]["foo.duplicate"] = true
+	metricWorkers = 2
+
+	// A dry run changes nothing
+	resetTarState()
+	repairDryRun = true
+	if code := repairCommand(Command{}); code != ExitOK {
+		t.Fatalf("Dry run failed: %d", code)
+	}
+	if !fake.metrics[other[owner("foo.misplaced")]]["foo.misplaced"] || fake.metrics[owner("foo.misplaced")]["foo.misplaced"] {
+		t.Errorf("Dry run moved foo.misplaced")
+	}
+
+	repairDryRun = false
+	repairRate = 1000
+	if code := repairCommand(Command{}); code != ExitOK {
+		t.Fatalf("Repair failed: %d", code)
+	}
+	if workerSucceeded != 2 || workerFailed != 0 {
+		t.Errorf("Expected 2 moved and 0 failed, got %d and %d", workerSucceeded, workerFailed)
+	}
+	for _, m := range []string{"foo.placed", "foo.misplaced", "foo.duplicate"} {
+		if !fake.metrics[owner(m)][m] || fake.metrics[other[owner(m)]][m] {
+			t.Errorf("Expected %s only on its owner %s, got %v", m, owner(m), fake.metrics)
+		}
+	}
+
+	// Running again finds nothing to do
+	resetTarState()
+	if code := repairCommand(Command{}); code != ExitOK || workerSucceeded != 0 {
+		t.Errorf("Expected nothing repaired again, got exit %d and %d moved", code, workerSucceeded)
+	}
+}
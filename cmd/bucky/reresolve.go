@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// Reresolve is the interval between re-running cluster discovery during a
+// long operation as set by -reresolve.  0 uses the ring found at start for
+// the whole run.
+var Reresolve time.Duration
+
+// SetupReresolve installs the -reresolve flag in the given Command.
+func SetupReresolve(c Command) {
+	c.Flag.DurationVar(&Reresolve, "reresolve", 0,
+		"Re-run cluster discovery this often and route new work by any changed ring.  0 to never.")
+}
+
+// RingResolver holds the hash ring that work not yet started is routed
+// through.  Resolve re-runs discovery and replaces the ring if the
+// cluster's membership changed.  Work already started keeps the server it
+// was routed to.
+type RingResolver struct {
+	lock     sync.RWMutex
+	current  *hashing.JSONRingType
+	hash     hashing.HashRing
+	discover func() (*hashing.JSONRingType, error)
+	changes  int
+	stop     chan struct{}
+	once     sync.Once
+}
+
+// NewRingResolver returns a RingResolver routing through hash, built from
+// current.  The discover function returns the cluster's ring when called
+// by Resolve.
+func NewRingResolver(current *hashing.JSONRingType, hash hashing.HashRing,
+	discover func() (*hashing.JSONRingType, error)) *RingResolver {
+
+	return &RingResolver{
+		current:  current,
+		hash:     hash,
+		discover: discover,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Ring returns the hash ring to route the next piece of work through.
+func (r *RingResolver) Ring() hashing.HashRing {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.hash
+}
+
+// Changes returns the number of membership changes Resolve has applied.
+func (r *RingResolver) Changes() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.changes
+}
+
+// Resolve re-runs discovery and, if the ring differs from the current
+// one, logs the differences and routes work through the new ring.  On an
+// error the current ring is kept.
+func (r *RingResolver) Resolve() error {
+	ring, err := r.discover()
+	if err != nil {
+		log.Printf("Error re-resolving the cluster, keeping the current ring: %s", err)
+		return err
+	}
+	r.lock.RLock()
+	diff := RingDiff(r.current, ring)
+	r.lock.RUnlock()
+	if len(diff) == 0 {
+		return nil
+	}
+	hash, err := NewHashRing(ring)
+	if err != nil {
+		log.Printf("Error building the re-resolved ring, keeping the current ring: %s", err)
+		return err
+	}
+
+	log.Printf("Cluster membership changed, routing work not yet started by the new ring:")
+	for _, d := range diff {
+		log.Printf("    %s", d)
+	}
+	r.lock.Lock()
+	r.current = ring
+	r.hash = hash
+	r.changes++
+	r.lock.Unlock()
+	return nil
+}
+
+// Start calls Resolve every interval until Stop is called.  An interval
+// of 0 or less does nothing.
+func (r *RingResolver) Start(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.Resolve()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the periodic Resolve calls begun by Start.
+func (r *RingResolver) Stop() {
+	r.once.Do(func() { close(r.stop) })
+}
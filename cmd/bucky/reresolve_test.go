@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/hashing"
+
+func TestRingResolverRemapsQueuedWork(t *testing.T) {
+	var lock sync.Mutex
+	hosts := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		hosts = append(hosts, r.Host)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	// 127.0.0.1 is drained from the cluster, leaving localhost
+	before := ringFor(1, "127.0.0.1")
+	after := ringFor(1, "localhost")
+	restoreTestCluster(before, port)
+	defer func() { Cluster = nil }()
+	workerFailed = 0
+
+	discovered := before
+	resolver := NewRingResolver(before, Cluster.Hash, func() (*hashing.JSONRingType, error) {
+		return discovered, nil
+	})
+	if err := resolver.Resolve(); err != nil || resolver.Changes() != 0 {
+		t.Fatalf("Unchanged membership was applied: %d changes, err %v", resolver.Changes(), err)
+	}
+
+	workIn := make(chan *MetricData, 2)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go restoreTarWorker(resolver, nil, workIn, nil, wg)
+	workIn <- &MetricData{Name: "foo.before", Data: []byte("whisper data"), Encoding: EncSnappy}
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		lock.Lock()
+		n := len(hosts)
+		lock.Unlock()
+		if n == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	discovered = after
+	if err := resolver.Resolve(); err != nil || resolver.Changes() != 1 {
+		t.Fatalf("Membership change was not applied: %d changes, err %v", resolver.Changes(), err)
+	}
+	workIn <- &MetricData{Name: "foo.after", Data: []byte("whisper data"), Encoding: EncSnappy}
+	close(workIn)
+	wg.Wait()
+
+	if len(hosts) != 2 || hostOnly(hosts[0]) != "127.0.0.1" || hostOnly(hosts[1]) != "localhost" {
+		t.Errorf("Expected uploads to 127.0.0.1 then localhost, got %v", hosts)
+	}
+}
@@ -3,28 +3,48 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 )
 
 import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/hashing"
 
 var tarPrefix string
+var restoreForce bool
+var restoreRemap bool
+
+// ErrRingChanged is returned when an archive's hash ring differs from the
+// cluster's and neither -force nor -remap was given.
+var ErrRingChanged = errors.New("Hash ring has changed, use -force or -remap to restore")
 
 func init() {
-	usage := "[options] <tar file>"
+	usage := "[options] <tar file> [tar file ...]"
 	short := "Restore a tar archive of metrics back to Graphite."
 	long := `Restores metrics from a tar archive back to the Graphite cluster.
 
-A uncompressed tar archive must be specifed.  If the first argument is "-"
+A tar archive must be specifed.  Archives compressed with gzip are
+decompressed automatically.  If the first argument is "-"
 then the tar archive will be read from STDIN.  Metrics are extracted from
 the archive and placed on the correct host in the Graphite cluster according
 to the consistent hash ring.
 
+More than one archive may be given to restore a multi-part set written with
+tar -split-size or -split-count, such as "bucky restore out.*.tar".  Each
+part is a complete archive with its own hash ring record and the parts are
+restored in the order given.  The restore stops at the first part that
+fails.
+
 Use -s to only restore metrics to the host specified by -h or the BUCKYSERVER
 environment variable.  That hosts hash ring dictates the ring and only metrics
 that hash to this hostname will be restored.  Cluster health and the
@@ -37,12 +57,56 @@ path and the path contained in the tar file must result in the relative path to
 the metric on the Graphite server rooted at the whisper storage directory.
 
 Set -w to change the number of worker threads used to upload the Whisper
-DBs to the remote servers.`
+DBs to the remote servers.
+
+Archives made by bucky tar record the hash ring of the cluster they were
+built from.  If the current ring has a different algorithm, replica count,
+or set of nodes the restore is refused and the differences are printed.
+Use -force to restore anyway, placing metrics according to the archive's
+ring.  Use -remap to place every metric according to the current ring
+accepting that data will move between servers.
+
+Metadata sidecars archived by tar -include-metadata are uploaded to the
+same server as their metric once the metric is restored.
+
+Failed uploads are retried -retries times.  Each upload carries a hash of
+its content so buckyd applies an upload only once even if a retry follows
+an upload whose response was lost.
+
+A long restore uses the hash ring found when it starts.  Use -reresolve to
+re-run cluster discovery at the given interval, such as -reresolve 10m.  If
+the cluster's membership has changed, such as a node that was drained, the
+changes are logged and metrics not yet uploaded are placed by the new ring.
+Uploads already in progress finish on their original server.  This has no
+effect when -force restores by the archive's ring.
+
+Use -target to bypass the hash ring and restore every metric to the given
+buckyd daemon, such as onto new nodes during a staged migration that are
+rebalanced afterwards.  A target is HOST[:PORT] like -h, or HOST=INSTANCE
+to reach the daemon of a carbon instance through -instance-port.  Repeat
+-target to spread the metrics over several daemons round robin.  Every
+target must answer and not be in maintenance before anything is restored.
+The archive's hash ring is not checked against the cluster's and -s can
+not be combined with -target.
+
+Use -compress-at-rest to have buckyd store each restored metric gzip
+compressed as a .wsp.gz file to save disk space for cold data.  The metric
+keeps its name and is served decompressed to bucky and any other buckyd
+client.  If the server already has the metric, compressed or not, it is
+backfilled with the archived data first.  An existing uncompressed .wsp is
+then replaced by the .wsp.gz and removed.  Carbon and graphite-web do not
+read .wsp.gz files, so only use this for metrics that are no longer
+written or queried directly.  If carbon creates the .wsp again it shadows
+the compressed copy, buckyd always prefers the uncompressed DB.  Buckyd
+daemons that predate this option ignore it and store the metric
+uncompressed.`
 
 	c := NewCommand(restoreCommand, "restore", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
+	SetupRetry(c)
+	SetupReresolve(c)
 
 	c.Flag.IntVar(&metricWorkers, "w", 5,
 		"Downloader threads.")
@@ -50,24 +114,129 @@ DBs to the remote servers.`
 		"Downloader threads.")
 	c.Flag.StringVar(&tarPrefix, "p", "",
 		"Prefix all metrics in the tar file with this path.")
+	c.Flag.BoolVar(&restoreForce, "force", false,
+		"Restore using the archive's hash ring if it differs from the cluster.")
+	c.Flag.BoolVar(&restoreRemap, "remap", false,
+		"Restore using the current hash ring if it differs from the archive.")
+	c.Flag.BoolVar(&CompressAtRest, "compress-at-rest", false,
+		"Store the restored Whisper DBs gzip compressed on the servers.")
+	c.Flag.Var(&restoreTargets, "target",
+		"Restore every metric to this buckyd daemon instead of its ring owner.  Repeatable.")
+}
+
+// nodeString formats a Node as HOST[:PORT][=INSTANCE].
+func nodeString(n hashing.Node) string {
+	s := n.Server
+	if n.Port != 0 {
+		s = fmt.Sprintf("%s:%d", s, n.Port)
+	}
+	if n.Instance != "" {
+		s = s + "=" + n.Instance
+	}
+	return s
 }
 
-func restoreTarWorker(workIn chan *MetricData, servers []string, wg *sync.WaitGroup) {
+// RingDiff returns a line for each difference between the hash ring an
+// archive was built from and the current ring.  No differences means
+// metrics are placed identically by both rings.
+func RingDiff(archived, current *hashing.JSONRingType) []string {
+	diff := make([]string, 0)
+	if archived.Algo != current.Algo {
+		diff = append(diff, fmt.Sprintf("algorithm: %s => %s", archived.Algo, current.Algo))
+	}
+	if archived.Replicas != current.Replicas {
+		diff = append(diff, fmt.Sprintf("replicas: %d => %d", archived.Replicas, current.Replicas))
+	}
+
+	old := make([]string, 0)
+	for _, n := range archived.Nodes {
+		old = append(old, nodeString(n))
+	}
+	cur := make([]string, 0)
+	for _, n := range current.Nodes {
+		cur = append(cur, nodeString(n))
+	}
+	for _, n := range old {
+		if !containsString(cur, n) {
+			diff = append(diff, "- "+n)
+		}
+	}
+	for _, n := range cur {
+		if !containsString(old, n) {
+			diff = append(diff, "+ "+n)
+		}
+	}
+
+	// The jump hash depends on the order of the nodes as well
+	if len(diff) == 0 && current.Algo == "jump_fnv1a" {
+		for i := range old {
+			if old[i] != cur[i] {
+				diff = append(diff, "node order changed")
+				break
+			}
+		}
+	}
+
+	return diff
+}
+
+// restoreRing returns the hash ring used to place metrics from an archive
+// that was built from the archived ring.  An error is returned if the
+// cluster's ring differs and neither -force nor -remap is set.
+func restoreRing(archived *hashing.JSONRingType) (hashing.HashRing, error) {
+	diff := RingDiff(archived, Cluster.Ring)
+	if len(diff) == 0 {
+		return Cluster.Hash, nil
+	}
+
+	log.Printf("Hash ring differs from the ring this archive was built from:")
+	for _, d := range diff {
+		log.Printf("    %s", d)
+	}
+	switch {
+	case restoreRemap:
+		log.Printf("Remapping metrics through the current hash ring.")
+		return Cluster.Hash, nil
+	case restoreForce:
+		log.Printf("Forcing restore using the archive's hash ring.")
+		return NewHashRing(archived)
+	}
+	return nil, ErrRingChanged
+}
+
+func restoreTarWorker(resolver *RingResolver, targets *TargetPicker, workIn chan *MetricData, servers []string, wg *sync.WaitGroup) {
 	for work := range workIn {
-		server := Cluster.Hash.GetNode(work.Name).Server
+		var server string
+		if targets != nil {
+			server = targets.Next()
+		} else {
+			server = Cluster.NodeHostPort(resolver.Ring().GetNode(work.Name))
+		}
 		if SingleHost && server != servers[0] {
 			log.Printf("In single mode, skipping metric %s for server %s", work.Name, server)
 			continue
 		}
-		if err := MetricEncode(work, EncSnappy); err != nil {
-			log.Printf("Skipping %s due to encoding error: %s", work.Name, err)
-			workerErrors = true
-			continue
+		// Metrics compressed by tar -compress are already encoded
+		if work.Encoding == EncIdentity {
+			if err := MetricEncode(work, EncSnappy); err != nil {
+				log.Printf("Skipping %s due to encoding error: %s", work.Name, err)
+				workFailed()
+				continue
+			}
 		}
 		log.Printf("Uploading %s => %s", work.Name, server)
-		err := PostMetric(server, work)
+		err := withRetry(context.Background(), "upload of "+work.Name, func() error {
+			return PostMetric(server, work)
+		})
+		if err == nil && work.Metadata != nil {
+			err = withRetry(context.Background(), "metadata upload of "+work.Name, func() error {
+				return PutMetadata(server, work.Name, work.Metadata)
+			})
+		}
 		if err != nil {
-			workerErrors = true
+			workFailedOn(server, work.Name)
+		} else {
+			workSucceeded()
 		}
 	}
 	wg.Done()
@@ -76,12 +245,46 @@ func restoreTarWorker(workIn chan *MetricData, servers []string, wg *sync.WaitGr
 func RestoreTar(servers []string, fd *os.File) error {
 	wg := new(sync.WaitGroup)
 	workIn := make(chan *MetricData, 25)
-	tr := tar.NewReader(fd)
+	in, err := openArchive(fd)
+	if err != nil {
+		log.Printf("Error reading tar archive: %s", err)
+		return err
+	}
+	tr := tar.NewReader(in)
 
-	wg.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go restoreTarWorker(workIn, servers, wg)
+	// Workers start with the first metric once the ring metadata at the
+	// start of the archive has been checked.
+	var ring hashing.HashRing
+	pinned := false
+	var resolver *RingResolver
+	targets := NewTargetPicker(restoreTargets)
+	start := func() {
+		if ring == nil {
+			if targets == nil {
+				// With -target the ring record is skipped, not missing
+				log.Printf("Archive has no hash ring record, using the current ring.")
+			}
+			ring = Cluster.Hash
+		}
+		resolver = NewRingResolver(Cluster.Ring, ring, func() (*hashing.JSONRingType, error) {
+			return discoverRing(HostPort)
+		})
+		switch {
+		case targets != nil && Reresolve > 0:
+			log.Printf("Warning: Restoring to -target, -reresolve has no effect.")
+		case pinned && Reresolve > 0:
+			log.Printf("Warning: Restoring by the archive's ring, -reresolve has no effect.")
+		case targets == nil:
+			resolver.Start(Reresolve)
+		}
+		wg.Add(metricWorkers)
+		for i := 0; i < metricWorkers; i++ {
+			go restoreTarWorker(resolver, targets, workIn, servers, wg)
+		}
 	}
+	started := false
+	// A metric is held until the next entry in case its sidecar follows
+	var pending *MetricData
 
 	for {
 		hdr, err := tr.Next()
@@ -93,6 +296,28 @@ func RestoreTar(servers []string, fd *os.File) error {
 			log.Printf("Error reading tar archive: %s", err)
 			return err
 		}
+		if _, ok := hdr.PAXRecords["BUCKYTOOLS.ring"]; ok && targets != nil {
+			// The ring is bypassed
+			continue
+		}
+		if blob, ok := hdr.PAXRecords["BUCKYTOOLS.ring"]; ok && hdr.Typeflag == tar.TypeXGlobalHeader {
+			archived := new(hashing.JSONRingType)
+			err = json.Unmarshal([]byte(blob), archived)
+			if err == nil {
+				ring, err = restoreRing(archived)
+				pinned = ring != Cluster.Hash
+			}
+			if err != nil {
+				log.Printf("Error checking archive hash ring: %s", err)
+				return err
+			}
+			continue
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader || hdr.Typeflag == tar.TypeDir {
+			// Archive metadata such as the totals record, or a directory
+			// written by tar -dirs
+			continue
+		}
 		if (hdr.Typeflag != tar.TypeRegA) && (hdr.Typeflag != tar.TypeReg) && (hdr.Typeflag != tar.TypeGNUSparse) {
 			// A non-normal file, probably directory
 			log.Printf("Non-restorable file/directory. Type: 0x%X Name: %s",
@@ -100,6 +325,21 @@ func RestoreTar(servers []string, fd *os.File) error {
 			continue
 		}
 
+		if isMetadataEntry(hdr.Name) {
+			// The sidecar follows the metric it belongs to
+			name := RelativeToMetric(filepath.Join(tarPrefix,
+				strings.TrimSuffix(hdr.Name, MetadataSuffix)))
+			if pending == nil || pending.Name != name {
+				log.Printf("Skipping metadata %s without its metric", hdr.Name)
+				continue
+			}
+			if pending.Metadata, err = ioutil.ReadAll(tr); err != nil {
+				log.Printf("Error reading data from tar: %s", err)
+				return err
+			}
+			continue
+		}
+
 		buf := new(bytes.Buffer)
 		metric := new(MetricData)
 		metric.Name = RelativeToMetric(filepath.Join(tarPrefix, hdr.Name))
@@ -113,19 +353,43 @@ func RestoreTar(servers []string, fd *os.File) error {
 			return err
 		}
 		metric.Data = buf.Bytes()
-		if int64(len(metric.Data)) != metric.Size {
+		if int64(len(metric.Data)) != hdr.Size {
 			log.Printf("Error: Data from tar file not the correct size.")
 			return fmt.Errorf("Data from tar file not the correct size.")
 		}
+		if hdr.PAXRecords["BUCKYTOOLS.encoding"] == "snappy" {
+			metric.Encoding = EncSnappy
+			metric.Size, err = strconv.ParseInt(hdr.PAXRecords["BUCKYTOOLS.entry_size"], 10, 64)
+			if err != nil {
+				log.Printf("Error: Bad size for compressed metric %s: %s", metric.Name, err)
+				return err
+			}
+		}
 		// XXX: Snappy Compress for transit?
-		workIn <- metric
+		if !started {
+			start()
+			started = true
+		}
+		if pending != nil {
+			workIn <- pending
+		}
+		pending = metric
+	}
+	if pending != nil {
+		workIn <- pending
 	}
 
 	close(workIn)
 	wg.Wait()
+	if resolver != nil {
+		resolver.Stop()
+		if n := resolver.Changes(); n > 0 {
+			log.Printf("Cluster membership changed %d times during the restore.", n)
+		}
+	}
 
 	log.Printf("Restore complete.")
-	if workerErrors {
+	if workerErrors() {
 		log.Printf("Errors are present in restore.")
 		return fmt.Errorf("Errors uploading metric data present.")
 	}
@@ -137,29 +401,74 @@ func restoreCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+		log.Print("At least one argument is required.")
+		return ExitUsage
 	}
 	if !Cluster.Healthy {
 		log.Printf("Cluster is not optimal.")
-		return 1
+		return ExitUsage
+	}
+	if len(restoreTargets) > 0 {
+		if SingleHost {
+			log.Print("The -s and -target options can not be combined.")
+			return ExitUsage
+		}
+		// Only the targets are written to
+		if !checkTargets(restoreTargets) {
+			return ExitUsage
+		}
+		log.Printf("Restoring to %s round robin, bypassing the hash ring.",
+			strings.Join(restoreTargets, ", "))
+	} else if !checkWritable(Cluster.HostPorts()) {
+		return ExitUsage
 	}
 
-	if c.Flag.Arg(0) != "-" {
-		fd, err := os.Open(c.Flag.Arg(0))
-		if err != nil {
-			log.Fatal("Error opening tar archive: %s", err)
+	if c.Flag.Arg(0) == "-" {
+		if c.Flag.NArg() > 1 {
+			log.Print("Only one archive may be read from STDIN.")
+			return ExitUsage
 		}
-		err = RestoreTar(Cluster.HostPorts(), fd)
-	} else {
 		err = RestoreTar(Cluster.HostPorts(), os.Stdin)
+	} else {
+		// Check every part is there before restoring any of them
+		for _, file := range c.Flag.Args() {
+			if _, err := os.Stat(file); err != nil {
+				log.Printf("Error opening tar archive: %s", err)
+				return ExitUsage
+			}
+		}
+		err = restoreArchives(c.Flag.Args())
+	}
+	if err == ErrRingChanged {
+		recordError(err)
+		return ExitUsage
 	}
 
-	if err != nil {
-		return 1
+	return exitStatus(err)
+}
+
+// restoreArchives restores each of the named archives in turn, such as the
+// parts written by tar -split-size.  It stops at the first archive that
+// can not be restored.
+func restoreArchives(files []string) error {
+	for _, file := range files {
+		fd, err := os.Open(file)
+		if err != nil {
+			log.Printf("Error opening tar archive: %s", err)
+			return err
+		}
+		if len(files) > 1 {
+			log.Printf("Restoring %s", file)
+		}
+		err = RestoreTar(Cluster.HostPorts(), fd)
+		fd.Close()
+		if err != nil {
+			return err
+		}
 	}
-	return 0
+	return nil
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// restoreTestCluster sets up Cluster with the given ring whose buckyd
+// daemons all listen on port.
+func restoreTestCluster(ring *hashing.JSONRingType, port string) {
+	hash, _ := NewHashRing(ring)
+	Cluster = &ClusterConfig{
+		Port:     port,
+		Hash:     hash,
+		Replicas: ring.Replicas,
+		Ring:     ring,
+		Healthy:  true,
+	}
+	for _, n := range ring.Nodes {
+		Cluster.Servers = append(Cluster.Servers, n.Server)
+	}
+}
+
+// restoreTestArchive writes an archive of one metric that records the
+// given ring and returns the open file.
+func restoreTestArchive(t *testing.T, ring *hashing.JSONRingType) *os.File {
+	fd, err := ioutil.TempFile("", "restore_test")
+	if err != nil {
+		t.Fatalf("Error creating archive: %s", err)
+	}
+	os.Remove(fd.Name())
+
+	tw := tar.NewWriter(fd)
+	th, _ := ringHeader(ring)
+	tw.WriteHeader(th)
+	data := []byte("whisper data")
+	tw.WriteHeader(&tar.Header{
+		Name:    "foo/bar.wsp",
+		Size:    int64(len(data)),
+		Mode:    0644,
+		ModTime: time.Now(),
+	})
+	tw.Write(data)
+	tw.Close()
+	fd.Seek(0, 0)
+	return fd
+}
+
+func ringFor(replicas int, servers ...string) *hashing.JSONRingType {
+	ring := &hashing.JSONRingType{Algo: "carbon", Replicas: replicas}
+	for _, s := range servers {
+		ring.Nodes = append(ring.Nodes, hashing.NewNode(s, 0, ""))
+	}
+	return ring
+}
+
+func TestRingDiff(t *testing.T) {
+	a := ringFor(1, "graphite010", "graphite011")
+	if diff := RingDiff(a, ringFor(1, "graphite011", "graphite010")); len(diff) != 0 {
+		t.Errorf("Node order should not matter for carbon: %v", diff)
+	}
+
+	diff := RingDiff(a, ringFor(2, "graphite010", "graphite012"))
+	expected := []string{"replicas: 1 => 2", "- graphite011", "+ graphite012"}
+	if len(diff) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, diff)
+	}
+	for i := range expected {
+		if diff[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, diff)
+		}
+	}
+
+	b := ringFor(1, "graphite010", "graphite011")
+	b.Algo = "jump_fnv1a"
+	c := ringFor(1, "graphite011", "graphite010")
+	c.Algo = "jump_fnv1a"
+	if diff := RingDiff(b, c); len(diff) != 1 {
+		t.Errorf("Node order change not detected for jump hash: %v", diff)
+	}
+}
+
+// restoreTo restores an archive built from the archived ring into a
+// cluster using the current ring and returns the hosts that received
+// uploads.
+func restoreTo(t *testing.T, archived, current *hashing.JSONRingType) ([]string, error) {
+	var lock sync.Mutex
+	hosts := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		hosts = append(hosts, r.Host)
+		lock.Unlock()
+	}))
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+
+	restoreTestCluster(current, port)
+	defer func() { Cluster = nil }()
+	workerFailed = 0
+	metricWorkers = 1
+
+	fd := restoreTestArchive(t, archived)
+	defer fd.Close()
+	err := RestoreTar(Cluster.HostPorts(), fd)
+	return hosts, err
+}
+
+func TestRestoreRingChanged(t *testing.T) {
+	archived := ringFor(1, "127.0.0.1")
+	current := ringFor(1, "localhost")
+	defer func() {
+		restoreForce = false
+		restoreRemap = false
+	}()
+
+	hosts, err := restoreTo(t, archived, current)
+	if err == nil {
+		t.Errorf("Restore into a changed ring was not refused")
+	}
+	if len(hosts) != 0 {
+		t.Errorf("Metrics uploaded in refused restore: %v", hosts)
+	}
+
+	restoreForce = true
+	hosts, err = restoreTo(t, archived, current)
+	if err != nil {
+		t.Errorf("Forced restore failed: %s", err)
+	}
+	if len(hosts) != 1 || hostOnly(hosts[0]) != "127.0.0.1" {
+		t.Errorf("Forced restore did not use the archive's ring: %v", hosts)
+	}
+
+	restoreForce = false
+	restoreRemap = true
+	hosts, err = restoreTo(t, archived, current)
+	if err != nil {
+		t.Errorf("Remapped restore failed: %s", err)
+	}
+	if len(hosts) != 1 || hostOnly(hosts[0]) != "localhost" {
+		t.Errorf("Remapped restore did not use the current ring: %v", hosts)
+	}
+}
+
+func TestRestoreRingUnchanged(t *testing.T) {
+	ring := ringFor(1, "127.0.0.1")
+	hosts, err := restoreTo(t, ring, ringFor(1, "127.0.0.1"))
+	if err != nil {
+		t.Errorf("Restore failed: %s", err)
+	}
+	if len(hosts) != 1 {
+		t.Errorf("Expected 1 upload, got %v", hosts)
+	}
+}
+
+func TestRestoreTargets(t *testing.T) {
+	var lock sync.Mutex
+	uploads := make(map[string][]string)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			w.Write([]byte(`{"Name": "target"}`))
+			return
+		}
+		lock.Lock()
+		uploads[r.Host] = append(uploads[r.Host], r.URL.Path)
+		lock.Unlock()
+	}
+	first := httptest.NewServer(http.HandlerFunc(handler))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(handler))
+	defer second.Close()
+	targets := []string{
+		strings.TrimPrefix(first.URL, "http://"),
+		strings.TrimPrefix(second.URL, "http://"),
+	}
+
+	// The ring owner is not a target and the archive's ring differs
+	restoreTestCluster(ringFor(1, "graphite010"), "4242")
+	restoreTargets = targets
+	workerFailed = 0
+	metricWorkers = 3
+	defer func() {
+		Cluster = nil
+		restoreTargets = nil
+	}()
+
+	fd, err := ioutil.TempFile("", "restore_test")
+	if err != nil {
+		t.Fatalf("Error creating archive: %s", err)
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	tw := tar.NewWriter(fd)
+	th, _ := ringHeader(ringFor(1, "graphite099"))
+	tw.WriteHeader(th)
+	for i := 0; i < 10; i++ {
+		data := []byte("whisper data")
+		tw.WriteHeader(&tar.Header{Name: fmt.Sprintf("foo/bar%d.wsp", i),
+			Size: int64(len(data)), Mode: 0644, ModTime: time.Now()})
+		tw.Write(data)
+	}
+	tw.Close()
+	fd.Seek(0, 0)
+
+	if err := RestoreTar(Cluster.HostPorts(), fd); err != nil {
+		t.Fatalf("Restore to targets failed: %s", err)
+	}
+	total := 0
+	for host, paths := range uploads {
+		if !containsString(targets, host) {
+			t.Errorf("Metrics restored to %s, not a target: %v", host, paths)
+		}
+		if len(paths) != 5 {
+			t.Errorf("Expected 5 metrics round robin on %s, got %d", host, len(paths))
+		}
+		total += len(paths)
+	}
+	if total != 10 {
+		t.Errorf("Expected 10 metrics restored, got %d", total)
+	}
+
+	if !checkTargets(targets) {
+		t.Errorf("Reachable targets failed the check")
+	}
+	second.Close()
+	if checkTargets(targets) {
+		t.Errorf("An unreachable target passed the check")
+	}
+}
+
+func TestRestoreTargetsWritable(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/status" {
+			w.Write([]byte(`{"Name": "target"}`))
+		}
+	}))
+	defer target.Close()
+	// The only cluster member is in read-only maintenance
+	maint := statusServer(`{"Name":"127.0.0.1","Maintenance":true}`)
+	defer maint.Close()
+	_, port, _ := net.SplitHostPort(maint.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	restoreTargets = []string{strings.TrimPrefix(target.URL, "http://")}
+	workerFailed = 0
+	metricWorkers = 1
+	defer func() {
+		Cluster = nil
+		restoreTargets = nil
+	}()
+
+	// An archive without a ring record
+	fd, err := ioutil.TempFile("", "restore_test")
+	if err != nil {
+		t.Fatalf("Error creating archive: %s", err)
+	}
+	defer os.Remove(fd.Name())
+	tw := tar.NewWriter(fd)
+	data := []byte("whisper data")
+	tw.WriteHeader(&tar.Header{Name: "foo/bar.wsp", Size: int64(len(data)),
+		Mode: 0644, ModTime: time.Now()})
+	tw.Write(data)
+	tw.Close()
+	fd.Close()
+
+	buf := new(bytes.Buffer)
+	log.SetOutput(buf)
+	defer log.SetOutput(os.Stderr)
+	c := Command{Name: "restore", Flag: flag.NewFlagSet("restore", flag.ContinueOnError)}
+	c.Flag.Parse([]string{fd.Name()})
+	if code := restoreCommand(c); code != ExitOK {
+		t.Errorf("Expected exit code %d, got %d: %s", ExitOK, code, buf.String())
+	}
+	if strings.Contains(buf.String(), "no hash ring record") {
+		t.Errorf("Restore to -target logged the missing ring: %s", buf.String())
+	}
+}
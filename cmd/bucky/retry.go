@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Retries is the number of times a failed request is retried.  Set up
+// by calling SetupRetry() from a sub-command's init().
+var Retries int
+
+// RetryBackoff is the delay before the first retry.  It doubles with each
+// following retry.
+var RetryBackoff time.Duration
+
+// SetupRetry installs the -retries and -retry-backoff flags in the given
+// Command.
+func SetupRetry(c Command) {
+	c.Flag.IntVar(&Retries, "retries", 3,
+		"Number of times to retry failed requests to buckyd.")
+	c.Flag.DurationVar(&RetryBackoff, "retry-backoff", time.Second,
+		"Delay before the first retry, doubled for each following retry.")
+}
+
+// withRetry calls f until it succeeds, Retries retries have been made, or
+// ctx is cancelled.  The last error from f is returned.  What describes
+// the operation in log messages.
+func withRetry(ctx context.Context, what string, f func() error) error {
+	return withRetries(ctx, Retries, what, f)
+}
+
+// withRetries is withRetry making at most retries retries.  Requests
+// refused by an open circuit breaker are not retried.
+func withRetries(ctx context.Context, retries int, what string, f func() error) error {
+	backoff := RetryBackoff
+	err := f()
+	for i := 1; err != nil && err != ErrCircuitOpen && i <= retries; i++ {
+		log.Printf("Retrying %s in %s (%d of %d): %s", what, backoff, i, retries, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+		err = f()
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWithRetry(t *testing.T) {
+	Retries = 3
+	RetryBackoff = time.Millisecond
+	defer func() { Retries = 0 }()
+
+	calls := 0
+	err := withRetry(context.Background(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return fmt.Errorf("failure %d", calls)
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("Expected success on third call: %d calls, err %v", calls, err)
+	}
+
+	calls = 0
+	err = withRetry(context.Background(), "test", func() error {
+		calls++
+		return fmt.Errorf("failure %d", calls)
+	})
+	if err == nil || calls != 4 {
+		t.Errorf("Expected failure after 4 calls: %d calls, err %v", calls, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	withRetry(ctx, "test", func() error {
+		calls++
+		return fmt.Errorf("failure %d", calls)
+	})
+	if calls != 1 {
+		t.Errorf("Retried after context was cancelled: %d calls", calls)
+	}
+}
+
+func TestInventoryRetry(t *testing.T) {
+	Retries = 2
+	RetryBackoff = time.Millisecond
+	defer func() { Retries = 0 }()
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`["foo.bar"]`))
+	}))
+	defer server.Close()
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	results, err := ListAllMetrics([]string{host}, false)
+	if err != nil {
+		t.Fatalf("Inventory was not retried: %s", err)
+	}
+	if len(results[host]) != 1 || results[host][0] != "foo.bar" {
+		t.Errorf("Bad inventory: %v", results)
+	}
+	if calls != 2 {
+		t.Errorf("Expected 2 inventory requests, got %d", calls)
+	}
+}
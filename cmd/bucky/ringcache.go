@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// RingCachePath is the file given by -ring-cache where the discovered hash
+// ring is saved and reused by later invocations until RingCacheTTL
+// passes.  RingRefresh ignores a saved ring and rediscovers it.
+var RingCachePath string
+var RingCacheTTL time.Duration
+var RingRefresh bool
+
+// SetupRingCache installs the -ring-cache, -ring-cache-ttl, and -refresh
+// flags in the given Command.  A saved ring is trusted to be healthy, so
+// only commands that look up metrics without changing them install it.
+func SetupRingCache(c Command) {
+	c.Flag.StringVar(&RingCachePath, "ring-cache", os.Getenv("BUCKYRINGCACHE"),
+		"Reuse the hash ring saved in this file rather than discovering the cluster.")
+	c.Flag.DurationVar(&RingCacheTTL, "ring-cache-ttl", 5*time.Minute,
+		"How long a hash ring saved by -ring-cache is reused.")
+	c.Flag.BoolVar(&RingRefresh, "refresh", false,
+		"Rediscover the hash ring and replace the one saved by -ring-cache.")
+}
+
+// RingCacheKey holds the options that select which cluster is discovered
+// and how its hash ring is built.  A saved ring is only used if they have
+// not changed.
+type RingCacheKey struct {
+	HostPort      string
+	RelayConfig   string
+	RelayCluster  string
+	Placement     string
+	KeyTransform  string
+	RingReplicas  int
+	Diverse       bool
+	InstancePorts string
+	Dedup         bool
+	ServerAliases string
+}
+
+// RingCacheEntry is a hash ring saved by -ring-cache.
+type RingCacheEntry struct {
+	Key   RingCacheKey
+	Saved time.Time
+	Ring  *hashing.JSONRingType
+}
+
+// ringCacheKey returns the RingCacheKey of the current options for the
+// initial buckyd daemon at hostport.
+func ringCacheKey(hostport string) RingCacheKey {
+	return RingCacheKey{
+		HostPort:      hostport,
+		RelayConfig:   RelayConfig,
+		RelayCluster:  RelayCluster,
+		Placement:     PlacementStrategy,
+		KeyTransform:  KeyTransform,
+		RingReplicas:  RingReplicas,
+		Diverse:       DiverseReplicas,
+		InstancePorts: InstancePortMap,
+		Dedup:         DedupServers,
+		ServerAliases: ServerAliasMap,
+	}
+}
+
+// loadRingCache returns the ring saved in -ring-cache for key or nil if
+// there is none, it has expired, it was saved with other options, or
+// -refresh is set.
+func loadRingCache(key RingCacheKey) *hashing.JSONRingType {
+	if RingCachePath == "" || RingRefresh {
+		return nil
+	}
+	blob, err := ioutil.ReadFile(RingCachePath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Warning: Error reading ring cache: %s", err)
+		}
+		return nil
+	}
+	entry := new(RingCacheEntry)
+	if err := json.Unmarshal(blob, entry); err != nil || entry.Ring == nil {
+		log.Printf("Warning: Ignoring corrupt ring cache %s", RingCachePath)
+		return nil
+	}
+	switch {
+	case entry.Key != key:
+		if Verbose {
+			log.Printf("Ring cache %s was saved with other options", RingCachePath)
+		}
+		return nil
+	case time.Since(entry.Saved) > RingCacheTTL:
+		if Verbose {
+			log.Printf("Ring cache %s has expired", RingCachePath)
+		}
+		return nil
+	}
+	if Verbose {
+		log.Printf("Using hash ring cached at %s", entry.Saved.Format(time.RFC3339))
+	}
+	return entry.Ring
+}
+
+// saveRingCache saves ring to -ring-cache for key.  The file is written to
+// a temporary name and renamed into place so concurrent invocations never
+// read a partial cache.  Errors are logged as the ring is still usable.
+func saveRingCache(key RingCacheKey, ring *hashing.JSONRingType) {
+	if RingCachePath == "" {
+		return
+	}
+	blob, err := json.Marshal(&RingCacheEntry{Key: key, Saved: time.Now(), Ring: ring})
+	if err != nil {
+		log.Printf("Warning: Error encoding ring cache: %s", err)
+		return
+	}
+	dir, base := filepath.Split(RingCachePath)
+	if dir == "" {
+		dir = "."
+	}
+	fd, err := ioutil.TempFile(dir, "."+base)
+	if err == nil {
+		_, err = fd.Write(blob)
+		if cerr := fd.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(fd.Name(), RingCachePath)
+		}
+		if err != nil {
+			os.Remove(fd.Name())
+		}
+	}
+	if err != nil {
+		log.Printf("Warning: Error saving ring cache: %s", err)
+	}
+}
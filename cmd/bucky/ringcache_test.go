@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func TestRingCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var discoveries int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&discoveries, 1)
+		host, _, _ := net.SplitHostPort(r.Host)
+		ring := &hashing.JSONRingType{Name: host, Algo: "carbon", Replicas: 1}
+		ring.Nodes = []hashing.Node{hashing.NewNode(host, 0, "")}
+		blob, _ := json.Marshal(ring)
+		w.Write(blob)
+	}))
+	defer server.Close()
+	hostport := strings.TrimPrefix(server.URL, "http://")
+
+	defer func() {
+		Cluster = nil
+		RingCachePath = ""
+		RingRefresh = false
+		RingReplicas = 0
+	}()
+	RingCachePath = filepath.Join(dir, "ring.json")
+	RingCacheTTL = time.Hour
+	discover := func(expected int32, msg string) {
+		t.Helper()
+		Cluster = nil
+		before := atomic.LoadInt32(&discoveries)
+		cluster, err := GetClusterConfig(hostport)
+		if err != nil {
+			t.Fatalf("%s: %s", msg, err)
+		}
+		if !cluster.Healthy || len(cluster.Servers) != 1 {
+			t.Errorf("%s: bad cluster %v", msg, cluster)
+		}
+		if n := atomic.LoadInt32(&discoveries) - before; n != expected {
+			t.Errorf("%s: expected %d discoveries, got %d", msg, expected, n)
+		}
+	}
+
+	discover(1, "Empty cache")
+	discover(0, "Within the TTL")
+	RingRefresh = true
+	discover(1, "With -refresh")
+	RingRefresh = false
+	RingReplicas = 50
+	discover(1, "With other -ring-replicas")
+	discover(0, "Cached with -ring-replicas")
+	RingCacheTTL = time.Nanosecond
+	discover(1, "After expiry")
+}
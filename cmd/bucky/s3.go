@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MinPartSize is the smallest part S3 accepts except for the last
+	s3MinPartSize = 5 * 1024 * 1024
+
+	// s3MaxPartSize is the largest part we upload.  S3 accepts parts of up
+	// to 5GiB but each part is held in memory until it is uploaded.
+	s3MaxPartSize = 1024 * 1024 * 1024
+
+	// s3MaxParts is the maximum number of parts in a multipart upload
+	s3MaxParts = 10000
+
+	// s3PartGrowth is the number of parts uploaded before the part size
+	// is doubled.  We don't know the size of the archive ahead of time so
+	// growing the part size lets a stream reach S3's 5TiB object limit
+	// without using more than s3MaxParts parts of at most s3MaxPartSize.
+	s3PartGrowth = 500
+)
+
+// S3 output options for sub-commands that call SetupS3()
+var s3Output string
+var s3Endpoint string
+var s3Region string
+var s3AccessKey string
+var s3SecretKey string
+var s3PathStyle bool
+var s3PartSize int64
+
+// SetupS3 installs the flags needed to write an archive to an S3
+// compatible object store.  Credentials default to the standard AWS
+// environment variables.
+func SetupS3(c Command) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	c.Flag.StringVar(&s3Output, "s3", "",
+		"Stream the archive to this s3://BUCKET/KEY URL rather than STDOUT.")
+	c.Flag.StringVar(&s3Endpoint, "s3-endpoint", os.Getenv("S3_ENDPOINT"),
+		"S3 endpoint URL.  Defaults to AWS for the given region.")
+	c.Flag.StringVar(&s3Region, "s3-region", region,
+		"S3 region used for request signing.")
+	c.Flag.StringVar(&s3AccessKey, "s3-access-key", os.Getenv("AWS_ACCESS_KEY_ID"),
+		"S3 access key.  Defaults to AWS_ACCESS_KEY_ID.")
+	c.Flag.StringVar(&s3SecretKey, "s3-secret-key", os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		"S3 secret key.  Defaults to AWS_SECRET_ACCESS_KEY.")
+	c.Flag.BoolVar(&s3PathStyle, "s3-path-style", false,
+		"Use path style S3 URLs.  Needed for MinIO and similar.")
+	c.Flag.Int64Var(&s3PartSize, "s3-part-size", 8*1024*1024,
+		"Initial multipart upload part size in bytes.")
+}
+
+// s3Part records an uploaded part for the final complete request.
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// s3Sink is a MetricSink that streams data to an S3 object using a
+// multipart upload.  Data is buffered in memory until a full part is
+// available.
+type s3Sink struct {
+	endpoint  *url.URL
+	bucket    string
+	key       string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	pathStyle bool
+
+	uploadID string
+	partSize int64
+	buf      *bytes.Buffer
+	parts    []s3Part
+}
+
+// NewS3Sink parses an s3://BUCKET/KEY URL and starts a multipart upload
+// to that location using the S3 flags.
+func NewS3Sink(s3url string) (MetricSink, error) {
+	u, err := url.Parse(s3url)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" || len(u.Path) <= 1 {
+		return nil, fmt.Errorf("Malformed S3 URL, must be s3://BUCKET/KEY: %s", s3url)
+	}
+	endpoint := s3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+		if s3Region != "us-east-1" {
+			endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s3Region)
+		}
+	}
+	e, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if s3AccessKey == "" || s3SecretKey == "" {
+		return nil, fmt.Errorf("S3 access and secret keys are required")
+	}
+	if s3PartSize < s3MinPartSize || s3PartSize > s3MaxPartSize {
+		return nil, fmt.Errorf("S3 part size must be between %d and %d bytes",
+			s3MinPartSize, s3MaxPartSize)
+	}
+
+	s := &s3Sink{
+		endpoint:  e,
+		bucket:    u.Host,
+		key:       u.Path[1:],
+		region:    s3Region,
+		accessKey: s3AccessKey,
+		secretKey: s3SecretKey,
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		pathStyle: s3PathStyle,
+		partSize:  s3PartSize,
+		buf:       new(bytes.Buffer),
+	}
+	if err := s.create(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// s3PartSizeFor returns the part size to use for the given 1 based
+// part number.  The size doubles every s3PartGrowth parts.
+func s3PartSizeFor(base int64, part int) int64 {
+	size := base << uint((part-1)/s3PartGrowth)
+	if size > s3MaxPartSize || size <= 0 {
+		return s3MaxPartSize
+	}
+	return size
+}
+
+// Write buffers p and uploads any full parts.
+func (s *s3Sink) Write(p []byte) (int, error) {
+	n, _ := s.buf.Write(p)
+	for {
+		size := s3PartSizeFor(s.partSize, len(s.parts)+1)
+		if int64(s.buf.Len()) < size {
+			break
+		}
+		// The part is only valid until the next write to the buffer
+		if err := s.upload(s.buf.Next(int(size))); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Close uploads any remaining data and completes the multipart upload.
+func (s *s3Sink) Close() error {
+	if s.buf.Len() > 0 || len(s.parts) == 0 {
+		if err := s.upload(s.buf.Bytes()); err != nil {
+			s.Abort()
+			return err
+		}
+		s.buf.Reset()
+	}
+
+	type completeUpload struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}
+	body, err := xml.Marshal(completeUpload{Parts: s.parts})
+	if err != nil {
+		s.Abort()
+		return err
+	}
+	q := url.Values{}
+	q.Set("uploadId", s.uploadID)
+	resp, err := s.do("POST", q, body)
+	if err != nil {
+		s.Abort()
+		return err
+	}
+	// S3 may report an error for a complete request with a 200 status
+	if bytes.Contains(resp, []byte("<Error>")) {
+		s.Abort()
+		return fmt.Errorf("S3 complete multipart upload failed: %s", string(resp))
+	}
+
+	log.Printf("Uploaded s3://%s/%s in %d parts", s.bucket, s.key, len(s.parts))
+	return nil
+}
+
+// Abort cancels the multipart upload so S3 discards the uploaded parts.
+func (s *s3Sink) Abort() error {
+	q := url.Values{}
+	q.Set("uploadId", s.uploadID)
+	_, err := s.do("DELETE", q, nil)
+	if err != nil {
+		log.Printf("Error aborting S3 upload %s: %s", s.uploadID, err)
+		return err
+	}
+	log.Printf("Aborted S3 upload of s3://%s/%s", s.bucket, s.key)
+	return nil
+}
+
+// create initiates the multipart upload and records the upload ID.
+func (s *s3Sink) create() error {
+	var result struct {
+		UploadId string
+	}
+
+	q := url.Values{}
+	q.Set("uploads", "")
+	resp, err := s.do("POST", q, nil)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(resp, &result); err != nil {
+		return fmt.Errorf("Error parsing S3 create multipart upload response: %s", err)
+	}
+	if result.UploadId == "" {
+		return fmt.Errorf("S3 did not return an upload ID")
+	}
+	s.uploadID = result.UploadId
+	return nil
+}
+
+// upload sends one part of the multipart upload.
+func (s *s3Sink) upload(part []byte) error {
+	if len(s.parts) >= s3MaxParts {
+		return fmt.Errorf("S3 upload exceeded %d parts", s3MaxParts)
+	}
+
+	n := len(s.parts) + 1
+	q := url.Values{}
+	q.Set("partNumber", fmt.Sprintf("%d", n))
+	q.Set("uploadId", s.uploadID)
+	r, err := s.request("PUT", q, part)
+	if err != nil {
+		return err
+	}
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("S3 upload of part %d returned %s: %s", n, resp.Status, string(msg))
+	}
+
+	s.parts = append(s.parts, s3Part{n, resp.Header.Get("ETag")})
+	if Verbose {
+		log.Printf("Uploaded S3 part %d: %d bytes", n, len(part))
+	}
+	return nil
+}
+
+// do executes a signed request against the object and returns the body.
+func (s *s3Sink) do(method string, q url.Values, body []byte) ([]byte, error) {
+	r, err := s.request(method, q, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	blob, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("S3 %s returned %s: %s", method, resp.Status, string(blob))
+	}
+	return blob, nil
+}
+
+// request builds a signed *http.Request for the object.
+func (s *s3Sink) request(method string, q url.Values, body []byte) (*http.Request, error) {
+	host := s.endpoint.Host
+	path := "/" + s.key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		host = s.bucket + "." + host
+	}
+	u := fmt.Sprintf("%s://%s%s", s.endpoint.Scheme, host, s3EncodePath(path))
+	if len(q) > 0 {
+		u = u + "?" + s3CanonicalQuery(q)
+	}
+
+	r, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if s.token != "" {
+		r.Header.Set("X-Amz-Security-Token", s.token)
+	}
+	signS3(r, body, s.accessKey, s.secretKey, s.region, time.Now())
+	return r, nil
+}
+
+// s3Escape URI encodes a string the way AWS Signature Version 4 requires.
+func s3Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// s3EncodePath URI encodes each segment of an object path.
+func s3EncodePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i := range segments {
+		segments[i] = s3Escape(segments[i])
+	}
+	return strings.Join(segments, "/")
+}
+
+// s3CanonicalQuery encodes the query parameters sorted by key.
+func s3CanonicalQuery(q url.Values) string {
+	keys := make([]string, 0)
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	params := make([]string, 0)
+	for _, k := range keys {
+		params = append(params, s3Escape(k)+"="+s3Escape(q.Get(k)))
+	}
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// signS3 adds an AWS Signature Version 4 Authorization header to the
+// request.  The host and every header already set on the request are
+// signed.
+func signS3(r *http.Request, body []byte, accessKey, secretKey, region string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	payload := sha256.Sum256(body)
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	headers := map[string]string{"host": r.URL.Host}
+	for k, v := range r.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0)
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, k := range names {
+		canonicalHeaders = canonicalHeaders + k + ":" + headers[k] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		s3CanonicalQuery(r.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, region)
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var scanExtra string
+var scanActions bool
+
+// ScanMove is a follow up action to copy a metric to a ring owner that
+// is missing its copy.
+type ScanMove struct {
+	Metric string
+	From   string
+	To     string
+}
+
+// ScanDelete is a follow up action to remove a copy of a metric from a
+// server that doesn't own it.
+type ScanDelete struct {
+	Metric string
+	Server string
+}
+
+// ScanReport is the categorized result of a consistency scan.  Server
+// keys are the HOST:PORT of the buckyd daemon that reported the metric.
+type ScanReport struct {
+	// Misplaced maps servers in the hash ring to metrics they hold but
+	// do not own
+	Misplaced map[string][]string
+
+	// UnderReplicated maps metrics to the ring owners missing a copy
+	UnderReplicated map[string][]string
+
+	// Orphaned maps servers not in the hash ring to the metrics they hold
+	Orphaned map[string][]string
+
+	// Moves and Deletes are the actions needed to repair the cluster.
+	// Moves should be completed before Deletes.
+	Moves   []ScanMove   `json:",omitempty"`
+	Deletes []ScanDelete `json:",omitempty"`
+}
+
+func init() {
+	usage := "[options] <metric expression>"
+	short := "Audit metric placement against the hash ring."
+	long := `Compare where each metric physically lives with where the hash ring says
+it should live.  Without any arguments every metric in the cluster is
+scanned.
+
+The default mode is to work with lists.  The arguments are a series of one or
+more metric key names.  If the first argument is a "-" then read a JSON array
+from STDIN as our list of metrics.  Use -r to enable regular expression mode.
+
+Metrics are reported in three categories:
+
+  misplaced         A copy lives on a ring member that doesn't own it.
+  under-replicated  Fewer ring owners than the replication factor hold a copy.
+  orphaned          A copy lives on a server no longer in the hash ring.
+
+Use -extra to give a comma separated list of HOST:PORT buckyd daemons that
+are not in the hash ring to search for orphaned metrics.
+
+Use -actions to include the move and delete actions needed to repair the
+cluster.  Moves copy a metric to each owner missing a copy and should be
+completed before the deletes that remove copies from non-owners.`
+
+	c := NewCommand(scanCommand, "scan", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupJSON(c)
+	SetupRetry(c)
+
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemons to rebuild their cache.")
+	c.Flag.StringVar(&scanExtra, "extra", "",
+		"Comma separated HOST:PORTs of buckyd daemons not in the hash ring.")
+	c.Flag.BoolVar(&scanActions, "actions", false,
+		"Include the move and delete actions needed to repair placement.")
+}
+
+// hostOnly strips the port from a HOST:PORT string if present.
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	return host
+}
+
+// ScanPlacement compares the inventory, a map of buckyd HOST:PORT =>
+// metrics, to the placement dictated by the ring and builds a report.
+// Replicas is the replication factor of the cluster.
+func ScanPlacement(ring hashing.HashRing, replicas int, inventory map[string][]string) *ScanReport {
+	report := &ScanReport{
+		Misplaced:       make(map[string][]string),
+		UnderReplicated: make(map[string][]string),
+		Orphaned:        make(map[string][]string),
+	}
+
+	members := make(map[string]bool)
+	for _, n := range ring.Nodes() {
+		members[n.Server] = true
+	}
+
+	// Invert the inventory to metric => servers holding a copy
+	locations := make(map[string][]string)
+	servers := make([]string, 0)
+	for server := range inventory {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		for _, m := range inventory[server] {
+			if strings.HasPrefix(m, "carbon.agents.") {
+				// Inserted after hashing, never consistent
+				continue
+			}
+			locations[m] = append(locations[m], server)
+		}
+	}
+
+	metrics := make([]string, 0)
+	for m := range locations {
+		metrics = append(metrics, m)
+	}
+	sort.Strings(metrics)
+	for _, m := range metrics {
+		owners := RingOwners(ring, replicas, m)
+		held := make(map[string]string) // owner host => HOST:PORT
+		strays := make([]string, 0)
+		for _, server := range locations[m] {
+			host := hostOnly(server)
+			switch {
+			case containsString(owners, host):
+				held[host] = server
+			case members[host]:
+				report.Misplaced[server] = append(report.Misplaced[server], m)
+				strays = append(strays, server)
+			default:
+				report.Orphaned[server] = append(report.Orphaned[server], m)
+				strays = append(strays, server)
+			}
+		}
+
+		missing := make([]string, 0)
+		for _, o := range owners {
+			if _, ok := held[o]; !ok {
+				missing = append(missing, o)
+			}
+		}
+		if len(missing) > 0 {
+			report.UnderReplicated[m] = missing
+		}
+
+		// Prefer copying from a stray copy as that is what the owner
+		// should have received.  Otherwise replicate from an owner.
+		source := ""
+		if len(strays) > 0 {
+			source = strays[0]
+		} else {
+			for _, o := range owners {
+				if held[o] != "" {
+					source = held[o]
+					break
+				}
+			}
+		}
+		for _, o := range missing {
+			report.Moves = append(report.Moves, ScanMove{m, source, o})
+		}
+		for _, s := range strays {
+			report.Deletes = append(report.Deletes, ScanDelete{m, s})
+		}
+	}
+
+	return report
+}
+
+// printScanReport writes a human readable report to STDOUT.
+func printScanReport(report *ScanReport) {
+	for _, category := range []struct {
+		name string
+		hash map[string][]string
+	}{
+		{"misplaced", report.Misplaced},
+		{"orphaned", report.Orphaned},
+	} {
+		servers := make([]string, 0)
+		for s := range category.hash {
+			servers = append(servers, s)
+		}
+		sort.Strings(servers)
+		for _, s := range servers {
+			for _, m := range category.hash[s] {
+				fmt.Printf("%s: %s: %s\n", category.name, s, m)
+			}
+		}
+	}
+
+	metrics := make([]string, 0)
+	for m := range report.UnderReplicated {
+		metrics = append(metrics, m)
+	}
+	sort.Strings(metrics)
+	for _, m := range metrics {
+		fmt.Printf("under-replicated: %s: missing on %s\n", m,
+			strings.Join(report.UnderReplicated[m], ", "))
+	}
+
+	if scanActions {
+		for _, a := range report.Moves {
+			fmt.Printf("move: %s: %s => %s\n", a.Metric, a.From, a.To)
+		}
+		for _, a := range report.Deletes {
+			fmt.Printf("delete: %s: %s\n", a.Metric, a.Server)
+		}
+	}
+}
+
+// scanCommand runs this subcommand.
+func scanCommand(c Command) int {
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if !Cluster.Healthy {
+		log.Printf("Warning: Cluster is not healthy!")
+	}
+
+	hostPorts := Cluster.HostPorts()
+	if scanExtra != "" {
+		hostPorts = append(hostPorts, strings.Split(scanExtra, ",")...)
+	}
+
+	inventory, err := ListSelection(c, hostPorts)
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return ExitError
+	}
+
+	report := ScanPlacement(Cluster.Hash, Cluster.Replicas, inventory)
+	log.Printf("%d misplaced, %d under-replicated, %d orphaned metrics found.",
+		countMap(report.Misplaced), len(report.UnderReplicated),
+		countMap(report.Orphaned))
+	if !scanActions {
+		report.Moves = nil
+		report.Deletes = nil
+	}
+
+	if JSONOutput {
+		blob, err := json.Marshal(report)
+		if err != nil {
+			log.Printf("%s", err)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		printScanReport(report)
+	}
+
+	return ExitOK
+}
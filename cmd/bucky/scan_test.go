@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func scanTestRing() hashing.HashRing {
+	ring := hashing.NewCarbonHashRing()
+	for _, s := range []string{"graphite010", "graphite011", "graphite012"} {
+		ring.AddNode(hashing.NewNode(s, 0, ""))
+	}
+	return ring
+}
+
+// notOwner returns the ring member that doesn't own the metric given
+// a replication factor of 2 in a 3 node ring.
+func notOwner(owners []string) string {
+	for _, s := range []string{"graphite010", "graphite011", "graphite012"} {
+		if !containsString(owners, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+func TestScanPlacement(t *testing.T) {
+	ring := scanTestRing()
+	inventory := make(map[string][]string)
+	add := func(server, metric string) {
+		hp := server + ":4242"
+		inventory[hp] = append(inventory[hp], metric)
+	}
+
+	// Correctly placed on both owners
+	ok := RingOwners(ring, 2, "foo.ok")
+	add(ok[0], "foo.ok")
+	add(ok[1], "foo.ok")
+
+	// Both owners plus an extra copy on a ring member
+	misplaced := RingOwners(ring, 2, "foo.misplaced")
+	add(misplaced[0], "foo.misplaced")
+	add(misplaced[1], "foo.misplaced")
+	add(notOwner(misplaced), "foo.misplaced")
+
+	// Only the primary owner has a copy
+	under := RingOwners(ring, 2, "foo.under")
+	add(under[0], "foo.under")
+
+	// Both owners plus a copy on a server removed from the ring
+	orphan := RingOwners(ring, 2, "foo.orphan")
+	add(orphan[0], "foo.orphan")
+	add(orphan[1], "foo.orphan")
+	add("graphite009", "foo.orphan")
+
+	report := ScanPlacement(ring, 2, inventory)
+
+	if countMap(report.Misplaced) != 1 {
+		t.Errorf("Expected 1 misplaced metric: %v", report.Misplaced)
+	}
+	m := report.Misplaced[notOwner(misplaced)+":4242"]
+	if len(m) != 1 || m[0] != "foo.misplaced" {
+		t.Errorf("foo.misplaced not reported as misplaced: %v", report.Misplaced)
+	}
+
+	if len(report.UnderReplicated) != 1 {
+		t.Errorf("Expected 1 under-replicated metric: %v", report.UnderReplicated)
+	}
+	missing := report.UnderReplicated["foo.under"]
+	if len(missing) != 1 || missing[0] != under[1] {
+		t.Errorf("foo.under should be missing on %s: %v", under[1], missing)
+	}
+
+	if countMap(report.Orphaned) != 1 {
+		t.Errorf("Expected 1 orphaned metric: %v", report.Orphaned)
+	}
+	o := report.Orphaned["graphite009:4242"]
+	if len(o) != 1 || o[0] != "foo.orphan" {
+		t.Errorf("foo.orphan not reported as orphaned: %v", report.Orphaned)
+	}
+
+	if len(report.Moves) != 1 {
+		t.Fatalf("Expected 1 move action: %v", report.Moves)
+	}
+	move := report.Moves[0]
+	if move.Metric != "foo.under" || move.From != under[0]+":4242" || move.To != under[1] {
+		t.Errorf("Bad move action: %v", move)
+	}
+	if len(report.Deletes) != 2 {
+		t.Errorf("Expected 2 delete actions: %v", report.Deletes)
+	}
+	for _, d := range report.Deletes {
+		if d.Metric == "foo.ok" || d.Metric == "foo.under" {
+			t.Errorf("Correctly placed copy scheduled for delete: %v", d)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// tarSecondaryOutput is the -secondary file, or s3://BUCKET/KEY, that
+// receives a best-effort copy of the archive.
+var tarSecondaryOutput string
+
+// tarSecondaryQueue is the number of metrics the -secondary copy may fall
+// behind the primary archive before metrics are dropped from it.
+var tarSecondaryQueue int
+
+// tarSecondary is the -secondary copy of the archive being written.
+var tarSecondary *SecondaryArchive
+
+// SecondaryArchive writes a best-effort copy of the archive to a slow
+// sink without slowing down the primary archive.  Prepared entries are
+// queued and written by their own goroutine.  An entry that does not fit
+// in the queue is dropped from the copy, which remains a valid archive of
+// the other metrics.
+type SecondaryArchive struct {
+	sink    MetricSink
+	queue   chan *tarEntry
+	done    chan struct{}
+	started bool
+	written int
+	dropped int32
+	err     error
+}
+
+// NewSecondaryArchive returns a SecondaryArchive writing to sink that may
+// fall queue metrics behind.
+func NewSecondaryArchive(sink MetricSink, queue int) *SecondaryArchive {
+	return &SecondaryArchive{
+		sink:  sink,
+		queue: make(chan *tarEntry, queue),
+		done:  make(chan struct{}),
+	}
+}
+
+// NewSecondarySink returns the sink of the -secondary output at path.
+func NewSecondarySink(path string) (MetricSink, error) {
+	if strings.HasPrefix(path, "s3://") {
+		return NewS3Sink(path)
+	}
+	return NewFileSink(path)
+}
+
+// Start begins writing the copy with the -format and -z of the primary
+// archive and the given hash ring record.
+func (s *SecondaryArchive) Start(ring *hashing.JSONRingType) {
+	s.started = true
+	go s.run(ring)
+}
+
+// Offer queues e to be written to the copy or drops it if the copy has
+// fallen too far behind.  It never blocks.
+func (s *SecondaryArchive) Offer(e *tarEntry) {
+	select {
+	case s.queue <- e:
+	default:
+		atomic.AddInt32(&s.dropped, 1)
+		log.Printf("Warning: Secondary archive can't keep up, dropped %s", e.Metric.Name)
+	}
+}
+
+// run writes the queued entries until the queue is closed.  After an
+// error the remaining entries are discarded.
+func (s *SecondaryArchive) run(ring *hashing.JSONRingType) {
+	defer close(s.done)
+	var w io.Writer = s.sink
+	var gz *gzip.Writer
+	if tarGzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+	tw, err := newMetricArchiveWriter(tarFormat, w)
+	if err == nil && ring != nil {
+		var th *tar.Header
+		th, err = ringHeader(ring)
+		if err == nil {
+			err = tw.WriteHeader(th)
+		}
+	}
+	s.err = err
+
+	var size int64
+	for e := range s.queue {
+		if s.err != nil {
+			continue
+		}
+		if s.err = writeEntryFiles(tw, e); s.err == nil {
+			s.written++
+			size += e.Size
+		}
+	}
+
+	if s.err == nil && tarTotals {
+		s.err = tw.WriteHeader(totalsHeader(s.written, size))
+	}
+	if s.err == nil {
+		s.err = tw.Close()
+	}
+	if s.err == nil && gz != nil {
+		s.err = gz.Close()
+	}
+}
+
+// Close waits for the queued entries to be written and completes the
+// copy.  The copy is discarded if writing it failed or never started.
+func (s *SecondaryArchive) Close() error {
+	if !s.started {
+		return s.sink.Abort()
+	}
+	close(s.queue)
+	<-s.done
+	if s.err != nil {
+		s.sink.Abort()
+		return s.err
+	}
+	return s.sink.Close()
+}
+
+// Abort discards the copy.
+func (s *SecondaryArchive) Abort() {
+	if s.started {
+		close(s.queue)
+		<-s.done
+	}
+	s.sink.Abort()
+}
+
+// Dropped returns the number of metrics left out of the copy.
+func (s *SecondaryArchive) Dropped() int {
+	return int(atomic.LoadInt32(&s.dropped))
+}
+
+// Summary logs how much of the archive the copy holds.
+func (s *SecondaryArchive) Summary() {
+	log.Printf("Secondary archive: %d metrics written, %d dropped.", s.written, s.Dropped())
+}
+
+// closeSecondary completes the -secondary copy, if any, once the primary
+// archive is done.  A failure is logged but does not fail the run.
+func closeSecondary() {
+	if tarSecondary == nil {
+		return
+	}
+	started := tarSecondary.started
+	if err := tarSecondary.Close(); err != nil {
+		log.Printf("Warning: Secondary archive failed: %s", err)
+	}
+	if started {
+		tarSecondary.Summary()
+	}
+}
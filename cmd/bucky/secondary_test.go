@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slowSink is a MetricSink that takes delay for every write.
+type slowSink struct {
+	bytes.Buffer
+	delay  time.Duration
+	closed bool
+}
+
+func (s *slowSink) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	return s.Buffer.Write(p)
+}
+
+func (s *slowSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func (s *slowSink) Abort() error {
+	return nil
+}
+
+// countEntries returns the number of metrics in the tar archive in buf.
+func countEntries(t *testing.T, buf *bytes.Buffer) int {
+	tr := tar.NewReader(buf)
+	n := 0
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			return n
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.Typeflag == tar.TypeReg {
+			n++
+		}
+	}
+}
+
+func TestTarSecondary(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 4
+	secondary := &slowSink{delay: 10 * time.Millisecond}
+	tarSecondary = NewSecondaryArchive(secondary, 2)
+	defer func() { tarSecondary = nil }()
+	names := make([]string, 0)
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("foo.m%02d", i))
+	}
+	metricMap := map[string][]string{strings.TrimPrefix(server.URL, "http://"): names}
+
+	// Writing every metric to the secondary would take at least 400ms
+	primary := new(bytes.Buffer)
+	start := time.Now()
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{primary}); err != nil {
+		t.Fatalf("Error building archive: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("The slow secondary slowed the primary archive to %s", elapsed)
+	}
+	if n := countEntries(t, primary); n != len(names) {
+		t.Errorf("Expected %d metrics in the primary archive, got %d", len(names), n)
+	}
+
+	dropped := tarSecondary.Dropped()
+	if dropped == 0 {
+		t.Errorf("Expected the slow secondary to drop metrics")
+	}
+	if TarRunStats().SecondaryDropped != dropped {
+		t.Errorf("Expected %d drops in the statistics, got %d", dropped, TarRunStats().SecondaryDropped)
+	}
+	if err := tarSecondary.Close(); err != nil || !secondary.closed {
+		t.Fatalf("Error closing secondary archive: %v", err)
+	}
+	if n := countEntries(t, &secondary.Buffer); n != len(names)-dropped || n != tarSecondary.written {
+		t.Errorf("Expected %d metrics in the secondary archive, got %d", len(names)-dropped, n)
+	}
+}
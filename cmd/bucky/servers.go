@@ -26,7 +26,7 @@ func serversCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	fmt.Printf("Buckd daemons are using port: %s\n", Cluster.Port)
@@ -40,8 +40,8 @@ func serversCommand(c Command) int {
 	fmt.Printf("\nIs cluster healthy: %v\n", Cluster.Healthy)
 	if !Cluster.Healthy {
 		log.Printf("Cluster is inconsistent.")
-		return 1
+		return ExitError
 	}
 
-	return 0
+	return ExitOK
 }
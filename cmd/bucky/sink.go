@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// MetricSink is a destination for an archive stream built by bucky.
+// Writes are the raw bytes of the archive.  Close finalizes the archive
+// and makes it available at its destination.  Abort discards everything
+// written so far so that a partial archive is never left addressable.
+type MetricSink interface {
+	io.Writer
+
+	// Close completes the archive.  The sink must not be used afterwards.
+	Close() error
+
+	// Abort throws away the archive.  The sink must not be used afterwards.
+	Abort() error
+}
+
+// stdoutSink writes the archive to STDOUT.  There is no way to take back
+// data written to STDOUT so Abort is a no-op.
+type stdoutSink struct {
+	io.Writer
+}
+
+func (s *stdoutSink) Close() error {
+	return nil
+}
+
+func (s *stdoutSink) Abort() error {
+	return nil
+}
+
+// NewStdoutSink returns a MetricSink that writes to STDOUT.
+func NewStdoutSink() MetricSink {
+	return &stdoutSink{os.Stdout}
+}
+
+// fileSink writes the archive to a temporary file in the same directory
+// as the final destination and renames it into place on Close.  Readers
+// never see a partially written archive.
+type fileSink struct {
+	*os.File
+	path string
+}
+
+// NewFileSink returns a MetricSink that atomically creates the file at
+// path when the archive is closed.
+func NewFileSink(path string) (MetricSink, error) {
+	fd, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	return &fileSink{fd, path}, nil
+}
+
+func (s *fileSink) Close() error {
+	if err := s.File.Sync(); err != nil {
+		s.Abort()
+		return err
+	}
+	if err := s.File.Close(); err != nil {
+		os.Remove(s.File.Name())
+		return err
+	}
+	if err := os.Chmod(s.File.Name(), 0644); err != nil {
+		os.Remove(s.File.Name())
+		return err
+	}
+	return os.Rename(s.File.Name(), s.path)
+}
+
+func (s *fileSink) Abort() error {
+	s.File.Close()
+	return os.Remove(s.File.Name())
+}
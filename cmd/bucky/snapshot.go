@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// snapshotFile is the -o file written by snapshot and the -i file read by
+// restore-snapshot.
+var snapshotFile string
+
+// snapshotTo is the -to server restore-snapshot uploads to.
+var snapshotTo string
+
+// snapshotAlgo is the checksum algorithm of the snapshot sidecar file.
+const snapshotAlgo = "sha256"
+
+func init() {
+	usage := "[options] <metric>"
+	short := "Save one metric's Whisper DB to a file for debugging."
+	long := `Download the Whisper DB of a single metric from its owner in the hash
+ring to the file given by -o.  The file is the plain Whisper DB with the
+metric's mode and modification time, and can be inspected with the usual
+Whisper tools.  Its SHA256 checksum is written next to it in FILE.sha256
+in the format of sha256sum.
+
+Use restore-snapshot to upload the snapshot again later.  Use -s to download
+from the server given by -h rather than the metric's owner.`
+
+	c := NewCommand(snapshotCommand, "snapshot", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+
+	c.Flag.StringVar(&snapshotFile, "o", "",
+		"Write the snapshot to this file.")
+
+	usage = "[options] <metric>"
+	short = "Upload a metric's Whisper DB saved by snapshot."
+	long = `Upload the Whisper DB saved by snapshot in the file given by -i as the
+metric, replacing the metric's current data.  The file is checked against
+its FILE.sha256 checksum before it is uploaded, and the metric is downloaded
+again afterwards to verify the upload.
+
+The snapshot is uploaded to the buckyd daemon given by -to as HOST[:PORT] or
+HOST=INSTANCE, or to the metric's owner in the hash ring without -to.  Use -s
+to upload to the server given by -h.`
+
+	c = NewCommand(restoreSnapshotCommand, "restore-snapshot", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+
+	c.Flag.StringVar(&snapshotFile, "i", "",
+		"Read the snapshot from this file.")
+	c.Flag.StringVar(&snapshotTo, "to", "",
+		"Upload to this buckyd daemon rather than the metric's owner.")
+}
+
+// SnapshotMetric downloads metric from server to the file at path and
+// writes its checksum to the sidecar file.  The checksum is returned.
+func SnapshotMetric(server, metric, path string) (string, error) {
+	data, err := GetMetricData(server, metric)
+	if err != nil {
+		return "", err
+	}
+	raw, err := MetricDecode(data)
+	if err != nil {
+		return "", err
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := sink.Write(raw); err != nil {
+		sink.Abort()
+		return "", err
+	}
+	if err := sink.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(path, os.FileMode(data.Mode).Perm()); err != nil {
+		return "", err
+	}
+	mtime := time.Unix(data.ModTime, 0)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write(raw)
+	if err := writeChecksumFile(path, snapshotAlgo, h); err != nil {
+		return "", err
+	}
+	return FormatChecksum(snapshotAlgo, h), nil
+}
+
+// RestoreSnapshot uploads the snapshot in the file at path to server as
+// metric after checking it against its sidecar checksum, and then
+// downloads the metric to verify that server stored the same data.
+func RestoreSnapshot(server, metric, path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	checksum, err := readChecksumFile(path, snapshotAlgo)
+	if err != nil {
+		return err
+	}
+	if err := VerifyChecksum(checksum, raw); err != nil {
+		return fmt.Errorf("Snapshot %s does not match its checksum: %s", path, err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	data := &MetricData{
+		Name:     metric,
+		Size:     int64(len(raw)),
+		Mode:     int64(fi.Mode().Perm()),
+		ModTime:  fi.ModTime().Unix(),
+		Encoding: EncIdentity,
+		Data:     raw,
+	}
+	if err := MetricEncode(data, EncSnappy); err != nil {
+		return err
+	}
+	// A POST would backfill into the current data rather than replace it
+	if err := PutMetric(server, data); err != nil {
+		return err
+	}
+
+	stored, err := GetMetricData(server, metric)
+	if err != nil {
+		return err
+	}
+	raw, err = MetricDecode(stored)
+	if err != nil {
+		return err
+	}
+	if err := VerifyChecksum(checksum, raw); err != nil {
+		return fmt.Errorf("Restored %s on %s does not match the snapshot: %s", metric, server, err)
+	}
+	return nil
+}
+
+// snapshotServer returns the server a snapshot of metric is taken from or
+// restored to.
+func snapshotServer(metric, to string) (string, error) {
+	if SingleHost {
+		return HostPort, nil
+	}
+	if _, err := GetClusterConfig(HostPort); err != nil {
+		return "", err
+	}
+	if to != "" {
+		return targetServer(to), nil
+	}
+	return Cluster.NodeHostPort(Cluster.Hash.GetNode(metric)), nil
+}
+
+// snapshotCommand runs this subcommand.
+func snapshotCommand(c Command) int {
+	if c.Flag.NArg() != 1 || snapshotFile == "" {
+		log.Print("Exactly one metric and the -o file are required.")
+		return ExitUsage
+	}
+	metric := c.Flag.Arg(0)
+	server, err := snapshotServer(metric, "")
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+
+	checksum, err := SnapshotMetric(server, metric, snapshotFile)
+	if err != nil {
+		log.Printf("Error taking snapshot of [%s]:%s: %s", server, metric, err)
+		return ExitError
+	}
+	log.Printf("Saved [%s]:%s to %s, %s", server, metric, snapshotFile, checksum)
+	return ExitOK
+}
+
+// restoreSnapshotCommand runs this subcommand.
+func restoreSnapshotCommand(c Command) int {
+	if c.Flag.NArg() != 1 || snapshotFile == "" {
+		log.Print("Exactly one metric and the -i file are required.")
+		return ExitUsage
+	}
+	if SingleHost && snapshotTo != "" {
+		log.Print("The -s and -to options can not be combined.")
+		return ExitUsage
+	}
+	metric := c.Flag.Arg(0)
+	server, err := snapshotServer(metric, snapshotTo)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if !checkWritable([]string{server}) {
+		return ExitUsage
+	}
+
+	if err := RestoreSnapshot(server, metric, snapshotFile); err != nil {
+		log.Printf("Error restoring snapshot of %s to %s: %s", metric, server, err)
+		return ExitError
+	}
+	log.Printf("Restored %s to [%s]:%s and verified it.", snapshotFile, server, metric)
+	return ExitOK
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+// snapshotTestServer is a buckyd that stores metrics uploaded with a PUT
+// as is and serves them back.  Like a backfill, a POST does not change a
+// metric that is already held.  Uploads of metrics named broken.* are
+// stored truncated.
+func snapshotTestServer(held map[string]*metrics.MetricData) *httptest.Server {
+	var lock sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+		switch r.Method {
+		case "PUT", "POST":
+			if _, ok := held[name]; ok && r.Method == "POST" {
+				return
+			}
+			m := new(metrics.MetricData)
+			json.Unmarshal([]byte(r.Header.Get("X-Metric-Stat")), m)
+			body, _ := ioutil.ReadAll(r.Body)
+			m.Data, _ = MetricDecode(&metrics.MetricData{Size: m.Size,
+				Encoding: metrics.EncSnappy, Data: body})
+			if strings.HasPrefix(name, "broken.") {
+				m.Data = m.Data[:1]
+				m.Size = 1
+			}
+			held[name] = m
+		case "GET":
+			m, ok := held[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			stat, _ := json.Marshal(m)
+			w.Header().Set("X-Metric-Stat", string(stat))
+			w.Write(m.Data)
+		}
+	}))
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	held := map[string]*metrics.MetricData{
+		"foo.bar": {Name: "foo.bar", Size: 12, Mode: 0600, ModTime: 1500000000,
+			Data: []byte("whisper data")},
+	}
+	server := snapshotTestServer(held)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "foo.bar.wsp")
+
+	checksum, err := SnapshotMetric(host, "foo.bar", path)
+	if err != nil {
+		t.Fatalf("Error taking snapshot: %s", err)
+	}
+	if expected, _ := metrics.Checksum("sha256", []byte("whisper data")); checksum != expected {
+		t.Errorf("Expected checksum %s, got %s", expected, checksum)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || fi.ModTime().Unix() != 1500000000 {
+		t.Errorf("Snapshot has mode %o and time %d", fi.Mode().Perm(), fi.ModTime().Unix())
+	}
+
+	// The metric changes and the snapshot puts it back
+	held["foo.bar"] = &metrics.MetricData{Name: "foo.bar", Size: 3, Data: []byte("bad")}
+	if err := RestoreSnapshot(host, "foo.bar", path); err != nil {
+		t.Fatalf("Error restoring snapshot: %s", err)
+	}
+	if m := held["foo.bar"]; string(m.Data) != "whisper data" || m.Mode != 0600 {
+		t.Errorf("Restored %q with mode %o", m.Data, m.Mode)
+	}
+
+	// A server that stores something else fails verification
+	if err := RestoreSnapshot(host, "broken.bar", path); err == nil {
+		t.Errorf("Restoring to a server that truncated the metric did not fail")
+	}
+
+	// A changed snapshot is refused before it is uploaded
+	ioutil.WriteFile(path, []byte("whisper dat!"), 0600)
+	if err := RestoreSnapshot(host, "other.bar", path); err == nil {
+		t.Errorf("Restoring a corrupt snapshot did not fail")
+	}
+	if _, ok := held["other.bar"]; ok {
+		t.Errorf("Corrupt snapshot was uploaded")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tarSplitSize is the size in bytes at which tar starts a new part when
+// writing to a series of files.  0 writes a single archive.
+var tarSplitSize int64
+
+// tarSplitCount is the number of metrics at which tar starts a new part
+// when writing to a series of files.  0 is no limit.
+var tarSplitCount int
+
+// splitEntryOverhead is the most archive space, besides the padded data,
+// that a metric's entry takes.  That is a header and a PAX extended header
+// with its records.
+const splitEntryOverhead = 3 * 512
+
+// splitTrailer is the space reserved at the end of each part for the
+// archive trailer.
+const splitTrailer = 2 * 512
+
+// splitPartName returns the name of the n'th part of the archive at path.
+// The number is inserted before the extension so out.tar is split into
+// out.000.tar, out.001.tar, and so on.
+func splitPartName(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%03d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// splitSink is a MetricSink writing a series of part files named by
+// splitPartName.  Each part is a fileSink so a part only appears at its
+// name once it is complete.
+type splitSink struct {
+	path    string
+	part    int
+	written int64
+	total   int64
+	current MetricSink
+	parts   []string
+}
+
+// NewSplitSink returns a MetricSink that writes the archive at path as a
+// series of parts.  NextPart starts a new part.
+func NewSplitSink(path string) (*splitSink, error) {
+	s := &splitSink{path: path}
+	var err error
+	s.current, err = NewFileSink(splitPartName(path, 0))
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *splitSink) Write(p []byte) (int, error) {
+	n, err := s.current.Write(p)
+	s.written += int64(n)
+	s.total += int64(n)
+	return n, err
+}
+
+// NextPart completes the current part and starts the next.
+func (s *splitSink) NextPart() error {
+	if err := s.current.Close(); err != nil {
+		return err
+	}
+	s.parts = append(s.parts, splitPartName(s.path, s.part))
+	s.part++
+	s.written = 0
+
+	var err error
+	s.current, err = NewFileSink(splitPartName(s.path, s.part))
+	return err
+}
+
+// Parts returns the names of the parts completed so far.
+func (s *splitSink) Parts() []string {
+	return s.parts
+}
+
+func (s *splitSink) Close() error {
+	if err := s.current.Close(); err != nil {
+		return err
+	}
+	s.parts = append(s.parts, splitPartName(s.path, s.part))
+	return nil
+}
+
+// Abort throws away the current part and removes the completed parts.
+func (s *splitSink) Abort() error {
+	err := s.current.Abort()
+	for _, p := range s.parts {
+		os.Remove(p)
+	}
+	return err
+}
+
+// splitting returns true if tar writes a series of parts.
+func splitting() bool {
+	return tarSplitSize > 0 || tarSplitCount > 0
+}
+
+// splitArchiveWriter is an ArchiveWriter that closes the archive and
+// starts a new one in the next part of a splitSink before a metric that
+// would take the part over limit bytes or count metrics.  Every part is a
+// complete archive that starts with the hash ring record.
+type splitArchiveWriter struct {
+	ArchiveWriter
+	sink    *splitSink
+	format  string
+	limit   int64
+	count   int
+	ring    *tar.Header
+	entries int
+}
+
+// newSplitArchiveWriter returns an ArchiveWriter of the given format that
+// writes to parts of sink no larger than limit bytes and holding at most
+// count metrics.  A limit or count of 0 is no limit.  A part may only
+// exceed the byte limit if it holds a single metric that is larger.
+func newSplitArchiveWriter(format string, sink *splitSink, limit int64, count int) (*splitArchiveWriter, error) {
+	tw, err := newMetricArchiveWriter(format, sink)
+	if err != nil {
+		return nil, err
+	}
+	return &splitArchiveWriter{
+		ArchiveWriter: tw,
+		sink:          sink,
+		format:        format,
+		limit:         limit,
+		count:         count,
+	}, nil
+}
+
+// WriteHeader starts a new part first if the entry hdr would not fit in
+// the current one.  A metadata sidecar always stays in the part of its
+// metric.
+func (s *splitArchiveWriter) WriteHeader(hdr *tar.Header) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		if _, ok := hdr.PAXRecords["BUCKYTOOLS.ring"]; ok {
+			s.ring = hdr
+		}
+		return s.ArchiveWriter.WriteHeader(hdr)
+	}
+	if isMetadataEntry(hdr.Name) {
+		return s.ArchiveWriter.WriteHeader(hdr)
+	}
+
+	size := splitEntryOverhead + (hdr.Size+511)/512*512
+	if d, ok := s.ArchiveWriter.(*dirArchiveWriter); ok {
+		size += int64(len(d.missingDirs(hdr.Name))) * splitEntryOverhead
+	}
+	full := s.limit > 0 && s.sink.written+size+splitTrailer > s.limit
+	if s.count > 0 && s.entries >= s.count {
+		full = true
+	}
+	if s.entries > 0 && full {
+		if err := s.rollover(); err != nil {
+			return err
+		}
+	}
+	s.entries++
+	return s.ArchiveWriter.WriteHeader(hdr)
+}
+
+// rollover closes the archive in the current part and starts a new
+// archive in the next.
+func (s *splitArchiveWriter) rollover() error {
+	if err := s.ArchiveWriter.Close(); err != nil {
+		return err
+	}
+	if err := s.sink.NextPart(); err != nil {
+		return err
+	}
+	tw, err := newMetricArchiveWriter(s.format, s.sink)
+	if err != nil {
+		return err
+	}
+	s.ArchiveWriter = tw
+	s.entries = 0
+	if s.ring != nil {
+		return tw.WriteHeader(s.ring)
+	}
+	return nil
+}
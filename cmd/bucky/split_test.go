@@ -0,0 +1,279 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestSplitPartName(t *testing.T) {
+	tests := []struct {
+		path string
+		n    int
+		name string
+	}{
+		{"out.tar", 0, "out.000.tar"},
+		{"/tmp/out.tar", 12, "/tmp/out.012.tar"},
+		{"out", 1, "out.001"},
+		{"out.tar", 1000, "out.1000.tar"},
+	}
+	for _, test := range tests {
+		if name := splitPartName(test.path, test.n); name != test.name {
+			t.Errorf("splitPartName(%q, %d) = %q, expected %q", test.path, test.n, name, test.name)
+		}
+	}
+}
+
+func TestWriteTarSplit(t *testing.T) {
+	resetTarState()
+	tarTotals = true
+	tarSplitSize = 8192
+	ring := ringFor(1, "a", "b")
+	restoreTestCluster(ring, "4242")
+	defer func() {
+		tarTotals = false
+		tarSplitSize = 0
+		Cluster = nil
+	}()
+
+	dir, err := ioutil.TempDir("", "split_test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Ten small metrics and one larger than the split size
+	workOut := make(chan *metrics.MetricData, 11)
+	for i := 0; i < 10; i++ {
+		data := make([]byte, 1000)
+		workOut <- &metrics.MetricData{Name: fmt.Sprintf("foo.bar%d", i),
+			Size: 1000, Mode: 0644, Encoding: metrics.EncIdentity, Data: data}
+	}
+	workOut <- &metrics.MetricData{Name: "foo.huge", Size: 10000, Mode: 0644,
+		Encoding: metrics.EncIdentity, Data: make([]byte, 10000)}
+	close(workOut)
+
+	sink, err := NewSplitSink(filepath.Join(dir, "out.tar"))
+	if err != nil {
+		t.Fatalf("Error creating sink: %s", err)
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(sink, workOut, wg)
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Error closing sink: %s", err)
+	}
+
+	parts := sink.Parts()
+	if len(parts) < 3 {
+		t.Fatalf("Expected at least 3 parts, got %v", parts)
+	}
+	seen := make(map[string]int)
+	for i, part := range parts {
+		if part != splitPartName(filepath.Join(dir, "out.tar"), i) {
+			t.Errorf("Part %d is named %s", i, part)
+		}
+		fi, err := os.Stat(part)
+		if err != nil {
+			t.Fatalf("Error opening part: %s", err)
+		}
+
+		// Each part is a standalone archive led by the ring record
+		fd, _ := os.Open(part)
+		tr := tar.NewReader(fd)
+		files, totals := 0, false
+		for index := 0; ; index++ {
+			th, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading %s: %s", part, err)
+			}
+			if index == 0 {
+				if _, ok := th.PAXRecords["BUCKYTOOLS.ring"]; !ok {
+					t.Errorf("Part %s does not start with the ring record", part)
+				}
+			}
+			if _, ok := th.PAXRecords["BUCKYTOOLS.files"]; ok {
+				totals = true
+				if th.PAXRecords["BUCKYTOOLS.files"] != "11" {
+					t.Errorf("Bad totals record: %v", th.PAXRecords)
+				}
+			}
+			if th.Typeflag == tar.TypeReg {
+				seen[th.Name]++
+				files++
+			}
+		}
+		fd.Close()
+
+		if totals != (i == len(parts)-1) {
+			t.Errorf("Part %s has totals record: %v", part, totals)
+		}
+		if files == 0 {
+			t.Errorf("Part %s has no metrics", part)
+		}
+		if files > 1 && fi.Size() > tarSplitSize {
+			t.Errorf("Part %s is %d bytes, over the split size", part, fi.Size())
+		}
+	}
+
+	if len(seen) != 11 {
+		t.Errorf("Expected 11 metrics across parts, found %d", len(seen))
+	}
+	for name, n := range seen {
+		if n != 1 {
+			t.Errorf("Metric %s found in %d parts", name, n)
+		}
+	}
+}
+
+func TestSplitSinkAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "split_test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := NewSplitSink(filepath.Join(dir, "out.tar"))
+	if err != nil {
+		t.Fatalf("Error creating sink: %s", err)
+	}
+	sink.Write([]byte("part one"))
+	if err := sink.NextPart(); err != nil {
+		t.Fatalf("Error starting part: %s", err)
+	}
+	sink.Write([]byte("part two"))
+	sink.Abort()
+
+	left, _ := ioutil.ReadDir(dir)
+	if len(left) != 0 {
+		t.Errorf("Abort left %d files behind", len(left))
+	}
+}
+
+// writeSplitParts archives n metrics of 1000 bytes to parts in dir and
+// returns the metrics in each part.  The fourth metric has a sidecar.
+func writeSplitParts(t *testing.T, dir string, n int) [][]string {
+	workOut := make(chan *metrics.MetricData, n)
+	for i := 0; i < n; i++ {
+		m := &metrics.MetricData{Name: fmt.Sprintf("foo.bar%d", i),
+			Size: 1000, Mode: 0644, Encoding: metrics.EncIdentity, Data: make([]byte, 1000)}
+		if i == 3 {
+			m.Metadata = []byte(`{"tags":{}}`)
+		}
+		workOut <- m
+	}
+	close(workOut)
+
+	sink, err := NewSplitSink(filepath.Join(dir, "out.tar"))
+	if err != nil {
+		t.Fatalf("Error creating sink: %s", err)
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(sink, workOut, wg)
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Error closing sink: %s", err)
+	}
+
+	result := make([][]string, 0)
+	for _, part := range sink.Parts() {
+		fi, err := os.Stat(part)
+		if err != nil {
+			t.Fatalf("Error opening part: %s", err)
+		}
+		fd, _ := os.Open(part)
+		tr := tar.NewReader(fd)
+		names := make([]string, 0)
+		sidecar := false
+		for {
+			th, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading %s: %s", part, err)
+			}
+			if th.Typeflag != tar.TypeReg {
+				continue
+			}
+			if isMetadataEntry(th.Name) {
+				sidecar = true
+			} else {
+				names = append(names, th.Name)
+			}
+		}
+		fd.Close()
+		if sidecar && !containsString(names, "foo/bar3.wsp") {
+			t.Errorf("Part %s has a sidecar without its metric: %v", part, names)
+		}
+		if tarSplitSize > 0 && len(names) > 1 && fi.Size() > tarSplitSize {
+			t.Errorf("Part %s is %d bytes, over the split size", part, fi.Size())
+		}
+		result = append(result, names)
+	}
+	return result
+}
+
+func TestWriteTarSplitCount(t *testing.T) {
+	tests := []struct {
+		size  int64
+		count int
+		parts []int
+	}{
+		// Count alone gives evenly membered parts
+		{0, 4, []int{4, 4, 2}},
+		{0, 10, []int{10}},
+		// With both limits a part ends at whichever is reached first
+		{8192, 5, []int{3, 2, 3, 2}},
+		{32768, 3, []int{3, 3, 3, 1}},
+	}
+
+	restoreTestCluster(ringFor(1, "a", "b"), "4242")
+	defer func() {
+		tarSplitSize = 0
+		tarSplitCount = 0
+		Cluster = nil
+	}()
+	for _, test := range tests {
+		resetTarState()
+		tarSplitSize = test.size
+		tarSplitCount = test.count
+		dir, err := ioutil.TempDir("", "split_test")
+		if err != nil {
+			t.Fatalf("Error creating directory: %s", err)
+		}
+
+		parts := writeSplitParts(t, dir, 10)
+		os.RemoveAll(dir)
+		if len(parts) != len(test.parts) {
+			t.Errorf("Split %d bytes and %d metrics: expected %d parts, got %v",
+				test.size, test.count, len(test.parts), parts)
+			continue
+		}
+		for i, names := range parts {
+			if len(names) > test.count {
+				t.Errorf("Part %d has %d metrics, over the split count %d", i, len(names), test.count)
+			}
+			if len(names) != test.parts[i] {
+				t.Errorf("Split %d bytes and %d metrics: part %d has %d metrics, expected %d",
+					test.size, test.count, i, len(names), test.parts[i])
+			}
+		}
+	}
+}
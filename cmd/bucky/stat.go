@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"sync"
 	"time"
 )
 
@@ -42,66 +41,17 @@ BUCKYSERVER environment variable.`
 		"Worker threads.")
 }
 
-func statWorker(workIn chan *DeleteWork, workOut chan *MetricData, wg *sync.WaitGroup) {
-	for work := range workIn {
-		stat, err := StatRemoteMetric(work.server, work.name)
-		if err != nil {
-			workerErrors = true
-		} else {
-			workOut <- stat
-		}
-	}
-	wg.Done()
-}
-
-func statResults(workOut chan *MetricData, wg *sync.WaitGroup) {
-	for stat := range workOut {
-		t := time.Unix(stat.ModTime, 0).UTC().Format(time.RFC3339)
-		fmt.Printf("%.2fKiB\t%s\t%s\n", float64(stat.Size)/1024.0, t, stat.Name)
-	}
-	wg.Done()
+// printStat prints a line describing the given stat.
+func printStat(stat *MetricData) {
+	t := time.Unix(stat.ModTime, 0).UTC().Format(time.RFC3339)
+	fmt.Printf("%.2fKiB\t%s\t%s\n", float64(stat.Size)/1024.0, t, stat.Name)
 }
 
 func statMetrics(metricMap map[string][]string) error {
-	wg := new(sync.WaitGroup)
-	wg2 := new(sync.WaitGroup)
-	workIn := make(chan *DeleteWork, 25)
-	workOut := make(chan *MetricData, 25)
-
-	wg.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go statWorker(workIn, workOut, wg)
-	}
-
-	wg2.Add(1)
-	go statResults(workOut, wg2)
-
-	c := 0
-	l := countMap(metricMap)
-	for server, metrics := range metricMap {
-		if len(metrics) == 0 {
-			continue
-		}
-		for _, m := range metrics {
-			work := new(DeleteWork)
-			work.server = server
-			work.name = m
-			workIn <- work
-			c++
-			if c%100 == 0 {
-				log.Printf("Progress: %d/%d %.2f%%", c, l, float64(c)/float64(l)*100)
-			}
-		}
-	}
-
-	close(workIn)
-	wg.Wait()
-
-	close(workOut)
-	wg2.Wait()
+	statBatches(metricMap, printStat)
 
 	log.Printf("Stat operation complete.")
-	if workerErrors {
+	if workerErrors() {
 		log.Printf("Errors occured in stat operation.")
 		return fmt.Errorf("Errors occured in stat operations.")
 	}
@@ -145,11 +95,12 @@ func statCommand(c Command) int {
 	_, err := GetClusterConfig(HostPort)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitError
 	}
 
 	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+		log.Print("At least one argument is required.")
+		return ExitUsage
 	} else if listRegexMode && c.Flag.NArg() > 0 {
 		err = StatRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
 	} else if c.Flag.Arg(0) != "-" {
@@ -158,8 +109,5 @@ func statCommand(c Command) int {
 		err = StatJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce)
 	}
 
-	if err != nil {
-		return 1
-	}
-	return 0
+	return exitStatus(err)
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"sync"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// tarStatStream is the file -stat-stream writes a JSON stat record of
+// each archived metric to.
+var tarStatStream string
+
+// tarStatStreamHash is the checksum algorithm of the Whisper data added to
+// each stat record with -stat-stream-hash.  Empty for none.
+var tarStatStreamHash string
+
+// statStream receives the stat records of the current tar run if enabled.
+var statStream *StatStream
+
+// StatRecord is the stat of one archived metric written by -stat-stream.
+type StatRecord struct {
+	Name     string
+	Server   string
+	Size     int64
+	ModTime  int64
+	Mode     int64
+	Checksum string `json:",omitempty"`
+}
+
+// StatStream writes a StatRecord as newline delimited JSON for each
+// metric written to the archive.  Records are written as metrics are
+// archived and are not buffered.  A nil *StatStream does nothing.
+type StatStream struct {
+	lock    sync.Mutex
+	enc     *json.Encoder
+	algo    string
+	servers map[string]string
+	records int
+	err     error
+}
+
+// NewStatStream returns a StatStream writing to w.  If algo is not empty
+// each record has a checksum of the metric's data using that algorithm.
+func NewStatStream(w io.Writer, algo string) *StatStream {
+	return &StatStream{
+		enc:     json.NewEncoder(w),
+		algo:    algo,
+		servers: make(map[string]string),
+	}
+}
+
+// Downloaded records the server metric name was downloaded from.
+func (s *StatStream) Downloaded(name, server string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.servers[name] = server
+	s.lock.Unlock()
+}
+
+// Archived writes the stat record of metric once it is in the archive.
+// After the first error writing the stream no more records are written.
+func (s *StatStream) Archived(metric *MetricData) {
+	if s == nil {
+		return
+	}
+	record := &StatRecord{
+		Name:    metric.Name,
+		Size:    metric.Size,
+		ModTime: metric.ModTime,
+		Mode:    metric.Mode,
+	}
+	if s.algo != "" {
+		record.Checksum, _ = Checksum(s.algo, metric.Data)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	record.Server = s.servers[metric.Name]
+	delete(s.servers, metric.Name)
+	if s.err != nil {
+		return
+	}
+	if s.err = s.enc.Encode(record); s.err != nil {
+		log.Printf("Error writing stat stream: %s", s.err)
+		return
+	}
+	s.records++
+}
+
+// Records returns the number of stat records written.
+func (s *StatStream) Records() int {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.records
+}
+
+// closeStatStream closes fd, the file of statStream, and returns the first
+// error writing the stream or closing the file.
+func closeStatStream(fd io.Closer) error {
+	err := statStream.Err()
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Err returns the first error writing the stream.
+func (s *StatStream) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
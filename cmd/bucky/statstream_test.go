@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestStatStream(t *testing.T) {
+	server := exitTestServer()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	resetTarState()
+	metricWorkers = 2
+	defer func(r int) { Retries = r }(Retries)
+	Retries = 0
+	buf := new(bytes.Buffer)
+	statStream = NewStatStream(buf, "sha256")
+	defer func() { statStream = nil }()
+	metricMap := map[string][]string{host: []string{"foo.a", "foo.b", "bad.c"}}
+	multiplexTarContext(context.Background(), metricMap, &stdoutSink{ioutil.Discard})
+
+	// The test server serves 12 bytes of data for each good metric
+	checksum, _ := metrics.Checksum("sha256", []byte("whisper data"))
+	names := make([]string, 0)
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		record := new(StatRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			t.Fatalf("Bad stat record %q: %s", scanner.Text(), err)
+		}
+		if record.Server != host || record.Size != 12 || record.Checksum != checksum {
+			t.Errorf("Unexpected stat record: %+v", record)
+		}
+		names = append(names, record.Name)
+	}
+	if len(names) != 2 || !containsString(names, "foo.a") || !containsString(names, "foo.b") {
+		t.Errorf("Expected a record for each archived metric, got %v", names)
+	}
+	if statStream.Records() != archiveFiles {
+		t.Errorf("Expected %d records, got %d", archiveFiles, statStream.Records())
+	}
+}
+
+// brokenStatFile is a stat stream file whose writes fail.
+type brokenStatFile struct {
+	closed bool
+}
+
+func (f *brokenStatFile) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (f *brokenStatFile) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestCloseStatStream(t *testing.T) {
+	fd := new(brokenStatFile)
+	statStream = NewStatStream(fd, "")
+	defer func() { statStream = nil }()
+	statStream.Archived(&metrics.MetricData{Name: "foo.a"})
+	statStream.Archived(&metrics.MetricData{Name: "foo.b"})
+
+	if err := closeStatStream(fd); err == nil || err.Error() != "disk full" {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+	if !fd.closed || statStream.Records() != 0 {
+		t.Errorf("Expected the file closed and no records, got %t and %d", fd.closed, statStream.Records())
+	}
+}
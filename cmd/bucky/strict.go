@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+// tarStrict refuses to archive a selection holding a metric whose name
+// does not survive the conversion to an archive path and back.
+var tarStrict bool
+
+// tarStrictSkip leaves the metrics refused by -strict out of the archive
+// rather than refusing the whole selection.
+var tarStrictSkip bool
+
+// ErrStrictNames is returned when -strict finds metrics whose names do not
+// round trip through their archive path.
+var ErrStrictNames = errors.New("Selection holds metrics whose names do not round trip")
+
+// StrictNameError returns why the archive path of the named metric, as
+// given by MetricToRelative, does not convert back to the same name with
+// RelativeToMetric or is refused by strict extractors.  It returns nil
+// for a name that round trips cleanly.
+func StrictNameError(name string) error {
+	p := metrics.MetricToRelative(name)
+	switch {
+	case name == "":
+		return errors.New("empty name")
+	case strings.ContainsRune(name, 0):
+		return errors.New("name contains a NUL byte")
+	case strings.Contains(name, "/"):
+		return errors.New("name contains a slash")
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("leading dot makes the absolute path %s", p)
+	case strings.HasSuffix(name, "."):
+		return fmt.Errorf("trailing dot makes the hidden file %s", p)
+	case strings.Contains(name, ".."):
+		return fmt.Errorf("empty path component is dropped from %s", p)
+	}
+	if back := metrics.RelativeToMetric(p); back != name {
+		return fmt.Errorf("path %s restores as %s", p, back)
+	}
+	return nil
+}
+
+// checkStrictNames applies -strict to the list of metrics.  Every name
+// that does not round trip is logged.  With -strict-skip they are removed
+// from the list and counted as failures, otherwise ErrStrictNames is
+// returned.
+func checkStrictNames(list []string) ([]string, error) {
+	if !tarStrict && !tarStrictSkip {
+		return list, nil
+	}
+	ret := make([]string, 0, len(list))
+	bad := 0
+	for _, m := range list {
+		err := StrictNameError(m)
+		if err == nil {
+			ret = append(ret, m)
+			continue
+		}
+		bad++
+		if tarStrictSkip {
+			log.Printf("Skipping %q: %s", m, err)
+			workFailed()
+		} else {
+			log.Printf("Name does not round trip %q: %s", m, err)
+		}
+	}
+	if bad > 0 && !tarStrictSkip {
+		log.Printf("Abort: %d metrics with -strict, use -strict-skip to archive the others.", bad)
+		return nil, ErrStrictNames
+	}
+	return ret, nil
+}
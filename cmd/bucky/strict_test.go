@@ -0,0 +1,96 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestStrictNameError(t *testing.T) {
+	good := []string{
+		"foo.bar.baz",
+		"carbon.agents.graphite01-a.cpuUsage",
+		"foo.wsp.bar",
+		"foo_bar.baz-1",
+	}
+	for _, name := range good {
+		if err := StrictNameError(name); err != nil {
+			t.Errorf("Expected %q to round trip, got %s", name, err)
+		}
+	}
+
+	// Each of these archives under a path that restores as another name
+	// or that strict extractors refuse
+	bad := []string{
+		"",
+		"foo/bar.baz",
+		"foo..bar",
+		"foo...bar",
+		".foo.bar",
+		"foo.bar.",
+		"foo.bar..",
+		"foo\x00bar",
+	}
+	for _, name := range bad {
+		if err := StrictNameError(name); err == nil {
+			t.Errorf("Expected %q to be refused, archived as %q and restored as %q",
+				name, metrics.MetricToRelative(name),
+				metrics.RelativeToMetric(metrics.MetricToRelative(name)))
+		}
+	}
+}
+
+func TestTarStrict(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	defer func() {
+		tarStrict = false
+		tarStrictSkip = false
+	}()
+
+	resetTarState()
+	tarStrict = true
+	buf := new(bytes.Buffer)
+	metricMap := map[string][]string{host: {"foo.a", "foo..b", "foo.c."}}
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != ErrStrictNames {
+		t.Errorf("Expected ErrStrictNames with -strict, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Archive written with -strict: %d bytes", buf.Len())
+	}
+
+	resetTarState()
+	tarStrict = false
+	tarStrictSkip = true
+	buf.Reset()
+	err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf})
+	if err == nil || workerFailed != 2 {
+		t.Errorf("Expected the 2 skipped metrics to fail, got %d: %v", workerFailed, err)
+	}
+	tr := tar.NewReader(buf)
+	names := make([]string, 0)
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.Typeflag == tar.TypeReg {
+			names = append(names, th.Name)
+		}
+	}
+	if len(names) != 1 || names[0] != "foo/a.wsp" {
+		t.Errorf("Expected only foo/a.wsp archived with -strict-skip, got %v", names)
+	}
+	if code := exitStatus(err); code != ExitPartial {
+		t.Errorf("Expected exit status %d with -strict-skip, got %d", ExitPartial, code)
+	}
+}
@@ -2,26 +2,110 @@ package main
 
 import (
 	"archive/tar"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"os/signal"
+	"runtime"
 	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 import "github.com/golang/crypto/ssh/terminal"
+import "github.com/jjneely/buckytools/hashing"
 import "github.com/jjneely/buckytools/metrics"
 
 var metricWorkers int
-var workerErrors bool
+var tarOutput string
+var tarFormat string
+var tarTotals bool
+var tarAssumeSorted bool
+var tarCompress bool
+var tarCompressAll bool
+var tarTimeout time.Duration
+var tarDrainTimeout time.Duration
+var tarCacheDir string
+var tarMaxInFlight int64
+var tarCompressWorkers int
+
+// tarAllowEmpty writes an archive even when no metrics are selected.
+var tarAllowEmpty bool
+
+// ErrEmptySelection is returned when no metrics are selected for the
+// archive and -allow-empty was not given.
+var ErrEmptySelection = errors.New("Selection matched no metrics, use -allow-empty to archive anyway")
+
+// tarErrorOnDuplicate refuses a selection that lists a metric more than
+// once rather than archiving it once.
+var tarErrorOnDuplicate bool
+
+// ErrDuplicateSelection is returned when a metric is selected more than
+// once and -error-on-duplicate was given.
+var ErrDuplicateSelection = errors.New("Selection lists metrics more than once")
+
+// tarListMetrics is the -list-metrics file, or - for STDOUT, the final
+// selection of metric names is written to.
+var tarListMetrics string
+
+// tarBudget bounds the bytes of metric data held between download and
+// being written to the archive when -max-in-flight-bytes is set.
+var tarBudget *ByteBudget
+
+// tarRing is the hash ring reported by the server archived with -s.  The
+// cluster's ring is recorded otherwise.
+var tarRing *hashing.JSONRingType
+
+// tarRetries maps metrics to the number of times their download is
+// retried when it differs from -retries.
+var tarRetries map[string]int
+
+// metricRetries returns the number of times the download of metric is
+// retried.
+func metricRetries(metric string) int {
+	if r, ok := tarRetries[metric]; ok {
+		return r
+	}
+	return Retries
+}
+
+// tarCache holds metrics from previous runs when -cache-dir is set.
+var tarCache *MetricCache
+
+// tarDrained and tarAbandoned count the downloads in flight when the tar
+// run was interrupted that did and did not finish in the drain period.
+var tarDrained int32
+var tarAbandoned int32
+
+// tarInterrupted is set if the archive was cut short by an interrupt or
+// the -timeout.
+var tarInterrupted bool
+
+// archiveFiles and archiveBytes count the metrics and uncompressed
+// bytes of Whisper data written to the archive.
+var archiveFiles int
+var archiveBytes int64
+
+// archiveErr records a failure writing the archive itself as opposed to
+// failures fetching individual metrics.
+var archiveErr error
 
 type MetricWork struct {
 	Name   string
 	Server string
+
+	// Fallback are other servers holding a copy of the metric that are
+	// tried in order if the download from Server fails.
+	Fallback []string
 }
 
 func init() {
@@ -31,25 +115,338 @@ func init() {
 
 The default mode is to work with lists.  The arguments are a series of one or
 more metric key names.  If the first argument is a "-" then read a JSON array
-from STDIN as our list of metrics.
+from STDIN as our list of metrics.  Elements of the array are metric names
+or objects that override -retries for a metric, for example when re-running
+metrics known to be flaky:
+
+    ["foo.bar", {"name": "foo.baz", "retries": 10}]
 
 Use -r to enable regular expression mode.  The first argument is a regular
 expression.  If metrics names match they will be included in the output.
 
-Use -s to only delete metrics found on the server specified by -h or the
-BUCKYSERVER environment variable.
+Use -s to only archive metrics found on the server specified by -h or the
+BUCKYSERVER environment variable.  Every selected metric on that server is
+downloaded directly from it.  The cluster's hash ring is not built and the
+other cluster members are not contacted, which makes dumping a single node
+faster and independent of the ring's health.  The hash ring that server
+reports is still recorded in the archive.  -only-server can not be used with
+-s.
 
 Set -w to change the number of worker threads used to download the Whisper
 DBs from the remote servers.
 
+Use -only-server to archive only the metrics a server owns in the hash ring,
+for example to make per-node backups.  With -only-location the metrics
+physically stored on that server are archived instead.  Use -ring-replicas
+to place each node that many times on the carbon or fnv1a ring instead of
+carbon's 100 when deciding which metrics a server owns.  It must be the
+count carbon uses for the selection to match where carbon routes metrics.
+
 The tar archive is written to STDOUT and will not be written to a
-terminal.`
+terminal.  Use -o to write the archive to a file instead.  The file is
+written to a temporary name and renamed into place once the archive is
+complete.
+
+Use -s3 s3://BUCKET/KEY to stream the archive to an S3 compatible object
+store with a multipart upload.  Credentials are taken from the -s3-access-key
+and -s3-secret-key flags or the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+AWS_SESSION_TOKEN environment variables.  Set -s3-endpoint and
+-s3-path-style to use MinIO or other S3 compatible stores.  The part size
+starts at -s3-part-size and doubles every 500 parts, up to 1GiB, so that
+large archives fit within S3's part limit.  Each part is held in memory
+until it is uploaded.  If writing the archive fails the upload is aborted
+so no partial object is left behind.
+
+The hash ring of the cluster is recorded in a PAX global header at the
+start of the archive in the BUCKYTOOLS.ring key.  Restore uses this to
+detect changes in cluster membership.
+
+Metrics are sorted and de-duplicated before downloading to balance the work
+across the cluster.  For very large pre-sorted and unique selections use
+-assume-sorted to skip sorting.  Metrics are then downloaded in the order
+each server returned them, grouped by server.  Misusing this may unbalance
+the load across the cluster.
+
+Each metric is archived once however many servers hold a copy.  A metric
+listed more than once by the same server, such as from overlapping lists
+that were concatenated, would be written as several entries with the same
+path that extractors overwrite or reject.  Only its first occurrence is
+archived and the number of duplicates is logged as a warning.  Use
+-error-on-duplicate to exit with status 5 instead, before anything is
+downloaded.
+
+Distinct metric names that map to the same file, such as "foo.bar.baz",
+"foo/bar.baz", and "foo..bar.baz", would overwrite each other in the archive
+and on restore.  Only the first of them is archived.  The others are
+reported and counted as failures.
+
+The metrics keep the permissions of their source files, owned by root.
+Use -owner and -group to set the user and group of every metric, given as
+NAME, a numeric ID, or NAME:ID, and -mode to set their permissions in
+octal, so that extracted files belong to the carbon user of the target
+without a chown afterwards.  For example: -owner carbon:998 -group
+carbon:998 -mode 0644.
+
+The archive only holds file entries by default.  Use -dirs to also write a
+directory entry with mode 0755 for each directory above the metrics, once
+and before the first metric in it, for extraction tools and restores that
+expect the full tree.
+
+Use -compress to Snappy compress each metric individually inside of the
+archive.  The first 4KiB of each metric is sampled and metrics that look
+already compressed are stored as-is.  Use -compress-all to compress every
+metric.  Metrics are compressed by -compress-workers goroutines, one per CPU
+by default, between the downloads and the single goroutine writing the
+archive.  This is a per-entry encoding recorded in the BUCKYTOOLS.encoding
+PAX record and only bucky restore decodes it.  It is unrelated to
+compressing the whole stream with gzip or similar tools, which remains the
+better choice for archives that standard tar tools must extract.
+
+Use -pipe-through CMD to filter the Whisper data of each metric through a
+shell command, such as a resampling tool for a one-off migration, before
+it is archived.  CMD is run with "sh -c" once per metric with the data on
+its STDIN and the metric's name in the BUCKY_METRIC environment variable.
+What it writes to STDOUT is archived in place of the data and the entry's
+size is updated to match.  A metric whose command exits non-zero or writes
+nothing is reported with the command's STDERR, counted as a failure, and
+left out of the archive while the others continue.  A command still
+running when tar stops at -timeout or a signal, after -drain-timeout, is
+killed and its metric counted as a failure.  Starting a process for
+every metric costs several milliseconds of CPU each, which dominates
+archives of many small metrics.  The commands run in the -compress-workers
+goroutines, use -pipe-workers to run fewer of them at once.  The hash ring
+record, the totals, and -stat-stream are not filtered.
+
+Use -z to compress the whole archive stream with gzip as "tar -z" would.
+Everything the compressor buffers is lost if bucky crashes during a long
+run to a remote sink, such as -s3 or a pipe.  Use -flush-interval to flush
+the archive and the compressor at most that often so a crash loses at most
+about one interval of metrics.  Flushes only happen between metrics so the
+archive written so far is always readable.  Each flush ends a compression
+block early, so short intervals cost some compression ratio, and S3
+uploads still only send full parts.
+
+Use -totals to append a PAX global header to the end of the archive that
+records the number of metrics and total uncompressed size of their data in
+the BUCKYTOOLS.files and BUCKYTOOLS.size keys.  Standard tar tools ignore
+this record when extracting.
+
+Use -timeout to limit the total run time.  When the timeout expires or an
+interrupt is received no new downloads are started.  Downloads already in
+flight are given -drain-timeout to finish and be written to the archive
+before they are cancelled.  The archive is then closed with the metrics
+fetched so far.
+
+Use -format cpio to write a cpio archive in the SVR4 newc format instead
+of tar.  Entries are named and ordered exactly as in a tar archive.  The cpio
+format has no place for the hash ring and totals records so they are left
+out, and -compress is not available.  Such archives can be extracted with
+"cpio -idm -H newc" but can not be read by bucky restore.
+
+Use -cache-dir to keep a copy of each downloaded metric in a local
+directory.  On later runs with the same directory each download asks buckyd
+for the metric only if it was modified after the cached copy.  Unchanged
+metrics are archived from the cache and the cache hit rate is logged at the
+end of the run.  Metrics are fully downloaded if the server does not support
+the conditional request or the cached copy does not match.
+
+Use -t FILE or -list FILE to list the metrics in an existing archive
+rather than making one.  A FILE of "-" reads the archive from STDIN.  The
+name, size, and modification time of each metric is printed, or a JSON
+array with -j.  Archives compressed with gzip are decompressed
+automatically.  Archives of a whisper store made with tar using absolute
+paths under /opt/graphite/storage/whisper or with individually gzip
+compressed .wsp.gz files may also be listed.
+
+Use -max-in-flight-bytes to cap the memory used by metric data that has
+been downloaded but not yet written to the archive.  A download waits once
+the response headers give its size until that size fits under the cap.
+A single metric larger than the cap is downloaded once nothing else is in
+flight.  The summary reports how often the cap throttled downloads.
+
+Use -sample-rate to archive a sample of the selected metrics, such as 0.01
+for 1%, when reproducing a problem on a huge selection.  Each metric is kept
+based on a hash of its name so the sample is spread across the name space
+and the same metrics are sampled on every run.  Change -sample-seed, or
+-seed, to draw a different sample.  The number of matched and sampled
+metrics is logged.  -sample takes the same as a percentage, so "-sample 1"
+is "-sample-rate 0.01".
+
+Use -skip-pattern to leave metrics matching a regular expression out of
+the archive, such as the output of carbon-aggregator or other rollups kept
+next to the raw series they are computed from.  The pattern is matched
+against the metric name before any download and before -sample-rate.  The
+number of metrics skipped is logged.
+
+Use -split-size with -o to write the archive as a series of files of at
+most that many bytes.  The part number is added before the extension of the
+-o file so "-o out.tar" writes out.000.tar, out.001.tar, and so on.  Each
+part is a complete archive starting with the hash ring record that standard
+tar tools can extract on its own.  A metric is never split across parts so
+a single metric larger than -split-size gets a part of its own.  The totals
+record of -totals is written to the last part and covers every part.
+Restore a multi-part set by passing every part to restore, for example
+"bucky restore out.*.tar".
+
+Use -split-count with -o to also start a new part after that many metrics,
+for tools that struggle with archives of millions of members whatever their
+size.  With both options a part ends at whichever limit is reached first.
+A metric's metadata sidecar is not counted and stays in its metric's part.
+
+Use -throttle-on-server-errors to back off from a failing or overloaded
+buckyd without slowing down the healthy ones.  After -throttle-errors
+consecutive 5xx responses, timeouts, or connection failures from a server,
+downloads from it pause for -throttle-pause.  It is then probed with one
+download at a time.  Each failed probe doubles the pause, up to 8 times
+-throttle-pause, and the first success restores full concurrency.  The
+servers that were throttled are listed in the summary.
+
+Use -circuit-breaker to fail fast instead, such as when a buckyd node is
+hard down and every request would wait for the connection to time out.
+After -throttle-errors consecutive errors the server's circuit breaker
+opens and downloads from it fail immediately, without retries, and move on
+to another server holding the metric if there is one.  Once -throttle-pause
+has passed a single download probes the server, with a fresh connection,
+and closes the breaker if it succeeds.  The number of times each breaker
+opened is reported in the summary.
+
+Use -secondary FILE, or s3://BUCKET/KEY, to also write a best-effort copy of
+the archive to a slow or remote destination for disaster recovery without
+slowing down the primary archive given by -o, -s3, or STDOUT.  Each metric
+is queued for the copy once it is written to the primary archive and a
+goroutine writes the queue to the copy.  If the copy falls -secondary-queue
+metrics behind, further metrics are dropped from it with a warning until
+it catches up.  The copy is still a valid archive, in the same -format and
+with the same -z, of the metrics it holds.  The queue holds up to
+-secondary-queue metrics in memory on top of -max-in-flight-bytes.  The
+copy is completed after the primary archive and a failure to write it is
+logged without failing the run.  The metrics written to and dropped from
+the copy are reported in the summary and the drops in -stats-json.  The
+primary archive is always complete.
+
+Use -stats-json FILE to write the accounting of the run as a single JSON
+object once it completes: the metrics archived and failed, the bytes
+downloaded in total and from each server, the uncompressed and written
+archive bytes, the compression ratio between them, and the wall time in
+seconds.  Use -stats-json - to print the object to STDOUT when the archive
+is written elsewhere with -o or -s3.  A FILE ending in .gz is written gzip
+compressed.
+
+Use -stat-stream FILE to write a stat record of each metric as it is
+written to the archive, for indexing the archive's contents.  Each record
+is a JSON object on its own line with the metric's Name, the Server it was
+downloaded from, and its Size, ModTime, and Mode.  Metrics that fail are
+not recorded.  Use -stat-stream-hash md5 or sha256 to add a Checksum of
+each metric's Whisper data.  An archive must be written, so -stat-stream
+can not be used with -list-metrics alone.  If the stream can not be
+written the archive is still completed but tar exits with status 1.
+
+Use -archive-checksum md5 or sha256 to compute a checksum of the archive
+as it is written, without reading it again, and log it when the archive is
+complete.  With -checksum-file and -o the checksum is also written to a
+sidecar file named after the archive with the algorithm as an extra
+extension, such as out.tar.sha256, that "sha256sum -c" can verify.  The
+sidecar is only written once the archive has been completed and renamed
+into place.  The checksum is not available with -split-size
+or -split-count.
+
+Use -max-total-bytes to refuse archives that would be larger than a
+budget, such as a too broad selection bound for object storage.  Every
+selected metric is stat()ed first, without downloading anything, and the
+sum of their sizes is the estimated archive size.  If it is over the budget
+tar exits with status 5 before the first download, logging the estimate and
+the limit.  Use -force to archive anyway.  The -f option, which forces the
+metric re-inventory, does not override the budget.
+
+When no metrics match the expression or list tar exits with status 5
+without writing an archive so a mistyped expression or an empty backup
+does not go unnoticed.  Use -allow-empty when an empty selection is
+expected to log a warning and write an archive holding only the hash ring
+record instead.
+
+Use -list-metrics FILE, or - for STDOUT, to write the names of the selected
+metrics as a JSON array once -only-server, -skip-pattern, -sample, and the
+removal of duplicates, path collisions, and -strict-skip metrics have been
+applied.  The array is the input "bucky tar -" and the other commands
+reading a JSON array from STDIN expect.  Without -o or -s3 nothing is
+downloaded and no archive is written, otherwise the archive is built as
+well.
+
+A list of no more than -direct-max metric names, 10 by default, is looked
+up on the server that owns each metric in the hash ring rather than by
+asking every server, so archiving a few known metrics is quick.  Metrics
+not found on their owner, or whose owner can not be reached, are then
+looked for on every server to catch misplaced metrics.  Metrics found on
+their owner are only downloaded from it.  Use -f or -direct-max 0 to ask
+every server.
+
+Use -changed-since-file FILE for incremental archives.  FILE is a marker
+holding the RFC 3339 time the last successful run started.  Only selected
+metrics whose modification time, as reported by a stat on the server they
+would be downloaded from, is at or after that time are archived.  Without
+the marker every selected metric is archived.  When no selected metric has
+changed an archive holding only the hash ring record is written.  The
+marker is replaced with the start time of this run only if it exits with
+status 0.
+
+Use -strict for archives destined for strict extractors to check that the
+name of every selected metric survives the conversion to its archive path
+and back before anything is downloaded.  Names holding a slash, a NUL, an
+empty component such as "foo..bar", or a leading or trailing dot fail.
+Each is logged and tar exits with status 5 without writing an archive.
+Use -strict-skip to leave them out of the archive instead, which exits
+with status 2.
+
+Use -include-metadata to also archive the metadata sidecar that buckyd
+keeps next to a metric's Whisper DB, such as its tags.  The sidecar is
+downloaded from the same server as the metric and archived right after it
+as a file named after the metric's file with a .meta extension, such as
+foo/bar.wsp.meta.  Metrics without a sidecar are archived alone.  Restore
+uploads sidecars alongside their metrics.
+
+Use -verify to check each metric right after it is written to the archive:
+the bytes written must match the size in its archive header.  Only the size
+is verified, the data is not read back from the archive.  The first
+mismatch stops the run, which exits with status 1 without completing the
+archive, so that truncation is caught when the archive is made rather than
+when it is restored.
+
+Use -w-max to scale the download workers during the run rather than running
+a fixed -w of them.  tar starts -w-min workers and every -w-interval looks at
+the downloads since the last interval.  If more than 5% failed, or their
+mean latency is over twice the lowest mean seen so far, -w-step percent of
+the workers are stopped once they finish their current metric.  Otherwise
+-w-step percent more are started, up to -w-max.  At least one worker is
+started or stopped each time.  The timeline of the worker count is logged
+in the summary.
+
+Use -metadata-only for a quick census of the cluster without downloading any
+Whisper data.  The selected metrics are stat()ed in batches on the server
+they would be downloaded from and, in place of the archive, a JSON object is
+written on its own line for each metric found with its Name, Server, Size,
+ModTime, and Mode, as in -stat-stream records.  The catalog can be diffed
+against an earlier one or against the -stat-stream of a later full backup.
+Metrics that are not found count as failures.  Checksums and retentions
+need the Whisper data and are not included.  Options that only apply to
+archived data, such as -verify or -stat-stream, are refused, as is
+-changed-since-file since the census backs up nothing.
+
+Failed inventory requests and downloads are retried -retries times with
+an exponential backoff starting at -retry-backoff.  If every retry of a
+download fails, such as while a buckyd daemon restarts, the metric is
+downloaded from any other server that reported holding it.`
 
 	c := NewCommand(tarCommand, "tar", usage, short, long)
 	SetupCommon(c)
 	SetupHostname(c)
 	SetupSingle(c)
 	SetupJSON(c)
+	SetupS3(c)
+	SetupRetry(c)
+	SetupOnlyServer(c)
+	SetupSample(c)
+	SetupSkipPattern(c)
+	SetupRingReplicas(c)
 
 	c.Flag.BoolVar(&listForce, "f", false,
 		"Force metric re-inventory.")
@@ -59,51 +456,429 @@ terminal.`
 		"Downloader threads.")
 	c.Flag.IntVar(&metricWorkers, "workers", 5,
 		"Downloader threads.")
+	c.Flag.IntVar(&tarWorkersMin, "w-min", 1,
+		"Downloader threads to start with when -w-max scales them.")
+	c.Flag.IntVar(&tarWorkersMax, "w-max", 0,
+		"Scale downloader threads between -w-min and this many by error rate and latency.")
+	c.Flag.IntVar(&tarScaleStep, "w-step", 25,
+		"Percent of the downloader threads added or removed each time they are scaled.")
+	c.Flag.DurationVar(&tarScaleInterval, "w-interval", 10*time.Second,
+		"How often downloader threads are scaled with -w-max.")
+	c.Flag.StringVar(&tarOutput, "o", "",
+		"Write the tar archive to this file rather than STDOUT.")
+	c.Flag.StringVar(&tarFormat, "format", "tar",
+		"Archive format: tar or cpio.")
+	c.Flag.BoolVar(&tarAssumeSorted, "assume-sorted", false,
+		"Skip sorting the selected metrics.")
+	c.Flag.IntVar(&tarDirectMax, "direct-max", 10,
+		"Find up to this many listed metrics on their ring owners without inventory.  0 to disable.")
+	c.Flag.BoolVar(&tarErrorOnDuplicate, "error-on-duplicate", false,
+		"Refuse a selection that lists a metric more than once.")
+	c.Flag.StringVar(&tarChangedSinceFile, "changed-since-file", "",
+		"Only archive metrics changed since the time in this marker, updated on success.")
+	c.Flag.BoolVar(&tarStrict, "strict", false,
+		"Refuse a selection holding names that do not round trip through the archive.")
+	c.Flag.BoolVar(&tarStrictSkip, "strict-skip", false,
+		"Like -strict but skip and report those metrics instead.")
+	c.Flag.BoolVar(&tarCompress, "compress", false,
+		"Snappy compress each compressible metric in the archive.")
+	c.Flag.BoolVar(&tarCompressAll, "compress-all", false,
+		"With -compress, compress every metric regardless of content.")
+	c.Flag.StringVar(&tarPipeThrough, "pipe-through", "",
+		"Filter each metric's data through this shell command before archiving.")
+	c.Flag.IntVar(&tarPipeWorkers, "pipe-workers", 0,
+		"Cap on -pipe-through commands running at once.  0 for -compress-workers.")
+	c.Flag.BoolVar(&tarTotals, "totals", false,
+		"Append a trailing record with the archive's file count and size.")
+	c.Flag.DurationVar(&tarTimeout, "timeout", 0,
+		"Stop starting new downloads after this long.  0 for no limit.")
+	c.Flag.DurationVar(&tarDrainTimeout, "drain-timeout", 5*time.Second,
+		"Time in-flight downloads have to finish once interrupted.")
+	c.Flag.StringVar(&tarList, "t", "",
+		"List the metrics in this archive instead of making one.")
+	c.Flag.StringVar(&tarList, "list", "",
+		"List the metrics in this archive instead of making one.")
+	c.Flag.Int64Var(&tarMaxInFlight, "max-in-flight-bytes", 0,
+		"Cap on bytes of downloaded metrics not yet archived.  0 for no limit.")
+	c.Flag.StringVar(&tarCacheDir, "cache-dir", "",
+		"Cache downloaded metrics here and skip unchanged metrics on re-runs.")
+	c.Flag.IntVar(&tarCompressWorkers, "compress-workers", runtime.NumCPU(),
+		"Goroutines decoding and compressing metrics for the archive.")
+	c.Flag.StringVar(&tarOwner, "owner", "",
+		"Owner of the archived metrics as NAME, UID, or NAME:UID.")
+	c.Flag.StringVar(&tarGroup, "group", "",
+		"Group of the archived metrics as NAME, GID, or NAME:GID.")
+	c.Flag.StringVar(&tarMode, "mode", "",
+		"Octal permissions of the archived metrics.")
+	c.Flag.BoolVar(&tarThrottleErrors, "throttle-on-server-errors", false,
+		"Back off from servers that return errors while others run at full speed.")
+	c.Flag.IntVar(&tarThrottleThreshold, "throttle-errors", 5,
+		"Consecutive server errors that throttle a server.")
+	c.Flag.DurationVar(&tarThrottlePause, "throttle-pause", 10*time.Second,
+		"Pause of a throttled server before it is probed again.")
+	c.Flag.BoolVar(&tarCircuitBreaker, "circuit-breaker", false,
+		"Fail downloads from a throttled server immediately rather than waiting.")
+	c.Flag.BoolVar(&tarDirs, "dirs", false,
+		"Write a directory entry for each directory above the metrics.")
+	c.Flag.StringVar(&tarStatsJSON, "stats-json", "",
+		"Write the run's statistics as JSON to this file, or - for STDOUT.")
+	c.Flag.StringVar(&tarChecksum, "archive-checksum", "",
+		"Checksum the archive as it is written: md5 or sha256.")
+	c.Flag.BoolVar(&tarChecksumFile, "checksum-file", false,
+		"Write the -archive-checksum next to the -o archive as FILE.ALGO.")
+	c.Flag.Int64Var(&tarSplitSize, "split-size", 0,
+		"With -o, start a new numbered archive at this many bytes.  0 for no limit.")
+	c.Flag.IntVar(&tarSplitCount, "split-count", 0,
+		"With -o, start a new numbered archive after this many metrics.  0 for no limit.")
+	c.Flag.Int64Var(&tarMaxTotalBytes, "max-total-bytes", 0,
+		"Refuse to start if the estimated archive size is larger.  0 for no limit.")
+	c.Flag.BoolVar(&tarForce, "force", false,
+		"Archive even if the estimate is over -max-total-bytes.")
+	c.Flag.BoolVar(&tarMetadata, "include-metadata", false,
+		"Archive the metadata sidecar of each metric that has one.")
+	c.Flag.BoolVar(&tarGzip, "z", false,
+		"Compress the archive stream with gzip.")
+	c.Flag.DurationVar(&tarFlushInterval, "flush-interval", 0,
+		"Flush the archive stream between metrics this often.  0 to never flush.")
+	c.Flag.StringVar(&tarSecondaryOutput, "secondary", "",
+		"Also write a best-effort copy of the archive to this file or s3://BUCKET/KEY.")
+	c.Flag.IntVar(&tarSecondaryQueue, "secondary-queue", 100,
+		"Metrics the -secondary copy may fall behind before metrics are dropped from it.")
+	c.Flag.StringVar(&tarStatStream, "stat-stream", "",
+		"Write a JSON stat record of each archived metric to this file.")
+	c.Flag.StringVar(&tarStatStreamHash, "stat-stream-hash", "",
+		"Add a checksum of each metric's data to -stat-stream records: md5 or sha256.")
+	c.Flag.StringVar(&tarListMetrics, "list-metrics", "",
+		"Write the selected metric names as a JSON array to this file, or - for STDOUT.")
+	c.Flag.BoolVar(&tarAllowEmpty, "allow-empty", false,
+		"Write an archive even if the selection matched no metrics.")
+	c.Flag.BoolVar(&tarMetadataOnly, "metadata-only", false,
+		"Write a JSON lines catalog of the selected metrics' stats instead of an archive.")
+	c.Flag.BoolVar(&tarVerify, "verify", false,
+		"Check each metric written against its header size, failing on the first mismatch.")
 }
 
-func writeTar(workOut chan *metrics.MetricData, wg *sync.WaitGroup) {
-	tw := tar.NewWriter(os.Stdout)
-	for work := range workOut {
-		if Verbose {
-			log.Printf("Writing %s...", work.Name)
-		}
-		th := new(tar.Header)
-		th.Name = metrics.MetricToRelative(work.Name)
-		th.Size = work.Size
-		th.Mode = work.Mode
-		th.ModTime = time.Unix(work.ModTime, 0)
+// ringHeader returns a PAX global header recording the hash ring the
+// archive was built from so that restore can detect topology changes.
+func ringHeader(ring *hashing.JSONRingType) (*tar.Header, error) {
+	blob, err := json.Marshal(ring)
+	if err != nil {
+		return nil, err
+	}
+	return &tar.Header{
+		Typeflag: tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{
+			"BUCKYTOOLS.ring": string(blob),
+		},
+	}, nil
+}
 
-		data, err := MetricDecode(work)
-		if err != nil {
-			log.Printf("Skipping %s due to error: %s", work.Name, err)
-			continue
+// totalsHeader returns a PAX global header recording the number of files
+// and their total uncompressed size.  Readers that don't understand it
+// skip over it.
+func totalsHeader(files int, size int64) *tar.Header {
+	return &tar.Header{
+		Typeflag: tar.TypeXGlobalHeader,
+		PAXRecords: map[string]string{
+			"BUCKYTOOLS.files": strconv.Itoa(files),
+			"BUCKYTOOLS.size":  strconv.FormatInt(size, 10),
+		},
+	}
+}
+
+// tarEntry is a metric prepared for the archive.  Data is the entry's
+// content described by Header.  Size is the size of the Whisper data
+// archived before any -compress.  Err is set if the metric can't be
+// archived.
+type tarEntry struct {
+	Metric *metrics.MetricData
+	Header *tar.Header
+	Data   []byte
+	Size   int64
+	Err    error
+}
+
+// prepareEntry builds the archive header for work and decodes, with
+// -pipe-through filters, and, with -compress, compresses its data.
+func prepareEntry(work *metrics.MetricData) *tarEntry {
+	th := new(tar.Header)
+	th.Name = metrics.MetricToRelative(work.Name)
+	th.Size = work.Size
+	th.Mode = work.Mode
+	th.ModTime = time.Unix(work.ModTime, 0)
+	if tarOwnership != nil {
+		tarOwnership.Apply(th)
+	}
+
+	data, err := MetricDecode(work)
+	if err == nil && tarPipeThrough != "" {
+		data, err = pipeThrough(tarPipeThrough, work.Name, data)
+		th.Size = int64(len(data))
+	}
+	size := th.Size
+	if err == nil && tarCompress {
+		data, err = compressEntry(th, data, tarCompressAll)
+	}
+	return &tarEntry{Metric: work, Header: th, Data: data, Size: size, Err: err}
+}
+
+// prepareEntries prepares the metrics received on workOut with
+// tarCompressWorkers goroutines and sends them to entries which is closed
+// once workOut is drained.
+func prepareEntries(workOut chan *metrics.MetricData, entries chan *tarEntry) {
+	workers := tarCompressWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	wg := new(sync.WaitGroup)
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for work := range workOut {
+				entries <- prepareEntry(work)
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	close(entries)
+}
+
+// writeTarEntry adds the prepared entry e to the archive.  Metrics that
+// couldn't be prepared are skipped and failures writing the archive are
+// stored in archiveErr.
+func writeTarEntry(tw ArchiveWriter, e *tarEntry) {
+	work := e.Metric
+	if Verbose {
+		log.Printf("Writing %s...", work.Name)
+	}
+	if e.Err != nil {
+		log.Printf("Skipping %s due to error: %s", work.Name, e.Err)
+		workFailedLate()
+		return
+	}
+	if err := writeEntryFiles(tw, e); err != nil {
+		archiveErr = err
+		return
+	}
+	archiveFiles++
+	archiveBytes += e.Size
+	statStream.Archived(work)
+	if tarSecondary != nil {
+		tarSecondary.Offer(e)
+	}
+}
+
+// writeEntryFiles writes the prepared entry e to tw, verifying it with
+// -verify.  The metadata sidecar, if any, follows its metric as is.
+func writeEntryFiles(tw ArchiveWriter, e *tarEntry) error {
+	var err error
+	if tarVerify {
+		err = writeVerifiedFile(tw, e.Header, e.Data)
+	} else {
+		err = writeArchiveFile(tw, e.Header, e.Data)
+	}
+	if err == nil && e.Metric.Metadata != nil {
+		err = writeArchiveFile(tw, metadataHeader(e.Header, len(e.Metric.Metadata)), e.Metric.Metadata)
+	}
+	return err
+}
+
+// writeArchiveFile writes a file entry described by th holding data to tw.
+func writeArchiveFile(tw ArchiveWriter, th *tar.Header, data []byte) error {
+	err := tw.WriteHeader(th)
+	if err != nil {
+		log.Printf("Error writing tar: %s", err)
+		return err
+	}
+	_, err = tw.Write(data)
+	if err != nil {
+		log.Printf("Error writing data to tar file: %s", err)
+	}
+	return err
+}
+
+// archiveRing returns the hash ring to record in the archive.
+func archiveRing() *hashing.JSONRingType {
+	if tarRing != nil {
+		return tarRing
+	}
+	if Cluster != nil {
+		return Cluster.Ring
+	}
+	return nil
+}
+
+// writeTar writes the metrics received on workOut as an archive in the
+// -format to w.  Errors writing the archive are stored in archiveErr and
+// the remaining work is drained so that the workers may exit.
+func writeTar(w io.Writer, workOut chan *metrics.MetricData, wg *sync.WaitGroup) {
+	var tw ArchiveWriter
+	var gz *gzip.Writer
+	var err error
+	parts, split := w.(*splitSink)
+	if split {
+		tw, err = newSplitArchiveWriter(tarFormat, parts, tarSplitSize, tarSplitCount)
+	} else {
+		w = io.MultiWriter(w, &archiveWritten)
+		if tarChecksum != "" {
+			// Checksum the archive stream as it is written
+			archiveHash, err = metrics.NewChecksum(tarChecksum)
+			if err == nil {
+				w = io.MultiWriter(w, archiveHash)
+			}
 		}
-		err = tw.WriteHeader(th)
-		if err != nil {
-			log.Fatalf("Error writing tar: %s", err)
+		if err == nil && tarGzip {
+			gz = gzip.NewWriter(w)
+			w = gz
+		}
+		if err == nil {
+			tw, err = newMetricArchiveWriter(tarFormat, w)
+		}
+	}
+	flusher := NewStreamFlusher(tarFlushInterval)
+	if tw != nil {
+		flusher.Add(tw)
+	}
+	if gz != nil {
+		flusher.Add(gz)
+	}
+	if err != nil {
+		log.Printf("Error creating archive: %s", err)
+		archiveErr = err
+	} else if ring := archiveRing(); ring != nil {
+		th, err := ringHeader(ring)
+		if err == nil {
+			err = tw.WriteHeader(th)
 		}
-		_, err = tw.Write(data)
 		if err != nil {
-			log.Fatalf("Error writing data to tar file: %s", err)
+			log.Printf("Error writing ring record: %s", err)
+			archiveErr = err
+		}
+	}
+	if tarSecondary != nil {
+		tarSecondary.Start(archiveRing())
+	}
+	// Entries are decoded and compressed in their own stage so that
+	// compression overlaps with downloads and writing the archive.
+	entries := make(chan *tarEntry, 25)
+	go prepareEntries(workOut, entries)
+	for e := range entries {
+		if archiveErr == nil {
+			writeTarEntry(tw, e)
+		}
+		if archiveErr == nil {
+			archiveErr = flusher.Boundary()
 		}
+		tarBudget.Release(e.Metric.Size)
 	}
 
-	err := tw.Close()
-	if err != nil {
-		log.Fatal("Error closing tar archive: %s", err)
+	if archiveErr == nil && tarTotals {
+		archiveErr = tw.WriteHeader(totalsHeader(archiveFiles, archiveBytes))
+		if archiveErr != nil {
+			log.Printf("Error writing totals record: %s", archiveErr)
+		}
+	}
+	if archiveErr == nil {
+		archiveErr = tw.Close()
+		if archiveErr == nil && gz != nil {
+			archiveErr = gz.Close()
+		}
+		if archiveErr != nil {
+			log.Printf("Error closing archive: %s", archiveErr)
+		}
+	}
+	if tarFlushInterval > 0 {
+		log.Printf("Flushed the archive stream %d times.", flusher.Flushes())
+	}
+	if split {
+		archiveWritten = writeCounter(parts.total)
 	}
 
 	wg.Done()
 }
 
-func getMetricWorker(workIn chan *MetricWork, workOut chan *metrics.MetricData, wg *sync.WaitGroup) {
+// getMetricWorker downloads the metrics received on workIn.  No new
+// downloads are started once stop is cancelled, but a download already in
+// flight runs until it completes or hard is cancelled.  The worker exits
+// early when quit, if not nil, is closed.
+func getMetricWorker(stop, hard context.Context, workIn chan *MetricWork, workOut chan *metrics.MetricData, quit <-chan struct{}, wg *sync.WaitGroup) {
 	var data []byte
-	for w := range workIn {
-		metric, err := GetMetricData(w.Server, w.Name)
+	for {
+		var w *MetricWork
+		var ok bool
+		select {
+		case <-quit:
+			wg.Done()
+			return
+		case w, ok = <-workIn:
+		}
+		if !ok {
+			break
+		}
+		if stop.Err() != nil {
+			continue
+		}
+		started := time.Now()
+		var metric *metrics.MetricData
+		var err error
+		var server string
+		for i, s := range append([]string{w.Server}, w.Fallback...) {
+			server = s
+			if i > 0 {
+				log.Printf("Falling back to %s for %s", server, w.Name)
+			}
+			err = withRetries(stop, metricRetries(w.Name),
+				fmt.Sprintf("download of [%s]:%s", server, w.Name),
+				func() (err error) {
+					done := func(error) {}
+					if tarThrottle != nil {
+						done, err = tarThrottle.Acquire(stop, server)
+						if err != nil {
+							return err
+						}
+					}
+					if tarCache != nil {
+						metric, err = tarCache.Get(hard, server, w.Name)
+					} else {
+						metric, err = GetMetricDataContext(hard, server, w.Name)
+					}
+					done(err)
+					return err
+				})
+			if err == nil || stop.Err() != nil {
+				break
+			}
+		}
+		if tarScaler != nil {
+			tarScaler.Observe(time.Since(started), err != nil)
+		}
 		if err != nil {
-			workerErrors = true
+			if hard.Err() != nil {
+				atomic.AddInt32(&tarAbandoned, 1)
+			}
+			workFailedOn(server, w.Name)
 			continue
 		}
+		if stop.Err() != nil {
+			// Completed during the drain period
+			atomic.AddInt32(&tarDrained, 1)
+		}
+		recordDownload(server, len(metric.Data))
+		statStream.Downloaded(w.Name, server)
+		if tarMetadata {
+			err = withRetries(stop, metricRetries(w.Name),
+				fmt.Sprintf("metadata download of [%s]:%s", server, w.Name),
+				func() (err error) {
+					metric.Metadata, err = GetMetadata(hard, server, w.Name)
+					return err
+				})
+			if err != nil {
+				tarBudget.Release(metric.Size)
+				workFailedOn(server, w.Name)
+				continue
+			}
+		}
 
 		// Decompress the metric here so that we store uncompressed data
 		// in the tar file which can then be better compressed.
@@ -111,51 +886,297 @@ func getMetricWorker(workIn chan *MetricWork, workOut chan *metrics.MetricData,
 		if err == nil {
 			metric.Data = data
 			metric.Encoding = metrics.EncIdentity
+			workSucceeded()
 			workOut <- metric
 		} else {
-			workerErrors = true
+			tarBudget.Release(metric.Size)
+			workFailedOn(server, w.Name)
 		}
 	}
 
 	wg.Done()
 }
 
-func multiplexTar(metricMap map[string][]string) error {
-	wgTar := new(sync.WaitGroup)
-	wgWork := new(sync.WaitGroup)
-	workIn := make(chan *MetricWork, 25)
-	workOut := make(chan *metrics.MetricData, 25)
+// drainContext returns a context that is cancelled drain after stop is
+// cancelled.  The returned CancelFunc must be called to release the
+// timer goroutine.
+func drainContext(stop context.Context, drain time.Duration) (context.Context, context.CancelFunc) {
+	hard, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop.Done():
+		case <-hard.Done():
+			return
+		}
+		timer := time.NewTimer(drain)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-hard.Done():
+		}
+	}()
+	return hard, cancel
+}
+
+// tarContext returns a context that is cancelled on SIGINT or SIGTERM or
+// when the -timeout expires.
+func tarContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if tarTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), tarTimeout)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigs:
+			log.Printf("Received %s, finishing in-flight downloads...", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sigs)
+	}()
+	return ctx, cancel
+}
+
+// uniqSorted removes adjacent duplicates from the sorted slice s in place.
+func uniqSorted(s []string) []string {
+	if len(s) == 0 {
+		return s
+	}
+	j := 0
+	for i := 1; i < len(s); i++ {
+		if s[i] != s[j] {
+			j++
+			s[j] = s[i]
+		}
+	}
+	return s[:j+1]
+}
+
+// uniqMetrics returns the metrics in list without duplicates, keeping the
+// first occurrence of each, and the number of duplicates removed.
+func uniqMetrics(list []string) ([]string, int) {
+	seen := make(map[string]bool, len(list))
+	ret := make([]string, 0, len(list))
+	for _, m := range list {
+		if !seen[m] {
+			seen[m] = true
+			ret = append(ret, m)
+		}
+	}
+	return ret, len(list) - len(ret)
+}
+
+// checkDuplicates warns that n metrics were selected more than once and
+// are archived once, or returns ErrDuplicateSelection with
+// -error-on-duplicate.
+func checkDuplicates(n int) error {
+	if n == 0 {
+		return nil
+	}
+	if tarErrorOnDuplicate {
+		log.Printf("Abort: %d duplicate metrics in the selection with -error-on-duplicate.", n)
+		return ErrDuplicateSelection
+	}
+	log.Printf("Warning: %d duplicate metrics in the selection, archiving each once.", n)
+	return nil
+}
+
+// PathCollisions returns the metrics whose archive path, as given by
+// MetricToRelative, is already used by an earlier metric in the list.  The
+// map is keyed by the colliding metric and holds the metric that first
+// used the path.  Names such as "foo/bar.baz" and "foo..bar.baz" both
+// collide with "foo.bar.baz".
+func PathCollisions(list []string) map[string]string {
+	seen := make(map[string]string)
+	ret := make(map[string]string)
+	for _, m := range list {
+		p := metrics.MetricToRelative(m)
+		if first, ok := seen[p]; ok {
+			if first != m {
+				ret[m] = first
+			}
+			continue
+		}
+		seen[p] = m
+	}
+	return ret
+}
+
+// dropPathCollisions removes the metrics from list that would overwrite
+// an earlier metric in the archive.  Each is logged and counted as a
+// failure.
+func dropPathCollisions(list []string) []string {
+	collisions := PathCollisions(list)
+	if len(collisions) == 0 {
+		return list
+	}
+	ret := make([]string, 0, len(list)-len(collisions))
+	for _, m := range list {
+		if first, ok := collisions[m]; ok {
+			log.Printf("Skipping %s: its path %s collides with %s", m,
+				metrics.MetricToRelative(m), first)
+			workFailed()
+			continue
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+func multiplexTar(metricMap map[string][]string, sink MetricSink) error {
+	stop, cancel := tarContext()
+	defer cancel()
+	return multiplexTarContext(stop, metricMap, sink)
+}
+
+// multiplexTarContext builds the archive until stop is cancelled.  In
+// flight downloads are then given -drain-timeout to complete and be
+// written to the archive before they are abandoned.
+func multiplexTarContext(stop context.Context, metricMap map[string][]string, sink MetricSink) error {
+	metricMap = applyOnlyServer(metricMap)
+	metricMap = applySkipPattern(metricMap)
+	metricMap = applySample(metricMap)
 
 	// Sort our work queue for sanity and balancing across the cluster
-	servers := make(map[string]string)
+	servers := make(map[string][]string)
 	sorted := make([]string, 0)
+	duplicates := 0
 	for server, metrics := range metricMap {
 		for _, m := range metrics {
-			servers[m] = server
-			sorted = append(sorted, m)
+			if containsString(servers[m], server) {
+				duplicates++
+				continue
+			}
+			if len(servers[m]) == 0 {
+				sorted = append(sorted, m)
+			}
+			servers[m] = append(servers[m], server)
 		}
 	}
-	sort.Strings(sorted)
+	if err := checkDuplicates(duplicates); err != nil {
+		return err
+	}
+	if !tarAssumeSorted {
+		sort.Strings(sorted)
+	}
 	log.Printf("Total metrics selected for tar: %d", len(sorted))
 
+	return tarMetrics(stop, sorted, func(m string) []string { return servers[m] }, sink)
+}
+
+// singleServerTar archives the given metrics all downloaded from server.
+// No hash ring or per-metric server map is needed.
+func singleServerTar(stop context.Context, server string, metrics []string, sink MetricSink) error {
+	metrics = applySkipPattern(map[string][]string{server: metrics})[server]
+	metrics = applySample(map[string][]string{server: metrics})[server]
+	metrics, duplicates := uniqMetrics(metrics)
+	if err := checkDuplicates(duplicates); err != nil {
+		return err
+	}
+	if !tarAssumeSorted {
+		sort.Strings(metrics)
+	}
+	log.Printf("Total metrics selected for tar from %s: %d", server, len(metrics))
+
+	return tarMetrics(stop, metrics, func(string) []string { return []string{server} }, sink)
+}
+
+// tarMetrics downloads the sorted metrics, each from the first of the
+// servers returned by serversFor that succeeds, and writes them to the
+// archive in sink until stop is cancelled.
+func tarMetrics(stop context.Context, sorted []string, serversFor func(string) []string, sink MetricSink) error {
+	sorted = dropPathCollisions(sorted)
+	sorted, err := checkStrictNames(sorted)
+	if err != nil {
+		return err
+	}
+	selected := len(sorted)
+	sorted = applyChangedSince(sorted, serversFor)
+	if tarListMetrics != "" {
+		if err := writeSelection(tarListMetrics, sorted); err != nil {
+			return err
+		}
+		if tarListOnly() {
+			log.Printf("Listed %d metrics, nothing archived without -o or -s3.", len(sorted))
+			return nil
+		}
+	}
+	if len(sorted) == 0 && selected > 0 {
+		log.Printf("No selected metrics changed, writing an empty archive.")
+	} else if len(sorted) == 0 {
+		if !tarAllowEmpty {
+			log.Printf("Abort: Selection matched no metrics, check the expression or list.")
+			return ErrEmptySelection
+		}
+		log.Printf("Warning: Selection matched no metrics, writing an empty archive with -allow-empty.")
+	}
+	if tarMetadataOnly {
+		return writeMetadataCatalog(sink, sorted, serversFor)
+	}
+	if tarMaxTotalBytes > 0 {
+		if err := checkTarBudget(sorted, serversFor); err != nil {
+			return err
+		}
+	}
+	hard, cancel := drainContext(stop, tarDrainTimeout)
+	defer cancel()
+	tarBudget = nil
+	if tarMaxInFlight > 0 {
+		tarBudget = NewByteBudget(tarMaxInFlight)
+		hard = withBudget(hard, tarBudget)
+	}
+	tarPipeContext = hard
+	defer func() { tarPipeContext = nil }()
+	tarThrottle = nil
+	if tarCircuitBreaker {
+		tarThrottle = NewCircuitBreaker(tarThrottleThreshold, tarThrottlePause)
+	} else if tarThrottleErrors {
+		tarThrottle = NewServerThrottle(tarThrottleThreshold, tarThrottlePause)
+	}
+
+	wgTar := new(sync.WaitGroup)
+	wgWork := new(sync.WaitGroup)
+	workIn := make(chan *MetricWork, 25)
+	workOut := make(chan *metrics.MetricData, 25)
+
 	// Start writers and workers
 	wgTar.Add(1)
-	go writeTar(workOut, wgTar)
+	go writeTar(sink, workOut, wgTar)
 
-	wgWork.Add(metricWorkers)
-	for i := 0; i < metricWorkers; i++ {
-		go getMetricWorker(workIn, workOut, wgWork)
+	tarScaler = nil
+	if tarWorkersMax > 0 {
+		tarScaler = NewWorkerScaler(tarWorkersMin, tarWorkersMax, tarScaleStep, tarScaleInterval,
+			func(quit <-chan struct{}) {
+				getMetricWorker(stop, hard, workIn, workOut, quit, wgWork)
+			}, wgWork)
+		tarScaler.Start()
+	} else {
+		wgWork.Add(metricWorkers)
+		for i := 0; i < metricWorkers; i++ {
+			go getMetricWorker(stop, hard, workIn, workOut, nil, wgWork)
+		}
 	}
 
 	// Feed work in
 	c := 0
 	l := len(sorted)
 	t := time.Now().Unix()
+feed:
 	for _, m := range sorted {
 		work := new(MetricWork)
 		work.Name = m
-		work.Server = servers[m]
-		workIn <- work
+		servers := serversFor(m)
+		work.Server = servers[0]
+		work.Fallback = servers[1:]
+		select {
+		case workIn <- work:
+		case <-stop.Done():
+			break feed
+		}
 		c++
 		if c%10 == 0 {
 			now := time.Now().Unix()
@@ -170,83 +1191,424 @@ func multiplexTar(metricMap map[string][]string) error {
 		}
 	}
 	close(workIn)
+	if tarScaler != nil {
+		tarScaler.Stop()
+	}
 	wgWork.Wait()
 
 	// All workers are complete, close workOut
 	close(workOut)
 	wgTar.Wait() // Wait for tar writer to complete
 
-	log.Printf("Archive complete.")
-	if workerErrors {
+	if archiveErr != nil {
+		return archiveErr
+	}
+	if stop.Err() != nil {
+		log.Printf("Archive interrupted after %d of %d metrics: %s", c, l, stop.Err())
+		tarInterrupted = true
+		log.Printf("Drain saved %d in-flight downloads, %d abandoned.",
+			tarDrained, tarAbandoned)
+	}
+	log.Printf("Archive complete: %d metrics, %d bytes uncompressed.",
+		archiveFiles, archiveBytes)
+	stats := TarRunStats()
+	log.Printf("Downloaded %d bytes, wrote %d bytes, compression ratio %.2f.",
+		stats.BytesDownloaded, stats.BytesWritten, stats.CompressionRatio)
+	if archiveHash != nil {
+		log.Printf("Archive checksum: %s", metrics.FormatChecksum(tarChecksum, archiveHash))
+	}
+	if tarCache != nil {
+		tarCache.Summary()
+	}
+	if tarThrottle != nil {
+		tarThrottle.Summary()
+	}
+	if tarScaler != nil {
+		tarScaler.Summary()
+	}
+	if tarBudget != nil {
+		peak, throttled := tarBudget.Stats()
+		log.Printf("In-flight cap of %d bytes throttled %d downloads, peak %d bytes.",
+			tarMaxInFlight, throttled, peak)
+	}
+	if workerErrors() || tarInterrupted {
 		return fmt.Errorf("Errors building tar file are present.")
 	}
 	return nil
 }
 
-func TarRegexMetrics(servers []string, regex string, force bool) error {
+func TarRegexMetrics(servers []string, regex string, force bool, sink MetricSink) error {
 	metricMap, err := ListRegexMetrics(servers, regex, listForce)
 	if err != nil {
 		return err
 	}
 
-	return multiplexTar(metricMap)
+	return multiplexTar(metricMap, sink)
 }
 
-func TarSliceMetrics(servers []string, metrics []string, force bool) error {
-	metricMap, err := ListSliceMetrics(servers, metrics, listForce)
+func TarSliceMetrics(servers []string, metrics []string, force bool, sink MetricSink) error {
+	metricMap, err := DirectSliceMetrics(servers, metrics, listForce)
 	if err != nil {
 		return err
 	}
 
-	return multiplexTar(metricMap)
+	return multiplexTar(metricMap, sink)
 }
 
-func TarJSONMetrics(servers []string, fd io.Reader, force bool) error {
-	// Read the JSON from the file-like object
-	blob, err := ioutil.ReadAll(fd)
-	metrics := make([]string, 0)
+func TarJSONMetrics(servers []string, fd io.Reader, force bool, sink MetricSink) error {
+	metrics, err := readTarJSON(fd)
+	if err != nil {
+		return err
+	}
+
+	return TarSliceMetrics(servers, metrics, force, sink)
+}
 
-	err = json.Unmarshal(blob, &metrics)
-	// We could just package this up and query the server, but lets check the
-	// JSON is valid first.
+// readTarJSON reads the JSON array of metrics given to tar on STDIN and
+// sets the number of retries of the metrics that override it.
+func readTarJSON(fd io.Reader) ([]string, error) {
+	metrics, retries, err := ReadAnnotatedMetrics(fd)
 	if err != nil {
-		log.Printf("Error unmarshalling JSON data: %s", err)
+		return nil, err
+	}
+	tarRetries = retries
+	if len(retries) > 0 {
+		log.Printf("%d metrics override the number of retries.", len(retries))
+	}
+	return metrics, nil
+}
+
+// tarListOnly returns true if -list-metrics is given without an archive
+// destination, so only the selection is written.
+func tarListOnly() bool {
+	return tarListMetrics != "" && tarOutput == "" && s3Output == ""
+}
+
+// writeSelection writes the selected metric names to path, or STDOUT for
+// "-", as a JSON array.
+func writeSelection(path string, names []string) error {
+	w := os.Stdout
+	if path != "-" {
+		fd, err := os.Create(path)
+		if err != nil {
+			log.Printf("Error opening metric list: %s", err)
+			return err
+		}
+		defer fd.Close()
+		w = fd
+	}
+	if err := writeNames(w, names); err != nil {
+		log.Printf("Error writing metric list: %s", err)
 		return err
 	}
+	return nil
+}
 
-	return TarSliceMetrics(servers, metrics, force)
+// singleServer returns the HOST:PORT of the buckyd daemon at hostport.
+// Without a cluster to take the port from a missing port defaults to
+// buckyd's 4242.
+func singleServer(hostport string) (string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if ae, ok := err.(*net.AddrError); ok && ae.Err == "missing port in address" {
+		host, port = hostport, "4242"
+	} else if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// TarSingleServer archives the metrics selected by the arguments of c that
+// are found on the buckyd daemon at hostport.  Every metric is downloaded
+// from that daemon and the cluster's hash ring is never built.  The ring
+// the daemon reports is still recorded in the archive for restore.
+func TarSingleServer(c Command, hostport string, sink MetricSink) error {
+	server, err := singleServer(hostport)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return err
+	}
+
+	tarRing, err = GetSingleHashRing(server)
+	if err != nil {
+		log.Printf("Warning: Archive will have no hash ring record.")
+	}
+	warnMaintenance([]string{server})
+
+	var metricMap map[string][]string
+	if !listRegexMode && c.Flag.Arg(0) == "-" {
+		// Keep the per-metric retries that ListSelection would drop
+		metrics, err := readTarJSON(os.Stdin)
+		if err != nil {
+			return err
+		}
+		metricMap, err = ListSliceMetrics([]string{server}, metrics, listForce)
+	} else {
+		metricMap, err = ListSelection(c, []string{server})
+	}
+	if err != nil {
+		return err
+	}
+
+	stop, cancel := tarContext()
+	defer cancel()
+	return singleServerTar(stop, server, metricMap[server], sink)
 }
 
 // tarCommand runs this subcommand.
 func tarCommand(c Command) int {
-	_, err := GetClusterConfig(HostPort)
+	if tarList != "" {
+		return tarListCommand()
+	}
+
+	var err error
+	if !checkRingReplicas() {
+		return ExitUsage
+	}
+	if !SingleHost {
+		_, err = GetClusterConfig(HostPort)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+	}
+
+	if c.Flag.NArg() == 0 {
+		log.Print("At least one argument is required.")
+		return ExitUsage
+	}
+	if SingleHost && OnlyServer != "" {
+		log.Print("The -only-server option requires the hash ring and can not be used with -s.")
+		return ExitUsage
+	}
+	if !containsString(archiveFormats, tarFormat) {
+		log.Printf("Unknown archive format: %s", tarFormat)
+		return ExitUsage
+	}
+	if tarFormat == "cpio" && tarCompress {
+		log.Printf("The -compress option requires -format tar.")
+		return ExitUsage
+	}
+	if tarChecksum != "" {
+		if _, err := metrics.NewChecksum(tarChecksum); err != nil {
+			log.Print(err)
+			return ExitUsage
+		}
+	}
+	if (tarChecksum != "" || tarChecksumFile) && splitting() {
+		log.Printf("The -archive-checksum option can not be used with -split-size or -split-count.")
+		return ExitUsage
+	}
+	if tarChecksumFile && (tarChecksum == "" || tarOutput == "" || s3Output != "") {
+		log.Printf("The -checksum-file option requires -archive-checksum and -o.")
+		return ExitUsage
+	}
+	if tarSplitSize < 0 || (tarSplitSize > 0 && tarOutput == "") {
+		log.Printf("The -split-size option requires -o and a positive size.")
+		return ExitUsage
+	}
+	if tarSplitCount < 0 || (tarSplitCount > 0 && tarOutput == "") {
+		log.Printf("The -split-count option requires -o and a positive count.")
+		return ExitUsage
+	}
+	if !checkSkipPattern() {
+		return ExitUsage
+	}
+	if !checkWorkerScaling() {
+		return ExitUsage
+	}
+	if !checkMetadataOnly() {
+		return ExitUsage
+	}
+	if SampleRate <= 0 || SampleRate > 1 {
+		log.Printf("The -sample-rate must be greater than 0 and at most 1, or -sample greater than 0 and at most 100.")
+		return ExitUsage
+	}
+	tarOwnership, err = ParseOwnership(tarOwner, tarGroup, tarMode)
 	if err != nil {
 		log.Print(err)
-		return 1
+		return ExitUsage
+	}
+	tarChangedSince = time.Time{}
+	if tarChangedSinceFile != "" {
+		tarChangedSince, err = ReadChangedSince(tarChangedSinceFile)
+		if err != nil {
+			log.Printf("Error reading -changed-since-file: %s", err)
+			return ExitError
+		}
+	}
+	if (tarThrottleErrors || tarCircuitBreaker) && (tarThrottleThreshold < 1 || tarThrottlePause <= 0) {
+		log.Printf("The -throttle-errors and -throttle-pause options must be positive.")
+		return ExitUsage
+	}
+	if tarGzip && splitting() {
+		log.Printf("The -z option can not be used with -split-size or -split-count.")
+		return ExitUsage
+	}
+	if tarFlushInterval < 0 {
+		log.Printf("The -flush-interval option can not be negative.")
+		return ExitUsage
+	}
+	if tarMaxTotalBytes < 0 {
+		log.Printf("The -max-total-bytes option can not be negative.")
+		return ExitUsage
+	}
+	if tarStatStreamHash != "" {
+		if _, err := metrics.NewChecksum(tarStatStreamHash); err != nil {
+			log.Print(err)
+			return ExitUsage
+		}
+	}
+	if tarPipeWorkers < 0 {
+		log.Printf("The -pipe-workers option can not be negative.")
+		return ExitUsage
+	}
+	if tarPipeWorkers > 0 {
+		tarPipeSlots = make(chan struct{}, tarPipeWorkers)
+	}
+	if tarSecondaryOutput != "" && (tarListOnly() || tarSecondaryQueue < 1) {
+		log.Printf("The -secondary option requires an archive and a -secondary-queue of at least 1.")
+		return ExitUsage
+	}
+	if tarStatStream != "" && tarListOnly() {
+		log.Printf("The -stat-stream option requires an archive.")
+		return ExitUsage
+	}
+	if tarStatsJSON == "-" && tarOutput == "" && s3Output == "" {
+		log.Printf("The -stats-json - option requires -o or -s3 to keep the archive off of STDOUT.")
+		return ExitUsage
 	}
 
-	if c.Flag.NArg() == 0 {
-		log.Fatal("At least one argument is required.")
+	if tarCacheDir != "" {
+		if err := os.MkdirAll(tarCacheDir, 0755); err != nil {
+			log.Printf("Error creating cache directory: %s", err)
+			return ExitError
+		}
+		tarCache = NewMetricCache(tarCacheDir)
+	}
+
+	var sink MetricSink
+	switch {
+	case tarListOnly():
+		// Only the selection is written
+	case s3Output != "":
+		sink, err = NewS3Sink(s3Output)
+	case tarOutput != "" && splitting():
+		sink, err = NewSplitSink(tarOutput)
+	case tarOutput != "":
+		sink, err = NewFileSink(tarOutput)
+	default:
+		if terminal.IsTerminal(int(os.Stdout.Fd())) {
+			log.Print("Refusing to write archive to terminal.")
+			return ExitUsage
+		}
+		sink = NewStdoutSink()
+	}
+	if err != nil {
+		log.Printf("Error opening archive output: %s", err)
+		return ExitError
 	}
 
-	if terminal.IsTerminal(int(os.Stdout.Fd())) {
-		log.Fatal("Refusing to write tar file to terminal.")
+	var statFile *os.File
+	if tarStatStream != "" {
+		statFile, err = os.Create(tarStatStream)
+		if err != nil {
+			log.Printf("Error opening stat stream: %s", err)
+			sink.Abort()
+			return ExitError
+		}
+		// Closed again below to check for errors
+		defer statFile.Close()
+		statStream = NewStatStream(statFile, tarStatStreamHash)
 	}
 
-	if !Cluster.Healthy {
-		log.Printf("Warning: Cluster is not optimal.")
+	if tarSecondaryOutput != "" {
+		secondary, err := NewSecondarySink(tarSecondaryOutput)
+		if err != nil {
+			log.Printf("Error opening secondary archive output: %s", err)
+			sink.Abort()
+			return ExitError
+		}
+		tarSecondary = NewSecondaryArchive(secondary, tarSecondaryQueue)
+		defer closeSecondary()
 	}
 
-	if listRegexMode && c.Flag.NArg() > 0 {
-		err = TarRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce)
-	} else if c.Flag.Arg(0) != "-" {
-		err = TarSliceMetrics(Cluster.HostPorts(), c.Flag.Args(), listForce)
+	tarStarted = time.Now()
+	if SingleHost {
+		err = TarSingleServer(c, HostPort, sink)
 	} else {
-		err = TarJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce)
+		if !Cluster.Healthy {
+			log.Printf("Warning: Cluster is not optimal.")
+		}
+		warnMaintenance(Cluster.HostPorts())
+
+		if listRegexMode && c.Flag.NArg() > 0 {
+			err = TarRegexMetrics(Cluster.HostPorts(), c.Flag.Arg(0), listForce, sink)
+		} else if c.Flag.Arg(0) != "-" {
+			err = TarSliceMetrics(Cluster.HostPorts(), c.Flag.Args(), listForce, sink)
+		} else {
+			err = TarJSONMetrics(Cluster.HostPorts(), os.Stdin, listForce, sink)
+		}
 	}
 
-	if err != nil {
-		return 1
+	if err == ErrOverBudget || err == ErrEmptySelection || err == ErrDuplicateSelection ||
+		err == ErrStrictNames {
+		recordError(err)
+		if sink != nil {
+			sink.Abort()
+		}
+		return ExitUsage
+	}
+	if tarListOnly() {
+		return exitStatus(err)
+	}
+
+	if tarStatsJSON != "" {
+		if serr := writeTarStats(tarStatsJSON, TarRunStats()); serr != nil {
+			log.Printf("Error writing statistics: %s", serr)
+		}
+	}
+	var statErr error
+	if statStream != nil {
+		statErr = closeStatStream(statFile)
+		if statErr != nil {
+			log.Printf("Error writing stat stream %s: %s", tarStatStream, statErr)
+		} else {
+			log.Printf("Wrote %d stat records to %s.", statStream.Records(), tarStatStream)
+		}
+	}
+
+	// Only a failure to produce the archive throws it away.  Errors
+	// fetching individual metrics still result in a usable archive.
+	if archiveErr != nil || (err != nil && !workerErrors() && !tarInterrupted) {
+		recordError(archiveErr)
+		sink.Abort()
+		return ExitError
+	}
+	if cerr := sink.Close(); cerr != nil {
+		log.Printf("Error finalizing archive: %s", cerr)
+		return ExitError
+	}
+	if tarChecksumFile {
+		if cerr := writeChecksumFile(tarOutput, tarChecksum, archiveHash); cerr != nil {
+			log.Printf("Error writing checksum file: %s", cerr)
+			return ExitError
+		}
+	}
+	if statErr != nil {
+		// The archive is complete but its index is not
+		recordError(statErr)
+		return ExitError
+	}
+	if tarInterrupted {
+		return ExitTimeout
+	}
+	status := exitStatus(err)
+	if status == ExitOK && tarChangedSinceFile != "" {
+		// The next run picks up what changed while this one ran
+		if werr := WriteChangedSince(tarChangedSinceFile, tarStarted); werr != nil {
+			log.Printf("Error updating -changed-since-file: %s", werr)
+			return ExitError
+		}
 	}
-	return 0
+	return status
 }
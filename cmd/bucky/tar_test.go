@@ -0,0 +1,635 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+// resetTarState clears the global state left behind by a tar run.
+func resetTarState() {
+	archiveErr = nil
+	archiveFiles = 0
+	archiveBytes = 0
+	tarDrained = 0
+	tarAbandoned = 0
+	tarInterrupted = false
+	workerSucceeded = 0
+	workerFailed = 0
+	tarRetries = nil
+	archiveHash = nil
+	tarStats = newTarStats()
+	archiveWritten = 0
+	tarStarted = time.Time{}
+	resetFailures()
+}
+
+func TestWriteTarTotals(t *testing.T) {
+	resetTarState()
+	tarTotals = true
+	defer func() { tarTotals = false }()
+
+	workOut := make(chan *metrics.MetricData, 2)
+	workOut <- &metrics.MetricData{Name: "foo.bar", Size: 3, Mode: 0644,
+		Encoding: metrics.EncIdentity, Data: []byte("abc")}
+	workOut <- &metrics.MetricData{Name: "foo.baz", Size: 5, Mode: 0644,
+		Encoding: metrics.EncIdentity, Data: []byte("abcde")}
+	close(workOut)
+
+	buf := new(bytes.Buffer)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(buf, workOut, wg)
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+	if archiveFiles != 2 || archiveBytes != 8 {
+		t.Errorf("Bad totals: %d files, %d bytes", archiveFiles, archiveBytes)
+	}
+
+	// Regular entries read back normally and the totals record is last
+	tr := tar.NewReader(buf)
+	files := 0
+	var global *tar.Header
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.Typeflag == tar.TypeXGlobalHeader {
+			if _, ok := th.PAXRecords["BUCKYTOOLS.files"]; ok {
+				global = th
+			}
+			continue
+		}
+		if global != nil {
+			t.Errorf("Entry %s follows the totals record", th.Name)
+		}
+		if _, err := ioutil.ReadAll(tr); err != nil {
+			t.Errorf("Error reading %s: %s", th.Name, err)
+		}
+		files++
+	}
+
+	if files != 2 {
+		t.Errorf("Expected 2 files in archive, found %d", files)
+	}
+	if global == nil {
+		t.Fatalf("Totals record not found")
+	}
+	if global.PAXRecords["BUCKYTOOLS.files"] != "2" {
+		t.Errorf("Bad file count: %v", global.PAXRecords)
+	}
+	if global.PAXRecords["BUCKYTOOLS.size"] != "8" {
+		t.Errorf("Bad size: %v", global.PAXRecords)
+	}
+}
+
+// slowMetricServer serves every metric after the given delay.
+func slowMetricServer(delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		data := []byte("whisper data")
+		stat, _ := json.Marshal(&metrics.MetricData{
+			Name: strings.TrimPrefix(r.URL.Path, "/metrics/"),
+			Size: int64(len(data)),
+			Mode: 0644,
+		})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write(data)
+	}))
+}
+
+// interruptedTar runs a tar of one slow metric that is interrupted while
+// the download is in flight and returns the number of archived metrics.
+func interruptedTar(t *testing.T, drain time.Duration) int {
+	server := slowMetricServer(300 * time.Millisecond)
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 1
+	tarDrainTimeout = drain
+	metricMap := map[string][]string{
+		strings.TrimPrefix(server.URL, "http://"): []string{"foo.slow"},
+	}
+
+	stop, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	buf := new(bytes.Buffer)
+	err := multiplexTarContext(stop, metricMap, &stdoutSink{buf})
+	if err == nil {
+		t.Errorf("Interrupted tar did not report an error")
+	}
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+
+	tr := tar.NewReader(buf)
+	files := 0
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		files++
+	}
+	return files
+}
+
+func TestTarDrain(t *testing.T) {
+	if files := interruptedTar(t, 5*time.Second); files != 1 {
+		t.Errorf("In-flight download was not archived during drain")
+	}
+	if tarDrained != 1 || tarAbandoned != 0 {
+		t.Errorf("Expected 1 drained download, got %d drained %d abandoned",
+			tarDrained, tarAbandoned)
+	}
+}
+
+func TestTarDrainExpired(t *testing.T) {
+	if files := interruptedTar(t, 10*time.Millisecond); files != 0 {
+		t.Errorf("Download finished after the drain period was archived")
+	}
+	if tarDrained != 0 || tarAbandoned != 1 {
+		t.Errorf("Expected 1 abandoned download, got %d drained %d abandoned",
+			tarDrained, tarAbandoned)
+	}
+}
+
+func TestUniqSorted(t *testing.T) {
+	tests := []struct {
+		in, out []string
+	}{
+		{[]string{}, []string{}},
+		{[]string{"a"}, []string{"a"}},
+		{[]string{"a", "a", "b", "c", "c", "c"}, []string{"a", "b", "c"}},
+	}
+	for _, v := range tests {
+		out := uniqSorted(v.in)
+		if strings.Join(out, ",") != strings.Join(v.out, ",") {
+			t.Errorf("Expected %v, got %v", v.out, out)
+		}
+	}
+}
+
+func TestSingleServer(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"graphite1", "graphite1:4242"},
+		{"graphite1:4343", "graphite1:4343"},
+		{"[::1]:4343", "[::1]:4343"},
+	}
+	for _, v := range tests {
+		out, err := singleServer(v.in)
+		if err != nil || out != v.out {
+			t.Errorf("singleServer(%q) = %q, %v, expected %q", v.in, out, err, v.out)
+		}
+	}
+}
+
+func TestTarSingleServer(t *testing.T) {
+	ring := ringFor(1, "127.0.0.1", "127.0.0.2")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hashring":
+			blob, _ := json.Marshal(ring)
+			w.Write(blob)
+		case "/metrics":
+			list := make([]string, 0)
+			json.Unmarshal([]byte(r.FormValue("list")), &list)
+			blob, _ := json.Marshal(list)
+			w.Write(blob)
+		default:
+			data := []byte("whisper data")
+			stat, _ := json.Marshal(&metrics.MetricData{
+				Name: strings.TrimPrefix(r.URL.Path, "/metrics/"),
+				Size: int64(len(data)),
+				Mode: 0644,
+			})
+			w.Header().Set("X-Metric-Stat", string(stat))
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	resetTarState()
+	Cluster = nil
+	metricWorkers = 2
+	defer func() { tarRing = nil }()
+
+	c := Command{Name: "tar", Flag: flag.NewFlagSet("tar", flag.ContinueOnError)}
+	c.Flag.Parse([]string{"foo.b", "foo.a", "foo.b"})
+	buf := new(bytes.Buffer)
+	err := TarSingleServer(c, strings.TrimPrefix(server.URL, "http://"), &stdoutSink{buf})
+	if err != nil {
+		t.Fatalf("Error building archive: %s", err)
+	}
+	if Cluster != nil {
+		t.Errorf("Hash ring was built in single server mode")
+	}
+
+	tr := tar.NewReader(buf)
+	names := make([]string, 0)
+	recorded := false
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if _, ok := th.PAXRecords["BUCKYTOOLS.ring"]; ok {
+			recorded = true
+			continue
+		}
+		names = append(names, th.Name)
+	}
+	// Entries are written in the order the downloads finish
+	sort.Strings(names)
+	if strings.Join(names, ",") != "foo/a.wsp,foo/b.wsp" {
+		t.Errorf("Unexpected archive contents: %v", names)
+	}
+	if !recorded {
+		t.Errorf("Server's hash ring was not recorded")
+	}
+}
+
+func TestTarFallback(t *testing.T) {
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+	server := slowMetricServer(0)
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 1
+	Retries = 0
+	defer func() { Retries = 3 }()
+	metricMap := map[string][]string{
+		strings.TrimPrefix(broken.URL, "http://"): []string{"foo.bar"},
+		strings.TrimPrefix(server.URL, "http://"): []string{"foo.bar"},
+	}
+
+	buf := new(bytes.Buffer)
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != nil {
+		t.Fatalf("Download did not fall back to the other server: %s", err)
+	}
+	if archiveFiles != 1 {
+		t.Errorf("Expected 1 metric archived, got %d", archiveFiles)
+	}
+}
+
+func TestWriteTarCompressWorkers(t *testing.T) {
+	resetTarState()
+	tarCompress = true
+	tarCompressWorkers = 4
+	defer func() { tarCompress, tarCompressWorkers = false, 0 }()
+
+	workOut := make(chan *metrics.MetricData, 20)
+	for i := 0; i < 20; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 8192)
+		workOut <- &metrics.MetricData{Name: fmt.Sprintf("foo.bar%d", i), Size: 8192,
+			Mode: 0644, Encoding: metrics.EncIdentity, Data: data}
+	}
+	close(workOut)
+
+	buf := new(bytes.Buffer)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(buf, workOut, wg)
+	if archiveErr != nil || archiveFiles != 20 {
+		t.Fatalf("Wrote %d files: %v", archiveFiles, archiveErr)
+	}
+
+	// A single valid stream with every entry compressed
+	tr := tar.NewReader(buf)
+	files := 0
+	for {
+		th, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading archive: %s", err)
+		}
+		if th.PAXRecords["BUCKYTOOLS.encoding"] != "snappy" {
+			t.Errorf("Entry %s is not compressed", th.Name)
+		}
+		if _, ok := th.PAXRecords["BUCKYTOOLS.size"]; ok {
+			t.Errorf("Entry %s has the archive total's BUCKYTOOLS.size key", th.Name)
+		}
+		files++
+	}
+	if files != 20 {
+		t.Errorf("Expected 20 entries, found %d", files)
+	}
+}
+
+// benchmarkWriteTar measures archiving compressed metrics with the given
+// number of compression workers.
+func benchmarkWriteTar(b *testing.B, workers int) {
+	tarCompress = true
+	tarCompressWorkers = workers
+	defer func() { tarCompress, tarCompressWorkers = false, 0 }()
+
+	data := make([]byte, 256*1024)
+	for i := range data {
+		data[i] = byte(i % 251 / 16)
+	}
+	b.SetBytes(int64(64 * len(data)))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		resetTarState()
+		workOut := make(chan *metrics.MetricData, 25)
+		go func() {
+			for i := 0; i < 64; i++ {
+				workOut <- &metrics.MetricData{Name: fmt.Sprintf("foo.bar%d", i),
+					Size: int64(len(data)), Mode: 0644,
+					Encoding: metrics.EncIdentity, Data: data}
+			}
+			close(workOut)
+		}()
+		wg := new(sync.WaitGroup)
+		wg.Add(1)
+		writeTar(ioutil.Discard, workOut, wg)
+	}
+}
+
+func BenchmarkWriteTarCompress1(b *testing.B) {
+	benchmarkWriteTar(b, 1)
+}
+
+func BenchmarkWriteTarCompress4(b *testing.B) {
+	benchmarkWriteTar(b, 4)
+}
+
+func TestTarMetricRetries(t *testing.T) {
+	calls := int32(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "Flaky", http.StatusInternalServerError)
+			return
+		}
+		data := []byte("whisper data")
+		stat, _ := json.Marshal(&metrics.MetricData{Name: "foo.flaky", Size: int64(len(data)), Mode: 0644})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	resetTarState()
+	metricWorkers = 1
+	Retries = 0
+	RetryBackoff = time.Millisecond
+	defer func() { Retries, RetryBackoff = 3, time.Second }()
+	metricMap := map[string][]string{
+		strings.TrimPrefix(server.URL, "http://"): []string{"foo.flaky"},
+	}
+
+	// Without an override the single attempt fails
+	buf := new(bytes.Buffer)
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err == nil {
+		t.Errorf("Flaky metric archived without retries")
+	}
+
+	resetTarState()
+	atomic.StoreInt32(&calls, 0)
+	tarRetries = map[string]int{"foo.flaky": 2}
+	buf.Reset()
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != nil {
+		t.Errorf("Flaky metric failed with 2 retries: %s", err)
+	}
+	if archiveFiles != 1 || calls != 3 {
+		t.Errorf("Expected 1 metric after 3 calls, got %d after %d", archiveFiles, calls)
+	}
+}
+
+func TestReadTarJSON(t *testing.T) {
+	defer resetTarState()
+	metrics, err := readTarJSON(strings.NewReader(`["foo.a", {"name": "foo.b", "retries": 5}]`))
+	if err != nil {
+		t.Fatalf("Error reading metrics: %s", err)
+	}
+	if fmt.Sprint(metrics) != "[foo.a foo.b]" {
+		t.Errorf("Bad metrics read: %v", metrics)
+	}
+	if len(tarRetries) != 1 || tarRetries["foo.b"] != 5 {
+		t.Errorf("Per-metric retries not kept: %v", tarRetries)
+	}
+}
+
+func TestPathCollisions(t *testing.T) {
+	list := []string{"foo.bar.baz", "foo/bar.baz", "foo..bar.baz", "foo.bar.qux", "foo.bar.qux"}
+	collisions := PathCollisions(list)
+	if len(collisions) != 2 {
+		t.Fatalf("Expected 2 collisions, got %v", collisions)
+	}
+	for _, m := range []string{"foo/bar.baz", "foo..bar.baz"} {
+		if collisions[m] != "foo.bar.baz" {
+			t.Errorf("Expected %s to collide with foo.bar.baz, got %q", m, collisions[m])
+		}
+	}
+
+	// Colliding metrics are reported as failures and not archived
+	server := slowMetricServer(0)
+	defer server.Close()
+	resetTarState()
+	metricWorkers = 1
+	metricMap := map[string][]string{
+		strings.TrimPrefix(server.URL, "http://"): list,
+	}
+	buf := new(bytes.Buffer)
+	err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf})
+	if err == nil || workerFailed != 2 {
+		t.Errorf("Expected the 2 collisions to fail, got %d: %v", workerFailed, err)
+	}
+	if archiveFiles != 2 {
+		t.Errorf("Expected 2 metrics archived, got %d", archiveFiles)
+	}
+	if code := exitStatus(err); code != ExitPartial {
+		t.Errorf("Expected exit code %d, got %d", ExitPartial, code)
+	}
+}
+
+func TestTarListMetrics(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	dir, err := ioutil.TempDir("", "tar_test")
+	if err != nil {
+		t.Fatalf("Error creating directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	resetTarState()
+	metricWorkers = 2
+	tarListMetrics = filepath.Join(dir, "selected.json")
+	SkipPattern = `\.sum$`
+	checkSkipPattern()
+	defer func() {
+		tarListMetrics = ""
+		tarOutput = ""
+		SkipPattern = ""
+		skipRegexp = nil
+	}()
+
+	// Duplicates from replicas and skipped metrics are not listed
+	metricMap := map[string][]string{
+		host:           {"foo.b", "foo.a", "foo.a.sum"},
+		"replica:4242": {"foo.a", "foo.c"},
+	}
+	buf := new(bytes.Buffer)
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != nil {
+		t.Fatalf("Error listing metrics: %s", err)
+	}
+	if buf.Len() != 0 || archiveFiles != 0 {
+		t.Errorf("Listing alone archived %d metrics, %d bytes", archiveFiles, buf.Len())
+	}
+	fd, err := os.Open(tarListMetrics)
+	if err != nil {
+		t.Fatalf("Error opening metric list: %s", err)
+	}
+	names, _, err := ReadAnnotatedMetrics(fd)
+	fd.Close()
+	if err != nil {
+		t.Fatalf("Metric list is not tar - input: %s", err)
+	}
+	if fmt.Sprint(names) != "[foo.a foo.b foo.c]" {
+		t.Errorf("Bad selection listed: %v", names)
+	}
+
+	// With an archive destination the metrics are archived too
+	resetTarState()
+	tarOutput = filepath.Join(dir, "out.tar")
+	metricMap = map[string][]string{host: {"foo.a", "foo.b"}}
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != nil {
+		t.Fatalf("Error archiving metrics: %s", err)
+	}
+	if archiveFiles != 2 {
+		t.Errorf("Expected 2 metrics archived with the list, got %d", archiveFiles)
+	}
+}
+
+func TestTarDuplicateSelection(t *testing.T) {
+	server := slowMetricServer(0)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	replica := slowMetricServer(0)
+	defer replica.Close()
+
+	for _, assumeSorted := range []bool{false, true} {
+		resetTarState()
+		metricWorkers = 2
+		tarAssumeSorted = assumeSorted
+		logs := new(bytes.Buffer)
+		log.SetOutput(logs)
+
+		// Replica copies are expected, a server listing foo.a twice is not
+		metricMap := map[string][]string{
+			host: {"foo.a", "foo.b", "foo.a"},
+			strings.TrimPrefix(replica.URL, "http://"): {"foo.a"},
+		}
+		buf := new(bytes.Buffer)
+		err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf})
+		log.SetOutput(os.Stderr)
+		if err != nil {
+			t.Fatalf("Error building archive: %s", err)
+		}
+		entries := make(map[string]int)
+		tr := tar.NewReader(buf)
+		for {
+			th, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Error reading archive: %s", err)
+			}
+			if th.Typeflag == tar.TypeReg {
+				entries[th.Name]++
+			}
+		}
+		if len(entries) != 2 || entries["foo/a.wsp"] != 1 || entries["foo/b.wsp"] != 1 {
+			t.Errorf("Expected each metric archived once with -assume-sorted %v, got %v",
+				assumeSorted, entries)
+		}
+		if !strings.Contains(logs.String(), "Warning: 1 duplicate metrics") {
+			t.Errorf("No warning of the duplicate:\n%s", logs.String())
+		}
+	}
+	tarAssumeSorted = false
+
+	resetTarState()
+	tarErrorOnDuplicate = true
+	defer func() { tarErrorOnDuplicate = false }()
+	buf := new(bytes.Buffer)
+	metricMap := map[string][]string{host: {"foo.a", "foo.a"}}
+	if err := multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf}); err != ErrDuplicateSelection {
+		t.Errorf("Expected ErrDuplicateSelection with -error-on-duplicate, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Archive written for a refused selection")
+	}
+}
+
+func TestTarEmptySelection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("regex") != "" {
+			w.Write([]byte("[]"))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+	servers := []string{strings.TrimPrefix(server.URL, "http://")}
+
+	resetTarState()
+	metricWorkers = 2
+	buf := new(bytes.Buffer)
+	err := TarRegexMetrics(servers, `^no\.such\.metric$`, false, &stdoutSink{buf})
+	if err != ErrEmptySelection {
+		t.Errorf("Expected ErrEmptySelection for an empty selection, got: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected no archive for an empty selection, got %d bytes", buf.Len())
+	}
+
+	resetTarState()
+	tarAllowEmpty = true
+	defer func() { tarAllowEmpty = false }()
+	buf.Reset()
+	if err := TarRegexMetrics(servers, `^no\.such\.metric$`, false, &stdoutSink{buf}); err != nil {
+		t.Fatalf("An empty selection with -allow-empty should archive, got: %s", err)
+	}
+	if archiveFiles != 0 || buf.Len() == 0 {
+		t.Errorf("Expected an empty but valid archive, got %d metrics, %d bytes",
+			archiveFiles, buf.Len())
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// restoreTargets are the -target servers every metric is restored to in
+// place of its owner in the hash ring.
+var restoreTargets targetList
+
+// targetList is a repeatable flag of buckyd daemons given as HOST[:PORT]
+// or HOST=INSTANCE.
+type targetList []string
+
+func (t *targetList) String() string {
+	return strings.Join(*t, ",")
+}
+
+func (t *targetList) Set(s string) error {
+	if s == "" || strings.HasPrefix(s, ":") || strings.HasPrefix(s, "=") {
+		return fmt.Errorf("Invalid target %q, expected HOST[:PORT] or HOST=INSTANCE", s)
+	}
+	*t = append(*t, s)
+	return nil
+}
+
+// targetServer returns the server string of the buckyd daemon of target.
+// A HOST=INSTANCE target is reached through the instance's -instance-port.
+func targetServer(target string) string {
+	if i := strings.Index(target, "="); i >= 0 {
+		return Cluster.NodeHostPort(hashing.NewNode(target[:i], 0, target[i+1:]))
+	}
+	return target
+}
+
+// TargetPicker hands out a set of servers round robin.  It is safe for
+// concurrent use.
+type TargetPicker struct {
+	servers []string
+	next    uint32
+}
+
+// NewTargetPicker returns a TargetPicker of the -target servers or nil if
+// there are none.
+func NewTargetPicker(targets []string) *TargetPicker {
+	if len(targets) == 0 {
+		return nil
+	}
+	p := &TargetPicker{}
+	for _, t := range targets {
+		p.servers = append(p.servers, targetServer(t))
+	}
+	return p
+}
+
+// Next returns the server to restore the next metric to.
+func (p *TargetPicker) Next() string {
+	n := atomic.AddUint32(&p.next, 1) - 1
+	return p.servers[int(n)%len(p.servers)]
+}
+
+// checkTargets returns true if every -target daemon answers and is not in
+// read-only maintenance.
+func checkTargets(targets []string) bool {
+	ok := true
+	for _, t := range targets {
+		status, err := GetNodeStatus(targetServer(t))
+		if err != nil {
+			log.Printf("Abort: Target %s is unreachable: %s", t, err)
+			ok = false
+		} else if status.Maintenance {
+			log.Printf("Abort: Target %s is in read-only maintenance.", t)
+			ok = false
+		}
+	}
+	return ok
+}
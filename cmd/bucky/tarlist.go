@@ -0,0 +1,147 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+var tarList string
+
+// ArchiveEntry describes a metric stored in an archive.  Size is the size
+// of the Whisper data once any per-entry encoding is removed.
+type ArchiveEntry struct {
+	Name     string
+	Size     int64
+	ModTime  int64
+	Encoding string `json:",omitempty"`
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// openArchive returns a reader of the uncompressed archive in r.  Streams
+// compressed as a whole with gzip are detected and decompressed.  There is
+// no zstd decoder available so zstd streams are reported as an error.
+func openArchive(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(br)
+	case bytes.HasPrefix(magic, zstdMagic):
+		return nil, fmt.Errorf("zstd compressed archives are not supported, decompress with zstd -d first")
+	}
+	return br, nil
+}
+
+// ListArchive returns an inventory of the metrics in the archive in r
+// without extracting them.  Besides archives made by bucky tar, archives of
+// a whisper store made with tar that use absolute paths or individually
+// gzip compressed .wsp.gz files are understood.
+func ListArchive(r io.Reader) ([]ArchiveEntry, error) {
+	in, err := openArchive(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(in)
+	result := make([]ArchiveEntry, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) ||
+			isMetadataEntry(hdr.Name) {
+			// Directories, archive metadata, and metadata sidecars
+			continue
+		}
+
+		entry := ArchiveEntry{
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime.Unix(),
+		}
+		name := hdr.Name
+		switch {
+		case hdr.PAXRecords["BUCKYTOOLS.encoding"] != "":
+			entry.Encoding = hdr.PAXRecords["BUCKYTOOLS.encoding"]
+			entry.Size, err = strconv.ParseInt(hdr.PAXRecords["BUCKYTOOLS.entry_size"], 10, 64)
+		case strings.HasSuffix(name, ".wsp.gz"):
+			name = strings.TrimSuffix(name, ".gz")
+			entry.Encoding = "gzip"
+			entry.Size, err = gzipSize(tr)
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error reading %s: %s", hdr.Name, err)
+		}
+		entry.Name = metrics.PathToMetric(name)
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// gzipSize returns the uncompressed size of the gzip data in r.
+func gzipSize(r io.Reader) (int64, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+	defer gz.Close()
+	return io.Copy(ioutil.Discard, gz)
+}
+
+// tarListCommand prints the inventory of the archive named by -t.
+func tarListCommand() int {
+	fd := os.Stdin
+	if tarList != "-" {
+		var err error
+		fd, err = os.Open(tarList)
+		if err != nil {
+			log.Printf("Error opening archive: %s", err)
+			return ExitError
+		}
+		defer fd.Close()
+	}
+
+	entries, err := ListArchive(fd)
+	if JSONOutput {
+		blob, jerr := json.MarshalIndent(entries, "", "\t")
+		if jerr != nil {
+			log.Printf("%s", jerr)
+			return ExitError
+		}
+		os.Stdout.Write(blob)
+		os.Stdout.Write([]byte("\n"))
+	} else {
+		var total int64
+		for _, e := range entries {
+			fmt.Printf("%s %d %s\n", e.Name, e.Size,
+				time.Unix(e.ModTime, 0).UTC().Format(time.RFC3339))
+			total += e.Size
+		}
+		log.Printf("%d metrics, %d bytes uncompressed.", len(entries), total)
+	}
+	if err != nil {
+		log.Printf("Error reading archive: %s", err)
+		return ExitError
+	}
+	return ExitOK
+}
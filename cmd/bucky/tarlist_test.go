@@ -0,0 +1,85 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"sync"
+	"testing"
+	"time"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestListArchiveGzip(t *testing.T) {
+	resetTarState()
+	written := []*metrics.MetricData{
+		{Name: "foo.bar", Size: 3, Mode: 0644, ModTime: 1500000000,
+			Encoding: metrics.EncIdentity, Data: []byte("abc")},
+		{Name: "foo.baz.qux", Size: 5, Mode: 0644, ModTime: 1500000001,
+			Encoding: metrics.EncIdentity, Data: []byte("abcde")},
+	}
+	workOut := make(chan *metrics.MetricData, len(written))
+	for _, m := range written {
+		workOut <- m
+	}
+	close(workOut)
+
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(gz, workOut, wg)
+	gz.Close()
+	if archiveErr != nil {
+		t.Fatalf("Error writing archive: %s", archiveErr)
+	}
+
+	entries, err := ListArchive(buf)
+	if err != nil {
+		t.Fatalf("Error listing archive: %s", err)
+	}
+	if len(entries) != len(written) {
+		t.Fatalf("Expected %d entries, got %v", len(written), entries)
+	}
+	for i, m := range written {
+		e := entries[i]
+		if e.Name != m.Name || e.Size != m.Size || e.ModTime != m.ModTime {
+			t.Errorf("Expected %s %d %d, got %v", m.Name, m.Size, m.ModTime, e)
+		}
+	}
+}
+
+func TestListArchiveLegacy(t *testing.T) {
+	// A whisper store archived with GNU tar and gzip compressed files
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	data := new(bytes.Buffer)
+	gz := gzip.NewWriter(data)
+	gz.Write(bytes.Repeat([]byte("a"), 1000))
+	gz.Close()
+	tw.WriteHeader(&tar.Header{Name: "/opt/graphite/storage/whisper/foo/",
+		Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "/opt/graphite/storage/whisper/foo/bar.wsp.gz",
+		Typeflag: tar.TypeReg, Mode: 0644, Size: int64(data.Len()),
+		ModTime: time.Unix(1500000000, 0)})
+	tw.Write(data.Bytes())
+	tw.Close()
+
+	entries, err := ListArchive(buf)
+	if err != nil {
+		t.Fatalf("Error listing archive: %s", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %v", entries)
+	}
+	if entries[0].Name != "foo.bar" || entries[0].Size != 1000 || entries[0].Encoding != "gzip" {
+		t.Errorf("Bad entry: %v", entries[0])
+	}
+}
+
+func TestOpenArchiveZstd(t *testing.T) {
+	if _, err := openArchive(bytes.NewReader(append(zstdMagic, 0, 0))); err == nil {
+		t.Errorf("zstd archive was not refused")
+	}
+}
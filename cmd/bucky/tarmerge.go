@@ -0,0 +1,347 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+import "github.com/golang/crypto/ssh/terminal"
+import "github.com/jjneely/buckytools/hashing"
+import . "github.com/jjneely/buckytools/metrics"
+
+var mergeOutput string
+var mergePolicy string
+var mergeGzip bool
+
+// mergePolicies are the ways tar-merge can choose between copies of a
+// metric found in more than one archive.
+var mergePolicies = []string{"newest", "largest", "error"}
+
+// ErrDuplicateMetric is returned when merging with the error policy and
+// a metric is found in more than one archive.
+var ErrDuplicateMetric = errors.New("Metric found in more than one archive")
+
+func init() {
+	usage := "[options] <tar file> <tar file> ..."
+	short := "Merge tar archives of metrics into one archive."
+	long := `Merge two or more archives made by bucky tar into a single archive
+without downloading the metrics again.  Archives compressed with gzip are
+decompressed automatically.  The merged archive is written to STDOUT, which
+may not be a terminal, or to the file given with -o.  Use -z to compress the
+merged archive with gzip.
+
+A metric found in more than one archive is written once.  The -policy
+chooses which copy using the modification time and size in the tar headers:
+
+    newest   The copy with the latest modification time.
+    largest  The copy with the most Whisper data.
+    error    Refuse to merge the archives.
+
+Ties are resolved in favor of the archive given first.  Copies with the
+same modification time and size are counted as duplicates and copies that
+differ are also counted as conflicts.
+
+Every metric's data is read and checked before the merged archive is
+written.  A truncated entry, or one whose compressed data does not decode
+to the recorded size, stops the merge without writing the archive.  The
+hash ring record of the first archive that has one is kept and differences
+with the rings of the other archives are logged.  A totals record is
+written if any archive had one.`
+
+	c := NewCommand(tarMergeCommand, "tar-merge", usage, short, long)
+	SetupCommon(c)
+
+	c.Flag.StringVar(&mergeOutput, "o", "",
+		"Write the merged archive to this file rather than STDOUT.")
+	c.Flag.StringVar(&mergePolicy, "policy", "newest",
+		"Choose between copies of a metric: newest, largest, or error.")
+	c.Flag.BoolVar(&mergeGzip, "z", false,
+		"Compress the merged archive with gzip.")
+}
+
+// mergeEntry is the copy of a metric chosen for the merged archive.  It
+// is the index'th entry of the archive'th input.
+type mergeEntry struct {
+	archive int
+	index   int
+	size    int64
+	modTime int64
+}
+
+// mergeInput is the parsed metadata of an input archive.
+type mergeInput struct {
+	ring    *hashing.JSONRingType
+	totals  bool
+	entries map[string]mergeEntry
+}
+
+// entrySize returns the size of the Whisper data of the tar entry hdr
+// once any per-entry encoding is removed.
+func entrySize(hdr *tar.Header) int64 {
+	if hdr.PAXRecords["BUCKYTOOLS.encoding"] != "" {
+		size, err := strconv.ParseInt(hdr.PAXRecords["BUCKYTOOLS.entry_size"], 10, 64)
+		if err == nil {
+			return size
+		}
+	}
+	return hdr.Size
+}
+
+// MergeStats counts the metrics written by MergeArchives and the copies
+// of metrics found in more than one archive.  Conflicts are duplicates
+// whose copies differ in modification time or size.
+type MergeStats struct {
+	Files      int
+	Duplicates int
+	Conflicts  int
+}
+
+// checkEntry reads the data of the metric entry hdr from tr and returns
+// an error if it is truncated or its encoding can not be decoded.
+func checkEntry(tr *tar.Reader, hdr *tar.Header) error {
+	var err error
+	switch {
+	case hdr.PAXRecords["BUCKYTOOLS.encoding"] == "snappy":
+		metric := &MetricData{Encoding: EncSnappy, Size: entrySize(hdr)}
+		metric.Data, err = ioutil.ReadAll(tr)
+		if err == nil {
+			_, err = MetricDecode(metric)
+		}
+	case strings.HasSuffix(hdr.Name, ".wsp.gz"):
+		_, err = gzipSize(tr)
+	default:
+		_, err = io.Copy(ioutil.Discard, tr)
+	}
+	if err != nil {
+		return fmt.Errorf("Corrupt entry %s: %s", hdr.Name, err)
+	}
+	return nil
+}
+
+// isMetricEntry returns true if the tar entry hdr holds a metric.
+func isMetricEntry(hdr *tar.Header) bool {
+	return hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA
+}
+
+// walkArchive calls f with each header of the archive in r.  The archive
+// is positioned at the data of the header when f is called.
+func walkArchive(r io.Reader, f func(tr *tar.Reader, hdr *tar.Header) error) error {
+	in, err := openArchive(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(in)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(tr, hdr); err != nil {
+			return err
+		}
+	}
+}
+
+// readMergeInput reads the headers of the archive'th input archive in r.
+func readMergeInput(r io.Reader, archive int) (*mergeInput, error) {
+	input := &mergeInput{entries: make(map[string]mergeEntry)}
+	index := 0
+	err := walkArchive(r, func(tr *tar.Reader, hdr *tar.Header) error {
+		defer func() { index++ }()
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if blob, ok := hdr.PAXRecords["BUCKYTOOLS.ring"]; ok {
+				input.ring = new(hashing.JSONRingType)
+				return json.Unmarshal([]byte(blob), input.ring)
+			}
+			if _, ok := hdr.PAXRecords["BUCKYTOOLS.files"]; ok {
+				input.totals = true
+			}
+			return nil
+		}
+		if isMetricEntry(hdr) {
+			if err := checkEntry(tr, hdr); err != nil {
+				return err
+			}
+			input.entries[path.Clean(hdr.Name)] = mergeEntry{
+				archive: archive,
+				index:   index,
+				size:    entrySize(hdr),
+				modTime: hdr.ModTime.Unix(),
+			}
+		}
+		return nil
+	})
+	return input, err
+}
+
+// chooseEntry returns the copy of a metric to keep between the copy cur
+// chosen so far and a later copy next according to policy.
+func chooseEntry(policy string, cur, next mergeEntry) (mergeEntry, error) {
+	switch policy {
+	case "newest":
+		if next.modTime > cur.modTime {
+			return next, nil
+		}
+	case "largest":
+		if next.size > cur.size {
+			return next, nil
+		}
+	default:
+		return cur, ErrDuplicateMetric
+	}
+	return cur, nil
+}
+
+// MergeArchives writes the metrics in the named archives as a single tar
+// archive to w.  Metrics in more than one archive are written once chosen
+// by policy.  Every entry is checked before anything is written.
+func MergeArchives(archives []string, w io.Writer, policy string) (*MergeStats, error) {
+	// First pass: check every entry and choose the copy of each metric
+	var ring *hashing.JSONRingType
+	totals := false
+	chosen := make(map[string]mergeEntry)
+	stats := new(MergeStats)
+	for i, file := range archives {
+		fd, err := os.Open(file)
+		if err != nil {
+			return stats, err
+		}
+		input, err := readMergeInput(fd, i)
+		fd.Close()
+		if err != nil {
+			return stats, fmt.Errorf("%s: %s", file, err)
+		}
+
+		if ring == nil {
+			ring = input.ring
+		} else if input.ring != nil {
+			for _, d := range RingDiff(ring, input.ring) {
+				log.Printf("Warning: Hash ring of %s differs: %s", file, d)
+			}
+		}
+		totals = totals || input.totals
+
+		for name, e := range input.entries {
+			cur, ok := chosen[name]
+			if !ok {
+				chosen[name] = e
+				continue
+			}
+			stats.Duplicates++
+			if cur.size != e.size || cur.modTime != e.modTime {
+				stats.Conflicts++
+			}
+			chosen[name], err = chooseEntry(policy, cur, e)
+			if err != nil {
+				log.Printf("%s found in %s and %s", name, archives[cur.archive], file)
+				return stats, err
+			}
+		}
+	}
+
+	// Second pass: copy the chosen entries
+	tw := tar.NewWriter(w)
+	if ring != nil {
+		th, err := ringHeader(ring)
+		if err == nil {
+			err = tw.WriteHeader(th)
+		}
+		if err != nil {
+			return stats, err
+		}
+	}
+	var size int64
+	for i, file := range archives {
+		fd, err := os.Open(file)
+		if err != nil {
+			return stats, err
+		}
+		index := 0
+		err = walkArchive(fd, func(tr *tar.Reader, hdr *tar.Header) error {
+			defer func() { index++ }()
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				return nil
+			}
+			e, ok := chosen[path.Clean(hdr.Name)]
+			if !isMetricEntry(hdr) || !ok || e.archive != i || e.index != index {
+				return nil
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			stats.Files++
+			size += e.size
+			return nil
+		})
+		fd.Close()
+		if err != nil {
+			return stats, fmt.Errorf("%s: %s", file, err)
+		}
+	}
+
+	if totals {
+		if err := tw.WriteHeader(totalsHeader(stats.Files, size)); err != nil {
+			return stats, err
+		}
+	}
+	return stats, tw.Close()
+}
+
+// tarMergeCommand runs this subcommand.
+func tarMergeCommand(c Command) int {
+	if c.Flag.NArg() < 2 {
+		log.Print("At least two archives are required.")
+		return ExitUsage
+	}
+	if !containsString(mergePolicies, mergePolicy) {
+		log.Printf("Unknown merge policy: %s", mergePolicy)
+		return ExitUsage
+	}
+
+	var w io.Writer = os.Stdout
+	if mergeOutput != "" {
+		fd, err := os.Create(mergeOutput)
+		if err != nil {
+			log.Printf("Error creating merged archive: %s", err)
+			return ExitUsage
+		}
+		defer fd.Close()
+		w = fd
+	} else if terminal.IsTerminal(int(os.Stdout.Fd())) {
+		log.Print("Refusing to write archive to terminal.")
+		return ExitUsage
+	}
+	var gz *gzip.Writer
+	if mergeGzip {
+		gz = gzip.NewWriter(w)
+		w = gz
+	}
+
+	stats, err := MergeArchives(c.Flag.Args(), w, mergePolicy)
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		log.Printf("Error merging archives: %s", err)
+		return ExitError
+	}
+	log.Printf("Merged %d metrics from %d archives, %d duplicates with %d conflicts resolved by %s.",
+		stats.Files, c.Flag.NArg(), stats.Duplicates, stats.Conflicts, mergePolicy)
+	return ExitOK
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// mergeTestEntry is a metric written to a test archive.
+type mergeTestEntry struct {
+	name    string
+	data    string
+	modTime int64
+}
+
+// mergeTestArchive writes an archive of the given entries, with a ring
+// record, to a temporary file and returns its name.
+func mergeTestArchive(t *testing.T, compress bool, entries ...mergeTestEntry) string {
+	fd, err := ioutil.TempFile("", "tarmerge_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	var w io.Writer = fd
+	var gz *gzip.Writer
+	if compress {
+		gz = gzip.NewWriter(fd)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	th, _ := ringHeader(ringFor(1, "graphite010"))
+	tw.WriteHeader(th)
+	for _, e := range entries {
+		tw.WriteHeader(&tar.Header{
+			Name:    e.name,
+			Mode:    0644,
+			Size:    int64(len(e.data)),
+			ModTime: time.Unix(e.modTime, 0),
+		})
+		tw.Write([]byte(e.data))
+	}
+	tw.Close()
+	if gz != nil {
+		gz.Close()
+	}
+	return fd.Name()
+}
+
+func TestMergeArchives(t *testing.T) {
+	a := mergeTestArchive(t, false,
+		mergeTestEntry{"foo/bar.wsp", "old and large", 1000},
+		mergeTestEntry{"foo/baz.wsp", "baz", 1000})
+	defer os.Remove(a)
+	b := mergeTestArchive(t, true,
+		mergeTestEntry{"foo/bar.wsp", "new", 2000},
+		mergeTestEntry{"foo/qux.wsp", "qux", 1000})
+	defer os.Remove(b)
+
+	tests := map[string]string{
+		"newest":  "new",
+		"largest": "old and large",
+	}
+	for policy, expected := range tests {
+		buf := new(bytes.Buffer)
+		stats, err := MergeArchives([]string{a, b}, buf, policy)
+		if err != nil {
+			t.Fatalf("%s: %s", policy, err)
+		}
+		if stats.Files != 3 || stats.Duplicates != 1 || stats.Conflicts != 1 {
+			t.Errorf("%s: expected 3 files, 1 duplicate, and 1 conflict, got %+v",
+				policy, stats)
+		}
+
+		tr := tar.NewReader(buf)
+		contents := make(map[string]string)
+		rings := 0
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: bad merged archive: %s", policy, err)
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				rings++
+				continue
+			}
+			data, _ := ioutil.ReadAll(tr)
+			if int64(len(data)) != hdr.Size {
+				t.Errorf("%s: %s has size %d in header and %d bytes",
+					policy, hdr.Name, hdr.Size, len(data))
+			}
+			contents[hdr.Name] = string(data)
+		}
+		if rings != 1 {
+			t.Errorf("%s: expected one ring record, got %d", policy, rings)
+		}
+		if len(contents) != 3 || contents["foo/baz.wsp"] != "baz" || contents["foo/qux.wsp"] != "qux" {
+			t.Errorf("%s: bad merged contents: %v", policy, contents)
+		}
+		if contents["foo/bar.wsp"] != expected {
+			t.Errorf("%s: expected %q for the duplicate, got %q",
+				policy, expected, contents["foo/bar.wsp"])
+		}
+	}
+
+	_, err := MergeArchives([]string{a, b}, ioutil.Discard, "error")
+	if err != ErrDuplicateMetric {
+		t.Errorf("Expected a duplicate metric error, got %v", err)
+	}
+}
+
+func TestMergeArchivesCorrupt(t *testing.T) {
+	a := mergeTestArchive(t, false,
+		mergeTestEntry{"foo/bar.wsp", "bar", 1000})
+	defer os.Remove(a)
+	b := mergeTestArchive(t, false,
+		mergeTestEntry{"foo/bar.wsp", "bar", 1000},
+		mergeTestEntry{"foo/baz.wsp", "a truncated entry", 1000})
+	defer os.Remove(b)
+
+	stats, err := MergeArchives([]string{a, a}, ioutil.Discard, "newest")
+	if err != nil || stats.Duplicates != 1 || stats.Conflicts != 0 {
+		t.Errorf("Identical copies should be a duplicate without conflict: %+v, %v", stats, err)
+	}
+
+	// Cut the archive off in the middle of the last entry
+	blob, _ := ioutil.ReadFile(b)
+	ioutil.WriteFile(b, blob[:bytes.Index(blob, []byte("a truncated"))+5], 0644)
+	buf := new(bytes.Buffer)
+	if _, err := MergeArchives([]string{a, b}, buf, "newest"); err == nil {
+		t.Errorf("Expected an error merging a truncated archive")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing written for a corrupt archive, got %d bytes", buf.Len())
+	}
+}
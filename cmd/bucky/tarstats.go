@@ -0,0 +1,140 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarStatsJSON is the file the tar statistics are written to as JSON on
+// completion.  "-" writes them to STDOUT.
+var tarStatsJSON string
+
+// ServerStats counts the metrics and bytes downloaded from one server.
+type ServerStats struct {
+	Metrics int
+	Bytes   int64
+}
+
+// TarStats is the accounting of a tar run.  BytesDownloaded is the metric
+// data received from the servers, including metrics served from
+// -cache-dir, BytesUncompressed is the decoded size of the archived
+// metrics, and BytesWritten is the size of the archive itself.
+// SecondaryDropped counts the metrics left out of the -secondary copy.
+type TarStats struct {
+	Metrics           int
+	Failures          int
+	SecondaryDropped  int
+	BytesDownloaded   int64
+	BytesUncompressed int64
+	BytesWritten      int64
+	CompressionRatio  float64
+	WallSeconds       float64
+	Servers           map[string]*ServerStats
+}
+
+// tarStats accumulates the statistics of the current tar run.
+var tarStats = newTarStats()
+
+// tarStatsLock protects tarStats from the download workers.
+var tarStatsLock sync.Mutex
+
+// tarStarted is when the current tar run began.
+var tarStarted time.Time
+
+// archiveWritten counts the bytes of archive written to the sink.
+var archiveWritten writeCounter
+
+func newTarStats() *TarStats {
+	return &TarStats{Servers: make(map[string]*ServerStats)}
+}
+
+// writeCounter is an io.Writer that counts the bytes written to it.
+type writeCounter int64
+
+func (c *writeCounter) Write(p []byte) (int, error) {
+	*c += writeCounter(len(p))
+	return len(p), nil
+}
+
+// recordDownload adds a metric of size bytes downloaded from server to
+// the run's statistics.
+func recordDownload(server string, size int) {
+	tarStatsLock.Lock()
+	defer tarStatsLock.Unlock()
+	s, ok := tarStats.Servers[server]
+	if !ok {
+		s = new(ServerStats)
+		tarStats.Servers[server] = s
+	}
+	s.Metrics++
+	s.Bytes += int64(size)
+	tarStats.BytesDownloaded += int64(size)
+}
+
+// TarRunStats returns the statistics of the tar run from the same counters
+// the progress and summary are logged from.
+func TarRunStats() *TarStats {
+	tarStatsLock.Lock()
+	defer tarStatsLock.Unlock()
+	ret := *tarStats
+	ret.Servers = make(map[string]*ServerStats)
+	for k, v := range tarStats.Servers {
+		s := *v
+		ret.Servers[k] = &s
+	}
+	ret.Metrics = archiveFiles
+	ret.Failures = int(workerFailed)
+	ret.BytesUncompressed = archiveBytes
+	ret.BytesWritten = int64(archiveWritten)
+	if tarSecondary != nil {
+		ret.SecondaryDropped = tarSecondary.Dropped()
+	}
+	if ret.BytesWritten > 0 {
+		ret.CompressionRatio = float64(ret.BytesUncompressed) / float64(ret.BytesWritten)
+	}
+	if !tarStarted.IsZero() {
+		ret.WallSeconds = time.Since(tarStarted).Seconds()
+	}
+	return &ret
+}
+
+// writeTarStats writes stats as a JSON object to path or, if path is "-",
+// to STDOUT.
+func writeTarStats(path string, stats *TarStats) error {
+	blob, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	blob = append(blob, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(blob)
+		return err
+	}
+	sink, err := NewFileSink(path)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = sink
+	var gz *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		gz = gzip.NewWriter(sink)
+		w = gz
+	}
+	if _, err = w.Write(blob); err != nil {
+		sink.Abort()
+		return err
+	}
+	// The gzip trailer must be written before the file is completed
+	if gz != nil {
+		if err = gz.Close(); err != nil {
+			sink.Abort()
+			return err
+		}
+	}
+	return sink.Close()
+}
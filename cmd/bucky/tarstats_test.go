@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTarStatsJSON(t *testing.T) {
+	server := exitTestServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "tarstats_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tarStatsJSON = filepath.Join(dir, "stats.json")
+	defer func() { tarStatsJSON = "" }()
+
+	if code := runTar(t, server, "foo.a", "foo.b", "bad.c"); code != ExitPartial {
+		t.Fatalf("Expected exit code %d, got %d", ExitPartial, code)
+	}
+
+	blob, err := ioutil.ReadFile(tarStatsJSON)
+	if err != nil {
+		t.Fatalf("Statistics were not written: %s", err)
+	}
+	stats := new(TarStats)
+	if err := json.Unmarshal(blob, stats); err != nil {
+		t.Fatalf("Bad statistics JSON: %s", err)
+	}
+
+	// The test server returns 12 bytes of data for each metric
+	if stats.Metrics != 2 || stats.Failures != 1 {
+		t.Errorf("Expected 2 metrics and 1 failure, got %d and %d",
+			stats.Metrics, stats.Failures)
+	}
+	if stats.BytesDownloaded != 24 || stats.BytesUncompressed != 24 {
+		t.Errorf("Expected 24 bytes downloaded and uncompressed, got %d and %d",
+			stats.BytesDownloaded, stats.BytesUncompressed)
+	}
+	if stats.BytesWritten == 0 || stats.BytesWritten%512 != 0 {
+		t.Errorf("Bad archive size: %d", stats.BytesWritten)
+	}
+	if ratio := float64(24) / float64(stats.BytesWritten); stats.CompressionRatio != ratio {
+		t.Errorf("Expected compression ratio %f, got %f", ratio, stats.CompressionRatio)
+	}
+	if stats.WallSeconds <= 0 {
+		t.Errorf("Bad wall time: %f", stats.WallSeconds)
+	}
+	host := strings.TrimPrefix(server.URL, "http://")
+	if len(stats.Servers) != 1 || stats.Servers[host] == nil {
+		t.Fatalf("Expected statistics for %s, got %v", host, stats.Servers)
+	}
+	if s := stats.Servers[host]; s.Metrics != 2 || s.Bytes != 24 {
+		t.Errorf("Expected 2 metrics and 24 bytes from %s, got %d and %d",
+			host, s.Metrics, s.Bytes)
+	}
+}
+
+func TestTarStatsJSONGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarstats_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "stats.json.gz")
+
+	stats := &TarStats{Metrics: 3, BytesDownloaded: 36,
+		Servers: map[string]*ServerStats{"graphite010:4242": {Metrics: 3, Bytes: 36}}}
+	if err := writeTarStats(path, stats); err != nil {
+		t.Fatalf("Error writing statistics: %s", err)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	zr, err := gzip.NewReader(fd)
+	if err != nil {
+		t.Fatalf("Statistics are not gzip compressed: %s", err)
+	}
+	blob, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Truncated statistics: %s", err)
+	}
+	expected, _ := json.Marshal(stats)
+	if string(blob) != string(expected)+"\n" {
+		t.Errorf("Expected %s, got %s", expected, blob)
+	}
+}
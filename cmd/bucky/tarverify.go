@@ -0,0 +1,36 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"log"
+)
+
+// tarVerify checks that each metric written to the archive matches its
+// header size with -verify.
+var tarVerify bool
+
+// ErrVerifyFailed is returned by -verify when a metric written to the
+// archive does not match its header.
+var ErrVerifyFailed = errors.New("Archive entry does not match its header")
+
+// writeVerifiedFile writes a file entry described by th holding data to tw
+// like writeArchiveFile and then checks that th.Size bytes were written.
+// A mismatch fails with ErrVerifyFailed.
+func writeVerifiedFile(tw ArchiveWriter, th *tar.Header, data []byte) error {
+	err := tw.WriteHeader(th)
+	if err != nil {
+		log.Printf("Error writing tar: %s", err)
+		return err
+	}
+	n, err := tw.Write(data)
+	if err != nil {
+		log.Printf("Error writing data to tar file: %s", err)
+		return err
+	}
+	if int64(n) != th.Size {
+		log.Printf("Verify failed for %s: wrote %d of %d bytes", th.Name, n, th.Size)
+		return ErrVerifyFailed
+	}
+	return nil
+}
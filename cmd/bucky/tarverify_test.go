@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/metrics"
+
+func TestWriteTarVerify(t *testing.T) {
+	resetTarState()
+	tarVerify = true
+	defer func() { tarVerify = false }()
+
+	// The body is shorter than the declared size
+	workOut := make(chan *metrics.MetricData, 2)
+	workOut <- &metrics.MetricData{Name: "foo.bar", Size: 3, Mode: 0644,
+		Encoding: metrics.EncIdentity, Data: []byte("abc")}
+	workOut <- &metrics.MetricData{Name: "foo.short", Size: 10, Mode: 0644,
+		Encoding: metrics.EncIdentity, Data: []byte("abcde")}
+	close(workOut)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	writeTar(new(bytes.Buffer), workOut, wg)
+	if archiveErr != ErrVerifyFailed {
+		t.Errorf("Expected %v, got %v", ErrVerifyFailed, archiveErr)
+	}
+	if archiveFiles != 1 {
+		t.Errorf("Expected only foo.bar to be archived, got %d files", archiveFiles)
+	}
+}
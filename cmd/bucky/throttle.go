@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tarThrottleErrors enables throttling servers that return errors.
+var tarThrottleErrors bool
+
+// tarThrottleThreshold is the number of consecutive server errors that
+// throttle a server.
+var tarThrottleThreshold int
+
+// tarThrottlePause is how long a throttled server is paused before it is
+// probed again.
+var tarThrottlePause time.Duration
+
+// tarCircuitBreaker fails requests to a throttled server immediately
+// rather than waiting for it with -circuit-breaker.
+var tarCircuitBreaker bool
+
+// tarThrottle throttles the servers of the current tar run if enabled.
+var tarThrottle *ServerThrottle
+
+// ErrCircuitOpen is returned by a circuit breaker for a request to a
+// server it has stopped sending requests to.
+var ErrCircuitOpen = errors.New("Circuit breaker open")
+
+// maxThrottleBackoff caps the pause of a server that keeps failing probes
+// at this multiple of the initial pause.
+const maxThrottleBackoff = 8
+
+// StatusError is an unexpected HTTP status returned by buckyd.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Fetching metric returned status code: %s", e.Status)
+}
+
+// isServerError returns true if err shows that the server is failing or
+// overloaded rather than that the request can't succeed: a 5xx status, a
+// timeout, or a failed connection.
+func isServerError(err error) bool {
+	switch e := err.(type) {
+	case *StatusError:
+		return e.Code >= 500
+	case net.Error:
+		return true
+	}
+	return false
+}
+
+// throttleState is the error tracking of one server.
+type throttleState struct {
+	errors    int
+	throttled bool
+	until     time.Time
+	pause     time.Duration
+	events    int
+	probe     chan struct{}
+}
+
+// ServerThrottle backs off from servers that return errors while leaving
+// healthy servers unthrottled.  After threshold consecutive server errors
+// a server is throttled: it is paused and then probed with one request
+// at a time.  A failed probe doubles the pause, up to 8 times the initial
+// pause, and a successful request restores full concurrency.
+//
+// As a circuit breaker requests to a throttled server fail immediately
+// with ErrCircuitOpen during the pause rather than waiting, so that they
+// may go to another replica, and a single probe is let through once it
+// has passed.
+type ServerThrottle struct {
+	lock      sync.Mutex
+	threshold int
+	pause     time.Duration
+	failFast  bool
+	servers   map[string]*throttleState
+}
+
+// NewServerThrottle returns a ServerThrottle that throttles a server for
+// pause after threshold consecutive errors.
+func NewServerThrottle(threshold int, pause time.Duration) *ServerThrottle {
+	return &ServerThrottle{
+		threshold: threshold,
+		pause:     pause,
+		servers:   make(map[string]*throttleState),
+	}
+}
+
+// NewCircuitBreaker returns a ServerThrottle that fails requests to a
+// server for pause after threshold consecutive errors.
+func NewCircuitBreaker(threshold int, pause time.Duration) *ServerThrottle {
+	t := NewServerThrottle(threshold, pause)
+	t.failFast = true
+	return t
+}
+
+// state returns the state of server.  The lock must be held.
+func (t *ServerThrottle) state(server string) *throttleState {
+	s, ok := t.servers[server]
+	if !ok {
+		s = &throttleState{pause: t.pause, probe: make(chan struct{}, 1)}
+		t.servers[server] = s
+	}
+	return s
+}
+
+// Acquire blocks while server is throttled until a probe may be made or
+// ctx is cancelled.  A circuit breaker returns ErrCircuitOpen instead of
+// blocking.  The returned function must be called with the result of the
+// request.
+func (t *ServerThrottle) Acquire(ctx context.Context, server string) (func(error), error) {
+	t.lock.Lock()
+	s := t.state(server)
+	throttled := s.throttled
+	wait := time.Until(s.until)
+	t.lock.Unlock()
+	if !throttled {
+		return func(err error) { t.record(server, s, err) }, nil
+	}
+	if t.failFast {
+		if wait > 0 {
+			return nil, ErrCircuitOpen
+		}
+		select {
+		case s.probe <- struct{}{}:
+		default:
+			// Another request is probing the server
+			return nil, ErrCircuitOpen
+		}
+		return func(err error) {
+			t.record(server, s, err)
+			<-s.probe
+		}, nil
+	}
+
+	// Throttled servers get one request at a time once paused
+	select {
+	case s.probe <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	t.lock.Lock()
+	wait = time.Until(s.until)
+	t.lock.Unlock()
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			<-s.probe
+			return nil, ctx.Err()
+		}
+	}
+	return func(err error) {
+		t.record(server, s, err)
+		<-s.probe
+	}, nil
+}
+
+// record updates the state s of server with the result of a request.
+func (t *ServerThrottle) record(server string, s *throttleState, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case err == nil:
+		if s.throttled && t.failFast {
+			log.Printf("%s recovered, circuit breaker closed.", server)
+		} else if s.throttled {
+			log.Printf("%s recovered, no longer throttled.", server)
+		}
+		s.errors = 0
+		s.throttled = false
+		s.pause = t.pause
+	case !isServerError(err):
+		// Missing metrics and the like say nothing of the server's health
+	case s.throttled:
+		s.pause *= 2
+		if s.pause > maxThrottleBackoff*t.pause {
+			s.pause = maxThrottleBackoff * t.pause
+		}
+		s.until = time.Now().Add(s.pause)
+	default:
+		s.errors++
+		if s.errors >= t.threshold {
+			s.throttled = true
+			s.events++
+			s.until = time.Now().Add(s.pause)
+			if !t.failFast {
+				log.Printf("Throttling %s for %s after %d errors: %s", server,
+					s.pause, s.errors, err)
+				return
+			}
+			log.Printf("Opening circuit breaker of %s for %s after %d errors: %s",
+				server, s.pause, s.errors, err)
+			// Pooled connections to the server are likely dead, so the
+			// probe dials a new one rather than reusing them
+			GetHTTP().CloseIdleConnections()
+		}
+	}
+}
+
+// Throttled returns true if server is currently throttled.
+func (t *ServerThrottle) Throttled(server string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.servers[server]
+	return ok && s.throttled
+}
+
+// Events returns the number of times each server was throttled.  Servers
+// that were never throttled are left out.
+func (t *ServerThrottle) Events() map[string]int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ret := make(map[string]int)
+	for server, s := range t.servers {
+		if s.events > 0 {
+			ret[server] = s.events
+		}
+	}
+	return ret
+}
+
+// Summary logs the servers that were throttled.
+func (t *ServerThrottle) Summary() {
+	events := t.Events()
+	servers := make([]string, 0, len(events))
+	for server := range events {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		if t.failFast {
+			log.Printf("Circuit breaker of %s opened %d times due to server errors.",
+				server, events[server])
+		} else {
+			log.Printf("Throttled %s %d times due to server errors.", server, events[server])
+		}
+	}
+}
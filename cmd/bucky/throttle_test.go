@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerThrottle(t *testing.T) {
+	pause := 50 * time.Millisecond
+	throttle := NewServerThrottle(2, pause)
+	ctx := context.Background()
+	fail := func(server string, err error) {
+		done, aerr := throttle.Acquire(ctx, server)
+		if aerr != nil {
+			t.Fatal(aerr)
+		}
+		done(err)
+	}
+
+	// Missing metrics are not server errors
+	for i := 0; i < 5; i++ {
+		fail("good", &StatusError{404, "404 Not Found"})
+	}
+	fail("bad", &StatusError{500, "500 Internal Server Error"})
+	if throttle.Throttled("bad") {
+		t.Errorf("Throttled before the threshold")
+	}
+	fail("bad", &StatusError{503, "503 Service Unavailable"})
+	if !throttle.Throttled("bad") || throttle.Throttled("good") {
+		t.Fatalf("Expected only bad to be throttled: %v", throttle.Events())
+	}
+
+	// Healthy servers are not held up
+	start := time.Now()
+	done, _ := throttle.Acquire(ctx, "good")
+	done(nil)
+	if time.Since(start) >= pause {
+		t.Errorf("Healthy server waited %s", time.Since(start))
+	}
+
+	// The throttled server is paused and then probed one at a time
+	probe, _ := throttle.Acquire(ctx, "bad")
+	if time.Since(start) < pause {
+		t.Errorf("Throttled server was not paused")
+	}
+	short, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := throttle.Acquire(short, "bad"); err == nil {
+		t.Errorf("A second request was let through during the probe")
+	}
+	probe(nil)
+	if throttle.Throttled("bad") {
+		t.Errorf("A successful probe did not recover the server")
+	}
+	if events := throttle.Events(); events["bad"] != 1 || len(events) != 1 {
+		t.Errorf("Bad throttle events: %v", events)
+	}
+}
+
+func TestTarThrottle(t *testing.T) {
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Overloaded", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := slowMetricServer(0)
+	defer good.Close()
+
+	resetTarState()
+	metricWorkers = 4
+	Retries = 0
+	tarThrottleErrors = true
+	tarThrottleThreshold = 2
+	tarThrottlePause = 10 * time.Millisecond
+	defer func() {
+		Retries = 3
+		tarThrottleErrors = false
+	}()
+	metricMap := map[string][]string{
+		strings.TrimPrefix(bad.URL, "http://"):  make([]string, 0),
+		strings.TrimPrefix(good.URL, "http://"): make([]string, 0),
+	}
+	for i := 0; i < 20; i++ {
+		host := strings.TrimPrefix(good.URL, "http://")
+		metricMap[host] = append(metricMap[host], fmt.Sprintf("good.metric%d", i))
+		if i < 8 {
+			host = strings.TrimPrefix(bad.URL, "http://")
+			metricMap[host] = append(metricMap[host], fmt.Sprintf("bad.metric%d", i))
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	multiplexTarContext(context.Background(), metricMap, &stdoutSink{buf})
+	if archiveFiles != 20 {
+		t.Errorf("Expected the 20 metrics of the healthy server, got %d", archiveFiles)
+	}
+	events := tarThrottle.Events()
+	if events[strings.TrimPrefix(bad.URL, "http://")] == 0 || len(events) != 1 {
+		t.Errorf("Expected only the failing server to be throttled: %v", events)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	pause := 50 * time.Millisecond
+	breaker := NewCircuitBreaker(2, pause)
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		done, err := breaker.Acquire(ctx, "down")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(&StatusError{503, "503 Service Unavailable"})
+	}
+
+	// An open breaker fails fast
+	start := time.Now()
+	if _, err := breaker.Acquire(ctx, "down"); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if time.Since(start) >= pause {
+		t.Errorf("Open breaker waited %s", time.Since(start))
+	}
+
+	// Half-open lets one probe through once the pause has passed
+	time.Sleep(pause)
+	probe, err := breaker.Acquire(ctx, "down")
+	if err != nil {
+		t.Fatalf("Expected a probe once the pause passed, got %s", err)
+	}
+	if _, err := breaker.Acquire(ctx, "down"); err != ErrCircuitOpen {
+		t.Errorf("A second request was let through during the probe: %v", err)
+	}
+	probe(nil)
+	if breaker.Throttled("down") {
+		t.Errorf("A successful probe did not close the breaker")
+	}
+	if events := breaker.Events(); events["down"] != 1 {
+		t.Errorf("Bad breaker events: %v", events)
+	}
+}
+
+func TestTarCircuitBreaker(t *testing.T) {
+	calls := 0
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "Down", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := slowMetricServer(0)
+	defer good.Close()
+
+	resetTarState()
+	metricWorkers = 1
+	Retries = 2
+	RetryBackoff = time.Millisecond
+	tarCircuitBreaker = true
+	tarThrottleThreshold = 2
+	tarThrottlePause = time.Minute
+	defer func() {
+		Retries = 3
+		tarCircuitBreaker = false
+	}()
+
+	// Every metric is on both servers, the failing one first
+	badHost := strings.TrimPrefix(bad.URL, "http://")
+	goodHost := strings.TrimPrefix(good.URL, "http://")
+	names := make([]string, 0)
+	for i := 0; i < 10; i++ {
+		names = append(names, fmt.Sprintf("foo.metric%d", i))
+	}
+	servers := func(string) []string { return []string{badHost, goodHost} }
+	buf := new(bytes.Buffer)
+	tarMetrics(context.Background(), names, servers, &stdoutSink{buf})
+
+	if archiveFiles != 10 {
+		t.Errorf("Expected every metric from the replica, got %d", archiveFiles)
+	}
+	if calls != 2 {
+		t.Errorf("Expected the breaker to stop requests after 2 errors, got %d", calls)
+	}
+	if events := tarThrottle.Events(); events[badHost] != 1 || len(events) != 1 {
+		t.Errorf("Expected the breaker of only the failing server to open: %v", events)
+	}
+}
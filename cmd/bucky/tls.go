@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// UseTLS is set by -tls to reach buckyd daemons over HTTPS.  Giving a
+// client certificate or CA certificate also enables HTTPS.
+var UseTLS bool
+
+// TLSClientCert and TLSClientKey are the PEM files of the certificate and
+// key presented to buckyd daemons that require mutual TLS.
+var TLSClientCert string
+var TLSClientKey string
+
+// TLSCACert is a PEM file of CA certificates trusted to sign the buckyd
+// daemons' certificates in addition to the system roots.
+var TLSCACert string
+
+// buckyScheme returns the URL scheme used to reach buckyd daemons.
+func buckyScheme() string {
+	if UseTLS || TLSClientCert != "" || TLSCACert != "" {
+		return "https"
+	}
+	return "http"
+}
+
+// NewTLSConfig returns the tls.Config presenting the client certificate in
+// the cert and key files and trusting the CA certificates in the ca file
+// along with the system roots.  Any of the files may be empty.  A nil
+// config is returned when none are given.
+func NewTLSConfig(cert, key, ca string) (*tls.Config, error) {
+	if cert == "" && key == "" && ca == "" {
+		return nil, nil
+	}
+	config := new(tls.Config)
+
+	if cert != "" || key != "" {
+		if cert == "" || key == "" {
+			return nil, fmt.Errorf("Both -client-cert and -client-key are required for a client certificate")
+		}
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading client certificate %s and key %s: %s", cert, key, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA certificate: %s", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No PEM certificates found in %s", ca)
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// ConfigureTLS sets up the shared HTTP client returned by GetHTTP with the
+// -client-cert, -client-key, and -ca-cert options.
+func ConfigureTLS() error {
+	config, err := NewTLSConfig(TLSClientCert, TLSClientKey, TLSCACert)
+	if err != nil || config == nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	GetHTTP().Transport = transport
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsTestCert writes a certificate and key for name signed by parent, or
+// self-signed if parent is nil, to dir and returns them.
+func tlsTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, name+".key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, key
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, caKey := tlsTestCert(t, dir, "ca", nil, nil)
+	tlsTestCert(t, dir, "server", ca, caKey)
+	tlsTestCert(t, dir, "client", ca, caKey)
+	tlsTestCert(t, dir, "other", nil, nil)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	// A buckyd that requires a client certificate signed by the CA
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		blob, _ := json.Marshal(ringFor(1, "127.0.0.1"))
+		w.Write(blob)
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverCert, err := tls.LoadX509KeyPair(file("server.pem"), file("server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	defer func() {
+		TLSClientCert, TLSClientKey, TLSCACert = "", "", ""
+		resetHTTPClient()
+	}()
+	tests := []struct {
+		cert, key, ca string
+		ok            bool
+	}{
+		{"client.pem", "client.key", "ca.pem", true},
+		{"", "", "ca.pem", false},
+		{"other.pem", "other.key", "ca.pem", false},
+	}
+	for _, v := range tests {
+		TLSClientCert, TLSClientKey, TLSCACert = "", "", file(v.ca)
+		if v.cert != "" {
+			TLSClientCert, TLSClientKey = file(v.cert), file(v.key)
+		}
+		resetHTTPClient()
+		if err := ConfigureTLS(); err != nil {
+			t.Fatalf("Error configuring TLS: %s", err)
+		}
+		if buckyScheme() != "https" {
+			t.Errorf("TLS options did not enable HTTPS")
+		}
+		_, err := GetSingleHashRing(host)
+		if (err == nil) != v.ok {
+			t.Errorf("Client cert %q: expected success %v, got %v", v.cert, v.ok, err)
+		}
+	}
+}
+
+func TestNewTLSConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tlsTestCert(t, dir, "client", nil, nil)
+	tlsTestCert(t, dir, "other", nil, nil)
+	ioutil.WriteFile(filepath.Join(dir, "empty.pem"), []byte("not a certificate"), 0600)
+	file := func(name string) string { return filepath.Join(dir, name) }
+
+	if config, err := NewTLSConfig("", "", ""); config != nil || err != nil {
+		t.Errorf("No options returned %v, %v", config, err)
+	}
+	bad := [][]string{
+		{file("client.pem"), "", ""},
+		{"", file("client.key"), ""},
+		{file("client.pem"), file("other.key"), ""},
+		{file("missing.pem"), file("client.key"), ""},
+		{"", "", file("empty.pem")},
+		{"", "", file("missing.pem")},
+	}
+	for _, v := range bad {
+		if _, err := NewTLSConfig(v[0], v[1], v[2]); err == nil {
+			t.Errorf("Expected an error for %v", v)
+		}
+	}
+	config, err := NewTLSConfig(file("client.pem"), file("client.key"), file("client.pem"))
+	if err != nil || len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("Bad config: %v, %v", config, err)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// verifyPerServer caps the concurrent downloads from any one server.
+var verifyPerServer int
+
+func init() {
+	usage := "[options] <tar file>"
+	short := "Verify an archive against the metrics in the cluster."
+	long := `Compare the metrics in an archive with the same metrics in the cluster
+and report which are unchanged, changed since the archive was made, or
+missing from the cluster.  Use "-" to read the archive from STDIN.
+
+Each metric is downloaded from its owner in the hash ring and its Whisper
+data compared to the archived data by SHA-256 checksum.  If the owner does
+not have the metric the other replicas are tried before it is reported as
+missing.  Failed downloads are retried -retries times with an exponential
+backoff starting at -retry-backoff.
+
+Metrics are verified by -w workers at a time with at most -per-server of
+them downloading from any one server so a large archive does not overload
+a single buckyd daemon.  Progress is logged as metrics are verified.
+
+Changed, missing, and failed metrics are printed as they are found, one per
+line, preceded by their category.  A summary of each category is logged at
+the end.  The exit status is 0 only if every metric is unchanged.`
+
+	c := NewCommand(verifyCommand, "verify", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupRetry(c)
+
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Downloader threads.")
+	c.Flag.IntVar(&metricWorkers, "workers", 5,
+		"Downloader threads.")
+	c.Flag.IntVar(&verifyPerServer, "per-server", 2,
+		"Concurrent downloads from each server.  0 for no limit.")
+}
+
+// ArchiveDigest is the checksum of a metric's Whisper data in an archive.
+type ArchiveDigest struct {
+	Name     string
+	Checksum string
+}
+
+// ArchiveDigests returns the SHA-256 checksum of the Whisper data of each
+// metric in the archive in r with any per-entry encoding removed.
+func ArchiveDigests(r io.Reader) ([]ArchiveDigest, error) {
+	in, err := openArchive(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(in)
+	result := make([]ArchiveDigest, 0)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, err
+		}
+		if (hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA) ||
+			isMetadataEntry(hdr.Name) {
+			// Directories, archive metadata, and metadata sidecars
+			continue
+		}
+
+		name := hdr.Name
+		var data []byte
+		switch {
+		case hdr.PAXRecords["BUCKYTOOLS.encoding"] == "snappy":
+			metric := &MetricData{Encoding: EncSnappy}
+			metric.Size, err = strconv.ParseInt(hdr.PAXRecords["BUCKYTOOLS.entry_size"], 10, 64)
+			if err == nil {
+				metric.Data, err = ioutil.ReadAll(tr)
+			}
+			if err == nil {
+				data, err = MetricDecode(metric)
+			}
+		case strings.HasSuffix(name, ".wsp.gz"):
+			name = strings.TrimSuffix(name, ".gz")
+			var gz *gzip.Reader
+			gz, err = gzip.NewReader(tr)
+			if err == nil {
+				data, err = ioutil.ReadAll(gz)
+			}
+		default:
+			data, err = ioutil.ReadAll(tr)
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error reading %s: %s", hdr.Name, err)
+		}
+		checksum, _ := Checksum("sha256", data)
+		result = append(result, ArchiveDigest{PathToMetric(name), checksum})
+	}
+	return result, nil
+}
+
+// ServerLimit caps the number of concurrent requests to each server.
+type ServerLimit struct {
+	limit int
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// NewServerLimit returns a ServerLimit allowing limit concurrent requests
+// to each server.  A limit of 0 or less is no limit.
+func NewServerLimit(limit int) *ServerLimit {
+	return &ServerLimit{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// Acquire waits for a free slot for server and returns the function that
+// releases it.
+func (l *ServerLimit) Acquire(server string) func() {
+	if l.limit <= 0 {
+		return func() {}
+	}
+	l.lock.Lock()
+	slot, ok := l.slots[server]
+	if !ok {
+		slot = make(chan struct{}, l.limit)
+		l.slots[server] = slot
+	}
+	l.lock.Unlock()
+	slot <- struct{}{}
+	return func() { <-slot }
+}
+
+// VerifyReport is the categorized result of verifying an archive.  It is
+// safe for concurrent use.
+type VerifyReport struct {
+	lock    sync.Mutex
+	OK      []string
+	Changed []string
+	Missing []string
+	Failed  []string
+}
+
+// add records metric under category and prints it unless it is OK.
+func (r *VerifyReport) add(category *[]string, label, metric string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	*category = append(*category, metric)
+	if label != "" {
+		fmt.Printf("%s %s\n", label, metric)
+	}
+}
+
+// Sort orders the metrics in each category by name.
+func (r *VerifyReport) Sort() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, s := range [][]string{r.OK, r.Changed, r.Missing, r.Failed} {
+		sort.Strings(s)
+	}
+}
+
+// verifyMetric compares the archived digest of a metric with the copy on
+// the first of its ring owners that has it and records the result.
+func verifyMetric(d ArchiveDigest, limit *ServerLimit, report *VerifyReport) {
+	var metric *MetricData
+	var lastErr error
+	for _, server := range RingOwners(Cluster.Hash, Cluster.Replicas, d.Name) {
+		release := limit.Acquire(server)
+		err := withRetry(context.Background(), "download of "+d.Name, func() error {
+			var err error
+			metric, err = GetMetricData(server, d.Name)
+			if e, ok := err.(*StatusError); ok && e.Code == http.StatusNotFound {
+				// Not retried, the next replica is tried
+				return nil
+			}
+			return err
+		})
+		release()
+		if err != nil {
+			lastErr = err
+		} else if metric != nil {
+			break
+		}
+	}
+
+	switch {
+	case metric == nil && lastErr != nil:
+		report.add(&report.Failed, "FAILED", d.Name)
+		workFailed()
+		return
+	case metric == nil:
+		report.add(&report.Missing, "MISSING", d.Name)
+		workFailed()
+		return
+	}
+	data, err := MetricDecode(metric)
+	if err != nil {
+		report.add(&report.Failed, "FAILED", d.Name)
+		workFailed()
+		return
+	}
+	if checksum, _ := Checksum("sha256", data); checksum != d.Checksum {
+		report.add(&report.Changed, "CHANGED", d.Name)
+		workFailed()
+		return
+	}
+	report.add(&report.OK, "", d.Name)
+	workSucceeded()
+}
+
+// VerifyDigests verifies each archived digest against the cluster with
+// -w workers and returns the report.
+func VerifyDigests(digests []ArchiveDigest) *VerifyReport {
+	report := new(VerifyReport)
+	limit := NewServerLimit(verifyPerServer)
+	wg := new(sync.WaitGroup)
+	workIn := make(chan ArchiveDigest, 25)
+
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go func() {
+			for d := range workIn {
+				verifyMetric(d, limit, report)
+			}
+			wg.Done()
+		}()
+	}
+
+	t := time.Now()
+	for i, d := range digests {
+		workIn <- d
+		if (i+1)%10 == 0 {
+			s := time.Since(t).Seconds()
+			if s < 1 {
+				s = 1
+			}
+			log.Printf("Progress %d / %d: %.2f  Metrics/second: %.2f",
+				i+1, len(digests),
+				100*float64(i+1)/float64(len(digests)),
+				float64(i+1)/s)
+		}
+	}
+	close(workIn)
+	wg.Wait()
+
+	report.Sort()
+	return report
+}
+
+// verifyCommand runs this subcommand.
+func verifyCommand(c Command) int {
+	if c.Flag.NArg() != 1 {
+		log.Print("One archive is required.")
+		return ExitUsage
+	}
+	if metricWorkers < 1 {
+		log.Print("The -w option must be at least 1.")
+		return ExitUsage
+	}
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if !Cluster.Healthy {
+		log.Printf("Warning: Cluster is not optimal.")
+	}
+
+	fd := os.Stdin
+	if c.Flag.Arg(0) != "-" {
+		fd, err = os.Open(c.Flag.Arg(0))
+		if err != nil {
+			log.Printf("Error opening archive: %s", err)
+			return ExitError
+		}
+		defer fd.Close()
+	}
+	digests, err := ArchiveDigests(fd)
+	if err != nil {
+		log.Printf("Error reading archive: %s", err)
+		return ExitError
+	}
+	log.Printf("Verifying %d metrics with %d workers.", len(digests), metricWorkers)
+
+	report := VerifyDigests(digests)
+	log.Printf("Verify complete: %d ok, %d changed, %d missing, %d failed.",
+		len(report.OK), len(report.Changed), len(report.Missing), len(report.Failed))
+	return workStatus()
+}
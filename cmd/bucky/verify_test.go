@@ -0,0 +1,143 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// verifyTestServer serves metrics named ok.* with the data verifyTestData
+// archives, changed.* with other data, and nothing else.  It records the
+// peak number of concurrent requests in peak.
+func verifyTestServer(delay time.Duration, peak *int32) *httptest.Server {
+	var active int32
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for p := atomic.LoadInt32(peak); n > p && !atomic.CompareAndSwapInt32(peak, p, n); {
+			p = atomic.LoadInt32(peak)
+		}
+		time.Sleep(delay)
+
+		name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+		data := verifyTestData(name)
+		switch {
+		case strings.HasPrefix(name, "changed."):
+			data = append(data, '!')
+		case !strings.HasPrefix(name, "ok."):
+			http.NotFound(w, r)
+			return
+		}
+		stat, _ := json.Marshal(&MetricData{Name: name, Size: int64(len(data)), Mode: 0644})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write(data)
+	}))
+}
+
+// verifyTestData is the archived Whisper data of a metric, unique to it.
+func verifyTestData(name string) []byte {
+	return []byte("whisper data of " + name)
+}
+
+// verifyTestArchive returns an archive of the given metrics.
+func verifyTestArchive(names []string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	tw := tar.NewWriter(buf)
+	for _, name := range names {
+		data := verifyTestData(name)
+		tw.WriteHeader(&tar.Header{
+			Name: MetricToRelative(name),
+			Size: int64(len(data)),
+			Mode: 0644,
+		})
+		tw.Write(data)
+	}
+	tw.Close()
+	return buf
+}
+
+// verifyTestCluster points Cluster at server and returns the digests of
+// an archive of n metrics of each category.
+func verifyTestCluster(t testing.TB, server *httptest.Server, n int) []ArchiveDigest {
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	names := make([]string, 0)
+	for i := 0; i < n; i++ {
+		for _, c := range []string{"ok", "changed", "missing"} {
+			names = append(names, fmt.Sprintf("%s.metric%d", c, i))
+		}
+	}
+	digests, err := ArchiveDigests(verifyTestArchive(names))
+	if err != nil || len(digests) != len(names) {
+		t.Fatalf("Error reading archive: %d digests, %v", len(digests), err)
+	}
+	return digests
+}
+
+func TestVerifyDigests(t *testing.T) {
+	var peak int32
+	server := verifyTestServer(time.Millisecond, &peak)
+	defer server.Close()
+	defer func() { Cluster = nil }()
+	digests := verifyTestCluster(t, server, 20)
+
+	resetTarState()
+	metricWorkers = 8
+	verifyPerServer = 3
+	defer func() { verifyPerServer = 2 }()
+	report := VerifyDigests(digests)
+
+	categories := map[string][]string{
+		"ok":      report.OK,
+		"changed": report.Changed,
+		"missing": report.Missing,
+	}
+	for c, metrics := range categories {
+		if len(metrics) != 20 {
+			t.Errorf("Expected 20 %s metrics, got %d: %v", c, len(metrics), metrics)
+		}
+		for _, m := range metrics {
+			if !strings.HasPrefix(m, c+".") {
+				t.Errorf("Metric %s reported as %s", m, c)
+			}
+		}
+	}
+	if len(report.Failed) != 0 {
+		t.Errorf("Expected no failures, got %v", report.Failed)
+	}
+	if peak > 3 {
+		t.Errorf("Expected at most 3 concurrent requests to the server, got %d", peak)
+	}
+	if workStatus() != ExitPartial {
+		t.Errorf("Expected exit status %d, got %d", ExitPartial, workStatus())
+	}
+}
+
+func BenchmarkVerifyDigests(b *testing.B) {
+	var peak int32
+	server := verifyTestServer(2*time.Millisecond, &peak)
+	defer server.Close()
+	defer func() { Cluster = nil }()
+	digests := verifyTestCluster(b, server, 100)
+	defer func() { verifyPerServer = 2 }()
+
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			metricWorkers = workers
+			verifyPerServer = workers
+			for i := 0; i < b.N; i++ {
+				VerifyDigests(digests)
+			}
+		})
+	}
+}
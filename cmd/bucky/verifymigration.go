@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// migrationTo is the -to HOST:PORT of a buckyd daemon in the cluster the
+// metrics were migrated to.
+var migrationTo string
+
+// maxMigrationDiffs caps the differences logged for each metric.
+const maxMigrationDiffs = 10
+
+func init() {
+	usage := "[options] <metric> [metric ...]"
+	short := "Verify that migrated metrics match between two clusters."
+	long := `Compare the metrics given as arguments in the cluster given by -h, the
+cluster they were migrated from, with the same metrics in the cluster of
+the buckyd daemon given by -to as HOST:PORT.  If the first argument is a
+"-" then read a JSON array of metric names from STDIN.
+
+Each metric is downloaded from its owner in each cluster's hash ring and the
+two Whisper DBs are decoded and compared.  The aggregation method, the
+xFilesFactor, and the retentions must be the same.  Then every datapoint of
+every archive is compared by timestamp, and a datapoint missing from one
+copy is a difference.  Failed downloads are retried -retries times with an
+exponential backoff starting at -retry-backoff.
+
+Metrics that differ, that are missing from either cluster, or that could
+not be compared are printed as they are found, one per line, preceded by
+DIFF, MISSING, or FAILED.  The first differences of each metric are logged.
+A summary is logged at the end.  The exit status is 0 only if every metric
+matches.  Run this over a sample of the metrics after a migration before
+the old cluster is retired.`
+
+	c := NewCommand(verifyMigrationCommand, "verify-migration", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupRetry(c)
+
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Downloader threads.")
+	c.Flag.IntVar(&metricWorkers, "workers", 5,
+		"Downloader threads.")
+	c.Flag.IntVar(&verifyPerServer, "per-server", 2,
+		"Concurrent downloads from each server.  0 for no limit.")
+	c.Flag.StringVar(&migrationTo, "to", "",
+		"HOST:PORT of a buckyd daemon in the cluster migrated to.")
+}
+
+// DestinationCluster returns the ClusterConfig of the cluster of the
+// buckyd daemon at hostport without replacing Cluster.  Its health is not
+// checked.
+func DestinationCluster(hostport string) (*ClusterConfig, error) {
+	ring, err := GetSingleHashRing(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot communicate with buckyd daemon %s: %s", hostport, err)
+	}
+	return newClusterConfig(hostport, ring)
+}
+
+// clusterOwner returns the HOST:PORT of the owner of metric in cluster.
+func clusterOwner(cluster *ClusterConfig, metric string) string {
+	server := cluster.NodeHostPort(cluster.Hash.GetNode(metric))
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		return net.JoinHostPort(server, cluster.Port)
+	}
+	return server
+}
+
+// CompareWhisper returns the differences between the Whisper DBs a and b.
+// If their aggregation, xFilesFactor, or retentions differ only those are
+// returned.  Otherwise the datapoints of each archive are compared by
+// timestamp and each archive that differs is described by the number of
+// datapoints that differ and the first of them.
+func CompareWhisper(a, b *whisper.Whisper) []string {
+	diffs := make([]string, 0)
+	if a.AggregationMethod() != b.AggregationMethod() {
+		diffs = append(diffs, fmt.Sprintf("aggregation method %d != %d",
+			a.AggregationMethod(), b.AggregationMethod()))
+	}
+	if a.XFilesFactor() != b.XFilesFactor() {
+		diffs = append(diffs, fmt.Sprintf("xFilesFactor %g != %g",
+			a.XFilesFactor(), b.XFilesFactor()))
+	}
+	ra, rb := a.Retentions(), b.Retentions()
+	if retentionString(ra) != retentionString(rb) {
+		diffs = append(diffs, fmt.Sprintf("retentions %s != %s",
+			retentionString(ra), retentionString(rb)))
+	}
+	if len(diffs) > 0 {
+		return diffs
+	}
+
+	sorted := whisper.RetentionsByPrecision{Retentions: ra}
+	sort.Sort(sorted)
+	for _, r := range sorted.Iterator() {
+		// One step inside the archive so that both fetches read from it
+		// even if the clock ticks in between.
+		now := int(time.Now().Unix())
+		from := now - r.MaxRetention() + r.SecondsPerPoint()
+		tsa, erra := a.Fetch(from, now)
+		tsb, errb := b.Fetch(from, now)
+		if erra != nil || errb != nil || tsa == nil || tsb == nil {
+			diffs = append(diffs, fmt.Sprintf("archive %s: cannot be read", retentionString(whisper.Retentions{r})))
+			continue
+		}
+		if d := comparePoints(tsa.Points(), tsb.Points()); d != "" {
+			diffs = append(diffs, fmt.Sprintf("archive %s: %s", retentionString(whisper.Retentions{r}), d))
+		}
+	}
+	return diffs
+}
+
+// comparePoints returns a description of the differences between the
+// datapoints of a and b or an empty string if they match.  Unknown values
+// match each other and timestamps outside of either series are skipped.
+func comparePoints(a, b []*whisper.TimeSeriesPoint) string {
+	values := make(map[int]float64, len(b))
+	for _, p := range b {
+		values[p.Time] = p.Value
+	}
+	count, total := 0, 0
+	first := ""
+	for _, p := range a {
+		v, ok := values[p.Time]
+		if !ok {
+			continue
+		}
+		total++
+		if p.Value == v || (math.IsNaN(p.Value) && math.IsNaN(v)) {
+			continue
+		}
+		if count == 0 {
+			first = fmt.Sprintf("%d: %v != %v", p.Time, p.Value, v)
+		}
+		count++
+	}
+	if count == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d datapoints differ, first at %s", count, total, first)
+}
+
+// retentionString formats retentions as in a storage-schemas.conf with
+// seconds as the unit.
+func retentionString(retentions whisper.Retentions) string {
+	s := ""
+	for i, r := range retentions {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("%ds:%d", r.SecondsPerPoint(), r.NumberOfPoints())
+	}
+	return s
+}
+
+// downloadMigrated downloads metric from server.  The MetricData is nil
+// without an error if server does not have the metric.
+func downloadMigrated(server, metric string, limit *ServerLimit) (*MetricData, error) {
+	var data *MetricData
+	release := limit.Acquire(server)
+	defer release()
+	err := withRetry(context.Background(), "download of "+metric, func() error {
+		var err error
+		data, err = GetMetricData(server, metric)
+		if e, ok := err.(*StatusError); ok && e.Code == http.StatusNotFound {
+			data = nil
+			return nil
+		}
+		return err
+	})
+	return data, err
+}
+
+// verifyMigrated compares metric in the source cluster with the copy in
+// dest and records the result.
+func verifyMigrated(dest *ClusterConfig, metric string, limit *ServerLimit, report *VerifyReport) {
+	src := clusterOwner(Cluster, metric)
+	dst := clusterOwner(dest, metric)
+	failed := func(server, format string, args ...interface{}) {
+		log.Printf(format, args...)
+		report.add(&report.Failed, "FAILED", metric)
+		workFailedOn(server, metric)
+	}
+
+	a, err := downloadMigrated(src, metric, limit)
+	if err != nil {
+		failed(src, "Error downloading [%s]:%s: %s", src, metric, err)
+		return
+	}
+	b, err := downloadMigrated(dst, metric, limit)
+	if err != nil {
+		failed(dst, "Error downloading [%s]:%s: %s", dst, metric, err)
+		return
+	}
+	switch {
+	case a == nil && b == nil:
+		log.Printf("%s is missing from both clusters", metric)
+	case a == nil:
+		log.Printf("%s is missing from [%s]", metric, src)
+	case b == nil:
+		log.Printf("%s is missing from [%s]", metric, dst)
+	}
+	if a == nil || b == nil {
+		report.add(&report.Missing, "MISSING", metric)
+		workFailedOn("", metric)
+		return
+	}
+
+	wa, err := OpenMetricData(a)
+	if err != nil {
+		failed(src, "Error decoding [%s]:%s: %s", src, metric, err)
+		return
+	}
+	defer wa.Close()
+	wb, err := OpenMetricData(b)
+	if err != nil {
+		failed(dst, "Error decoding [%s]:%s: %s", dst, metric, err)
+		return
+	}
+	defer wb.Close()
+
+	diffs := CompareWhisper(wa, wb)
+	if len(diffs) == 0 {
+		report.add(&report.OK, "", metric)
+		workSucceeded()
+		return
+	}
+	for i, d := range diffs {
+		if i == maxMigrationDiffs {
+			log.Printf("%s: %d more differences", metric, len(diffs)-i)
+			break
+		}
+		log.Printf("%s: %s", metric, d)
+	}
+	report.add(&report.Changed, "DIFF", metric)
+	workFailedOn("", metric)
+}
+
+// VerifyMigration compares each metric in the source cluster with its copy
+// in dest with -w workers and returns the report.
+func VerifyMigration(dest *ClusterConfig, metrics []string) *VerifyReport {
+	report := new(VerifyReport)
+	limit := NewServerLimit(verifyPerServer)
+	wg := new(sync.WaitGroup)
+	workIn := make(chan string, 25)
+
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go func() {
+			for m := range workIn {
+				verifyMigrated(dest, m, limit, report)
+			}
+			wg.Done()
+		}()
+	}
+
+	t := time.Now()
+	for i, m := range metrics {
+		workIn <- m
+		if (i+1)%10 == 0 {
+			s := time.Since(t).Seconds()
+			if s < 1 {
+				s = 1
+			}
+			log.Printf("Progress %d / %d: %.2f  Metrics/second: %.2f",
+				i+1, len(metrics),
+				100*float64(i+1)/float64(len(metrics)),
+				float64(i+1)/s)
+		}
+	}
+	close(workIn)
+	wg.Wait()
+
+	report.Sort()
+	return report
+}
+
+// verifyMigrationCommand runs this subcommand.
+func verifyMigrationCommand(c Command) int {
+	if c.Flag.NArg() == 0 || migrationTo == "" {
+		log.Print("At least one metric and the -to server are required.")
+		return ExitUsage
+	}
+	if metricWorkers < 1 {
+		log.Print("The -w option must be at least 1.")
+		return ExitUsage
+	}
+	if _, _, err := net.SplitHostPort(migrationTo); err != nil {
+		log.Printf("The -to option must be HOST:PORT: %s", err)
+		return ExitUsage
+	}
+
+	metrics := c.Flag.Args()
+	if c.Flag.Arg(0) == "-" {
+		blob, _ := ioutil.ReadAll(os.Stdin)
+		if err := json.Unmarshal(blob, &metrics); err != nil {
+			log.Printf("Error unmarshalling JSON data: %s", err)
+			return ExitUsage
+		}
+	}
+
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	dest, err := DestinationCluster(migrationTo)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	log.Printf("Verifying %d metrics from %s against %s with %d workers.",
+		len(metrics), HostPort, migrationTo, metricWorkers)
+
+	report := VerifyMigration(dest, metrics)
+	log.Printf("Verify complete: %d ok, %d different, %d missing, %d failed.",
+		len(report.OK), len(report.Changed), len(report.Missing), len(report.Failed))
+	return workStatus()
+}
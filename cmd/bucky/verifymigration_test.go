@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// migrationTestWhisper returns a Whisper DB with the given retentions and
+// a value of v for each of the last 3 minutes.
+func migrationTestWhisper(t *testing.T, defs string, v float64) []byte {
+	dir, err := ioutil.TempDir("", "verifymigration_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metric.wsp")
+	retentions, _ := whisper.ParseRetentionDefs(defs)
+	wsp, err := whisper.Create(path, retentions, whisper.Average, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := int(time.Now().Unix())
+	now -= now % 60
+	for i := 1; i <= 3; i++ {
+		wsp.Update(v, now-60*i)
+	}
+	wsp.Close()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// migrationTestServer serves the Whisper DBs in held by metric name.
+func migrationTestServer(held map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/metrics/")
+		data, ok := held[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		stat, _ := json.Marshal(&MetricData{Name: name, Size: int64(len(data)), Mode: 0644})
+		w.Header().Set("X-Metric-Stat", string(stat))
+		w.Write(data)
+	}))
+}
+
+func TestVerifyMigration(t *testing.T) {
+	same := migrationTestWhisper(t, "60s:1d,1h:30d", 1)
+	src := migrationTestServer(map[string][]byte{
+		"same.metric":   same,
+		"diff.metric":   same,
+		"schema.metric": same,
+		"gone.metric":   same,
+	})
+	defer src.Close()
+	dst := migrationTestServer(map[string][]byte{
+		"same.metric":   same,
+		"diff.metric":   migrationTestWhisper(t, "60s:1d,1h:30d", 2),
+		"schema.metric": migrationTestWhisper(t, "60s:2d", 1),
+	})
+	defer dst.Close()
+
+	_, port, _ := net.SplitHostPort(dst.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	dest := Cluster
+	_, port, _ = net.SplitHostPort(src.Listener.Addr().String())
+	restoreTestCluster(ringFor(1, "127.0.0.1"), port)
+	defer func() { Cluster = nil }()
+
+	resetTarState()
+	metricWorkers = 2
+	report := VerifyMigration(dest, []string{"same.metric", "diff.metric", "schema.metric", "gone.metric"})
+
+	expected := map[string][]string{
+		"ok":      {"same.metric"},
+		"changed": {"diff.metric", "schema.metric"},
+		"missing": {"gone.metric"},
+		"failed":  nil,
+	}
+	got := map[string][]string{
+		"ok":      report.OK,
+		"changed": report.Changed,
+		"missing": report.Missing,
+		"failed":  report.Failed,
+	}
+	for c, metrics := range expected {
+		if strings.Join(got[c], ",") != strings.Join(metrics, ",") {
+			t.Errorf("Expected %s metrics %v, got %v", c, metrics, got[c])
+		}
+	}
+	if workStatus() != ExitPartial {
+		t.Errorf("Expected exit status %d, got %d", ExitPartial, workStatus())
+	}
+}
+
+func TestComparePoints(t *testing.T) {
+	nan := math.NaN()
+	a := []*whisper.TimeSeriesPoint{{Time: 60, Value: 1}, {Time: 120, Value: nan}, {Time: 180, Value: 3}, {Time: 240, Value: 4}}
+	b := []*whisper.TimeSeriesPoint{{Time: 120, Value: nan}, {Time: 180, Value: 3}, {Time: 240, Value: 4}, {Time: 300, Value: 5}}
+	if d := comparePoints(a, b); d != "" {
+		t.Errorf("Expected the overlapping datapoints to match, got %q", d)
+	}
+
+	b = []*whisper.TimeSeriesPoint{{Time: 60, Value: 1}, {Time: 120, Value: 2}, {Time: 180, Value: 3}, {Time: 240, Value: 5}}
+	expected := "2 of 4 datapoints differ, first at 120: NaN != 2"
+	if d := comparePoints(a, b); d != expected {
+		t.Errorf("Expected %q, got %q", expected, d)
+	}
+}
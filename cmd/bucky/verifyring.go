@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+var verifyCarbonConfig string
+var verifyCarbonCluster string
+
+func init() {
+	usage := "[options] <metric list>"
+	short := "Verify the hash ring routes metrics as carbon does."
+	long := `Confirm that bucky places a sample of metrics on the same nodes that
+carbon routes them to.  Use this to catch drift between the cluster's hash
+ring and carbon's configuration before trusting rebalance or tar.
+
+The carbon-c-relay configuration given with -carbon-config is imported and
+the consistent hashing cluster named by -carbon-cluster, or the first one, is
+used to compute where carbon sends each metric.  The metric is then placed
+using bucky's hash ring from the buckyd daemons, or -relay-config, with the
+-placement and -key-transform options applied.  The primary node and the
+replicas, one per distinct server, must match exactly including the carbon
+instance.
+
+Metrics may be listed on the command line as arguments or, if the first
+argument is "-" we read the list from a JSON array on STDIN.  Each metric
+that routes differently is printed with the nodes chosen by bucky and by
+carbon, or with -j a JSON array of the divergent metrics is printed.
+
+Exits 0 if every metric matched.  Exits 2 if some metrics diverge and 3 if
+all of them do.`
+
+	c := NewCommand(verifyRingCommand, "verify-ring", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+
+	c.Flag.StringVar(&verifyCarbonConfig, "carbon-config", "",
+		"carbon-c-relay configuration file carbon routes metrics with.")
+	c.Flag.StringVar(&verifyCarbonCluster, "carbon-cluster", "",
+		"Cluster to use from -carbon-config.  Defaults to the first hashing cluster.")
+}
+
+// RingMismatch is a metric that bucky and carbon route to different nodes.
+type RingMismatch struct {
+	Metric string
+	Bucky  []string
+	Carbon []string
+}
+
+// ringNodes returns the nodes holding the given metric in ring, one for
+// each of the first replicas distinct servers.  The primary node is first.
+func ringNodes(ring hashing.HashRing, replicas int, metric string) []hashing.Node {
+	if replicas < 1 {
+		replicas = 1
+	}
+	servers := make([]string, 0)
+	nodes := make([]hashing.Node, 0)
+	for _, n := range ring.GetNodes(metric) {
+		if containsString(servers, n.Server) {
+			continue
+		}
+		servers = append(servers, n.Server)
+		nodes = append(nodes, n)
+		if len(nodes) == replicas {
+			break
+		}
+	}
+	return nodes
+}
+
+// nodeStrings formats each Node as HOST[:PORT][=INSTANCE].
+func nodeStrings(nodes []hashing.Node) []string {
+	ret := make([]string, 0)
+	for _, n := range nodes {
+		ret = append(ret, nodeString(n))
+	}
+	return ret
+}
+
+// VerifyRing routes each metric through bucky's ring and through the ring
+// carbon uses and returns the metrics whose nodes differ.
+func VerifyRing(bucky hashing.HashRing, buckyReplicas int, carbon hashing.HashRing, carbonReplicas int, metrics []string) []RingMismatch {
+	ret := make([]RingMismatch, 0)
+	for _, m := range metrics {
+		b := ringNodes(bucky, buckyReplicas, m)
+		c := ringNodes(carbon, carbonReplicas, m)
+		same := len(b) == len(c)
+		for i := 0; same && i < len(b); i++ {
+			same = hashing.NodeCmp(b[i], c[i])
+		}
+		if !same {
+			ret = append(ret, RingMismatch{m, nodeStrings(b), nodeStrings(c)})
+		}
+	}
+	return ret
+}
+
+// verifyRingCommand runs this subcommand.
+func verifyRingCommand(c Command) int {
+	if verifyCarbonConfig == "" {
+		log.Print("The -carbon-config option is required.")
+		return ExitUsage
+	}
+	if c.Flag.NArg() == 0 {
+		log.Print("At least one argument is required.")
+		return ExitUsage
+	}
+
+	_, err := GetClusterConfig(HostPort)
+	if err != nil {
+		log.Print(err)
+		return ExitError
+	}
+	if !Cluster.Healthy {
+		log.Printf("Warning: Cluster is not optimal.")
+	}
+
+	ring, err := GetRelayRing(verifyCarbonConfig, verifyCarbonCluster)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+	carbon, err := NewAlgoRing(ring)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+	for _, d := range RingDiff(Cluster.Ring, ring) {
+		log.Printf("Carbon ring differs: %s", d)
+	}
+
+	metrics := c.Flag.Args()
+	if c.Flag.Arg(0) == "-" {
+		blob, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = json.Unmarshal(blob, &metrics)
+		}
+		if err != nil {
+			log.Printf("Error reading metrics from STDIN: %s", err)
+			return ExitUsage
+		}
+	}
+
+	mismatches := VerifyRing(Cluster.Hash, Cluster.Replicas, carbon, ring.Replicas, metrics)
+	if JSONOutput {
+		blob, err := json.Marshal(mismatches)
+		if err != nil {
+			log.Printf("%s", err)
+		} else {
+			os.Stdout.Write(blob)
+			os.Stdout.Write([]byte("\n"))
+		}
+	} else {
+		for _, m := range mismatches {
+			fmt.Printf("%s\tbucky: %s\tcarbon: %s\n", m.Metric,
+				strings.Join(m.Bucky, ","), strings.Join(m.Carbon, ","))
+		}
+	}
+	log.Printf("Verified %d metrics, %d route differently than carbon.",
+		len(metrics), len(mismatches))
+
+	switch {
+	case len(mismatches) == 0:
+		return ExitOK
+	case len(mismatches) == len(metrics):
+		return ExitFailed
+	}
+	return ExitPartial
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func verifyTestMetrics(n int) []string {
+	metrics := make([]string, 0)
+	for i := 0; i < n; i++ {
+		metrics = append(metrics, fmt.Sprintf("foo.bar.metric%d", i))
+	}
+	return metrics
+}
+
+func TestVerifyRing(t *testing.T) {
+	metrics := verifyTestMetrics(200)
+	ring := ringFor(2, "a", "b", "c")
+	bucky, _ := NewHashRing(ring)
+	carbon, _ := NewAlgoRing(ringFor(2, "a", "b", "c"))
+	if m := VerifyRing(bucky, 2, carbon, 2, metrics); len(m) != 0 {
+		t.Errorf("Identical rings diverge on %d metrics: %v", len(m), m[0])
+	}
+
+	// A node carbon doesn't know about moves some metrics
+	carbon, _ = NewAlgoRing(ringFor(2, "a", "b", "c", "d"))
+	m := VerifyRing(bucky, 2, carbon, 2, metrics)
+	if len(m) == 0 || len(m) == len(metrics) {
+		t.Errorf("Expected some metrics to diverge, got %d", len(m))
+	}
+	for _, d := range m {
+		if len(d.Bucky) != 2 || len(d.Carbon) != 2 {
+			t.Errorf("Expected 2 replicas for %s: %v", d.Metric, d)
+		}
+	}
+
+	// Differing replica counts diverge on every metric
+	carbon, _ = NewAlgoRing(ringFor(1, "a", "b", "c"))
+	if m := VerifyRing(bucky, 2, carbon, 1, metrics); len(m) != len(metrics) {
+		t.Errorf("Expected every metric to diverge, got %d", len(m))
+	}
+
+	// Instances are significant
+	inst := ringFor(2, "a", "b", "c")
+	inst.Nodes[0].Instance = "x"
+	carbon, _ = NewAlgoRing(inst)
+	if m := VerifyRing(bucky, 2, carbon, 2, metrics); len(m) == 0 {
+		t.Errorf("Expected instance change to diverge")
+	}
+}
+
+func TestVerifyRingPlacement(t *testing.T) {
+	metrics := verifyTestMetrics(200)
+	ring := ringFor(1, "a", "b", "c")
+	carbon, _ := NewAlgoRing(ring)
+
+	// Rendezvous placement is not carbon compatible
+	PlacementStrategy = "rendezvous"
+	defer func() { PlacementStrategy = "" }()
+	bucky, err := NewHashRing(ring)
+	if err != nil {
+		t.Fatalf("Error building ring: %s", err)
+	}
+	if m := VerifyRing(bucky, 1, carbon, 1, metrics); len(m) == 0 {
+		t.Errorf("Expected rendezvous placement to diverge from carbon")
+	}
+
+	// NewAlgoRing ignores the placement strategy
+	algo, _ := NewAlgoRing(ring)
+	if _, ok := algo.(*hashing.CarbonHashRing); !ok {
+		t.Errorf("Expected a carbon ring, got %T", algo)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// defaultXFilesFactor is the xFilesFactor carbon creates Whisper DBs with
+// when no storage-aggregation rule sets one.
+const defaultXFilesFactor = 0.5
+
+var xffConfig string
+var xffFix bool
+
+func init() {
+	usage := "[options] <metric expression>"
+	short := "Find and fix xFilesFactor mismatches."
+	long := `Compare the xFilesFactor in each metric's Whisper header with the
+xFilesFactor carbon's storage-aggregation.conf, given by -config, assigns
+the metric.  Without any arguments every metric in the cluster is checked.
+Every copy of the metric on every server is checked unless -s limits the
+check to the buckyd daemon given by -h.
+
+The default mode is to work with lists.  The arguments are a series of one or
+more metric key names.  If the first argument is a "-" then read a JSON array
+from STDIN as our list of metrics.  Use -r to enable regular expression mode.
+
+The rules of the configuration are tried in order and the first whose
+pattern matches the metric name applies as carbon does.  A metric no rule
+matches, or whose rule has no xFilesFactor, expects 0.5.
+
+Each mismatch is printed as server, metric, the xFilesFactor found, and the
+xFilesFactor expected.  Use -j for a JSON array.  This is a dry run unless
+-fix is given.  With -fix the mismatches are listed first and then, after
+confirmation per server unless -noconfirm is given, the header of each is
+rewritten in place.  Data points are not touched.  Gzip compressed metrics
+can not be checked.`
+
+	c := NewCommand(xffCommand, "xff", usage, short, long)
+	SetupCommon(c)
+	SetupHostname(c)
+	SetupSingle(c)
+	SetupJSON(c)
+
+	c.Flag.StringVar(&xffConfig, "config", "",
+		"Carbon storage-aggregation.conf the metrics should match.")
+	c.Flag.BoolVar(&xffFix, "fix", false,
+		"Rewrite the xFilesFactor of mismatched metrics.")
+	c.Flag.BoolVar(&listRegexMode, "r", false,
+		"Filter by a regular expression.")
+	c.Flag.BoolVar(&listForce, "f", false,
+		"Force the remote daemons to rebuild their cache.")
+	c.Flag.BoolVar(&deleteForce, "noconfirm", false,
+		"No confirmation.")
+	c.Flag.IntVar(&metricWorkers, "w", 5,
+		"Worker threads.")
+}
+
+// AggregationRule is a section of carbon's storage-aggregation.conf.
+type AggregationRule struct {
+	Name         string
+	Pattern      *regexp.Regexp
+	XFilesFactor *float32
+}
+
+// XFFMismatch is a copy of a metric whose xFilesFactor differs from the
+// storage-aggregation configuration.
+type XFFMismatch struct {
+	Server   string
+	Metric   string
+	Actual   float32
+	Expected float32
+}
+
+// ParseStorageAggregation reads the rules of carbon's
+// storage-aggregation.conf at path in the order carbon applies them.
+func ParseStorageAggregation(path string) ([]AggregationRule, error) {
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]AggregationRule, 0)
+	var rule *AggregationRule
+	for i, line := range strings.Split(string(blob), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			rules = append(rules, AggregationRule{Name: line[1 : len(line)-1]})
+			rule = &rules[len(rules)-1]
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if rule == nil || len(kv) != 2 {
+			return nil, fmt.Errorf("%s:%d: Malformed line: %s", path, i+1, line)
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "pattern":
+			rule.Pattern, err = regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: Bad pattern: %s", path, i+1, err)
+			}
+		case "xFilesFactor":
+			f, err := strconv.ParseFloat(value, 32)
+			if err != nil || f < 0 || f > 1 {
+				return nil, fmt.Errorf("%s:%d: Bad xFilesFactor: %s", path, i+1, value)
+			}
+			xff := float32(f)
+			rule.XFilesFactor = &xff
+		}
+	}
+	for _, r := range rules {
+		if r.Pattern == nil {
+			return nil, fmt.Errorf("%s: Section [%s] has no pattern", path, r.Name)
+		}
+	}
+	return rules, nil
+}
+
+// ExpectedXFilesFactor returns the xFilesFactor carbon creates metric with
+// under rules.
+func ExpectedXFilesFactor(rules []AggregationRule, metric string) float32 {
+	for _, r := range rules {
+		if r.Pattern.MatchString(metric) {
+			if r.XFilesFactor == nil {
+				break
+			}
+			return *r.XFilesFactor
+		}
+	}
+	return defaultXFilesFactor
+}
+
+// headerURL returns the URL of the Whisper header of metric on the buckyd
+// daemon at server.
+func headerURL(server, metric string) (string, error) {
+	var err error
+	u := &url.URL{
+		Scheme: buckyScheme(),
+		Path:   "/header/" + metric,
+	}
+	u.Host, err = SanitizeHostPort(server)
+	if err != nil {
+		log.Printf("Malformed hostname: %s", err)
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// doHeader makes a request of the given method against the Whisper header
+// of metric on server and decodes the header returned.
+func doHeader(method, server, metric string, update *WhisperHeader) (*WhisperHeader, error) {
+	u, err := headerURL(server, metric)
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	if update != nil {
+		if body, err = json.Marshal(update); err != nil {
+			return nil, err
+		}
+	}
+	r, err := NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Error building request: %s", err)
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	resp, err := GetHTTP().Do(r)
+	if err != nil {
+		log.Printf("Error communicating with server: %s", err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Error: Header of [%s]:%s returned status code: %d",
+			server, metric, resp.StatusCode)
+		return nil, &StatusError{resp.StatusCode, resp.Status}
+	}
+	header := new(WhisperHeader)
+	if err := json.NewDecoder(resp.Body).Decode(header); err != nil {
+		log.Printf("Error decoding header of [%s]:%s: %s", server, metric, err)
+		return nil, err
+	}
+	return header, nil
+}
+
+// GetHeader retrieves the Whisper header of metric on server.
+func GetHeader(server, metric string) (*WhisperHeader, error) {
+	return doHeader("GET", server, metric, nil)
+}
+
+// SetXFilesFactor rewrites the xFilesFactor in the Whisper header of
+// metric on server.
+func SetXFilesFactor(server, metric string, xff float32) error {
+	_, err := doHeader("PUT", server, metric, &WhisperHeader{XFilesFactor: xff})
+	return err
+}
+
+// FindXFFMismatches checks every copy in metricMap, a map of buckyd
+// HOST:PORT => metrics, against rules and returns the mismatches sorted by
+// server and metric.
+func FindXFFMismatches(metricMap map[string][]string, rules []AggregationRule) []XFFMismatch {
+	type work struct{ server, metric string }
+	ret := make([]XFFMismatch, 0)
+	lock := new(sync.Mutex)
+	wg := new(sync.WaitGroup)
+	workIn := make(chan work)
+
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for w := range workIn {
+				header, err := GetHeader(w.server, w.metric)
+				if err != nil {
+					workFailed()
+					continue
+				}
+				workSucceeded()
+				expected := ExpectedXFilesFactor(rules, w.metric)
+				if header.XFilesFactor != expected {
+					lock.Lock()
+					ret = append(ret, XFFMismatch{w.server, w.metric,
+						header.XFilesFactor, expected})
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	for server, metrics := range metricMap {
+		for _, m := range metrics {
+			workIn <- work{server, m}
+		}
+	}
+	close(workIn)
+	wg.Wait()
+
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Server != ret[j].Server {
+			return ret[i].Server < ret[j].Server
+		}
+		return ret[i].Metric < ret[j].Metric
+	})
+	return ret
+}
+
+// FixXFFMismatches rewrites the xFilesFactor of each mismatch, asking for
+// confirmation per server unless -noconfirm was given.
+func FixXFFMismatches(mismatches []XFFMismatch) {
+	byServer := make(map[string][]XFFMismatch)
+	servers := make([]string, 0)
+	for _, m := range mismatches {
+		if _, ok := byServer[m.Server]; !ok {
+			servers = append(servers, m.Server)
+		}
+		byServer[m.Server] = append(byServer[m.Server], m)
+	}
+
+	wg := new(sync.WaitGroup)
+	workIn := make(chan XFFMismatch)
+	wg.Add(metricWorkers)
+	for i := 0; i < metricWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for m := range workIn {
+				if err := SetXFilesFactor(m.Server, m.Metric, m.Expected); err != nil {
+					workFailed()
+				}
+			}
+		}()
+	}
+	for _, server := range servers {
+		msg := fmt.Sprintf("Fixing the xFilesFactor of %d metrics on %s: Please Confirm:",
+			len(byServer[server]), server)
+		if !deleteForce && !askForConfirmation(msg) {
+			continue
+		}
+		log.Printf("Fixing the xFilesFactor of %d metrics on %s...",
+			len(byServer[server]), server)
+		for _, m := range byServer[server] {
+			workIn <- m
+		}
+	}
+	close(workIn)
+	wg.Wait()
+}
+
+// xffCommand runs this subcommand.
+func xffCommand(c Command) int {
+	if xffConfig == "" {
+		log.Print("The -config option is required.")
+		return ExitUsage
+	}
+	rules, err := ParseStorageAggregation(xffConfig)
+	if err != nil {
+		log.Print(err)
+		return ExitUsage
+	}
+
+	var servers []string
+	if SingleHost {
+		server, err := singleServer(HostPort)
+		if err != nil {
+			log.Printf("Malformed hostname: %s", err)
+			return ExitUsage
+		}
+		servers = []string{server}
+	} else {
+		_, err := GetClusterConfig(HostPort)
+		if err != nil {
+			log.Print(err)
+			return ExitError
+		}
+		if !Cluster.Healthy {
+			log.Printf("Warning: Cluster is not optimal.")
+		}
+		servers = Cluster.HostPorts()
+	}
+	if xffFix && !checkWritable(servers) {
+		return ExitUsage
+	}
+
+	metricMap, err := ListSelection(c, servers)
+	if err != nil {
+		log.Printf("Error retrieving metric lists: %s", err)
+		return ExitError
+	}
+
+	mismatches := FindXFFMismatches(metricMap, rules)
+	if JSONOutput {
+		blob, err := json.Marshal(mismatches)
+		if err != nil {
+			log.Printf("%s", err)
+		} else {
+			os.Stdout.Write(blob)
+			os.Stdout.Write([]byte("\n"))
+		}
+	} else {
+		for _, m := range mismatches {
+			fmt.Printf("%s: %s\t%v\texpected %v\n", m.Server, m.Metric,
+				m.Actual, m.Expected)
+		}
+	}
+	log.Printf("Checked %d metric copies, %d have a mismatched xFilesFactor.",
+		countMap(metricMap), len(mismatches))
+
+	if xffFix && len(mismatches) > 0 {
+		FixXFFMismatches(mismatches)
+	}
+	return workStatus()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestParseStorageAggregation(t *testing.T) {
+	fd, err := ioutil.TempFile("", "xff_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.WriteString(`# carbon aggregation rules
+[min]
+pattern = \.min$
+xFilesFactor = 0.1
+aggregationMethod = min
+
+[count]
+pattern = \.count$
+aggregationMethod = sum
+
+[default_average]
+pattern = .*
+xFilesFactor = 0.3
+`)
+	fd.Close()
+
+	rules, err := ParseStorageAggregation(fd.Name())
+	if err != nil {
+		t.Fatalf("Error parsing rules: %s", err)
+	}
+	for metric, expected := range map[string]float32{
+		"foo.bar.min":   0.1,
+		"foo.bar.count": 0.5,
+		"foo.bar.mean":  0.3,
+	} {
+		if xff := ExpectedXFilesFactor(rules, metric); xff != expected {
+			t.Errorf("%s: expected %v, got %v", metric, expected, xff)
+		}
+	}
+	if xff := ExpectedXFilesFactor(nil, "foo"); xff != defaultXFilesFactor {
+		t.Errorf("Expected the default without rules, got %v", xff)
+	}
+
+	ioutil.WriteFile(fd.Name(), []byte("[bad]\nxFilesFactor = 2\npattern = .*\n"), 0644)
+	if _, err := ParseStorageAggregation(fd.Name()); err == nil {
+		t.Errorf("Expected an out of range xFilesFactor to fail")
+	}
+	ioutil.WriteFile(fd.Name(), []byte("[bad]\nxFilesFactor = 0.2\n"), 0644)
+	if _, err := ParseStorageAggregation(fd.Name()); err == nil {
+		t.Errorf("Expected a section without a pattern to fail")
+	}
+}
+
+func TestXFFMismatches(t *testing.T) {
+	lock := new(sync.Mutex)
+	headers := map[string]float32{"foo.min": 0.5, "foo.mean": 0.5}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metric := strings.TrimPrefix(r.URL.Path, "/header/")
+		lock.Lock()
+		defer lock.Unlock()
+		xff, ok := headers[metric]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method == "PUT" {
+			update := new(WhisperHeader)
+			json.NewDecoder(r.Body).Decode(update)
+			xff = update.XFilesFactor
+			headers[metric] = xff
+		}
+		json.NewEncoder(w).Encode(&WhisperHeader{Name: metric, XFilesFactor: xff})
+	}))
+	defer server.Close()
+	hostport := strings.TrimPrefix(server.URL, "http://")
+	resetTarState()
+	defer resetTarState()
+	metricWorkers = 2
+	deleteForce = true
+	defer func() { deleteForce = false }()
+
+	min := float32(0.1)
+	rules := []AggregationRule{
+		{"min", regexp.MustCompile(`\.min$`), &min},
+	}
+	metricMap := map[string][]string{hostport: {"foo.min", "foo.mean", "foo.missing"}}
+	mismatches := FindXFFMismatches(metricMap, rules)
+	if len(mismatches) != 1 || mismatches[0].Metric != "foo.min" ||
+		mismatches[0].Actual != 0.5 || mismatches[0].Expected != 0.1 {
+		t.Fatalf("Unexpected mismatches: %+v", mismatches)
+	}
+	if workerSucceeded != 2 || workerFailed != 1 {
+		t.Errorf("Expected 2 checked and 1 failed, got %d and %d",
+			workerSucceeded, workerFailed)
+	}
+
+	FixXFFMismatches(mismatches)
+	if headers["foo.min"] != 0.1 || headers["foo.mean"] != 0.5 {
+		t.Errorf("Unexpected headers after fix: %v", headers)
+	}
+	if mismatches := FindXFFMismatches(metricMap, rules); len(mismatches) != 0 {
+		t.Errorf("Mismatches remain after fix: %+v", mismatches)
+	}
+}
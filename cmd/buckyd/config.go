@@ -0,0 +1,26 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// serveConfig sends the parameters this daemon's hash ring was configured
+// with to the client so that it can adopt them.
+func serveConfig(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request.", http.StatusBadRequest)
+		return
+	}
+
+	blob, err := json.Marshal(hashring.Config())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error marshalling data: %s", err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
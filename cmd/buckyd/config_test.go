@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+func TestServeConfig(t *testing.T) {
+	defer func(r *hashing.JSONRingType) { hashring = r }(hashring)
+	hashring = &hashing.JSONRingType{Name: "graphite1", Algo: "jump_fnv1a", Replicas: 2,
+		Nodes: []hashing.Node{hashing.NewNode("graphite1", 0, "a")}}
+
+	w := httptest.NewRecorder()
+	serveConfig(w, httptest.NewRequest("GET", "/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var config hashing.RingConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatalf("Error decoding %q: %s", w.Body.String(), err)
+	}
+	if config != hashring.Config() {
+		t.Errorf("Expected %+v, got %+v", hashring.Config(), config)
+	}
+
+	w = httptest.NewRecorder()
+	serveConfig(w, httptest.NewRequest("POST", "/config", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for POST, got %d", w.Code)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+import "github.com/jjneely/buckytools/fill"
+
+// compressHeader asks buckyd to store an uploaded Whisper DB gzip
+// compressed at rest.
+const compressHeader = "X-Bucky-Compress-At-Rest"
+
+// gzipSuffix is appended to the path of a Whisper DB stored gzip
+// compressed at rest.
+const gzipSuffix = ".gz"
+
+// isGzipMetric returns true if the Whisper DB at path is stored gzip
+// compressed.
+func isGzipMetric(path string) bool {
+	return strings.HasSuffix(path, ".wsp"+gzipSuffix)
+}
+
+// uncompressedPath returns the path of the uncompressed Whisper DB for the
+// Whisper DB at path which may be stored gzip compressed.
+func uncompressedPath(path string) string {
+	return strings.TrimSuffix(path, gzipSuffix)
+}
+
+// gzipReader returns a reader of the decompressed content of the gzip
+// compressed file fd from its start.
+func gzipReader(fd *os.File) (*gzip.Reader, error) {
+	if _, err := fd.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return gzip.NewReader(fd)
+}
+
+// gzipSize returns the size of the decompressed content of the gzip
+// compressed file at path.  The content is decompressed to count it as
+// the size recorded in the gzip trailer is truncated to 32 bits.
+func gzipSize(path string) (int64, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fd.Close()
+	gz, err := gzipReader(fd)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(ioutil.Discard, gz)
+}
+
+// readMetric returns the content of the Whisper DB at path, decompressed
+// if it is stored gzip compressed.  The file is locked while it is read so
+// the content is not in the middle of an update by carbon-cache.
+func readMetric(path string) ([]byte, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, err
+	}
+	if !isGzipMetric(path) {
+		return ioutil.ReadAll(fd)
+	}
+	gz, err := gzipReader(fd)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(gz)
+}
+
+// decompressMetric copies the Whisper DB at path, which may be stored gzip
+// compressed, to a temporary file and returns its name.  The caller
+// removes the file.
+func decompressMetric(path string) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	var data io.Reader = src
+	if isGzipMetric(path) {
+		gz, err := gzipReader(src)
+		if err != nil {
+			return "", err
+		}
+		data = gz
+	}
+
+	fd, err := ioutil.TempFile(tmpDir, "buckyd")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(fd, data)
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return "", err
+	}
+	return fd.Name(), nil
+}
+
+// compressMetric writes the Whisper DB in the file src gzip compressed to
+// dst.  It is written to a temporary file beside dst and renamed into
+// place so readers never see a partial DB.
+func compressMetric(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fd, err := ioutil.TempFile(filepath.Dir(dst), ".buckyd")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(fd)
+	_, err = io.Copy(gz, in)
+	if e := gz.Close(); err == nil {
+		err = e
+	}
+	if e := fd.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(fd.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// healGzipMetric backfills the metric at path with the Whisper DB in the
+// body of the request and stores the result gzip compressed.  The metric
+// may be stored compressed or not.  An uncompressed copy is replaced by
+// the compressed DB and then removed.  If the metric doesn't exist it is
+// created as a compressed copy of the DB found in the request.
+func healGzipMetric(w http.ResponseWriter, r *http.Request, path string) {
+	data, stat, sum, digest, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
+	plain := uncompressedPath(path)
+	dst := plain + gzipSuffix
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		log.Printf("Error creating %s: %s", filepath.Dir(dst), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	srcName, ok := spoolUpload(w, dst, data, stat, sum, digest)
+	if !ok {
+		return
+	}
+	defer os.Remove(srcName) // not concerned with errors here
+
+	// Backfill the existing DB, the uncompressed copy first as reads
+	// prefer it
+	existing := ""
+	for _, p := range []string{plain, dst} {
+		_, err := os.Stat(p)
+		if err == nil {
+			existing = p
+			break
+		}
+		if !os.IsNotExist(err) {
+			log.Printf("Error stat'ing file %s: %s", p, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	result := srcName
+	if existing != "" {
+		tmp, err := decompressMetric(existing)
+		if err != nil {
+			log.Printf("Error reading %s: %s", existing, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp) // not concerned with errors here
+		if err = fill.All(srcName, tmp); err != nil {
+			log.Printf("Error backfilling %s => %s: %s", srcName, existing, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result = tmp
+	}
+
+	if err := compressMetric(result, dst); err != nil {
+		log.Printf("Error compressing %s: %s", dst, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == plain {
+		if err := os.Remove(plain); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing %s: %s", plain, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
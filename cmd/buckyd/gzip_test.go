@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/golang/snappy"
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+func writeGzip(t *testing.T, path string, data []byte) {
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	gz.Write(data)
+	gz.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGzipMetrics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { Prefix = p }(Prefix)
+	Prefix = dir
+
+	data := bytes.Repeat([]byte("whisper data"), 100)
+	os.MkdirAll(filepath.Join(dir, "foo"), 0755)
+	writeGzip(t, filepath.Join(dir, "foo", "bar.wsp.gz"), data)
+	ioutil.WriteFile(filepath.Join(dir, "foo", "both.wsp"), []byte("plain"), 0644)
+	writeGzip(t, filepath.Join(dir, "foo", "both.wsp.gz"), []byte("compressed"))
+
+	// The uncompressed copy takes precedence
+	if p := metricPath("foo.both"); p != filepath.Join(dir, "foo", "both.wsp") {
+		t.Errorf("Expected the uncompressed foo.both, got %s", p)
+	}
+	path := metricPath("foo.bar")
+	if p := filepath.Join(dir, "foo", "bar.wsp.gz"); path != p {
+		t.Errorf("Expected foo.bar at %s, got %s", p, path)
+	}
+
+	stat, err := statMetric("foo.bar", path)
+	if err != nil || stat.Size != int64(len(data)) {
+		t.Errorf("Expected the decompressed size %d, got %v, %v", len(data), stat, err)
+	}
+
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics/foo.bar", nil))
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("GET did not decompress foo.bar: %d, %d bytes", w.Code, w.Body.Len())
+	}
+
+	sum, _ := Checksum("md5", data)
+	r := httptest.NewRequest("GET", "/metrics/foo.bar", nil)
+	r.Header.Set("Accept-Encoding", "snappy")
+	w = httptest.NewRecorder()
+	serveMetrics(w, r)
+	blob, err := ioutil.ReadAll(snappy.NewReader(w.Body))
+	if err != nil || !bytes.Equal(blob, data) {
+		t.Errorf("Snappy GET did not decompress foo.bar: %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/metrics/foo.bar", nil)
+	r.Header.Set(ChecksumHeader, "md5")
+	w = httptest.NewRecorder()
+	serveMetrics(w, r)
+	if w.Header().Get(ChecksumHeader) != sum || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Expected checksum %s, got %s", sum, w.Header().Get(ChecksumHeader))
+	}
+
+	// Both forms of foo.both are listed once
+	cache := NewMetricsCacheRoots(dataRoots())
+	cache.RefreshCache()
+	metrics, _ := cache.GetMetrics()
+	if strings.Join(metrics, ",") != "foo.bar,foo.both" {
+		t.Errorf("Expected [foo.bar foo.both], got %v", metrics)
+	}
+}
+
+// writeWhisper creates a Whisper DB at path holding value at each of the
+// given timestamps.
+func writeWhisper(t *testing.T, path string, value float64, stamps ...int) {
+	retentions, _ := whisper.ParseRetentionDefs("1m:30m")
+	wsp, err := whisper.Create(path, retentions, whisper.Sum, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsp.Close()
+	for _, ts := range stamps {
+		if err := wsp.Update(value, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// whisperValues returns the known values of the Whisper DB in data by
+// timestamp.
+func whisperValues(t *testing.T, data []byte, from, until int) map[int]float64 {
+	fd, err := ioutil.TempFile("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fd.Name())
+	fd.Write(data)
+	fd.Close()
+	wsp, err := whisper.Open(fd.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wsp.Close()
+	ts, err := wsp.Fetch(from, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[int]float64)
+	for _, p := range ts.Points() {
+		if p.Value == p.Value { // not NaN
+			values[p.Time] = p.Value
+		}
+	}
+	return values
+}
+
+func TestCompressAtRest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { Prefix = p }(Prefix)
+	Prefix = dir
+
+	now := int(time.Now().Unix()) / 60 * 60
+	upload := filepath.Join(dir, "upload.wsp")
+	writeWhisper(t, upload, 1, now-120)
+	data, _ := ioutil.ReadFile(upload)
+	os.MkdirAll(filepath.Join(dir, "foo"), 0755)
+	writeWhisper(t, filepath.Join(dir, "foo", "old.wsp"), 2, now-60)
+
+	post := func(metric string) {
+		r := httptest.NewRequest("POST", "/metrics/"+metric, bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/octet-stream")
+		r.Header.Set("X-Metric-Stat", fmt.Sprintf(`{"Name": "%s", "Size": %d}`, metric, len(data)))
+		r.Header.Set(compressHeader, "true")
+		w := httptest.NewRecorder()
+		serveMetrics(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s: expected 200, got %d: %s", metric, w.Code, w.Body.String())
+		}
+	}
+	get := func(metric string) []byte {
+		w := httptest.NewRecorder()
+		serveMetrics(w, httptest.NewRequest("GET", "/metrics/"+metric, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: expected 200, got %d", metric, w.Code)
+		}
+		return w.Body.Bytes()
+	}
+
+	// A new metric is stored compressed as a copy of the upload
+	post("foo.new")
+	if p := metricPath("foo.new"); p != filepath.Join(dir, "foo", "new.wsp.gz") {
+		t.Errorf("Expected foo.new stored compressed, got %s", p)
+	}
+	if blob := get("foo.new"); !bytes.Equal(blob, data) {
+		t.Errorf("Compressed foo.new does not match the upload")
+	}
+
+	// An uncompressed metric is backfilled and replaced
+	post("foo.old")
+	if _, err := os.Stat(filepath.Join(dir, "foo", "old.wsp")); !os.IsNotExist(err) {
+		t.Errorf("Uncompressed foo.old was not removed: %v", err)
+	}
+	values := whisperValues(t, get("foo.old"), now-600, now)
+	if values[now-120] != 1 || values[now-60] != 2 || len(values) != 2 {
+		t.Errorf("Expected foo.old backfilled, got %v", values)
+	}
+
+	// A compressed metric is backfilled in place
+	writeWhisper(t, upload+".2", 3, now-180)
+	data, _ = ioutil.ReadFile(upload + ".2")
+	post("foo.old")
+	values = whisperValues(t, get("foo.old"), now-600, now)
+	if values[now-180] != 3 || values[now-120] != 1 || len(values) != 3 {
+		t.Errorf("Expected compressed foo.old backfilled, got %v", values)
+	}
+}
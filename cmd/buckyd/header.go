@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+// serveHeader handles the /header/<metric> endpoint which reads and
+// updates the header of a metric's Whisper DB in place.
+func serveHeader(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+
+	metric := r.URL.Path[len("/header/"):]
+	if len(metric) == 0 {
+		http.Error(w, "Metric name missing.", http.StatusBadRequest)
+		return
+	}
+	path := metricPath(metric)
+	if inMaintenance() && r.Method != "GET" {
+		w.Header().Set("X-Bucky-Maintenance", "true")
+		http.Error(w, "Node is in read-only maintenance.",
+			http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != "GET" && r.Method != "PUT" {
+		http.Error(w, "Bad method request.", http.StatusBadRequest)
+		return
+	}
+	if isGzipMetric(path) {
+		http.Error(w, "Can not access the header of a gzip compressed metric.",
+			http.StatusNotImplemented)
+		return
+	}
+
+	// Open takes the same lock carbon-cache.py does
+	wsp, err := whisper.Open(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "Metric not found.", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Error opening %s: %s", path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer wsp.Close()
+
+	if r.Method == "PUT" {
+		update := new(WhisperHeader)
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := wsp.SetXFilesFactor(update.XFilesFactor); err != nil {
+			log.Printf("Error updating header of %s: %s", path, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Set xFilesFactor of %s to %v", metric, update.XFilesFactor)
+	}
+
+	header := &WhisperHeader{
+		Name:              metric,
+		AggregationMethod: int(wsp.AggregationMethod()),
+		XFilesFactor:      wsp.XFilesFactor(),
+	}
+	blob, err := json.Marshal(header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(blob)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+import "github.com/jjneely/buckytools/whisper"
+
+func TestServeHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { Prefix = p }(Prefix)
+	Prefix = dir
+
+	w := httptest.NewRecorder()
+	serveHeader(w, httptest.NewRequest("GET", "/header/foo.bar", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing metric, got %d", w.Code)
+	}
+
+	os.MkdirAll(filepath.Join(dir, "foo"), 0755)
+	retentions, _ := whisper.ParseRetentionDefs("60s:1d")
+	wsp, err := whisper.Create(filepath.Join(dir, "foo", "bar.wsp"), retentions, whisper.Max, 0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsp.Close()
+
+	w = httptest.NewRecorder()
+	serveHeader(w, httptest.NewRequest("PUT", "/header/foo.bar",
+		strings.NewReader(`{"XFilesFactor": 0.25}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	serveHeader(w, httptest.NewRequest("GET", "/header/foo.bar", nil))
+	header := new(WhisperHeader)
+	if err := json.Unmarshal(w.Body.Bytes(), header); err != nil {
+		t.Fatalf("Error decoding header: %s: %s", err, w.Body.String())
+	}
+	if header.XFilesFactor != 0.25 || header.AggregationMethod != int(whisper.Max) {
+		t.Errorf("Unexpected header: %+v", header)
+	}
+
+	w = httptest.NewRecorder()
+	serveHeader(w, httptest.NewRequest("PUT", "/header/foo.bar",
+		strings.NewReader(`{"XFilesFactor": 2}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid xFilesFactor, got %d", w.Code)
+	}
+}
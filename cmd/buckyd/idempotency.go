@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// uploads remembers the idempotency keys of recently applied uploads.
+var uploads = newUploadCache(10 * time.Minute)
+
+// uploadEntry tracks one idempotency key.  Done is closed when the upload
+// that first used the key completes.  At is when it was applied.
+type uploadEntry struct {
+	done chan struct{}
+	at   time.Time
+}
+
+// uploadCache deduplicates uploads that are retried by clients that did
+// not see the response to an earlier attempt.  Merging the same data
+// twice must not happen.
+type uploadCache struct {
+	lock       sync.Mutex
+	entries    map[string]*uploadEntry
+	ttl        time.Duration
+	lastExpire time.Time
+}
+
+func newUploadCache(ttl time.Duration) *uploadCache {
+	return &uploadCache{
+		entries: make(map[string]*uploadEntry),
+		ttl:     ttl,
+	}
+}
+
+// expire removes keys applied longer than ttl ago.  The lock must be held.
+func (c *uploadCache) expire(now time.Time) {
+	if now.Sub(c.lastExpire) < time.Minute {
+		return
+	}
+	c.lastExpire = now
+	for key, e := range c.entries {
+		if !e.at.IsZero() && now.Sub(e.at) > c.ttl {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// Do calls apply unless an upload with the same key has already been
+// applied.  Apply returns true if the upload succeeded.  A duplicate that
+// arrives while the first upload is in progress waits for it and is only
+// applied if the first upload failed.  Do returns true if apply was called.
+func (c *uploadCache) Do(key string, apply func() bool) bool {
+	for {
+		c.lock.Lock()
+		c.expire(time.Now())
+		e, ok := c.entries[key]
+		if !ok {
+			e = &uploadEntry{done: make(chan struct{})}
+			c.entries[key] = e
+			c.lock.Unlock()
+
+			success := apply()
+			c.lock.Lock()
+			if success {
+				e.at = time.Now()
+			} else {
+				delete(c.entries, key)
+			}
+			close(e.done)
+			c.lock.Unlock()
+			return true
+		}
+		c.lock.Unlock()
+
+		<-e.done
+		c.lock.Lock()
+		_, ok = c.entries[key]
+		c.lock.Unlock()
+		if ok {
+			return false
+		}
+	}
+}
+
+// statusRecorder records the status code written to a ResponseWriter.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	s.status = code
+	s.ResponseWriter.WriteHeader(code)
+}
+
+// idempotent applies an upload of metric with apply unless the request's
+// X-Bucky-Idempotency-Key header shows it has already been applied.
+func idempotent(w http.ResponseWriter, r *http.Request, metric string,
+	apply func(w http.ResponseWriter)) {
+
+	key := r.Header.Get("X-Bucky-Idempotency-Key")
+	if key == "" {
+		apply(w)
+		return
+	}
+
+	applied := uploads.Do(r.Method+" "+metric+" "+key, func() bool {
+		rec := &statusRecorder{w, http.StatusOK}
+		apply(rec)
+		return rec.status < 300
+	})
+	if !applied {
+		log.Printf("Ignoring duplicate %s of %s", r.Method, metric)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIdempotentUpload(t *testing.T) {
+	uploads = newUploadCache(time.Minute)
+	applied := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotent(w, r, "foo.bar", func(w http.ResponseWriter) {
+			applied++
+		})
+	})
+
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/metrics/foo.bar", nil)
+		r.Header.Set("X-Bucky-Idempotency-Key", "abc123")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("Retry %d returned status %d", i, w.Code)
+		}
+	}
+	if applied != 1 {
+		t.Errorf("Retried upload applied %d times", applied)
+	}
+
+	// A different key or no key is a new upload
+	r := httptest.NewRequest("POST", "/metrics/foo.bar", nil)
+	r.Header.Set("X-Bucky-Idempotency-Key", "def456")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/metrics/foo.bar", nil))
+	if applied != 3 {
+		t.Errorf("Expected 3 applied uploads, got %d", applied)
+	}
+}
+
+func TestIdempotentFailedUpload(t *testing.T) {
+	uploads = newUploadCache(time.Minute)
+	applied := 0
+	fail := true
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idempotent(w, r, "foo.bar", func(w http.ResponseWriter) {
+			applied++
+			if fail {
+				http.Error(w, "Disk full", http.StatusInternalServerError)
+			}
+		})
+	})
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/metrics/foo.bar", nil)
+		r.Header.Set("X-Bucky-Idempotency-Key", "abc123")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		fail = false
+	}
+	if applied != 2 {
+		t.Errorf("Retry of a failed upload was not applied")
+	}
+}
+
+func TestUploadCacheConcurrent(t *testing.T) {
+	c := newUploadCache(time.Minute)
+	var lock sync.Mutex
+	applied := 0
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			c.Do("key", func() bool {
+				time.Sleep(10 * time.Millisecond)
+				lock.Lock()
+				applied++
+				lock.Unlock()
+				return true
+			})
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if applied != 1 {
+		t.Errorf("Concurrent duplicates applied %d times", applied)
+	}
+}
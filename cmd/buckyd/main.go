@@ -4,10 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
 )
 
 import . "github.com/jjneely/buckytools"
@@ -21,6 +25,13 @@ var hashring *hashing.JSONRingType
 // sparseFiles defines if we create and manage sparse files.
 var sparseFiles bool
 
+// followSymlinks defines if symbolic links in the data store are followed
+// when listing metrics.
+var followSymlinks bool
+
+// verbose enables logging the details of listing metrics.
+var verbose bool
+
 func usage() {
 	t := []string{
 		"%s [options] <graphite-node1> <graphite-node2> ...\n",
@@ -90,6 +101,18 @@ func main() {
 		fmt.Sprintf("Consistent Hash algorithm to use: %v", SupportedHashTypes))
 	flag.IntVar(&replicas, "replicas", 1,
 		"Number of copies of each metric in the cluster.")
+	flag.StringVar(&maintenanceFile, "maintenance-file", "",
+		"Refuse to alter metrics while this file exists.")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second,
+		"Time in-flight requests have to finish on SIGTERM or SIGINT.")
+	flag.StringVar(&dataDirs, "data-dirs", "",
+		"Comma separated list of additional whisper data stores to serve.")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false,
+		"Follow symbolic links to directories and files when listing metrics.")
+	flag.BoolVar(&verbose, "verbose", false,
+		"Log the symbolic links skipped when listing metrics.")
+	flag.IntVar(&readsPerDir, "reads-per-dir", 0,
+		"Concurrent whisper reads from each data store root.  0 for no limit.")
 	flag.Parse()
 
 	i := sort.SearchStrings(SupportedHashTypes, hashType)
@@ -98,14 +121,27 @@ func main() {
 			SupportedHashTypes)
 	}
 	hashring = parseRing(hostname, hashType, replicas)
+	readLimiter = NewDirLimiter(readsPerDir)
 
 	http.HandleFunc("/", http.NotFound)
 	http.HandleFunc("/metrics", listMetrics)
 	http.HandleFunc("/metrics/", serveMetrics)
+	http.HandleFunc("/metadata/", serveMetadata)
+	http.HandleFunc("/header/", serveHeader)
+	http.HandleFunc("/stat", statList)
 	http.HandleFunc("/hashring", listHashring)
+	http.HandleFunc("/config", serveConfig)
+	http.HandleFunc("/status", serveStatus)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
 
 	log.Printf("Starting server on %s", bindAddress)
-	err = http.ListenAndServe(bindAddress, nil)
+	l, err := net.Listen("tcp", bindAddress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = serve(&http.Server{}, l, sig, shutdownTimeout)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// serveMetadata handles the /metadata/<metric> endpoint which operates on
+// the metadata sidecar kept next to a metric's Whisper DB.
+func serveMetadata(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+
+	metric := r.URL.Path[len("/metadata/"):]
+	if len(metric) == 0 {
+		http.Error(w, "Metric name missing.", http.StatusBadRequest)
+		return
+	}
+	path := uncompressedPath(metricPath(metric)) + MetadataSuffix
+	if inMaintenance() && r.Method != "GET" {
+		w.Header().Set("X-Bucky-Maintenance", "true")
+		http.Error(w, "Node is in read-only maintenance.",
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		blob, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			http.Error(w, "Metadata not found.", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("Error reading metadata %s: %s", path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(blob)
+	case "PUT":
+		writeMetadata(w, r, path)
+	default:
+		http.Error(w, "Bad method request.", http.StatusBadRequest)
+	}
+}
+
+// writeMetadata replaces the metadata sidecar at path with the body of
+// the request.  The sidecar is written to a temporary file and renamed
+// into place so readers never see a partial file.
+func writeMetadata(w http.ResponseWriter, r *http.Request, path string) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Error creating %s: %s", dir, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fd, err := ioutil.TempFile(dir, ".buckyd")
+	if err != nil {
+		log.Printf("Error creating temp file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(fd.Name()) // not concerned with errors here
+
+	_, err = fd.ReadFrom(r.Body)
+	if err == nil {
+		err = fd.Chmod(0644)
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), path)
+	}
+	if err != nil {
+		log.Printf("Error writing metadata %s: %s", path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
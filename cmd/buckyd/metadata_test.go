@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestServeMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { Prefix = p }(Prefix)
+	Prefix = dir
+
+	w := httptest.NewRecorder()
+	serveMetadata(w, httptest.NewRequest("GET", "/metadata/foo.bar", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing sidecar, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	serveMetadata(w, httptest.NewRequest("PUT", "/metadata/foo.bar", strings.NewReader("tags")))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "foo", "bar.wsp"+MetadataSuffix))
+	if err != nil || string(blob) != "tags" {
+		t.Errorf("Sidecar not written next to the metric: %q, %v", blob, err)
+	}
+
+	w = httptest.NewRecorder()
+	serveMetadata(w, httptest.NewRequest("GET", "/metadata/foo.bar", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "tags" {
+		t.Errorf("Expected the sidecar, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"bytes"
+	"encoding/hex"
 	"encoding/json"
+	"hash"
 	"io"
 	"io/ioutil"
 	"log"
@@ -30,7 +32,9 @@ func listMetrics(w http.ResponseWriter, r *http.Request) {
 
 	// Do we need to init the metricsCache?
 	if metricsCache == nil {
-		metricsCache = NewMetricsCache()
+		metricsCache = NewMetricsCacheRoots(dataRoots())
+		metricsCache.SetFollowSymlinks(followSymlinks)
+		metricsCache.SetVerbose(verbose)
 	}
 
 	// XXX: Calling r.FormValue will set a safety limit on the size of
@@ -83,15 +87,66 @@ func listMetrics(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// statList stats each metric given in the JSON encoded list form value
+// and returns a JSON array of the results.  Metrics that are not found
+// locally are left out of the array.  This saves the client a HEAD
+// request per metric for stat only operations.
+func statList(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "POST" {
+		http.Error(w, "Bad request method.", http.StatusBadRequest)
+		return
+	}
+
+	// See listMetrics for the limits on the size of the form
+	if r.ContentLength >= 10<<24 {
+		http.Error(w, "Query larger than 160MiB", http.StatusBadRequest)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 10<<24)
+
+	metrics, err := unmarshalList(r.FormValue("list"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	stats := make([]*MetricData, 0, len(metrics))
+	for _, m := range metrics {
+		stat, err := statMetric(m, metricPath(m))
+		if err != nil {
+			continue
+		}
+		stats = append(stats, stat)
+	}
+
+	blob, err := json.Marshal(stats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error marshaling data: %s", err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
+
 func serveMetrics(w http.ResponseWriter, r *http.Request) {
 	logRequest(r)
 
 	metric := r.URL.Path[len("/metrics/"):]
-	path := MetricToPath(metric)
+	path := metricPath(metric)
 	if len(metric) == 0 {
 		http.Error(w, "Metric name missing.", http.StatusBadRequest)
 		return
 	}
+	if inMaintenance() {
+		w.Header().Set("X-Bucky-Maintenance", "true")
+		if r.Method != "HEAD" && r.Method != "GET" {
+			http.Error(w, "Node is in read-only maintenance.",
+				http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	switch r.Method {
 	case "HEAD":
@@ -118,13 +173,41 @@ func serveMetrics(w http.ResponseWriter, r *http.Request) {
 	case "PUT":
 		// Replace metric data on disk
 		// XXX: Metric will still be deleted if an error in heal occurs
-		err := deleteMetric(w, path, false)
-		if err == nil {
-			healMetric(w, r, path)
-		}
+		idempotent(w, r, metric, func(w http.ResponseWriter) {
+			if r.Header.Get(compressHeader) != "" {
+				// Replace both copies with a gzip compressed DB
+				plain := uncompressedPath(path)
+				err := deleteMetric(w, plain, false)
+				if err == nil {
+					err = deleteMetric(w, plain+gzipSuffix, false)
+				}
+				if err == nil {
+					healGzipMetric(w, r, plain)
+				}
+				return
+			}
+			// A gzip compressed Whisper DB is replaced uncompressed
+			err := deleteMetric(w, path, false)
+			if err == nil {
+				healMetric(w, r, uncompressedPath(path))
+			}
+		})
 	case "POST":
 		// Backfill
-		healMetric(w, r, path)
+		if r.Header.Get(compressHeader) != "" {
+			idempotent(w, r, metric, func(w http.ResponseWriter) {
+				healGzipMetric(w, r, path)
+			})
+			return
+		}
+		if isGzipMetric(path) {
+			http.Error(w, "Can not backfill a gzip compressed metric.",
+				http.StatusNotImplemented)
+			return
+		}
+		idempotent(w, r, metric, func(w http.ResponseWriter) {
+			healMetric(w, r, path)
+		})
 	default:
 		http.Error(w, "Bad method request.", http.StatusBadRequest)
 	}
@@ -142,6 +225,13 @@ func statMetric(metric, path string) (*MetricData, error) {
 	stat := new(MetricData)
 	stat.Name = metric
 	stat.Size = s.Size()
+	if isGzipMetric(path) {
+		// Report the size of the Whisper DB, not the compressed file
+		stat.Size, err = gzipSize(path)
+		if err != nil {
+			return nil, err
+		}
+	}
 	stat.Mode = int64(s.Mode())
 	stat.ModTime = s.ModTime().Unix()
 
@@ -179,14 +269,11 @@ func deleteMetric(w http.ResponseWriter, path string, fatal bool) error {
 	return nil
 }
 
-// healMetric will use the Whisper DB in the body of the request to
-// backfill the metric found at the given filesystem path.  If the metric
-// doesn't exist it will be created as an identical copy of the DB found
-// in the request.
-func healMetric(w http.ResponseWriter, r *http.Request, path string) {
-	var err error
-	var data io.Reader
-
+// readUpload checks that the request r uploads a Whisper DB and returns a
+// reader of the decoded Whisper data, its stat from the X-Metric-Stat
+// header, and the hash and digest to verify the body with if the client
+// sent a checksum.  Problems are reported to the client and ok is false.
+func readUpload(w http.ResponseWriter, r *http.Request) (data io.Reader, stat *MetricData, sum hash.Hash, digest string, ok bool) {
 	// Does this request look sane?
 	if r.Header.Get("Content-Type") != "application/octet-stream" {
 		http.Error(w, "Content-Type must be application/octet-stream.",
@@ -194,12 +281,23 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 		log.Printf("Got send a content-type of %s, abort!", r.Header.Get("Content-Type"))
 		return
 	}
+	// Verify the body as sent if the client gave us its checksum
+	body := io.Reader(r.Body)
+	sum, digest, err := checksumReader(r)
+	if err != nil {
+		log.Printf("Error decoding %s header: %s", ChecksumHeader, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sum != nil {
+		body = io.TeeReader(r.Body, sum)
+	}
 	if r.Header.Get("content-encoding") == "snappy" {
-		data = snappy.NewReader(r.Body)
+		data = snappy.NewReader(body)
 	} else {
-		data = r.Body
+		data = body
 	}
-	stat := new(MetricData)
+	stat = new(MetricData)
 	err = json.Unmarshal([]byte(r.Header.Get("X-Metric-Stat")), &stat)
 	if err != nil {
 		log.Printf("Error decoding X-Metric-Stat header: %s", err)
@@ -212,6 +310,53 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 		http.Error(w, "Whisper data in request too small.", http.StatusBadRequest)
 		return
 	}
+	return data, stat, sum, digest, true
+}
+
+// spoolUpload writes the uploaded Whisper data for path to a temporary
+// file and returns its name once its size and checksum are verified.
+// Problems are reported to the client and ok is false.  The caller
+// removes the file.
+func spoolUpload(w http.ResponseWriter, path string, data io.Reader, stat *MetricData, sum hash.Hash, digest string) (string, bool) {
+	fd, err := ioutil.TempFile(tmpDir, "buckyd")
+	if err != nil {
+		log.Printf("Error creating temp file: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return "", false
+	}
+	nr, err := io.Copy(fd, data)
+	srcName := fd.Name()
+	fd.Close()
+	if err != nil || nr != stat.Size {
+		if err != nil {
+			log.Printf("Error writing to temp file: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			log.Printf("Decoded whisper file data does not match size %d != %d",
+				nr, stat.Size)
+			http.Error(w, "Malformed whisper data", http.StatusBadRequest)
+		}
+		os.Remove(srcName)
+		return "", false
+	}
+	if sum != nil && hex.EncodeToString(sum.Sum(nil)) != digest {
+		log.Printf("Whisper data for %s does not match its checksum", path)
+		http.Error(w, ErrChecksumMismatch.Error(), http.StatusBadRequest)
+		os.Remove(srcName)
+		return "", false
+	}
+	return srcName, true
+}
+
+// healMetric will use the Whisper DB in the body of the request to
+// backfill the metric found at the given filesystem path.  If the metric
+// doesn't exist it will be created as an identical copy of the DB found
+// in the request.
+func healMetric(w http.ResponseWriter, r *http.Request, path string) {
+	data, stat, sum, digest, ok := readUpload(w, r)
+	if !ok {
+		return
+	}
 
 	// Does the destination path on dist exist?
 	dstExists := true
@@ -232,30 +377,14 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 
 	if dstExists {
 		// Write request body to a tmpfile
-		fd, err := ioutil.TempFile(tmpDir, "buckyd")
-		if err != nil {
-			log.Printf("Error creating temp file: %s", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		srcName, ok := spoolUpload(w, path, data, stat, sum, digest)
+		if !ok {
 			return
 		}
-		nr, err := io.Copy(fd, data)
-		srcName := fd.Name()
-		fd.Close()
 		defer os.Remove(srcName) // not concerned with errors here
-		if err != nil || nr != stat.Size {
-			if err != nil {
-				log.Printf("Error writing to temp file: %s", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			} else {
-				log.Printf("Decoded whisper file data does not match size %d != %d",
-					nr, stat.Size)
-				http.Error(w, "Malformed whisper data", http.StatusBadRequest)
-			}
-			return
-		}
 
 		// XXX: How can we check the tmpfile for sanity?
-		err = fill.All(srcName, path)
+		err := fill.All(srcName, path)
 		if err != nil {
 			log.Printf("Error backfilling %s => %s: %s", srcName, path, err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -294,7 +423,34 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 			defer os.Remove(dst.Name()) // not concerned with errors here
 			return
 		}
+		if sum != nil && hex.EncodeToString(sum.Sum(nil)) != digest {
+			log.Printf("Whisper data for %s does not match its checksum", path)
+			http.Error(w, ErrChecksumMismatch.Error(), http.StatusBadRequest)
+			defer os.Remove(dst.Name()) // not concerned with errors here
+			return
+		}
+	}
+}
+
+// checksumReader returns a hash.Hash to verify the request body with and
+// the expected digest if the request has a checksum header.  Otherwise
+// the returned hash.Hash is nil.
+func checksumReader(r *http.Request) (hash.Hash, string, error) {
+	checksum := r.Header.Get(ChecksumHeader)
+	if checksum == "" {
+		return nil, "", nil
 	}
+	return ParseChecksum(checksum)
+}
+
+// notModified returns true if the request has an If-Modified-Since header
+// at or after the modification time of the metric.
+func notModified(r *http.Request, stat *MetricData) bool {
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return stat.ModTime <= since.Unix()
 }
 
 // serveMetric will serve a GET request for the metric that path
@@ -302,7 +458,6 @@ func healMetric(w http.ResponseWriter, r *http.Request, path string) {
 // not in the middle of an update by carbon-cache.  The parameter metric is
 // the dotted notation of the metric name.
 func serveMetric(w http.ResponseWriter, r *http.Request, path, metric string) {
-	var content io.ReadSeeker
 	stat, err := statMetric(metric, path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -312,20 +467,30 @@ func serveMetric(w http.ResponseWriter, r *http.Request, path, metric string) {
 		}
 		return
 	}
-	fd, err := os.Open(path)
+	if notModified(r, stat) {
+		// Skip locking and compressing data the client already has
+		setStatHeader(w, stat)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	release, err := readLimiter.Acquire(r.Context(), dataRoot(path))
 	if err != nil {
-		// I know the file exists
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		// The client went away while waiting
 		return
 	}
-	defer fd.Close()
-	if err = syscall.Flock(int(fd.Fd()), syscall.LOCK_EX); err != nil {
+	// The read slot is only held while reading the disk, not while a
+	// possibly slow client receives the response
+	data, err := readMetric(path)
+	release()
+	if err != nil {
+		log.Printf("Error reading %s: %s", path, err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	var content io.ReadSeeker = bytes.NewReader(data)
 	if r.Header.Get("accept-encoding") == "snappy" {
-		blob, err := copySnappy(fd)
+		blob, err := copySnappy(content)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -339,8 +504,28 @@ func serveMetric(w http.ResponseWriter, r *http.Request, path, metric string) {
 		stat.Encoding = EncSnappy
 		w.Header().Set("content-encoding", "snappy")
 		content = bytes.NewReader(blob.Bytes())
-	} else {
-		content = fd
+	} else if isGzipMetric(path) {
+		// Don't let the .gz name set the content type
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	if algo := r.Header.Get(ChecksumHeader); algo != "" {
+		// Checksum the body as it will be sent
+		h, err := NewChecksum(algo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err = io.Copy(h, content)
+		if err == nil {
+			_, err = content.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			log.Printf("Error checksumming %s: %s", path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(ChecksumHeader, FormatChecksum(algo, h))
 	}
 
 	err = setStatHeader(w, stat)
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestServeMetricNotModified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bar.wsp")
+	ioutil.WriteFile(path, []byte("whisper data"), 0644)
+	mtime := time.Unix(1500000000, 0)
+	os.Chtimes(path, mtime, mtime)
+
+	tests := []struct {
+		since  time.Time
+		status int
+	}{
+		{time.Time{}, http.StatusOK},
+		{mtime.Add(-time.Second), http.StatusOK},
+		{mtime, http.StatusNotModified},
+		{mtime.Add(time.Hour), http.StatusNotModified},
+	}
+	for _, v := range tests {
+		r := httptest.NewRequest("GET", "/metrics/foo.bar", nil)
+		if !v.since.IsZero() {
+			r.Header.Set("If-Modified-Since", v.since.UTC().Format(http.TimeFormat))
+		}
+		w := httptest.NewRecorder()
+		serveMetric(w, r, path, "foo.bar")
+		if w.Code != v.status {
+			t.Errorf("If-Modified-Since %s: expected %d, got %d", v.since, v.status, w.Code)
+		}
+		if w.Header().Get("X-Metric-Stat") == "" {
+			t.Errorf("If-Modified-Since %s: no X-Metric-Stat header", v.since)
+		}
+		if v.status == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("Not modified response has a body")
+		}
+	}
+}
+
+func TestStatList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p string) { Prefix = p }(Prefix)
+	Prefix = dir
+	os.MkdirAll(filepath.Join(dir, "foo"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "foo", "bar.wsp"), []byte("whisper data"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "foo", "baz.wsp"), []byte("data"), 0644)
+
+	form := url.Values{}
+	form.Set("list", `["foo.bar", "foo.missing", "foo.baz"]`)
+	r := httptest.NewRequest("POST", "/stat", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	statList(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	stats := make([]*MetricData, 0)
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("Expected 2 stats, got %d", len(stats))
+	}
+	if stats[0].Name != "foo.bar" || stats[0].Size != 12 {
+		t.Errorf("Bad stat: %v", stats[0])
+	}
+	if stats[1].Name != "foo.baz" || stats[1].Size != 4 {
+		t.Errorf("Bad stat: %v", stats[1])
+	}
+
+	w = httptest.NewRecorder()
+	statList(w, httptest.NewRequest("GET", "/stat", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected GET to be refused, got %d", w.Code)
+	}
+}
+
+func TestMetricChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data := bytes.Repeat([]byte("whisper data"), 10)
+	path := filepath.Join(dir, "bar.wsp")
+	ioutil.WriteFile(path, data, 0644)
+
+	// GET returns the checksum of the body in the requested algorithm
+	sum, _ := Checksum("sha256", data)
+	r := httptest.NewRequest("GET", "/metrics/foo.bar", nil)
+	r.Header.Set(ChecksumHeader, "sha256")
+	w := httptest.NewRecorder()
+	serveMetric(w, r, path, "foo.bar")
+	if w.Header().Get(ChecksumHeader) != sum {
+		t.Errorf("Expected checksum %s, got %s", sum, w.Header().Get(ChecksumHeader))
+	}
+	if !bytes.Equal(w.Body.Bytes(), data) {
+		t.Errorf("Body changed by checksumming")
+	}
+
+	r = httptest.NewRequest("GET", "/metrics/foo.bar", nil)
+	r.Header.Set(ChecksumHeader, "crc32")
+	w = httptest.NewRecorder()
+	serveMetric(w, r, path, "foo.bar")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected unsupported algorithm to fail, got %d", w.Code)
+	}
+
+	// Uploads that do not match their checksum are not written
+	stat := `{"Name": "foo.new", "Size": 120}`
+	bad, _ := Checksum("md5", []byte("other data"))
+	for checksum, status := range map[string]int{sum: http.StatusOK, bad: http.StatusBadRequest} {
+		dst := filepath.Join(dir, "new.wsp")
+		os.Remove(dst)
+		r = httptest.NewRequest("PUT", "/metrics/foo.new", bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/octet-stream")
+		r.Header.Set("X-Metric-Stat", stat)
+		r.Header.Set(ChecksumHeader, checksum)
+		w = httptest.NewRecorder()
+		healMetric(w, r, dst)
+		if w.Code != status {
+			t.Errorf("Checksum %s: expected %d, got %d", checksum, status, w.Code)
+		}
+		_, err := os.Stat(dst)
+		if status == http.StatusOK && err != nil {
+			t.Errorf("Upload not written: %s", err)
+		} else if status != http.StatusOK && err == nil {
+			t.Errorf("Upload with a bad checksum was written")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// readsPerDir is the number of whisper files that may be read at once
+// from each data store root.  0 is no limit.
+var readsPerDir int
+
+// readLimiter limits the concurrent reads of each data store root.
+var readLimiter *DirLimiter
+
+// DirLimiter caps the number of concurrent reads from each directory so
+// that a node with data stores on several disks reads from all of them in
+// parallel without making any one disk seek between many files.  A nil
+// DirLimiter is no limit.
+type DirLimiter struct {
+	limit int
+	lock  sync.Mutex
+	slots map[string]chan struct{}
+}
+
+// NewDirLimiter returns a DirLimiter allowing limit concurrent reads from
+// each directory.  A limit of 0 or less is no limit.
+func NewDirLimiter(limit int) *DirLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &DirLimiter{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// Acquire waits for a free read slot of dir or until ctx is cancelled,
+// such as by the client going away.  It returns the function that
+// releases the slot.
+func (l *DirLimiter) Acquire(ctx context.Context, dir string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	l.lock.Lock()
+	slot, ok := l.slots[dir]
+	if !ok {
+		slot = make(chan struct{}, l.limit)
+		l.slots[dir] = slot
+	}
+	l.lock.Unlock()
+
+	select {
+	case slot <- struct{}{}:
+		return func() { <-slot }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dataRoot returns the data store root that holds path, the longest of
+// dataRoots() that path is under, or -prefix.
+func dataRoot(path string) string {
+	root := dataRoots()[0]
+	longest := -1
+	for _, r := range dataRoots() {
+		r = filepath.Clean(r)
+		if strings.HasPrefix(path, r+string(filepath.Separator)) && len(r) > longest {
+			root, longest = r, len(r)
+		}
+	}
+	return root
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestDirLimiter(t *testing.T) {
+	l := NewDirLimiter(1)
+	release, err := l.Acquire(context.Background(), "/disk1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another disk is read in parallel
+	other, err := l.Acquire(context.Background(), "/disk2")
+	if err != nil {
+		t.Fatalf("A read of another directory waited: %s", err)
+	}
+	other()
+
+	// The same disk waits for the read in progress
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := l.Acquire(ctx, "/disk1"); err == nil {
+		t.Errorf("A second read of the same directory did not wait")
+	}
+	release()
+	again, err := l.Acquire(context.Background(), "/disk1")
+	if err != nil {
+		t.Fatalf("Read slot was not released: %s", err)
+	}
+	again()
+
+	none := NewDirLimiter(0)
+	for i := 0; i < 3; i++ {
+		if _, err := none.Acquire(ctx, "/disk1"); err != nil {
+			t.Errorf("No limit waited: %s", err)
+		}
+	}
+}
+
+func TestDataRoot(t *testing.T) {
+	defer func(p, d string) { Prefix, dataDirs = p, d }(Prefix, dataDirs)
+	Prefix = "/data/whisper"
+	dataDirs = "/data/whisper/big,/disk2"
+
+	tests := map[string]string{
+		"/data/whisper/foo/bar.wsp":     "/data/whisper",
+		"/data/whisper/big/foo/bar.wsp": "/data/whisper/big",
+		"/disk2/foo/bar.wsp.gz":         "/disk2",
+		"/disk20/foo/bar.wsp":           "/data/whisper",
+	}
+	for path, root := range tests {
+		if r := dataRoot(filepath.Clean(path)); r != root {
+			t.Errorf("dataRoot(%s) = %s, expected %s", path, r, root)
+		}
+	}
+}
+
+// slotWriter records if the read slot of dir is free when the response
+// is written.
+type slotWriter struct {
+	*httptest.ResponseRecorder
+	dir  string
+	free bool
+}
+
+func (w *slotWriter) Write(p []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if release, err := readLimiter.Acquire(ctx, w.dir); err == nil {
+		w.free = true
+		release()
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestServeMetricReleasesSlot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(p, d string, l *DirLimiter) { Prefix, dataDirs, readLimiter = p, d, l }(Prefix, dataDirs, readLimiter)
+	Prefix, dataDirs = dir, ""
+	readLimiter = NewDirLimiter(1)
+	path := filepath.Join(dir, "bar.wsp")
+	ioutil.WriteFile(path, []byte("whisper data"), 0644)
+
+	// A slow client does not hold the read slot of the disk
+	w := &slotWriter{ResponseRecorder: httptest.NewRecorder(), dir: dir}
+	serveMetric(w, httptest.NewRequest("GET", "/metrics/foo.bar", nil), path, "foo.bar")
+	if w.Body.String() != "whisper data" {
+		t.Errorf("Expected the metric, got %q", w.Body.String())
+	}
+	if !w.free {
+		t.Errorf("Read slot was held while writing the response")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+// dataDirs is a comma separated list of additional whisper data stores
+// served along with the one given by -prefix.
+var dataDirs string
+
+// dataRoots returns the whisper data store roots this daemon serves.  The
+// -prefix root is always first.
+func dataRoots() []string {
+	roots := []string{Prefix}
+	for _, d := range strings.Split(dataDirs, ",") {
+		d = strings.TrimSpace(d)
+		if d == "" || filepath.Clean(d) == filepath.Clean(Prefix) {
+			continue
+		}
+		roots = append(roots, d)
+	}
+	return roots
+}
+
+// metricPath returns the absolute path of the whisper file for metric in
+// the first data store root where it exists.  Within a root an uncompressed
+// whisper file is preferred over one stored gzip compressed.  Metrics that
+// exist in no root are placed under -prefix so that new metrics are always
+// created there.
+func metricPath(metric string) string {
+	rel := MetricToRelative(metric)
+	for _, root := range dataRoots() {
+		p := filepath.Join(root, rel)
+		for _, path := range []string{p, p + gzipSuffix} {
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return MetricToPath(metric)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+import . "github.com/jjneely/buckytools/metrics"
+
+func TestDataRoots(t *testing.T) {
+	first, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(first)
+	second, err := ioutil.TempDir("", "buckyd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(second)
+	defer func(p, d string) { Prefix, dataDirs = p, d }(Prefix, dataDirs)
+	Prefix = first
+	dataDirs = second + "," + first
+
+	os.MkdirAll(filepath.Join(first, "foo"), 0755)
+	os.MkdirAll(filepath.Join(second, "foo"), 0755)
+	ioutil.WriteFile(filepath.Join(first, "foo", "bar.wsp"), []byte("first"), 0644)
+	ioutil.WriteFile(filepath.Join(second, "foo", "bar.wsp"), []byte("second"), 0644)
+	ioutil.WriteFile(filepath.Join(second, "foo", "baz.wsp"), []byte("second root"), 0644)
+
+	if roots := dataRoots(); len(roots) != 2 || roots[0] != first || roots[1] != second {
+		t.Errorf("Expected roots [%s %s], got %v", first, second, roots)
+	}
+
+	// The first root wins, metrics missing everywhere belong to -prefix
+	tests := map[string]string{
+		"foo.bar":     filepath.Join(first, "foo", "bar.wsp"),
+		"foo.baz":     filepath.Join(second, "foo", "baz.wsp"),
+		"foo.missing": filepath.Join(first, "foo", "missing.wsp"),
+	}
+	for metric, path := range tests {
+		if p := metricPath(metric); p != path {
+			t.Errorf("Expected %s at %s, got %s", metric, path, p)
+		}
+	}
+
+	// A metric only in the second root is served from there
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics/foo.baz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "second root" {
+		t.Errorf("Expected the second root's data, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The inventory is the union of the roots
+	cache := NewMetricsCacheRoots(dataRoots())
+	cache.RefreshCache()
+	metrics, ok := cache.GetMetrics()
+	if !ok {
+		t.Fatalf("Metrics cache is not available")
+	}
+	if len(metrics) != 2 || metrics[0] != "foo.bar" || metrics[1] != "foo.baz" {
+		t.Errorf("Expected [foo.bar foo.baz], got %v", metrics)
+	}
+}
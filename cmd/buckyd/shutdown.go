@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// shutdownTimeout is how long in-flight requests have to complete once
+// buckyd is asked to stop.
+var shutdownTimeout time.Duration
+
+// serve answers HTTP requests on l with srv until a signal arrives on sig.
+// New connections are then refused and in-flight requests are given
+// timeout to complete.  Connections still active after the timeout are
+// closed and their clients must retry.  An error is returned only if the
+// server fails.
+func serve(srv *http.Server, l net.Listener, sig <-chan os.Signal, timeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case s := <-sig:
+		log.Printf("Received %s, draining in-flight requests for up to %s", s, timeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Closing connections still active after %s: %s", timeout, err)
+		srv.Close()
+	} else {
+		log.Printf("In-flight requests drained, exiting.")
+	}
+	if err := <-errs; err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// shutdownServer starts serve with a handler that takes delay to answer
+// and returns the URL, signal channel, and the channel serve returns on.
+func shutdownServer(t *testing.T, delay, timeout time.Duration) (string, chan os.Signal, chan error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("whisper data"))
+	})}
+	sig := make(chan os.Signal, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(srv, l, sig, timeout)
+	}()
+	return "http://" + l.Addr().String() + "/metrics/foo.bar", sig, done
+}
+
+func TestServeDrains(t *testing.T) {
+	u, sig, done := shutdownServer(t, 300*time.Millisecond, 5*time.Second)
+
+	// Signal while the request is in flight
+	time.AfterFunc(100*time.Millisecond, func() { sig <- syscall.SIGTERM })
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("In-flight request failed: %s", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "whisper data" {
+		t.Errorf("In-flight response cut off: %q %v", body, err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown returned %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server did not shut down")
+	}
+
+	// No new requests are accepted
+	if _, err := http.Get(u); err == nil {
+		t.Errorf("Request accepted after shutdown")
+	}
+}
+
+func TestServeDrainTimeout(t *testing.T) {
+	u, sig, done := shutdownServer(t, 2*time.Second, 100*time.Millisecond)
+
+	time.AfterFunc(100*time.Millisecond, func() { sig <- syscall.SIGTERM })
+	start := time.Now()
+	if resp, err := http.Get(u); err == nil {
+		resp.Body.Close()
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown returned %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server did not shut down")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Shutdown waited %s past the timeout", time.Since(start))
+	}
+}
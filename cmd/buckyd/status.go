@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// maintenanceFile is a file system path.  While this file exists the
+// daemon is in read-only maintenance and refuses requests that would
+// alter metrics.
+var maintenanceFile string
+
+// StatusType is the JSON encoded response of the /status endpoint.
+type StatusType struct {
+	Name        string
+	Maintenance bool
+}
+
+// inMaintenance returns true if this daemon is in read-only maintenance.
+func inMaintenance() bool {
+	if maintenanceFile == "" {
+		return false
+	}
+	_, err := os.Stat(maintenanceFile)
+	return err == nil
+}
+
+// serveStatus reports the state of this daemon to the client.
+func serveStatus(w http.ResponseWriter, r *http.Request) {
+	logRequest(r)
+	if r.Method != "GET" {
+		http.Error(w, "Bad Request.", http.StatusBadRequest)
+		return
+	}
+
+	status := StatusType{
+		Name:        hashring.Name,
+		Maintenance: inMaintenance(),
+	}
+	blob, err := json.Marshal(status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		log.Printf("Error marshalling data: %s", err)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(blob)
+	}
+}
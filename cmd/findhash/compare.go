@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// Move is a metric key whose owner differs between two hash rings.
+type Move struct {
+	Key string
+	Old hashing.Node
+	New hashing.Node
+}
+
+// nodeName formats a Node as SERVER:INSTANCE as in the key analysis.
+func nodeName(n hashing.Node) string {
+	return fmt.Sprintf("%s:%s", n.Server, n.Instance)
+}
+
+// makeFixedRing builds the hash ring of a complete configuration.  Nodes
+// without an instance keep carbon's None instance.
+func makeFixedRing(config []string) *hashing.CarbonHashRing {
+	hr := hashing.NewCarbonHashRing()
+	for _, n := range config {
+		hr.AddNode(parseNode(n, false))
+	}
+
+	return hr
+}
+
+// makeReplicaRing builds the hash ring of a complete configuration with
+// the given number of replicas, the virtual nodes each member is placed
+// at on the ring.
+func makeReplicaRing(config []string, replicas int) *hashing.CarbonHashRing {
+	hr := hashing.NewCarbonHashRing()
+	hr.SetReplicas(replicas)
+	for _, n := range config {
+		hr.AddNode(parseNode(n, false))
+	}
+
+	return hr
+}
+
+// readKeys returns the metric keys in the newline delimited file.  A file
+// of "-" reads the keys from STDIN.
+func readKeys(file string) ([]string, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0)
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if len(l) > 0 {
+			keys = append(keys, l)
+		}
+	}
+	return keys, nil
+}
+
+// CompareRings returns the keys that are owned by a different node in the
+// proposed hash ring than in the current one.
+func CompareRings(current, proposed hashing.HashRing, keys []string) []Move {
+	moves := make([]Move, 0)
+	for _, k := range keys {
+		o := current.GetNode(k)
+		n := proposed.GetNode(k)
+		if !hashing.NodeCmp(o, n) {
+			moves = append(moves, Move{k, o, n})
+		}
+	}
+	return moves
+}
+
+// printMoves writes each move followed by the total moved and the number
+// of keys moving to each destination.
+func printMoves(w io.Writer, moves []Move, total int) {
+	inflow := make(map[string]int)
+	for _, m := range moves {
+		fmt.Fprintf(w, "%s\t%s -> %s\n", m.Key, nodeName(m.Old), nodeName(m.New))
+		inflow[nodeName(m.New)]++
+	}
+
+	percent := float64(0)
+	if total > 0 {
+		percent = float64(len(moves)) / float64(total) * 100
+	}
+	fmt.Fprintf(w, "\nMoved: %d of %d metric keys (%.2f%%)\n", len(moves), total, percent)
+
+	nodes := make([]string, 0)
+	for k := range inflow {
+		nodes = append(nodes, k)
+	}
+	sort.Strings(nodes)
+	fmt.Fprintf(w, "Inflow per node:\n")
+	for _, k := range nodes {
+		fmt.Fprintf(w, "%s\t%d\n", k, inflow[k])
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompareRings(t *testing.T) {
+	current := makeFixedRing([]string{"graphite010:a", "graphite011:b", "graphite012:"})
+	proposed := makeFixedRing([]string{"graphite010:a", "graphite011:b", "graphite012:", "graphite013:d"})
+
+	keys := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("foo.bar%d.baz", i))
+	}
+
+	moves := CompareRings(current, proposed, keys)
+	if len(moves) == 0 || len(moves) > 500 {
+		t.Fatalf("Expected about a quarter of keys to move, got %d", len(moves))
+	}
+	for _, m := range moves {
+		// Adding a node only moves keys to the new node
+		if m.New.Server != "graphite013" || m.Old.Server == "graphite013" {
+			t.Errorf("Unexpected move: %v", m)
+		}
+		if !strings.HasPrefix(m.Key, "foo.bar") {
+			t.Errorf("Bad key: %s", m.Key)
+		}
+	}
+	if moves := CompareRings(current, current, keys); len(moves) != 0 {
+		t.Errorf("Identical rings moved %d keys", len(moves))
+	}
+
+	buf := new(bytes.Buffer)
+	printMoves(buf, moves, len(keys))
+	out := buf.String()
+	first := fmt.Sprintf("%s\t%s -> graphite013:d\n", moves[0].Key, nodeName(moves[0].Old))
+	if !strings.HasPrefix(out, first) {
+		t.Errorf("Expected output to start with %q, got %q", first, out[:len(first)])
+	}
+	summary := fmt.Sprintf("Moved: %d of 1000 metric keys", len(moves))
+	if !strings.Contains(out, summary) {
+		t.Errorf("Missing summary %q in %s", summary, out)
+	}
+	if !strings.Contains(out, fmt.Sprintf("graphite013:d\t%d\n", len(moves))) {
+		t.Errorf("Missing inflow in %s", out)
+	}
+}
+
+func TestParseNode(t *testing.T) {
+	tests := map[string]string{
+		"graphite010":        "graphite010:2003=None",
+		"graphite010:a":      "graphite010:2003=a",
+		"graphite010:2004":   "graphite010:2004=None",
+		"graphite010:2004:a": "graphite010:2004=a",
+		"graphite010:":       "graphite010:2003=None",
+	}
+	for in, expected := range tests {
+		if n := parseNode(in, false).String(); n != expected {
+			t.Errorf("%s: expected %s, got %s", in, expected, n)
+		}
+	}
+	if n := parseNode("graphite010", true); n.Instance == "" {
+		t.Errorf("Expected a guessed instance")
+	}
+}
+
+func TestCompareReplicas(t *testing.T) {
+	config := []string{"graphite010:a", "graphite011:b", "graphite012:", "graphite013:d"}
+	keys := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("foo.bar%d.baz", i))
+	}
+
+	current := makeReplicaRing(config, 100)
+	if current.Replicas() != 100 || current.Len() != len(config) {
+		t.Fatalf("Bad ring: %s", current)
+	}
+	if moves := CompareRings(current, makeFixedRing(config), keys); len(moves) != 0 {
+		t.Errorf("The default ring has 100 replicas, %d keys moved", len(moves))
+	}
+
+	// The same nodes with more replicas shift some, but not all, owners
+	moves := CompareRings(current, makeReplicaRing(config, 200), keys)
+	if len(moves) == 0 || len(moves) == len(keys) {
+		t.Errorf("Expected some keys to move, got %d", len(moves))
+	}
+	for _, m := range moves {
+		if m.Old.Server == m.New.Server {
+			t.Errorf("Key %s did not change owner: %v", m.Key, m)
+		}
+	}
+}
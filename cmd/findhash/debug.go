@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+import "github.com/jjneely/buckytools/hashing"
+
+// printNeighbors writes the ring position of key and the k ring entries on
+// either side of it.  The entry that owns key is marked with a *.
+func printNeighbors(w io.Writer, hr *hashing.CarbonHashRing, key string, k int) error {
+	e, err := hashing.Explain(hr, key, 0)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Key: %s\n", key)
+	fmt.Fprintf(w, "Position: 0x%04x\n", e.Position)
+	fmt.Fprintf(w, "Owner: %s\n", nodeName(e.Node))
+	fmt.Fprintf(w, "Neighbors:\n")
+	for _, n := range hr.Neighbors(key, k) {
+		mark := " "
+		if n.Index == e.Index {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%s %d\t0x%04x\t%s\n", mark, n.Index, n.Position, nodeName(n.Node))
+	}
+	return nil
+}
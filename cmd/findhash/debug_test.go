@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestPrintNeighbors(t *testing.T) {
+	hr := makeFixedRing([]string{"graphite010:a", "graphite011:b", "graphite012:"})
+	buf := new(bytes.Buffer)
+	if err := printNeighbors(buf, hr, "foo.bar.baz", 2); err != nil {
+		t.Fatalf("Error printing neighbors: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 8 {
+		t.Fatalf("Expected 4 header lines and 4 neighbors, got:\n%s", buf.String())
+	}
+	owner := nodeName(hr.GetNode("foo.bar.baz"))
+	if lines[2] != "Owner: "+owner {
+		t.Errorf("Bad owner line: %s", lines[2])
+	}
+	// The owner is the first entry after the key's position
+	if !strings.HasPrefix(lines[6], "* ") || !strings.HasSuffix(lines[6], owner) {
+		t.Errorf("Owning entry not marked: %s", lines[6])
+	}
+	for _, l := range append(lines[4:6], lines[7]) {
+		if strings.HasPrefix(l, "*") {
+			t.Errorf("Unexpected mark: %s", l)
+		}
+	}
+}
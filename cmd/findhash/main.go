@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
@@ -95,37 +96,48 @@ func printAnalysis(hr *hashing.CarbonHashRing) {
 	fmt.Printf("Deviation: %.4f\n", math.Sqrt(v))
 }
 
+// parseNode parses a SERVER[:PORT][:INSTANCE] line of the hash ring
+// configuration.  With guess set a missing instance is given a random
+// value to search for, otherwise it is left empty as carbon's None.
+func parseNode(n string, guess bool) hashing.Node {
+	instance := ""
+	if guess {
+		instance = uuid.New()
+	}
+	fields := strings.Split(n, ":")
+	if len(fields) == 1 {
+		fields = append(fields, "2003")
+		fields = append(fields, instance)
+	} else if len(fields) == 2 {
+		_, err := strconv.Atoi(fields[1])
+		if err != nil {
+			// assume instance
+			fields = append(fields, fields[1])
+			fields[1] = "2003"
+		} else {
+			fields = append(fields, instance)
+		}
+	} else {
+		// 3 or more fields
+		fields = fields[:3]
+	}
+	if fields[1] == "" {
+		fields[1] = "2003"
+	}
+	if fields[2] == "" {
+		fields[2] = instance
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		port = 2003
+	}
+	return hashing.NewNode(fields[0], int(port), fields[2])
+}
+
 func makeRing(config []string) *hashing.CarbonHashRing {
 	hr := hashing.NewCarbonHashRing()
 	for _, n := range config {
-		fields := strings.Split(n, ":")
-		if len(fields) == 1 {
-			fields = append(fields, "2003")
-			fields = append(fields, uuid.New())
-		} else if len(fields) == 2 {
-			_, err := strconv.Atoi(fields[1])
-			if err != nil {
-				// assume instance
-				fields = append(fields, fields[1])
-				fields[1] = "2003"
-			} else {
-				fields = append(fields, uuid.New())
-			}
-		} else {
-			// 3 or more fields
-			fields = fields[:3]
-		}
-		if fields[1] == "" {
-			fields[1] = "2003"
-		}
-		if fields[2] == "" {
-			fields[2] = uuid.New()
-		}
-		port, err := strconv.ParseUint(fields[1], 10, 16)
-		if err != nil {
-			port = 2003
-		}
-		hr.AddNode(hashing.NewNode(fields[0], int(port), fields[2]))
+		hr.AddNode(parseNode(n, true))
 	}
 
 	return hr
@@ -162,6 +174,16 @@ func main() {
 		"Print Hashring analysis of given configuration")
 	keys := flag.String("keys", "",
 		"Print analysis of key distribution using keys from the newline delimited file")
+	compare := flag.String("compare", "",
+		"Print the keys from -keys that move to a new node in this proposed hash ring configuration")
+	replicas := flag.Int("replicas", 0,
+		"Print the keys from -keys that move to a new node when the ring has this many replicas")
+	currentReplicas := flag.Int("current-replicas", 100,
+		"Replicas of the current hash ring compared against with -replicas")
+	debug := flag.String("debug", "",
+		"Print the ring position, owner, and neighboring ring entries of this metric key")
+	neighbors := flag.Int("neighbors", 3,
+		"Ring entries on either side of the key printed with -debug")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
@@ -169,6 +191,44 @@ func main() {
 	}
 
 	config := getConfig(flag.Arg(0))
+	if *debug != "" {
+		if *neighbors < 1 {
+			log.Fatalf("The -neighbors option must be at least 1")
+		}
+		if err := printNeighbors(os.Stdout, makeFixedRing(config), *debug, *neighbors); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		return
+	}
+	if *compare != "" {
+		if *keys == "" {
+			log.Fatalf("The -compare option requires -keys")
+		}
+		sample, err := readKeys(*keys)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		moves := CompareRings(makeFixedRing(config),
+			makeFixedRing(getConfig(*compare)), sample)
+		printMoves(os.Stdout, moves, len(sample))
+		return
+	}
+	if *replicas > 0 {
+		if *keys == "" {
+			log.Fatalf("The -replicas option requires -keys")
+		}
+		if *currentReplicas < 1 {
+			log.Fatalf("The -current-replicas option must be at least 1")
+		}
+		sample, err := readKeys(*keys)
+		if err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+		moves := CompareRings(makeReplicaRing(config, *currentReplicas),
+			makeReplicaRing(config, *replicas), sample)
+		printMoves(os.Stdout, moves, len(sample))
+		return
+	}
 	if *analyze {
 		hr := makeRing(config)
 		printAnalysis(hr)
@@ -0,0 +1,104 @@
+package hashing
+
+import (
+	"fmt"
+)
+
+// RingOption configures the hash ring built by NewHashRingWith.
+type RingOption func(*ringConfig) error
+
+// ringConfig is the configuration collected from the RingOptions.
+type ringConfig struct {
+	algo     string
+	replicas int
+	diverse  bool
+	nodes    []Node
+}
+
+// HashType selects the consistent hash algorithm: carbon, fnv1a, or
+// jump_fnv1a.  The default is carbon.
+func HashType(algo string) RingOption {
+	return func(c *ringConfig) error {
+		c.algo = algo
+		return nil
+	}
+}
+
+// Replicas sets the replicas of the ring.  For the carbon and fnv1a rings
+// this is the number of times each node is placed on the ring, 100 by
+// default.  For the jump_fnv1a ring it is the number of Nodes returned by
+// GetNodes, 1 by default.
+func Replicas(n int) RingOption {
+	return func(c *ringConfig) error {
+		if n < 1 {
+			return fmt.Errorf("Replicas must be at least 1, got %d", n)
+		}
+		c.replicas = n
+		return nil
+	}
+}
+
+// DiverseReplicas returns at most one Node of each server from GetNodes
+// as carbon does with DIVERSE_REPLICAS.  Only the carbon and fnv1a rings
+// support it.
+func DiverseReplicas() RingOption {
+	return func(c *ringConfig) error {
+		c.diverse = true
+		return nil
+	}
+}
+
+// Nodes adds nodes to the ring in the order given.  It may be used more
+// than once.
+func Nodes(nodes ...Node) RingOption {
+	return func(c *ringConfig) error {
+		c.nodes = append(c.nodes, nodes...)
+		return nil
+	}
+}
+
+// NewHashRingWith returns a hash ring configured by opts with its nodes
+// added and ready to be queried.  The replicas are always set before any
+// node is added, whatever the order of opts.  It is equivalent to creating
+// the ring, calling SetReplicas, and then AddNode for each node.
+func NewHashRingWith(opts ...RingOption) (HashRing, error) {
+	c := &ringConfig{algo: "carbon"}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, err
+		}
+	}
+
+	var hr HashRing
+	switch c.algo {
+	case "carbon":
+		chr := NewCarbonHashRing()
+		if c.replicas > 0 {
+			chr.SetReplicas(c.replicas)
+		}
+		chr.SetDiverseReplicas(c.diverse)
+		hr = chr
+	case "fnv1a":
+		fhr := NewFNV1aHashRing()
+		if c.replicas > 0 {
+			fhr.SetReplicas(c.replicas)
+		}
+		fhr.SetDiverseReplicas(c.diverse)
+		hr = fhr
+	case "jump_fnv1a":
+		if c.diverse {
+			return nil, fmt.Errorf("The jump_fnv1a ring does not support diverse replicas")
+		}
+		if c.replicas == 0 {
+			c.replicas = 1
+		}
+		hr = NewJumpHashRing(c.replicas)
+	default:
+		return nil, fmt.Errorf("Unknown consistent hash algorithm: %s", c.algo)
+	}
+
+	for _, n := range c.nodes {
+		hr.AddNode(n)
+	}
+	return hr, nil
+}
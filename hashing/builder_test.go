@@ -0,0 +1,64 @@
+package hashing
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestNewHashRingWith(t *testing.T) {
+	nodes := []Node{
+		NewNode("graphite010-g5", 2003, "a"),
+		NewNode("graphite011-g5", 2003, "b"),
+		NewNode("graphite012-g5", 2003, ""),
+		NewNode("graphite013-g5", 2003, "c"),
+	}
+
+	carbon := NewCarbonHashRing()
+	carbon.SetReplicas(150)
+	fnv := NewFNV1aHashRing()
+	fnv.SetReplicas(150)
+	jump := NewJumpHashRing(2)
+	for _, n := range nodes {
+		carbon.AddNode(n)
+		fnv.AddNode(n)
+		jump.AddNode(n)
+	}
+	defaults := NewCarbonHashRing()
+	for _, n := range nodes {
+		defaults.AddNode(n)
+	}
+
+	tests := []struct {
+		opts []RingOption
+		want HashRing
+	}{
+		// Replicas take effect even when given after the nodes
+		{[]RingOption{Nodes(nodes...), Replicas(150)}, carbon},
+		{[]RingOption{HashType("fnv1a"), Replicas(150), Nodes(nodes[:2]...), Nodes(nodes[2:]...)}, fnv},
+		{[]RingOption{HashType("jump_fnv1a"), Replicas(2), Nodes(nodes...)}, jump},
+		{[]RingOption{Nodes(nodes...)}, defaults},
+	}
+	for i, test := range tests {
+		hr, err := NewHashRingWith(test.opts...)
+		if err != nil {
+			t.Fatalf("Test %d: error building ring: %s", i, err)
+		}
+		if !reflect.DeepEqual(hr, test.want) {
+			t.Errorf("Test %d: built %s, expected %s", i, hr, test.want)
+		}
+		for j := 0; j < 100; j++ {
+			key := fmt.Sprintf("foo.bar.metric%d", j)
+			if a, b := hr.GetNode(key), test.want.GetNode(key); a != b {
+				t.Errorf("Test %d: %s maps to %v, expected %v", i, key, a, b)
+			}
+		}
+	}
+
+	if _, err := NewHashRingWith(HashType("md5")); err == nil {
+		t.Errorf("Expected an error for an unknown hash type")
+	}
+	if _, err := NewHashRingWith(Replicas(0)); err == nil {
+		t.Errorf("Expected an error for 0 replicas")
+	}
+}
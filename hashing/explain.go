@@ -0,0 +1,178 @@
+package hashing
+
+import (
+	"fmt"
+)
+
+// RingPosition is a read-only view of one entry in a position based hash
+// ring.  Index is the entry's place in the sorted ring.
+type RingPosition struct {
+	Index    int
+	Position int
+	Node     Node
+}
+
+// PositionRing is implemented by hash rings that map keys and nodes to
+// positions on a 16 bit ring such as the carbon and fnv1a rings.
+type PositionRing interface {
+	HashRing
+
+	// Position returns the ring position of key.
+	Position(key string) int
+
+	// Entries returns a copy of the ring entries in ring order.
+	Entries() []RingPosition
+
+	// Neighbors returns up to k ring entries on either side of the point
+	// key is inserted at, in ring order and wrapping around the ring.
+	// The first of the entries after the insertion point owns key.
+	Neighbors(key string, k int) []RingPosition
+}
+
+// Explanation details how a key is routed to a node in a PositionRing.
+type Explanation struct {
+	// Key is the metric key and HashedKey is the key after any key
+	// transformation and NormalizeMetric.  HashedKey is what the ring
+	// position is computed from.
+	Key       string
+	HashedKey string
+
+	// Position is the ring position of HashedKey.
+	Position int
+
+	// Bisect is the index the position bisects the ring at.  This is the
+	// first entry with a position greater than or equal to Position.
+	// When the position is past the last entry Bisect equals Size and
+	// Wrapped is true.
+	Bisect  int
+	Wrapped bool
+
+	// Index is the entry chosen after wrapping around the ring and Node
+	// is the node that owns it.
+	Index int
+	Node  Node
+
+	// Size is the number of entries in the ring.
+	Size int
+
+	// Entries are the ring entries surrounding Index in routing order.
+	Entries []RingPosition
+}
+
+// Collisions returns the entries in the explanation that share the chosen
+// entry's position.  The ring orders these by server and instance.
+func (e *Explanation) Collisions() []RingPosition {
+	result := make([]RingPosition, 0)
+	for _, r := range e.Entries {
+		if r.Position == e.Entries[e.chosen()].Position && r.Index != e.Index {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// chosen returns the offset of the chosen entry in Entries.
+func (e *Explanation) chosen() int {
+	for i, r := range e.Entries {
+		if r.Index == e.Index {
+			return i
+		}
+	}
+	return 0
+}
+
+// Explain routes key through ring and records each step.  Up to context
+// entries on either side of the chosen entry are included.  Rings wrapped
+// by NewKeyTransformRing are explained using the transformed key.
+func Explain(ring HashRing, key string, context int) (*Explanation, error) {
+	e := &Explanation{Key: key, HashedKey: key}
+	if t, ok := ring.(*KeyTransformRing); ok {
+		e.HashedKey = t.transform(key)
+		ring = t.HashRing
+	}
+	e.HashedKey = NormalizeMetric(e.HashedKey)
+	pr, ok := ring.(PositionRing)
+	if !ok {
+		return nil, fmt.Errorf("Hash ring %T has no ring positions to explain", ring)
+	}
+
+	entries := pr.Entries()
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("HashRing is empty")
+	}
+	e.Size = len(entries)
+	e.Position = pr.Position(e.HashedKey)
+	for e.Bisect = 0; e.Bisect < e.Size; e.Bisect++ {
+		if entries[e.Bisect].Position >= e.Position {
+			break
+		}
+	}
+	e.Wrapped = e.Bisect == e.Size
+	e.Index = mod(e.Bisect, e.Size)
+	e.Node = entries[e.Index].Node
+
+	if 2*context+1 > e.Size {
+		context = (e.Size - 1) / 2
+	}
+	for i := -context; i <= context; i++ {
+		e.Entries = append(e.Entries, entries[(e.Index+i+e.Size)%e.Size])
+	}
+	return e, nil
+}
+
+// entries returns a copy of ring as a slice of RingPosition.
+func entries(ring []RingEntry) []RingPosition {
+	result := make([]RingPosition, len(ring))
+	for i, e := range ring {
+		result[i] = RingPosition{i, e.position, e.node}
+	}
+	return result
+}
+
+// neighbors returns up to k entries of ring before and after the point
+// e bisects the ring at.  The ring has fewer than 2k entries when the
+// result holds every entry once.
+func neighbors(ring []RingEntry, e RingEntry, k int) []RingPosition {
+	n := len(ring)
+	if n == 0 || k < 1 {
+		return []RingPosition{}
+	}
+	before, after := k, k
+	if before+after > n {
+		after = (n + 1) / 2
+		before = n - after
+	}
+	index := mod(bisectLeft(ring, e), n)
+	result := make([]RingPosition, 0, before+after)
+	for i := index - before; i < index+after; i++ {
+		j := (i + n) % n
+		result = append(result, RingPosition{j, ring[j].position, ring[j].node})
+	}
+	return result
+}
+
+func (t *CarbonHashRing) Position(key string) int {
+	return computeCarbonRingPosition(NormalizeMetric(key))
+}
+
+func (t *CarbonHashRing) Entries() []RingPosition {
+	return entries(t.ring)
+}
+
+func (t *CarbonHashRing) Neighbors(key string, k int) []RingPosition {
+	key = NormalizeMetric(key)
+	return neighbors(t.ring, RingEntry{computeCarbonRingPosition(key), NewNode(key, 0, "")}, k)
+}
+
+func (t *FNV1aHashRing) Position(key string) int {
+	return computeFNV1aRingPosition(NormalizeMetric(key))
+}
+
+func (t *FNV1aHashRing) Entries() []RingPosition {
+	return entries(t.ring)
+}
+
+func (t *FNV1aHashRing) Neighbors(key string, k int) []RingPosition {
+	key = NormalizeMetric(key)
+	return neighbors(t.ring, RingEntry{computeFNV1aRingPosition(key), NewNode(key, 0, "")}, k)
+}
@@ -0,0 +1,121 @@
+package hashing
+
+import (
+	"testing"
+)
+
+// explainRing returns a carbon ring with 2 replicas of nodes a, b, and c.
+// Computed with Python's hashlib the entries are:
+//
+//	0: 0x6e0e c    1: 0x77f5 a    2: 0x98e4 c
+//	3: 0xc3c1 b    4: 0xcd8d b    5: 0xd050 a
+func explainRing() *CarbonHashRing {
+	ring := NewCarbonHashRing()
+	ring.SetReplicas(2)
+	for _, s := range []string{"a", "b", "c"} {
+		ring.AddNode(NewNode(s, 0, ""))
+	}
+	return ring
+}
+
+func TestExplain(t *testing.T) {
+	ring := explainRing()
+	positions := []int{0x6e0e, 0x77f5, 0x98e4, 0xc3c1, 0xcd8d, 0xd050}
+	for i, e := range ring.Entries() {
+		if e.Index != i || e.Position != positions[i] {
+			t.Fatalf("Ring entry %d is at 0x%x, expected 0x%x", i, e.Position, positions[i])
+		}
+	}
+
+	tests := []struct {
+		key      string
+		position int
+		index    int
+		wrapped  bool
+		server   string
+	}{
+		{"a.b.c", 0x553f, 0, false, "c"},
+		{"x", 0x9dd4, 3, false, "b"},
+		// Past the last entry the key wraps to the first
+		{"z", 0xfbad, 0, true, "c"},
+		// A key at an entry's exact position routes to that entry
+		{"('a', None):0", 0x77f5, 1, false, "a"},
+	}
+	for _, v := range tests {
+		e, err := Explain(ring, v.key, 1)
+		if err != nil {
+			t.Fatalf("Error explaining %s: %s", v.key, err)
+		}
+		if e.Position != v.position || e.Index != v.index || e.Wrapped != v.wrapped {
+			t.Errorf("%s: position 0x%x index %d wrapped %v", v.key, e.Position, e.Index, e.Wrapped)
+		}
+		if e.Node.Server != v.server || !NodeCmp(e.Node, ring.GetNode(v.key)) {
+			t.Errorf("%s: explained %s, GetNode routes to %s", v.key, e.Node, ring.GetNode(v.key))
+		}
+		if e.Wrapped && e.Bisect != e.Size {
+			t.Errorf("%s: wrapped with bisect index %d", v.key, e.Bisect)
+		}
+		if len(e.Entries) != 3 || e.Entries[1].Index != v.index {
+			t.Errorf("%s: bad surrounding entries %v", v.key, e.Entries)
+		}
+	}
+
+	// Surrounding entries wrap around the ring
+	e, _ := Explain(ring, "a.b.c", 2)
+	for i, index := range []int{4, 5, 0, 1, 2} {
+		if e.Entries[i].Index != index {
+			t.Errorf("Expected entry %d at offset %d, got %v", index, i, e.Entries)
+		}
+	}
+	if len(e.Collisions()) != 0 {
+		t.Errorf("Unexpected collisions: %v", e.Collisions())
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	ring := explainRing()
+	tests := []struct {
+		key     string
+		k       int
+		indexes []int
+	}{
+		{"a.b.c", 1, []int{5, 0}},
+		{"x", 2, []int{1, 2, 3, 4}},
+		// Past the last entry the neighborhood wraps to the first
+		{"z", 2, []int{4, 5, 0, 1}},
+		// A small ring holds every entry once
+		{"x", 5, []int{0, 1, 2, 3, 4, 5}},
+		{"x", 0, []int{}},
+	}
+	for _, v := range tests {
+		n := ring.Neighbors(v.key, v.k)
+		if len(n) != len(v.indexes) {
+			t.Errorf("%s: expected %d neighbors, got %v", v.key, len(v.indexes), n)
+			continue
+		}
+		for i, index := range v.indexes {
+			if n[i].Index != index {
+				t.Errorf("%s: expected entry %d at offset %d, got %v", v.key, index, i, n)
+			}
+		}
+		if v.k > 0 && v.k <= 3 && !NodeCmp(n[v.k].Node, ring.GetNode(v.key)) {
+			t.Errorf("%s: first entry after the key is %s, GetNode routes to %s",
+				v.key, n[v.k].Node, ring.GetNode(v.key))
+		}
+	}
+}
+
+func TestExplainTransformed(t *testing.T) {
+	ring := NewKeyTransformRing(explainRing(), TaggedBaseName)
+	e, err := Explain(ring, "x;host=a", 1)
+	if err != nil {
+		t.Fatalf("Error explaining: %s", err)
+	}
+	if e.HashedKey != "x" || e.Index != 3 {
+		t.Errorf("Transformed key explained as %s at index %d", e.HashedKey, e.Index)
+	}
+
+	if _, err := Explain(NewJumpHashRing(1), "x", 1); err == nil {
+		t.Errorf("Jump hash ring explained without ring positions")
+	}
+}
@@ -11,6 +11,7 @@ type FNV1aHashRing struct {
 	ring     []RingEntry
 	nodes    []Node
 	replicas int
+	diverse  bool
 }
 
 func NewFNV1aHashRing() *FNV1aHashRing {
@@ -56,6 +57,12 @@ func (t *FNV1aHashRing) SetReplicas(r int) {
 	t.replicas = r
 }
 
+// SetDiverseReplicas makes GetNodes return at most one Node of each
+// server like CarbonHashRing.SetDiverseReplicas.
+func (t *FNV1aHashRing) SetDiverseReplicas(diverse bool) {
+	t.diverse = diverse
+}
+
 func (t *FNV1aHashRing) AddNode(node Node) {
 	t.nodes = append(t.nodes, node)
 	for i := 0; i < t.replicas; i++ {
@@ -90,6 +97,7 @@ func (t *FNV1aHashRing) RemoveNode(node Node) {
 }
 
 func (t *FNV1aHashRing) GetNode(key string) Node {
+	key = NormalizeMetric(key)
 	if len(t.ring) == 0 {
 		panic("HashRing is empty")
 	}
@@ -100,26 +108,14 @@ func (t *FNV1aHashRing) GetNode(key string) Node {
 }
 
 func (t *FNV1aHashRing) GetNodes(key string) []Node {
+	key = NormalizeMetric(key)
 	if len(t.ring) == 0 {
 		panic("HashRing is empty")
 	}
 
-	result := make([]Node, 0)
-	seen := make(map[string]bool)
 	e := RingEntry{computeFNV1aRingPosition(key), NewNode(key, 0, "")}
 	index := mod(bisectLeft(t.ring, e), len(t.ring))
-	last := index - 1
-
-	for len(seen) < len(t.nodes) && index != last {
-		next := t.ring[index]
-		if !seen[next.node.String()] {
-			seen[next.node.String()] = true
-			result = append(result, next.node)
-		}
-		index = mod((index + 1), len(t.ring))
-	}
-
-	return result
+	return ringNodes(t.ring, index, len(t.nodes), t.diverse)
 }
 
 func (t *FNV1aHashRing) BucketsPerNode() map[string]int {
@@ -31,6 +31,7 @@ type JSONRingType struct {
 // HashRing is an interface that allows us to plug in multiple hash ring
 // implementations.
 type HashRing interface {
+	Placement
 
 	// Len returns the number of Nodes or servers in the hash ring.
 	Len() int
@@ -70,6 +71,7 @@ type CarbonHashRing struct {
 	ring     []RingEntry
 	nodes    []Node
 	replicas int
+	diverse  bool
 }
 
 // String marshals a JSONRingType into its string representation
@@ -81,6 +83,19 @@ func (j *JSONRingType) String() string {
 	return string(blob)
 }
 
+// RingConfig holds the parameters a buckyd daemon's hash ring was
+// configured with.  Every member of a cluster must agree on them.
+type RingConfig struct {
+	Name     string
+	Algo     string
+	Replicas int
+}
+
+// Config returns the parameters of the ring.
+func (j *JSONRingType) Config() RingConfig {
+	return RingConfig{Name: j.Name, Algo: j.Algo, Replicas: j.Replicas}
+}
+
 // NewCarbonHashRing sets up a new CarbonHashRing and returns it.
 func NewCarbonHashRing() *CarbonHashRing {
 	var chr = new(CarbonHashRing)
@@ -102,7 +117,9 @@ func NewNode(server string, port int, instance string) (n Node) {
 
 // NewNodeParser parses a HOST[:PORT][=INSTANCE] format string and builds a
 // Node object which is returned.  An error is returned if the string could
-// not be parsed.
+// not be parsed.  This is the grammar carbon-c-relay uses for its hosts so
+// the text after = is always the carbon instance.  It is never a weight as
+// carbon's rings have none and the instance is part of the ring position.
 func NewNodeParser(s string) (Node, error) {
 	var (
 		state    int
@@ -199,7 +216,11 @@ func bisectLeft(ring []RingEntry, e RingEntry) (i int) {
 }
 
 // cmp compares two RingEntry variables similar to the way that the Python
-// code in hashing.py compares nodes in the hashring.
+// code in hashing.py compares nodes in the hashring.  Entries at the same
+// position are ordered by server, instance, and finally port so that the
+// ring is a total order and a key routes to the same node regardless of
+// the order the nodes were added in.  Only nodes that differ solely in
+// their port can be placed differently than by hashing.py.
 func cmp(a, b RingEntry) int {
 	if a.position < b.position {
 		return -1
@@ -224,6 +245,15 @@ func cmp(a, b RingEntry) int {
 		return 1
 	}
 
+	// Python has no port to compare but the ring must not depend on
+	// insertion order
+	if a.node.Port < b.node.Port {
+		return -1
+	}
+	if a.node.Port > b.node.Port {
+		return 1
+	}
+
 	// Out of crazy mess to compare -- must be equal
 	return 0
 }
@@ -299,6 +329,14 @@ func (t *CarbonHashRing) SetReplicas(r int) {
 	t.replicas = r
 }
 
+// SetDiverseReplicas makes GetNodes return at most one Node of each
+// server, skipping the other instances of a server already chosen, as
+// carbon does with DIVERSE_REPLICAS so that no two replicas of a key share
+// a machine.
+func (t *CarbonHashRing) SetDiverseReplicas(diverse bool) {
+	t.diverse = diverse
+}
+
 func (t *CarbonHashRing) AddNode(node Node) {
 	//log.Printf("insertRing(): %s", node.CarbonKeyValue())
 	t.nodes = append(t.nodes, node)
@@ -334,6 +372,7 @@ func (t *CarbonHashRing) RemoveNode(node Node) {
 }
 
 func (t *CarbonHashRing) GetNode(key string) Node {
+	key = NormalizeMetric(key)
 	if len(t.ring) == 0 {
 		panic("HashRing is empty")
 	}
@@ -352,23 +391,35 @@ func (t *CarbonHashRing) GetNode(key string) Node {
 }
 
 func (t *CarbonHashRing) GetNodes(key string) []Node {
+	key = NormalizeMetric(key)
 	if len(t.ring) == 0 {
 		panic("HashRing is empty")
 	}
 
-	result := make([]Node, 0)
-	seen := make(map[string]bool)
 	e := RingEntry{computeCarbonRingPosition(key), NewNode(key, 0, "")}
 	index := mod(bisectLeft(t.ring, e), len(t.ring))
+	return ringNodes(t.ring, index, len(t.nodes), t.diverse)
+}
+
+// ringNodes walks ring from index and returns each distinct Node in the
+// order found until all n Nodes have been seen.  With diverse only the
+// first Node of each server is returned.
+func ringNodes(ring []RingEntry, index, n int, diverse bool) []Node {
+	result := make([]Node, 0)
+	seen := make(map[string]bool)
+	servers := make(map[string]bool)
 	last := index - 1
 
-	for len(seen) < len(t.nodes) && index != last {
-		next := t.ring[index]
+	for len(seen) < n && index != last {
+		next := ring[index]
 		if !seen[next.node.String()] {
 			seen[next.node.String()] = true
-			result = append(result, next.node)
+			if !diverse || !servers[next.node.Server] {
+				servers[next.node.Server] = true
+				result = append(result, next.node)
+			}
 		}
-		index = mod((index + 1), len(t.ring))
+		index = mod((index + 1), len(ring))
 	}
 
 	return result
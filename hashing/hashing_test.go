@@ -106,6 +106,31 @@ func TestNewNode(t *testing.T) {
 	}
 }
 
+func TestNewNodeParser(t *testing.T) {
+	expected := map[string]Node{
+		"graphite010-g5":        NewNode("graphite010-g5", 0, ""),
+		"graphite010-g5:2004":   NewNode("graphite010-g5", 2004, ""),
+		"graphite010-g5=a":      NewNode("graphite010-g5", 0, "a"),
+		"graphite010-g5:2004=2": NewNode("graphite010-g5", 2004, "2"),
+	}
+	for s, e := range expected {
+		n, err := NewNodeParser(s)
+		if err != nil {
+			t.Errorf("Error parsing %s: %s", s, err)
+			continue
+		}
+		if !NodeCmp(n, e) {
+			t.Errorf("Parsed %s as %s, expected %s", s, n, e)
+		}
+	}
+
+	for _, s := range []string{"graphite010-g5:2004:a", "graphite010-g5=a=2", "graphite010-g5:port"} {
+		if n, err := NewNodeParser(s); err == nil {
+			t.Errorf("Expected %s to fail, got %s", s, n)
+		}
+	}
+}
+
 func TestNewHashRing(t *testing.T) {
 	hr := NewCarbonHashRing()
 	hr.SetReplicas(5)
@@ -150,3 +175,81 @@ func TestGraphiteCompatible(t *testing.T) {
 		}
 	}
 }
+
+func TestInsertionOrder(t *testing.T) {
+	// Nodes that differ only in port collide on every ring position
+	nodes := []Node{
+		NewNode("graphite010", 2003, ""),
+		NewNode("graphite010", 2004, ""),
+		NewNode("graphite011", 2003, "a"),
+		NewNode("graphite011", 2004, "a"),
+		NewNode("graphite012", 0, "b"),
+	}
+	rings := []struct {
+		forward, reverse HashRing
+	}{
+		{NewCarbonHashRing(), NewCarbonHashRing()},
+		{NewFNV1aHashRing(), NewFNV1aHashRing()},
+	}
+	for _, r := range rings {
+		for i := range nodes {
+			r.forward.AddNode(nodes[i])
+			r.reverse.AddNode(nodes[len(nodes)-1-i])
+		}
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("foo.bar.metric%d", i)
+			a, b := r.forward.GetNode(key), r.reverse.GetNode(key)
+			if !NodeCmp(a, b) {
+				t.Errorf("%T routes %s to %s or %s by insertion order", r.forward, key, a, b)
+				break
+			}
+		}
+	}
+}
+
+func TestDiverseReplicas(t *testing.T) {
+	plain := makeRing()
+	diverse := makeRing()
+	diverse.SetDiverseReplicas(true)
+	fnv, err := NewHashRingWith(HashType("fnv1a"), DiverseReplicas(), Nodes(plain.Nodes()...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fnvPlain, _ := NewHashRingWith(HashType("fnv1a"), Nodes(plain.Nodes()...))
+
+	shared := 0
+	for _, rings := range [][2]HashRing{{plain, diverse}, {fnvPlain, fnv}} {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("foo.bar.metric%d", i)
+			all := rings[0].GetNodes(key)
+			if all[0].Server == all[1].Server {
+				shared++
+			}
+
+			// Carbon walks the same distinct nodes skipping servers
+			// already used
+			expected := make([]Node, 0)
+			used := make(map[string]bool)
+			for _, n := range all {
+				if !used[n.Server] {
+					used[n.Server] = true
+					expected = append(expected, n)
+				}
+			}
+			got := rings[1].GetNodesN(key, 3)
+			if fmt.Sprint(got) != fmt.Sprint(expected[:3]) {
+				t.Errorf("%s: expected replicas %v, got %v", key, expected[:3], got)
+			}
+			if got[0] != all[0] {
+				t.Errorf("%s: diverse replicas changed the primary", key)
+			}
+		}
+	}
+	if shared == 0 {
+		t.Errorf("No key had two instances of one server as replicas, test is ineffective")
+	}
+
+	if _, err := NewHashRingWith(HashType("jump_fnv1a"), DiverseReplicas()); err == nil {
+		t.Errorf("Expected an error for diverse replicas on the jump ring")
+	}
+}
@@ -121,6 +121,7 @@ func (chr *JumpHashRing) RemoveNode(node Node) {
 // GetNode returns a bucket for the given key using Google's Jump Hash
 // algorithm.
 func (chr *JumpHashRing) GetNode(key string) Node {
+	key = NormalizeMetric(key)
 	var key64 uint64 = Fnv1a64([]byte(key))
 	idx := Jump(key64, len(chr.ring))
 	//fmt.Printf("JUMP: %s => %x => %d\n", key, key64, idx)
@@ -130,6 +131,7 @@ func (chr *JumpHashRing) GetNode(key string) Node {
 // GetNodes returns a slice of Node objects one for each replica where the
 // object is stored.
 func (chr *JumpHashRing) GetNodes(key string) []Node {
+	key = NormalizeMetric(key)
 	ring := make([]Node, 0)
 	ret := make([]Node, 0)
 	h := Fnv1a64([]byte(key))
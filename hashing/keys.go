@@ -0,0 +1,103 @@
+package hashing
+
+import (
+	"sort"
+	"strings"
+)
+
+// KeyTransforms maps the names of key transformations to functions that
+// normalize a metric key before it is hashed.  This lets the hash ring
+// match how the cluster's relays route Graphite tagged metrics of the form
+// name;tag1=value1;tag2=value2.
+//
+//	none    The key is hashed as is.
+//	tagged  Tags are sorted as carbon does with TaggedSeries.parse() before
+//	        routing.  "cpu;host=a;dc=x" is hashed as "cpu;dc=x;host=a".
+//	name    Only the name before the first ";" is hashed.  All series of a
+//	        tagged metric are stored on the same node.
+var KeyTransforms = map[string]func(string) string{
+	"none":   func(key string) string { return key },
+	"tagged": CanonicalTaggedKey,
+	"name":   TaggedBaseName,
+}
+
+// CanonicalTaggedKey returns the canonical form of a tagged metric key
+// as produced by carbon's TaggedSeries.format().  Each tag is formatted as
+// ";tag=value" and the formatted tags are sorted and appended to the name.
+// If a tag is repeated the last value wins.  Keys without tags or with
+// malformed tags are returned unchanged.
+func CanonicalTaggedKey(key string) string {
+	parts := strings.Split(key, ";")
+	if len(parts) == 1 {
+		return key
+	}
+
+	tags := make(map[string]string)
+	for _, t := range parts[1:] {
+		i := strings.Index(t, "=")
+		if i < 1 || i == len(t)-1 {
+			return key
+		}
+		tags[t[:i]] = t[i+1:]
+	}
+	name := parts[0]
+	if v, ok := tags["name"]; ok {
+		name = v
+		delete(tags, "name")
+	}
+
+	formatted := make([]string, 0, len(tags))
+	for tag, value := range tags {
+		formatted = append(formatted, ";"+tag+"="+value)
+	}
+	sort.Strings(formatted)
+	return name + strings.Join(formatted, "")
+}
+
+// NormalizeMetric returns the canonical form of a metric name as carbon
+// stores it.  Repeated dots are collapsed and leading and trailing dots are
+// removed so "foo..bar." becomes "foo.bar".  Only the name of a tagged
+// metric key is normalized; its tags are kept as is.  Every HashRing in
+// this package normalizes keys before placing them.
+func NormalizeMetric(name string) string {
+	tags := ""
+	if i := strings.Index(name, ";"); i >= 0 {
+		name, tags = name[:i], name[i:]
+	}
+	if !strings.Contains(name, "..") && !strings.HasPrefix(name, ".") &&
+		!strings.HasSuffix(name, ".") {
+		return name + tags
+	}
+
+	fields := strings.FieldsFunc(name, func(r rune) bool { return r == '.' })
+	return strings.Join(fields, ".") + tags
+}
+
+// TaggedBaseName returns the name portion of a tagged metric key.
+func TaggedBaseName(key string) string {
+	if i := strings.Index(key, ";"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// KeyTransformRing is a HashRing that transforms keys before they are
+// hashed by the wrapped HashRing.
+type KeyTransformRing struct {
+	HashRing
+	transform func(string) string
+}
+
+// NewKeyTransformRing returns ring wrapped so that transform is applied
+// to each key before hashing.
+func NewKeyTransformRing(ring HashRing, transform func(string) string) *KeyTransformRing {
+	return &KeyTransformRing{ring, transform}
+}
+
+func (t *KeyTransformRing) GetNode(key string) Node {
+	return t.HashRing.GetNode(t.transform(key))
+}
+
+func (t *KeyTransformRing) GetNodes(key string) []Node {
+	return t.HashRing.GetNodes(t.transform(key))
+}
@@ -0,0 +1,109 @@
+package hashing
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCanonicalTaggedKey(t *testing.T) {
+	tests := map[string]string{
+		"foo.bar":                       "foo.bar",
+		"cpu;host=a;dc=x":               "cpu;dc=x;host=a",
+		"cpu;dc=x;host=a":               "cpu;dc=x;host=a",
+		"cpu;host=a;host=b":             "cpu;host=b",
+		"cpu;name=mem;host=a":           "mem;host=a",
+		"cpu;a=1;aa=2;a.b=3":            "cpu;a.b=3;a=1;aa=2",
+		"disk.used;mount=/var;dev=sda1": "disk.used;dev=sda1;mount=/var",
+		"cpu;broken":                    "cpu;broken",
+		"cpu;=x":                        "cpu;=x",
+	}
+	for key, expected := range tests {
+		if result := CanonicalTaggedKey(key); result != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, result)
+		}
+	}
+}
+
+func TestTaggedBaseName(t *testing.T) {
+	if TaggedBaseName("cpu;host=a") != "cpu" || TaggedBaseName("foo.bar") != "foo.bar" {
+		t.Errorf("Bad base name")
+	}
+}
+
+func TestKeyTransformRing(t *testing.T) {
+	base := makeRing()
+	ring := NewKeyTransformRing(base, KeyTransforms["tagged"])
+
+	// Carbon routes tagged series by their canonical form so every tag
+	// order must land on the node that owns the canonical key.
+	canonical := "cpu.usage;dc=east;host=web01;role=frontend"
+	owner := base.GetNode(canonical)
+	for _, key := range []string{
+		"cpu.usage;host=web01;dc=east;role=frontend",
+		"cpu.usage;role=frontend;host=web01;dc=east",
+		canonical,
+	} {
+		if n := ring.GetNode(key); !NodeCmp(n, owner) {
+			t.Errorf("%s routed to %s, carbon routes to %s", key, n, owner)
+		}
+		nodes := ring.GetNodes(key)
+		if len(nodes) == 0 || !NodeCmp(nodes[0], owner) {
+			t.Errorf("%s: GetNodes does not agree with GetNode", key)
+		}
+	}
+
+	named := NewKeyTransformRing(base, KeyTransforms["name"])
+	if n := named.GetNode("cpu.usage;host=web01"); !NodeCmp(n, base.GetNode("cpu.usage")) {
+		t.Errorf("Base name transform routed to %s", n)
+	}
+}
+
+func TestNormalizeMetric(t *testing.T) {
+	tests := map[string]string{
+		"foo.bar":              "foo.bar",
+		"foo..bar":             "foo.bar",
+		"foo...bar..baz":       "foo.bar.baz",
+		".foo.bar":             "foo.bar",
+		"foo.bar.":             "foo.bar",
+		"..foo..bar..":         "foo.bar",
+		"cpu..usage;dc=a..b":   "cpu.usage;dc=a..b",
+		"cpu.usage;host=web01": "cpu.usage;host=web01",
+		"":                     "",
+	}
+	for name, expected := range tests {
+		if result := NormalizeMetric(name); result != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, result)
+		}
+	}
+}
+
+func TestNormalizedPlacement(t *testing.T) {
+	rings := map[string]HashRing{
+		"carbon":     makeRing(),
+		"fnv1a":      NewFNV1aHashRing(),
+		"jump":       NewJumpHashRing(1),
+		"rendezvous": NewRendezvousHash(2),
+	}
+	for name, ring := range rings {
+		if name != "carbon" {
+			for _, n := range placementNodes() {
+				ring.AddNode(n)
+			}
+		}
+		for i := 0; i < 100; i++ {
+			canonical := fmt.Sprintf("foo.bar.metric%d", i)
+			for _, raw := range []string{
+				fmt.Sprintf("foo..bar.metric%d", i),
+				fmt.Sprintf(".foo.bar..metric%d.", i),
+			} {
+				if a, b := ring.GetNode(raw), ring.GetNode(canonical); !NodeCmp(a, b) {
+					t.Errorf("%s: %s routed to %s, %s to %s", name, raw, a, canonical, b)
+				}
+				a, b := ring.GetNodes(raw), ring.GetNodes(canonical)
+				if len(a) != len(b) || !NodeCmp(a[0], b[0]) {
+					t.Errorf("%s: GetNodes differs for %s", name, raw)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package hashing
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Placement decides which Nodes store a key.  Every HashRing is a
+// Placement so that alternate strategies such as RendezvousHash can be
+// swapped in for the consistent hash rings.
+type Placement interface {
+	// GetNode returns the Node that owns key.
+	GetNode(key string) Node
+
+	// GetNodesN returns up to n distinct Nodes for key in order of
+	// preference.  The first is the Node returned by GetNode.
+	GetNodesN(key string, n int) []Node
+}
+
+// firstNodes returns at most the first n Nodes of nodes.
+func firstNodes(nodes []Node, n int) []Node {
+	if n < len(nodes) {
+		return nodes[:n]
+	}
+	return nodes
+}
+
+func (t *CarbonHashRing) GetNodesN(key string, n int) []Node {
+	return firstNodes(t.GetNodes(key), n)
+}
+
+func (t *FNV1aHashRing) GetNodesN(key string, n int) []Node {
+	return firstNodes(t.GetNodes(key), n)
+}
+
+// GetNodesN returns at most n of the Nodes returned by GetNodes which are
+// limited by the replicas of the ring.
+func (chr *JumpHashRing) GetNodesN(key string, n int) []Node {
+	return firstNodes(chr.GetNodes(key), n)
+}
+
+func (t *KeyTransformRing) GetNodesN(key string, n int) []Node {
+	return t.HashRing.GetNodesN(t.transform(key), n)
+}
+
+// RendezvousHash places keys with rendezvous or highest random weight
+// hashing.  Each Node is scored against the key and the highest scores
+// win.  Adding or removing a Node only moves the keys that Node wins or
+// owned.
+//
+// This is NOT compatible with carbon-cache.py, carbon-relay, or
+// carbon-c-relay routing.  Use it only with clusters where buckytools
+// manages placement.
+type RendezvousHash struct {
+	nodes    []Node
+	replicas int
+}
+
+// NewRendezvousHash returns an empty RendezvousHash that stores each key
+// on replicas Nodes.
+func NewRendezvousHash(replicas int) *RendezvousHash {
+	if replicas < 1 {
+		replicas = 1
+	}
+	return &RendezvousHash{make([]Node, 0), replicas}
+}
+
+// rendezvousScore returns the weight of node for key.  The FNV-1a hash of
+// the pair is mixed with XorShift for better spread.
+func rendezvousScore(node Node, key string) uint64 {
+	return XorShift(Fnv1a64([]byte(node.String() + "\x00" + key)))
+}
+
+func (r *RendezvousHash) String() string {
+	servers := make([]string, 0)
+	for _, n := range r.nodes {
+		servers = append(servers, n.String())
+	}
+	return fmt.Sprintf("[rendezvous: %d nodes, %d replicas %s]",
+		len(r.nodes), r.replicas, strings.Join(servers, " "))
+}
+
+func (r *RendezvousHash) Len() int {
+	return len(r.nodes)
+}
+
+func (r *RendezvousHash) Nodes() []Node {
+	return r.nodes
+}
+
+func (r *RendezvousHash) Replicas() int {
+	return r.replicas
+}
+
+func (r *RendezvousHash) AddNode(node Node) {
+	r.nodes = append(r.nodes, node)
+}
+
+func (r *RendezvousHash) RemoveNode(node Node) {
+	for i := 0; i < len(r.nodes); {
+		if NodeCmp(node, r.nodes[i]) {
+			r.nodes = append(r.nodes[:i], r.nodes[i+1:]...)
+		} else {
+			i++
+		}
+	}
+}
+
+func (r *RendezvousHash) GetNode(key string) Node {
+	key = NormalizeMetric(key)
+	if len(r.nodes) == 0 {
+		panic("HashRing is empty")
+	}
+	best := r.nodes[0]
+	score := rendezvousScore(best, key)
+	for _, n := range r.nodes[1:] {
+		if s := rendezvousScore(n, key); s > score {
+			best, score = n, s
+		}
+	}
+	return best
+}
+
+// GetNodes returns the Nodes for each replica of key.
+func (r *RendezvousHash) GetNodes(key string) []Node {
+	return r.GetNodesN(key, r.replicas)
+}
+
+func (r *RendezvousHash) GetNodesN(key string, n int) []Node {
+	key = NormalizeMetric(key)
+	if len(r.nodes) == 0 {
+		panic("HashRing is empty")
+	}
+	scores := make(map[string]uint64)
+	nodes := make([]Node, len(r.nodes))
+	copy(nodes, r.nodes)
+	for _, node := range nodes {
+		scores[node.String()] = rendezvousScore(node, key)
+	}
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return scores[nodes[i].String()] > scores[nodes[j].String()]
+	})
+	return firstNodes(nodes, n)
+}
@@ -0,0 +1,107 @@
+package hashing
+
+import (
+	"fmt"
+	"testing"
+)
+
+// checkDistribution places count keys with p and fails if any of the
+// nodes receives a share more than tolerance away from an even split.
+func checkDistribution(t *testing.T, name string, p Placement, nodes []Node, count int, tolerance float64) {
+	hits := make(map[string]int)
+	for i := 0; i < count; i++ {
+		hits[p.GetNode(fmt.Sprintf("carbon.agents.host%d.metric%d", i%97, i)).String()]++
+	}
+	even := float64(count) / float64(len(nodes))
+	for _, n := range nodes {
+		share := float64(hits[n.String()]) / even
+		if share < 1-tolerance || share > 1+tolerance {
+			t.Errorf("%s: %s received %d keys, expected about %.0f", name, n, hits[n.String()], even)
+		}
+	}
+}
+
+func placementNodes() []Node {
+	nodes := make([]Node, 0)
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, NewNode(fmt.Sprintf("graphite%03d", i), 0, ""))
+	}
+	return nodes
+}
+
+func TestPlacementDistribution(t *testing.T) {
+	nodes := placementNodes()
+	carbon := NewCarbonHashRing()
+	rendezvous := NewRendezvousHash(2)
+	for _, n := range nodes {
+		carbon.AddNode(n)
+		rendezvous.AddNode(n)
+	}
+
+	// The 16 bit carbon ring with 100 replicas per node is lumpy
+	checkDistribution(t, "carbon", carbon, nodes, 100000, 0.35)
+	checkDistribution(t, "rendezvous", rendezvous, nodes, 100000, 0.05)
+}
+
+func TestPlacementGetNodesN(t *testing.T) {
+	nodes := placementNodes()
+	rendezvous := NewRendezvousHash(2)
+	carbon := NewCarbonHashRing()
+	for _, n := range nodes {
+		rendezvous.AddNode(n)
+		carbon.AddNode(n)
+	}
+
+	for _, p := range []Placement{rendezvous, carbon} {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("foo.bar.%d", i)
+			result := p.GetNodesN(key, 3)
+			if len(result) != 3 || !NodeCmp(result[0], p.GetNode(key)) {
+				t.Fatalf("%T: bad nodes for %s: %v", p, key, result)
+			}
+			if NodeCmp(result[0], result[1]) || NodeCmp(result[1], result[2]) || NodeCmp(result[0], result[2]) {
+				t.Errorf("%T: duplicate nodes for %s: %v", p, key, result)
+			}
+		}
+	}
+	if len(rendezvous.GetNodes("foo")) != 2 {
+		t.Errorf("Rendezvous GetNodes did not honor replicas")
+	}
+}
+
+func TestRendezvousAddNode(t *testing.T) {
+	nodes := placementNodes()
+	r := NewRendezvousHash(1)
+	for _, n := range nodes[:9] {
+		r.AddNode(n)
+	}
+	before := make(map[string]Node)
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("foo.bar.%d", i)
+		before[key] = r.GetNode(key)
+	}
+
+	// Only keys won by the new node move
+	r.AddNode(nodes[9])
+	moved := 0
+	for key, n := range before {
+		after := r.GetNode(key)
+		if NodeCmp(after, n) {
+			continue
+		}
+		if !NodeCmp(after, nodes[9]) {
+			t.Fatalf("%s moved from %s to %s", key, n, after)
+		}
+		moved++
+	}
+	if moved < 800 || moved > 1200 {
+		t.Errorf("Expected about 1000 keys to move, %d moved", moved)
+	}
+
+	r.RemoveNode(nodes[9])
+	for key, n := range before {
+		if !NodeCmp(r.GetNode(key), n) {
+			t.Fatalf("%s did not return to %s", key, n)
+		}
+	}
+}
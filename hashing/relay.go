@@ -0,0 +1,156 @@
+package hashing
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RelayCluster is a cluster definition parsed from a carbon-c-relay
+// configuration file.
+type RelayCluster struct {
+	Name     string
+	Type     string
+	Replicas int
+	Nodes    []Node
+}
+
+// relayAlgos maps the carbon-c-relay consistent hashing cluster types to
+// the hash ring algorithm names used by buckytools.
+var relayAlgos = map[string]string{
+	"carbon_ch":     "carbon",
+	"fnv1a_ch":      "fnv1a",
+	"jump_fnv1a_ch": "jump_fnv1a",
+}
+
+// relayHostOptions are the keywords that may follow a host in a
+// carbon-c-relay cluster and the number of arguments each takes.
+var relayHostOptions = map[string]int{
+	"proto":     1,
+	"type":      1,
+	"transport": 1,
+	"ssl":       0,
+	"mtls":      2,
+}
+
+// relayStatements splits a carbon-c-relay configuration into statements.
+// Each statement is a slice of whitespace separated tokens that ended
+// with a ";".  Comments are removed.
+func relayStatements(r io.Reader) ([][]string, error) {
+	statements := make([][]string, 0)
+	current := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.Replace(line, ";", " ; ", -1)
+		for _, token := range strings.Fields(line) {
+			if token == ";" {
+				if len(current) > 0 {
+					statements = append(statements, current)
+				}
+				current = make([]string, 0)
+			} else {
+				current = append(current, token)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		return nil, fmt.Errorf("Statement not terminated by ';': %s",
+			strings.Join(current, " "))
+	}
+	return statements, nil
+}
+
+// parseRelayCluster parses the tokens of a cluster statement.
+func parseRelayCluster(tokens []string) (*RelayCluster, error) {
+	if len(tokens) < 3 {
+		return nil, fmt.Errorf("Incomplete cluster definition: %s",
+			strings.Join(tokens, " "))
+	}
+	c := &RelayCluster{Name: tokens[1], Type: tokens[2], Replicas: 1}
+	if _, ok := relayAlgos[c.Type]; !ok {
+		// Only consistent hashing clusters are interesting
+		return c, nil
+	}
+
+	i := 3
+	if i+1 < len(tokens) && tokens[i] == "replication" {
+		r, err := strconv.Atoi(tokens[i+1])
+		if err != nil || r < 1 {
+			return nil, fmt.Errorf("Bad replication factor in cluster %s: %s",
+				c.Name, tokens[i+1])
+		}
+		c.Replicas = r
+		i = i + 2
+	}
+	if i < len(tokens) && tokens[i] == "dynamic" {
+		i++
+	}
+
+	for ; i < len(tokens); i++ {
+		if args, ok := relayHostOptions[tokens[i]]; ok {
+			i = i + args
+			continue
+		}
+		n, err := NewNodeParser(tokens[i])
+		if err != nil {
+			return nil, fmt.Errorf("Bad host in cluster %s: %s", c.Name, err)
+		}
+		c.Nodes = append(c.Nodes, n)
+	}
+	if len(c.Nodes) == 0 {
+		return nil, fmt.Errorf("Cluster %s has no hosts", c.Name)
+	}
+	return c, nil
+}
+
+// ParseRelayConfig reads a carbon-c-relay configuration and returns the
+// clusters it defines in order.  Only cluster statements are parsed, all
+// other statements are ignored.  Hosts of consistent hashing clusters are
+// parsed from the HOST[:PORT][=INSTANCE] format.
+func ParseRelayConfig(r io.Reader) ([]*RelayCluster, error) {
+	statements, err := relayStatements(r)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]*RelayCluster, 0)
+	for _, s := range statements {
+		if s[0] != "cluster" {
+			continue
+		}
+		c, err := parseRelayCluster(s)
+		if err != nil {
+			return nil, err
+		}
+		clusters = append(clusters, c)
+	}
+	return clusters, nil
+}
+
+// JSONRing returns the hash ring configuration that routes metrics
+// identically to this cluster.  An error is returned for cluster types
+// that are not consistent hashing clusters.
+func (c *RelayCluster) JSONRing() (*JSONRingType, error) {
+	algo, ok := relayAlgos[c.Type]
+	if !ok {
+		return nil, fmt.Errorf("Cluster %s has unsupported type %s.  "+
+			"Supported types are carbon_ch, fnv1a_ch, and jump_fnv1a_ch.",
+			c.Name, c.Type)
+	}
+
+	ring := new(JSONRingType)
+	ring.Name = c.Name
+	ring.Algo = algo
+	ring.Replicas = c.Replicas
+	ring.Nodes = append(ring.Nodes, c.Nodes...)
+	return ring, nil
+}
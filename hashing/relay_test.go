@@ -0,0 +1,102 @@
+package hashing
+
+import (
+	"strings"
+	"testing"
+)
+
+const relayConfig = `
+# Graphite relay configuration
+cluster graphite
+    carbon_ch replication 2
+        graphite010-g5:2003=a
+        graphite010-g5:2003=b
+        graphite011-g5:2003=a proto tcp
+        graphite011-g5:2003=b
+    ;
+
+cluster fnv fnv1a_ch
+    10.0.0.1:2003 10.0.0.2:2003 type linemode;
+
+cluster jump
+    jump_fnv1a_ch replication 2
+        10.0.0.1:2003
+        10.0.0.2:2003
+        10.0.0.3:2003
+    ;
+
+cluster backup forward 10.0.0.9:2003;
+
+match * send to graphite;
+`
+
+func TestParseRelayConfig(t *testing.T) {
+	clusters, err := ParseRelayConfig(strings.NewReader(relayConfig))
+	if err != nil {
+		t.Fatalf("Error parsing config: %s", err)
+	}
+	if len(clusters) != 4 {
+		t.Fatalf("Expected 4 clusters, got %d", len(clusters))
+	}
+
+	ring, err := clusters[0].JSONRing()
+	if err != nil {
+		t.Fatalf("Error building ring: %s", err)
+	}
+	if ring.Algo != "carbon" || ring.Replicas != 2 || len(ring.Nodes) != 4 {
+		t.Errorf("Bad carbon_ch ring: %v", ring)
+	}
+	if !NodeCmp(ring.Nodes[2], NewNode("graphite011-g5", 2003, "a")) {
+		t.Errorf("Bad node: %v", ring.Nodes[2])
+	}
+
+	// The ring must route the same as one built by hand
+	chr := NewCarbonHashRing()
+	for _, n := range ring.Nodes {
+		chr.AddNode(n)
+	}
+	expected := NewCarbonHashRing()
+	expected.AddNode(NewNode("graphite010-g5", 2003, "a"))
+	expected.AddNode(NewNode("graphite010-g5", 2003, "b"))
+	expected.AddNode(NewNode("graphite011-g5", 2003, "a"))
+	expected.AddNode(NewNode("graphite011-g5", 2003, "b"))
+	for _, m := range []string{"foo.bar", "carbon.agents.foo", "a.b.c.d"} {
+		if !NodeCmp(chr.GetNode(m), expected.GetNode(m)) {
+			t.Errorf("%s routed to %s, expected %s", m, chr.GetNode(m), expected.GetNode(m))
+		}
+	}
+
+	ring, err = clusters[1].JSONRing()
+	if err != nil {
+		t.Fatalf("Error building ring: %s", err)
+	}
+	if ring.Algo != "fnv1a" || ring.Replicas != 1 || len(ring.Nodes) != 2 {
+		t.Errorf("Bad fnv1a_ch ring: %v", ring)
+	}
+
+	ring, err = clusters[2].JSONRing()
+	if err != nil {
+		t.Fatalf("Error building ring: %s", err)
+	}
+	if ring.Algo != "jump_fnv1a" || ring.Replicas != 2 || len(ring.Nodes) != 3 {
+		t.Errorf("Bad jump_fnv1a_ch ring: %v", ring)
+	}
+
+	_, err = clusters[3].JSONRing()
+	if err == nil {
+		t.Errorf("Expected an error for a forward cluster")
+	}
+}
+
+func TestParseRelayConfigErrors(t *testing.T) {
+	bad := []string{
+		"cluster graphite carbon_ch graphite010:2003",
+		"cluster graphite carbon_ch replication x graphite010:2003;",
+		"cluster graphite carbon_ch;",
+	}
+	for _, config := range bad {
+		if _, err := ParseRelayConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("Expected an error parsing: %s", config)
+		}
+	}
+}
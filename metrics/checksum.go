@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ChecksumHeader carries the checksum of Whisper data in transit.  In a
+// GET request it names the algorithm the client wants.  Otherwise it is
+// ALGORITHM:HEXDIGEST of the request or response body as sent, so the
+// receiver knows how to verify it.
+const ChecksumHeader = "X-Metric-Checksum"
+
+// ChecksumAlgorithms are the algorithms supported for ChecksumHeader.  MD5
+// is a lightweight integrity check, use SHA-256 where MD5 isn't welcome.
+var ChecksumAlgorithms = []string{"md5", "sha256"}
+
+// ErrChecksumMismatch is returned when data does not match its checksum.
+var ErrChecksumMismatch = errors.New("Checksum mismatch")
+
+// NewChecksum returns a hash.Hash for the named checksum algorithm.
+func NewChecksum(algo string) (hash.Hash, error) {
+	switch algo {
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	}
+	return nil, fmt.Errorf("Unsupported checksum algorithm %q, use one of %v",
+		algo, ChecksumAlgorithms)
+}
+
+// FormatChecksum returns the ALGORITHM:HEXDIGEST form of the sum in h.
+func FormatChecksum(algo string, h hash.Hash) string {
+	return algo + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+// ParseChecksum splits an ALGORITHM:HEXDIGEST checksum and returns a new
+// hash.Hash for the algorithm along with the digest.
+func ParseChecksum(checksum string) (hash.Hash, string, error) {
+	fields := strings.SplitN(checksum, ":", 2)
+	if len(fields) != 2 || fields[1] == "" {
+		return nil, "", fmt.Errorf("Malformed checksum %q", checksum)
+	}
+	h, err := NewChecksum(fields[0])
+	if err != nil {
+		return nil, "", err
+	}
+	return h, strings.ToLower(fields[1]), nil
+}
+
+// Checksum returns the ALGORITHM:HEXDIGEST checksum of data.
+func Checksum(algo string, data []byte) (string, error) {
+	h, err := NewChecksum(algo)
+	if err != nil {
+		return "", err
+	}
+	h.Write(data)
+	return FormatChecksum(algo, h), nil
+}
+
+// VerifyChecksum returns nil if data matches the ALGORITHM:HEXDIGEST
+// checksum and ErrChecksumMismatch if it does not.
+func VerifyChecksum(checksum string, data []byte) error {
+	h, digest, err := ParseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	h.Write(data)
+	if hex.EncodeToString(h.Sum(nil)) != digest {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	data := []byte("whisper data")
+	tests := map[string]string{
+		"md5":    "md5:00380e0d70150d0d2aa751196c1ae53f",
+		"sha256": "sha256:877a5d65cdbfbc19be866ae87a5f01c03be35a2f1463e88c62ed2eb62fb69078",
+	}
+	for algo, expected := range tests {
+		sum, err := Checksum(algo, data)
+		if err != nil {
+			t.Fatalf("%s: %s", algo, err)
+		}
+		if sum != expected {
+			t.Errorf("Expected %s, got %s", expected, sum)
+		}
+		if err := VerifyChecksum(sum, data); err != nil {
+			t.Errorf("%s: %s", algo, err)
+		}
+		if err := VerifyChecksum(sum, []byte("whisper dat4")); err != ErrChecksumMismatch {
+			t.Errorf("%s: expected a mismatch, got %v", algo, err)
+		}
+	}
+
+	if _, err := Checksum("sha1", data); err == nil {
+		t.Errorf("Expected an error for an unsupported algorithm")
+	}
+	for _, bad := range []string{"", "md5", "md5:", "crc32:1234"} {
+		if err := VerifyChecksum(bad, data); err == nil || err == ErrChecksumMismatch {
+			t.Errorf("Expected %q to be malformed, got %v", bad, err)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package metrics
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID identifies a file on the local system by its device and inode.
+type fileID struct {
+	dev, ino uint64
+}
+
+// newFileID returns the fileID of the file described by info and false if
+// the system does not report one.
+func newFileID(info os.FileInfo) (fileID, bool) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fileID{uint64(st.Dev), uint64(st.Ino)}, true
+	}
+	return fileID{}, false
+}
@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"flag"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
@@ -27,6 +28,15 @@ type MetricData struct {
 	ModTime  int64
 	Encoding int
 	Data     []byte `json:"-"` // We never JSON encode metric data
+	Metadata []byte `json:"-"` // Sidecar metadata, if any
+}
+
+// WhisperHeader is the part of a Whisper DB's header that can be read
+// and updated without touching the data points.
+type WhisperHeader struct {
+	Name              string
+	AggregationMethod int
+	XFilesFactor      float32
 }
 
 type MetricsCacheType struct {
@@ -34,10 +44,17 @@ type MetricsCacheType struct {
 	timestamp int64
 	lock      sync.Mutex
 	updating  bool
+	roots     []string
+	follow    bool
+	verbose   bool
 }
 
 var Prefix string
 
+// MetadataSuffix is appended to the path of a Whisper DB to name the
+// sidecar file holding the metric's tags or other metadata.
+const MetadataSuffix = ".meta"
+
 // Init common bits
 func init() {
 	flag.StringVar(&Prefix, "prefix", "/opt/graphite/storage/whisper",
@@ -144,8 +161,8 @@ func FilterRegex(regex string, metrics []string) ([]string, error) {
 	return result, nil
 }
 
-// checkWalk is a helper function to sanity check for *.wsp files in a
-// file tree walk.  If the file is valid, normal *.wsp nil is returned.
+// checkWalk is a helper function to sanity check for *.wsp and *.wsp.gz
+// files in a file tree walk.  If the file is valid, normal *.wsp nil is returned.
 // Otherwise a non-nil error value is returned.
 func checkWalk(path string, info os.FileInfo, err error) (bool, error) {
 	// Did the Walk function hit an error on this file?
@@ -167,14 +184,74 @@ func checkWalk(path string, info os.FileInfo, err error) (bool, error) {
 		// Not a regular file
 		return false, nil
 	}
-	if !strings.HasSuffix(path, ".wsp") {
-		// Not a Whisper Database
+	if !strings.HasSuffix(path, ".wsp") && !strings.HasSuffix(path, ".wsp.gz") {
+		// Not a Whisper Database, or one stored gzip compressed
 		return false, nil
 	}
 
 	return true, nil
 }
 
+// walkMetrics calls found with the path relative to root of each Whisper
+// DB under root in lexical order.  Symbolic links are skipped unless follow
+// is set, in which case linked directories and files are walked as if they
+// were in place.  Each directory is entered once so that symbolic link
+// loops end.
+func walkMetrics(root string, follow, verbose bool, found func(rel string)) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	visited := make(map[fileID]bool)
+	if id, ok := newFileID(info); ok {
+		visited[id] = true
+	}
+
+	var walk func(dir, rel string)
+	walk = func(dir, rel string) {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			// File perm or exists error, log and skip
+			log.Printf("%s\n", err)
+			return
+		}
+		for _, info := range entries {
+			path := filepath.Join(dir, info.Name())
+			name := filepath.Join(rel, info.Name())
+			if info.Mode()&os.ModeSymlink != 0 {
+				if !follow {
+					if verbose {
+						log.Printf("Skipping symbolic link %s", path)
+					}
+					continue
+				}
+				if info, err = os.Stat(path); err != nil {
+					log.Printf("%s\n", err)
+					continue
+				}
+			}
+			ok, err := checkWalk(path, info, nil)
+			switch {
+			case err == filepath.SkipDir:
+			case info.IsDir():
+				id, ok := newFileID(info)
+				if ok && visited[id] {
+					if verbose {
+						log.Printf("Skipping %s, already scanned", path)
+					}
+					continue
+				}
+				visited[id] = true
+				walk(path, name)
+			case ok:
+				found(name)
+			}
+		}
+	}
+	walk(root, "")
+	return nil
+}
+
 // NewMetricsCache creates and returns a MetricsCacheType object
 func NewMetricsCache() *MetricsCacheType {
 	m := new(MetricsCacheType)
@@ -183,6 +260,27 @@ func NewMetricsCache() *MetricsCacheType {
 	return m
 }
 
+// NewMetricsCacheRoots creates a MetricsCacheType object that builds its
+// list of metric names from the union of the given data store roots rather
+// than the --prefix flag alone.
+func NewMetricsCacheRoots(roots []string) *MetricsCacheType {
+	m := NewMetricsCache()
+	m.roots = roots
+	return m
+}
+
+// SetFollowSymlinks sets whether symbolic links to directories and files
+// are followed when the cache is rebuilt.  They are skipped by default.
+func (m *MetricsCacheType) SetFollowSymlinks(follow bool) {
+	m.follow = follow
+}
+
+// SetVerbose sets whether the symbolic links skipped when the cache is
+// rebuilt are logged.
+func (m *MetricsCacheType) SetVerbose(verbose bool) {
+	m.verbose = verbose
+}
+
 // IsAvailable returns a boolean true value if the MetricsCache is avaliable
 // for use.  Rebuilding the cache can take some time.
 func (m *MetricsCacheType) IsAvailable() bool {
@@ -202,25 +300,29 @@ func (m *MetricsCacheType) RefreshCache() error {
 	m.lock.Lock()
 	m.updating = true
 
-	examine := func(path string, info os.FileInfo, err error) error {
-		ok, err := checkWalk(path, info, err)
-		if err != nil {
-			return err
-		}
-		if ok {
-			//log.Printf("Found %s or %s", path, PathToMetric(path))
-			m.metrics = append(m.metrics, PathToMetric(path))
-		}
-		return nil
+	roots := m.roots
+	if len(roots) == 0 {
+		roots = []string{Prefix}
 	}
+	seen := make(map[string]bool)
 
 	// Create new empty slice
-	log.Printf("Scaning %s for metrics...", Prefix)
 	m.metrics = make([]string, 0)
-	err := filepath.Walk(Prefix, examine)
-	log.Printf("Scan complete.")
-	if err != nil {
-		log.Printf("Scan returned an Error: %s", err)
+	for _, root := range roots {
+		log.Printf("Scaning %s for metrics...", root)
+		err := walkMetrics(root, m.follow, m.verbose, func(rel string) {
+			// A metric in more than one root, or stored both as is and
+			// gzip compressed, is listed once
+			metric := RelativeToMetric(strings.TrimSuffix(rel, ".gz"))
+			if !seen[metric] {
+				seen[metric] = true
+				m.metrics = append(m.metrics, metric)
+			}
+		})
+		log.Printf("Scan complete.")
+		if err != nil {
+			log.Printf("Scan returned an Error: %s", err)
+		}
 	}
 
 	m.timestamp = time.Now().Unix()
@@ -1,6 +1,10 @@
 package metrics
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +28,40 @@ func TestPathToMetric(t *testing.T) {
 			"bobby.sue.foo.bar")
 	}
 }
+
+func TestWalkMetricsSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	tenant, err := ioutil.TempDir("", "metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tenant)
+
+	os.MkdirAll(filepath.Join(root, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "a", "x.wsp"), []byte("data"), 0644)
+	ioutil.WriteFile(filepath.Join(tenant, "y.wsp"), []byte("data"), 0644)
+	os.Symlink(tenant, filepath.Join(root, "b"))
+	os.Symlink(filepath.Join(root, "a", "x.wsp"), filepath.Join(root, "c.wsp"))
+	os.Symlink(root, filepath.Join(root, "a", "loop"))
+
+	tests := []struct {
+		follow   bool
+		expected string
+	}{
+		{false, "a.x"},
+		{true, "a.x,b.y,c"},
+	}
+	for _, v := range tests {
+		cache := NewMetricsCacheRoots([]string{root})
+		cache.SetFollowSymlinks(v.follow)
+		cache.RefreshCache()
+		metrics, _ := cache.GetMetrics()
+		if strings.Join(metrics, ",") != v.expected {
+			t.Errorf("Follow %v: expected %s, got %v", v.follow, v.expected, metrics)
+		}
+	}
+}
@@ -308,6 +308,37 @@ func (whisper *Whisper) MetadataSize() int {
 	return MetadataSize + (ArchiveInfoSize * len(whisper.archives))
 }
 
+/*
+  XFilesFactor returns the xFilesFactor recorded in the header.
+*/
+func (whisper *Whisper) XFilesFactor() float32 {
+	return whisper.xFilesFactor
+}
+
+/*
+  AggregationMethod returns the aggregation method recorded in the header.
+*/
+func (whisper *Whisper) AggregationMethod() AggregationMethod {
+	return whisper.aggregationMethod
+}
+
+/*
+  SetXFilesFactor rewrites the xFilesFactor in the header in place.  The
+  archives and their data points are left untouched.
+*/
+func (whisper *Whisper) SetXFilesFactor(xFilesFactor float32) error {
+	if xFilesFactor < 0 || xFilesFactor > 1 {
+		return fmt.Errorf("Invalid xFilesFactor %v, must be between 0 and 1", xFilesFactor)
+	}
+	b := make([]byte, FloatSize)
+	packFloat32(b, xFilesFactor, 0)
+	if _, err := whisper.file.WriteAt(b, IntSize*2); err != nil {
+		return err
+	}
+	whisper.xFilesFactor = xFilesFactor
+	return nil
+}
+
 /*
   Retentions returns a Retentions type which lists each archive's retention
   in this Whisper file.  A deep copy so that the internal data structure
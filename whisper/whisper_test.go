@@ -2,6 +2,7 @@ package whisper
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
 	"sort"
@@ -152,6 +153,47 @@ func TestCreateCreatesFile(t *testing.T) {
 	tearDown()
 }
 
+func TestSetXFilesFactor(t *testing.T) {
+	path, _, retentions, tearDown := setUpCreate()
+	defer tearDown()
+	wsp, err := Create(path, retentions, Sum, 0.5)
+	if err != nil {
+		t.Fatalf("Failed to create whisper file: %v", err)
+	}
+	if err = wsp.Update(42, int(time.Now().Unix())); err != nil {
+		t.Fatalf("Failed to update whisper file: %v", err)
+	}
+	wsp.Close()
+	before, _ := ioutil.ReadFile(path)
+
+	wsp, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open whisper file: %v", err)
+	}
+	if err = wsp.SetXFilesFactor(1.5); err == nil {
+		t.Fatalf("Expected an out of range xFilesFactor to fail")
+	}
+	if err = wsp.SetXFilesFactor(0.1); err != nil {
+		t.Fatalf("Failed to set xFilesFactor: %v", err)
+	}
+	wsp.Close()
+
+	wsp, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open whisper file: %v", err)
+	}
+	defer wsp.Close()
+	if wsp.XFilesFactor() != 0.1 {
+		t.Fatalf("Unexpected xFilesFactor %v, expected 0.1", wsp.XFilesFactor())
+	}
+	if wsp.AggregationMethod() != Sum {
+		t.Fatalf("Unexpected aggregationMethod %v, expected %v", wsp.AggregationMethod(), Sum)
+	}
+	after, _ := ioutil.ReadFile(path)
+	checkBytes(t, before[:8], after[:8])
+	checkBytes(t, before[12:], after[12:])
+}
+
 func TestCreateFileAlreadyExists(t *testing.T) {
 	path, _, retentions, tearDown := setUpCreate()
 	os.Create(path)